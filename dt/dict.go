@@ -2,6 +2,7 @@ package dt
 
 import (
 	"hash/fnv"
+	"math/bits"
 	"math/rand"
 	"time"
 )
@@ -259,6 +260,88 @@ func (dt *Dict) Delete(key string) interface{} {
 	return nil
 }
 
+// Iterate calls fn for each entry in the dictionary until fn returns false.
+// The dictionary must not be modified while iterating.
+func (dt *Dict) Iterate(fn func(e *Entry) bool) {
+	for _, ht := range dt.hts {
+		for _, he := range ht.table {
+			for he != nil {
+				next := he.next
+				if !fn(he) {
+					return
+				}
+				he = next
+			}
+		}
+	}
+}
+
+// Scan visits the buckets pointed by cursor, calling fn for every entry
+// found, and returns the cursor to use for the next call, 0 once the
+// iteration is complete.
+//
+// The cursor is incremented from its most significant bits, so buckets
+// which were already visited are not visited again when the table grows,
+// and every element present during the whole iteration is returned at least
+// once, even while rehashing.
+func (dt *Dict) Scan(cursor uint64, fn func(e *Entry)) uint64 {
+	if dt.Used() == 0 {
+		return 0
+	}
+
+	emit := func(ht *hashtable, idx uint64) {
+		for he := ht.table[idx]; he != nil; he = he.next {
+			fn(he)
+		}
+	}
+
+	if !dt.IsRehashing() {
+		t0 := dt.hts[0]
+		m0 := uint64(t0.sizemask)
+		emit(t0, cursor&m0)
+
+		cursor = nextScanCursor(cursor, m0)
+		return cursor
+	}
+
+	t0, t1 := dt.hts[0], dt.hts[1]
+	if t0.size > t1.size {
+		t0, t1 = t1, t0
+	}
+	m0, m1 := uint64(t0.sizemask), uint64(t1.sizemask)
+
+	// emit the bucket of the smaller table, then all the buckets of the
+	// larger table which are expansions of it.
+	emit(t0, cursor&m0)
+	for {
+		emit(t1, cursor&m1)
+		cursor = nextScanCursor(cursor, m1)
+		if cursor&(m0^m1) == 0 {
+			break
+		}
+	}
+	return cursor
+}
+
+// nextScanCursor increments the reversed cursor, setting the unmasked
+// bits first so the increment happens on the masked ones.
+func nextScanCursor(cursor, mask uint64) uint64 {
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// Dup returns a copy of the dictionary, the values are copied as they are.
+func (dt *Dict) Dup() *Dict {
+	d := NewDict()
+	dt.Iterate(func(e *Entry) bool {
+		d.Add(e.Key, e.Value)
+		return true
+	})
+	return d
+}
+
 func (dt *Dict) Used() int64 {
 	return dt.hts[0].used + dt.hts[1].used
 }
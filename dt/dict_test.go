@@ -141,3 +141,62 @@ func TestDictGetRandomKeys(t *testing.T) {
 
 	d.SomeEntries(int64(j))
 }
+
+func TestDictScan(t *testing.T) {
+	d := NewDict()
+	n := 1000
+	for i := 0; i < n; i++ {
+		d.Add(strconv.Itoa(i), i)
+	}
+
+	seen := make(map[string]bool)
+	var cursor uint64
+	steps := 0
+	for {
+		cursor = d.Scan(cursor, func(e *Entry) {
+			seen[e.Key] = true
+		})
+
+		// keep growing the table in the middle of the scan
+		if steps%10 == 0 {
+			d.Add("extra"+strconv.Itoa(steps), steps)
+		}
+		steps++
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		assert.True(t, seen[strconv.Itoa(i)])
+	}
+}
+
+func TestDictScanWhileRehashing(t *testing.T) {
+	d := NewDict()
+	n := 500
+	for i := 0; i < n; i++ {
+		d.Add(strconv.Itoa(i), i)
+	}
+	for d.IsRehashing() {
+		d.doRehashing(100)
+	}
+
+	// the scan starts on the small table, and ends on the large one
+	assert.True(t, d.expandDict(int64(n*8)))
+	seen := make(map[string]int)
+	var cursor uint64
+	for {
+		cursor = d.Scan(cursor, func(e *Entry) {
+			seen[e.Key]++
+		})
+		d.doRehashing(1)
+		if cursor == 0 {
+			break
+		}
+	}
+
+	assert.False(t, d.IsRehashing())
+	assert.Equal(t, n, len(seen))
+}
@@ -0,0 +1,394 @@
+package dt
+
+import "math"
+
+// The points of a geo set are sorted set members whose score is the 52 bits
+// geohash of their coordinates: the longitude and latitude are each
+// quantized on 26 bits and interleaved, so that the points of any cell of
+// the geohash grid have contiguous scores, and a search area is covered by
+// a few score ranges of the skiplist.
+
+// The limits of the coordinates, the latitude is limited like in the
+// EPSG:900913 / EPSG:3785 / OSGEO:41001 projections.
+const (
+	GeoLongMin = -180
+	GeoLongMax = 180
+	GeoLatMin  = -85.05112878
+	GeoLatMax  = 85.05112878
+
+	// GeoStepMax is the number of bits of each coordinate, for 52 bits hashes
+	GeoStepMax = 26
+
+	earthRadiusInMeters = 6372797.560856
+	mercatorMax         = 20037726.37
+)
+
+// GeoHashBits is a geohash of step bits for each coordinate.
+type GeoHashBits struct {
+	Bits uint64
+	Step uint8
+}
+
+// IsZero reports whether the hash was discarded from a search.
+func (h GeoHashBits) IsZero() bool {
+	return h.Bits == 0 && h.Step == 0
+}
+
+// ScoreRange returns the scores of the points in the cell of the hash,
+// the min is inclusive and the max exclusive.
+func (h GeoHashBits) ScoreRange() (uint64, uint64) {
+	shift := 52 - uint(h.Step)*2
+	return h.Bits << shift, (h.Bits + 1) << shift
+}
+
+// GeoHashRange is the interval of a coordinate.
+type GeoHashRange struct {
+	Min, Max float64
+}
+
+// GeoHashArea is the rectangle covered by a hash.
+type GeoHashArea struct {
+	Hash      GeoHashBits
+	Longitude GeoHashRange
+	Latitude  GeoHashRange
+}
+
+// GeoHashNeighbors are the 8 cells around a hash.
+type GeoHashNeighbors struct {
+	North, East, West, South                   GeoHashBits
+	NorthEast, SouthEast, NorthWest, SouthWest GeoHashBits
+}
+
+// GeoHashRadius is the cell of the center of a search with its neighbors,
+// the neighbors which can't contain any point of the search are zero.
+type GeoHashRadius struct {
+	Hash      GeoHashBits
+	Area      GeoHashArea
+	Neighbors GeoHashNeighbors
+}
+
+// Cells returns the center cell followed by its neighbors.
+func (r *GeoHashRadius) Cells() []GeoHashBits {
+	n := r.Neighbors
+	return []GeoHashBits{r.Hash, n.North, n.South, n.East, n.West,
+		n.NorthEast, n.NorthWest, n.SouthEast, n.SouthWest}
+}
+
+var (
+	geoLongRange = GeoHashRange{GeoLongMin, GeoLongMax}
+	geoLatRange  = GeoHashRange{GeoLatMin, GeoLatMax}
+)
+
+// interleave64 interleaves the bits of x in the even bits of the result,
+// and the bits of y in the odd bits.
+func interleave64(x, y uint32) uint64 {
+	spread := func(v uint64) uint64 {
+		v = (v | v<<16) & 0x0000FFFF0000FFFF
+		v = (v | v<<8) & 0x00FF00FF00FF00FF
+		v = (v | v<<4) & 0x0F0F0F0F0F0F0F0F
+		v = (v | v<<2) & 0x3333333333333333
+		v = (v | v<<1) & 0x5555555555555555
+		return v
+	}
+	return spread(uint64(x)) | spread(uint64(y))<<1
+}
+
+// deinterleave64 is the reverse of interleave64.
+func deinterleave64(v uint64) (uint32, uint32) {
+	squash := func(v uint64) uint32 {
+		v &= 0x5555555555555555
+		v = (v | v>>1) & 0x3333333333333333
+		v = (v | v>>2) & 0x0F0F0F0F0F0F0F0F
+		v = (v | v>>4) & 0x00FF00FF00FF00FF
+		v = (v | v>>8) & 0x0000FFFF0000FFFF
+		v = (v | v>>16) & 0x00000000FFFFFFFF
+		return uint32(v)
+	}
+	return squash(v), squash(v >> 1)
+}
+
+func geohashEncode(longRange, latRange GeoHashRange, longitude, latitude float64, step uint8) (GeoHashBits, bool) {
+	if step > 32 || step == 0 ||
+		longitude < GeoLongMin || longitude > GeoLongMax ||
+		latitude < GeoLatMin || latitude > GeoLatMax ||
+		longitude < longRange.Min || longitude > longRange.Max ||
+		latitude < latRange.Min || latitude > latRange.Max {
+		return GeoHashBits{}, false
+	}
+
+	latOffset := (latitude - latRange.Min) / (latRange.Max - latRange.Min)
+	longOffset := (longitude - longRange.Min) / (longRange.Max - longRange.Min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return GeoHashBits{Bits: interleave64(uint32(latOffset), uint32(longOffset)), Step: step}, true
+}
+
+func geohashDecode(longRange, latRange GeoHashRange, hash GeoHashBits) GeoHashArea {
+	lat, long := deinterleave64(hash.Bits)
+	latScale := latRange.Max - latRange.Min
+	longScale := longRange.Max - longRange.Min
+	cells := float64(uint64(1) << hash.Step)
+
+	area := GeoHashArea{Hash: hash}
+	area.Latitude.Min = latRange.Min + (float64(lat)/cells)*latScale
+	area.Latitude.Max = latRange.Min + (float64(lat+1)/cells)*latScale
+	area.Longitude.Min = longRange.Min + (float64(long)/cells)*longScale
+	area.Longitude.Max = longRange.Min + (float64(long+1)/cells)*longScale
+	return area
+}
+
+// center returns the coordinates of the center of the area.
+func (a GeoHashArea) center() (float64, float64) {
+	longitude := (a.Longitude.Min + a.Longitude.Max) / 2
+	if longitude > GeoLongMax {
+		longitude = GeoLongMax
+	}
+	if longitude < GeoLongMin {
+		longitude = GeoLongMin
+	}
+	latitude := (a.Latitude.Min + a.Latitude.Max) / 2
+	if latitude > GeoLatMax {
+		latitude = GeoLatMax
+	}
+	if latitude < GeoLatMin {
+		latitude = GeoLatMin
+	}
+	return longitude, latitude
+}
+
+// GeoEncode returns the 52 bits score of the coordinates, false if they
+// are out of the limits.
+func GeoEncode(longitude, latitude float64) (float64, bool) {
+	hash, ok := geohashEncode(geoLongRange, geoLatRange, longitude, latitude, GeoStepMax)
+	if !ok {
+		return 0, false
+	}
+	return float64(hash.Bits), true
+}
+
+// GeoDecode returns the coordinates of the center of the cell of a score.
+func GeoDecode(score float64) (float64, float64) {
+	hash := GeoHashBits{Bits: uint64(score), Step: GeoStepMax}
+	return geohashDecode(geoLongRange, geoLatRange, hash).center()
+}
+
+var geoAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// GeoHashString returns the standard 11 characters geohash of a score.
+// The standard hashes use the [-90, 90] latitude range, so the score is
+// decoded and encoded again.
+func GeoHashString(score float64) string {
+	longitude, latitude := GeoDecode(score)
+	hash, _ := geohashEncode(GeoHashRange{-180, 180}, GeoHashRange{-90, 90}, longitude, latitude, GeoStepMax)
+
+	buf := make([]byte, 11)
+	for i := range buf {
+		// there are only 52 bits, the last character is always zero
+		idx := 0
+		if i < 10 {
+			idx = int(hash.Bits>>(52-uint(i+1)*5)) & 0x1f
+		}
+		buf[i] = geoAlphabet[idx]
+	}
+	return string(buf)
+}
+
+// moveX moves the hash of d cells along the longitude, wrapping around.
+func (h GeoHashBits) moveX(d int) GeoHashBits {
+	x := h.Bits & 0xaaaaaaaaaaaaaaaa
+	y := h.Bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - uint(h.Step)*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - uint(h.Step)*2)
+	return GeoHashBits{Bits: x | y, Step: h.Step}
+}
+
+// moveY moves the hash of d cells along the latitude, wrapping around.
+func (h GeoHashBits) moveY(d int) GeoHashBits {
+	x := h.Bits & 0xaaaaaaaaaaaaaaaa
+	y := h.Bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(h.Step)*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= 0x5555555555555555 >> (64 - uint(h.Step)*2)
+	return GeoHashBits{Bits: x | y, Step: h.Step}
+}
+
+func (h GeoHashBits) neighbors() GeoHashNeighbors {
+	return GeoHashNeighbors{
+		East:      h.moveX(1),
+		West:      h.moveX(-1),
+		South:     h.moveY(-1),
+		North:     h.moveY(1),
+		NorthEast: h.moveX(1).moveY(1),
+		NorthWest: h.moveX(-1).moveY(1),
+		SouthEast: h.moveX(1).moveY(-1),
+		SouthWest: h.moveX(-1).moveY(-1),
+	}
+}
+
+func degRad(deg float64) float64 { return deg * math.Pi / 180 }
+func radDeg(rad float64) float64 { return rad * 180 / math.Pi }
+
+// GeoLatDistance returns the distance between two latitudes in meters.
+func GeoLatDistance(lat1, lat2 float64) float64 {
+	return earthRadiusInMeters * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// GeoDistance returns the distance in meters between two points with the
+// haversine formula.
+func GeoDistance(long1, lat1, long2, lat2 float64) float64 {
+	v := math.Sin((degRad(long2) - degRad(long1)) / 2)
+	// the points are on the same meridian
+	if v == 0 {
+		return GeoLatDistance(lat1, lat2)
+	}
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * earthRadiusInMeters * math.Asin(math.Sqrt(a))
+}
+
+// GeoShape is the area of a search in meters: a circle of Radius, or a
+// rectangle of Width and Height when Box is set.
+type GeoShape struct {
+	Longitude, Latitude float64
+	Box                 bool
+	Radius              float64
+	Width, Height       float64
+}
+
+// Contains returns the distance between the center of the shape and the
+// point, and whether the point is inside the shape.
+func (s *GeoShape) Contains(longitude, latitude float64) (float64, bool) {
+	if !s.Box {
+		dist := GeoDistance(s.Longitude, s.Latitude, longitude, latitude)
+		return dist, dist <= s.Radius
+	}
+
+	// the latitude distance is cheaper, so it's checked first
+	if GeoLatDistance(latitude, s.Latitude) > s.Height/2 {
+		return 0, false
+	}
+	if GeoDistance(longitude, latitude, s.Longitude, latitude) > s.Width/2 {
+		return 0, false
+	}
+	return GeoDistance(s.Longitude, s.Latitude, longitude, latitude), true
+}
+
+// boundingBox returns the min longitude, min latitude, max longitude and
+// max latitude of the shape.
+func (s *GeoShape) boundingBox() (float64, float64, float64, float64) {
+	height, width := s.Radius, s.Radius
+	if s.Box {
+		height, width = s.Height/2, s.Width/2
+	}
+
+	latDelta := radDeg(height / earthRadiusInMeters)
+	longDeltaTop := radDeg(width / earthRadiusInMeters / math.Cos(degRad(s.Latitude+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusInMeters / math.Cos(degRad(s.Latitude-latDelta)))
+	// the widest side is the one closest to the equator
+	longDelta := longDeltaTop
+	if s.Latitude < 0 {
+		longDelta = longDeltaBottom
+	}
+	return s.Longitude - longDelta, s.Latitude - latDelta, s.Longitude + longDelta, s.Latitude + latDelta
+}
+
+// geohashEstimateSteps returns the step of the cells which are large
+// enough for the area around the center to be covered by the cell of the
+// center and its neighbors.
+func geohashEstimateSteps(rangeMeters, latitude float64) uint8 {
+	if rangeMeters == 0 {
+		return GeoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	// make sure the range is included in most of the base cases
+	step -= 2
+
+	// the cells are narrower towards the poles
+	if latitude > 66 || latitude < -66 {
+		step--
+		if latitude > 80 || latitude < -80 {
+			step--
+		}
+	}
+
+	if step < 1 {
+		step = 1
+	}
+	if step > GeoStepMax {
+		step = GeoStepMax
+	}
+	return uint8(step)
+}
+
+// Areas returns the cells covering the shape.
+func (s *GeoShape) Areas() *GeoHashRadius {
+	minLong, minLat, maxLong, maxLat := s.boundingBox()
+
+	// the distance from the center to the corners for the boxes
+	radius := s.Radius
+	if s.Box {
+		radius = math.Sqrt((s.Width/2)*(s.Width/2) + (s.Height/2)*(s.Height/2))
+	}
+	steps := geohashEstimateSteps(radius, s.Latitude)
+
+	hash, _ := geohashEncode(geoLongRange, geoLatRange, s.Longitude, s.Latitude, steps)
+	neighbors := hash.neighbors()
+	area := geohashDecode(geoLongRange, geoLatRange, hash)
+
+	// the estimated step may be too large when the center is close to the
+	// border of its cell, as the neighbors don't cover the whole shape.
+	north := geohashDecode(geoLongRange, geoLatRange, neighbors.North)
+	south := geohashDecode(geoLongRange, geoLatRange, neighbors.South)
+	east := geohashDecode(geoLongRange, geoLatRange, neighbors.East)
+	west := geohashDecode(geoLongRange, geoLatRange, neighbors.West)
+	decreaseStep := north.Latitude.Max < maxLat || south.Latitude.Min > minLat ||
+		east.Longitude.Max < maxLong || west.Longitude.Min > minLong
+
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = geohashEncode(geoLongRange, geoLatRange, s.Longitude, s.Latitude, steps)
+		neighbors = hash.neighbors()
+		area = geohashDecode(geoLongRange, geoLatRange, hash)
+	}
+
+	// exclude the neighbors which are outside of the shape
+	if steps >= 2 {
+		if area.Latitude.Min < minLat {
+			neighbors.South = GeoHashBits{}
+			neighbors.SouthWest = GeoHashBits{}
+			neighbors.SouthEast = GeoHashBits{}
+		}
+		if area.Latitude.Max > maxLat {
+			neighbors.North = GeoHashBits{}
+			neighbors.NorthEast = GeoHashBits{}
+			neighbors.NorthWest = GeoHashBits{}
+		}
+		if area.Longitude.Min < minLong {
+			neighbors.West = GeoHashBits{}
+			neighbors.SouthWest = GeoHashBits{}
+			neighbors.NorthWest = GeoHashBits{}
+		}
+		if area.Longitude.Max > maxLong {
+			neighbors.East = GeoHashBits{}
+			neighbors.SouthEast = GeoHashBits{}
+			neighbors.NorthEast = GeoHashBits{}
+		}
+	}
+	return &GeoHashRadius{Hash: hash, Area: area, Neighbors: neighbors}
+}
@@ -0,0 +1,89 @@
+package dt
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoEncode(t *testing.T) {
+	score, ok := GeoEncode(13.361389, 38.115556)
+	assert.True(t, ok)
+	assert.Equal(t, float64(3479099956230698), score)
+	long, lat := GeoDecode(score)
+	assert.InDelta(t, 13.361389, long, 1e-5)
+	assert.InDelta(t, 38.115556, lat, 1e-5)
+	assert.Equal(t, "sqc8b49rny0", GeoHashString(score))
+
+	_, ok = GeoEncode(200, 0)
+	assert.False(t, ok)
+	_, ok = GeoEncode(0, 86)
+	assert.False(t, ok)
+
+	x, y := deinterleave64(interleave64(0x3ffffff, 0x1234567))
+	assert.Equal(t, uint32(0x3ffffff), x)
+	assert.Equal(t, uint32(0x1234567), y)
+}
+
+func TestGeoDistance(t *testing.T) {
+	assert.InDelta(t, 166274.1516, GeoDistance(13.361389, 38.115556, 15.087269, 37.502669), 1)
+	assert.Equal(t, GeoLatDistance(10, 20), GeoDistance(5, 10, 5, 20))
+	assert.Equal(t, 0.0, GeoDistance(5, 10, 5, 10))
+}
+
+func TestGeoNeighbors(t *testing.T) {
+	hash, _ := geohashEncode(geoLongRange, geoLatRange, 10, 10, 10)
+	area := geohashDecode(geoLongRange, geoLatRange, hash)
+	n := hash.neighbors()
+	north := geohashDecode(geoLongRange, geoLatRange, n.North)
+	east := geohashDecode(geoLongRange, geoLatRange, n.East)
+	southWest := geohashDecode(geoLongRange, geoLatRange, n.SouthWest)
+	assert.Equal(t, area.Latitude.Max, north.Latitude.Min)
+	assert.Equal(t, area.Longitude, north.Longitude)
+	assert.Equal(t, area.Longitude.Max, east.Longitude.Min)
+	assert.Equal(t, area.Latitude, east.Latitude)
+	assert.Equal(t, area.Latitude.Min, southWest.Latitude.Max)
+	assert.Equal(t, area.Longitude.Min, southWest.Longitude.Max)
+}
+
+func TestGeoShapeAreas(t *testing.T) {
+	// every point of the shape must be in one of the cells
+	shapes := []*GeoShape{
+		{Longitude: 15, Latitude: 37, Radius: 200000},
+		{Longitude: -70, Latitude: -50, Radius: 1000},
+		{Longitude: 179.99, Latitude: 0, Radius: 5000},
+		{Longitude: 15, Latitude: 37, Box: true, Width: 400000, Height: 100000},
+	}
+	for _, shape := range shapes {
+		cells := shape.Areas().Cells()
+		for i := 0; i < 360; i += 5 {
+			rad := float64(i) * math.Pi / 180
+			for _, f := range []float64{0.1, 0.5, 0.99} {
+				dlat := radDeg(f * shape.Radius * math.Sin(rad) / earthRadiusInMeters)
+				long := shape.Longitude + radDeg(f*shape.Radius*math.Cos(rad)/earthRadiusInMeters/math.Cos(degRad(shape.Latitude)))
+				if shape.Box {
+					dlat = radDeg(f * shape.Height / 2 * math.Sin(rad) / earthRadiusInMeters)
+					long = shape.Longitude + radDeg(f*shape.Width/2*math.Cos(rad)/earthRadiusInMeters/math.Cos(degRad(shape.Latitude)))
+				}
+				if long > GeoLongMax {
+					long -= 360
+				}
+				score, ok := GeoEncode(long, shape.Latitude+dlat)
+				assert.True(t, ok)
+				if _, inside := shape.Contains(GeoDecode(score)); !inside {
+					continue
+				}
+
+				found := false
+				for _, cell := range cells {
+					min, max := cell.ScoreRange()
+					if !cell.IsZero() && uint64(score) >= min && uint64(score) < max {
+						found = true
+					}
+				}
+				assert.True(t, found, "%v %v %v", shape, long, shape.Latitude+dlat)
+			}
+		}
+	}
+}
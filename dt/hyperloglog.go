@@ -0,0 +1,396 @@
+package dt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog estimates the cardinality of a set with 2^14 registers of 6
+// bits, with a standard error of 0.81%. The HLLs are plain strings using the
+// same layout as Redis, a 16 bytes header followed by the registers:
+//
+//	+------+---+-----+----------+
+//	| HYLL | E | N/U | Cardin.  |
+//	+------+---+-----+----------+
+//
+// E is the encoding, N/U are 3 unused bytes and Cardin. is the cached
+// cardinality as a little endian 64 bits integer, the most significant bit
+// set means that the cache is invalid.
+//
+// The dense encoding stores every register as 6 bits, from the least
+// significant bit of every byte, using 12KB. The sparse encoding is a run
+// length encoding of the registers with 3 opcodes:
+//
+//	ZERO   00xxxxxx          1 to 64 registers set to 0
+//	XZERO  01xxxxxx yyyyyyyy 1 to 16384 registers set to 0
+//	VAL    1vvvvvxx          1 to 4 registers set to the value 1 to 32
+//
+// which makes the HLLs with few elements much smaller. A sparse HLL is
+// converted to the dense encoding once a register needs a larger value, or
+// it gets too large.
+
+// HLL encodings
+const (
+	HLLDense = iota
+	HLLSparse
+)
+
+const (
+	hllP          = 14
+	hllQ          = 64 - hllP
+	hllPMask      = HLLRegisters - 1
+	hllBits       = 6
+	hllRegMax     = 1<<hllBits - 1
+	hllHeaderSize = 16
+
+	// HLLRegisters is the number of registers of an HLL.
+	HLLRegisters = 1 << hllP
+
+	// HLLDenseSize is the size in bytes of a dense HLL.
+	HLLDenseSize = hllHeaderSize + (HLLRegisters*hllBits+7)/8
+
+	hllSparseValMax    = 32
+	hllSparseValMaxLen = 4
+	hllSparseZeroMax   = 64
+	hllSparseXZeroMax  = 16384
+
+	hllAlphaInf = 0.721347520444481703680 // 0.5/ln(2)
+)
+
+// ErrBadHLL is returned when a sparse HLL can't be decoded.
+var ErrBadHLL = errors.New("corrupted HLL object")
+
+// NewHLL creates an empty sparse HLL.
+func NewHLL() []byte {
+	b := make([]byte, hllHeaderSize, hllHeaderSize+2)
+	copy(b, "HYLL")
+	b[4] = HLLSparse
+	return appendHLLZeros(b, HLLRegisters)
+}
+
+// IsHLL reports whether b looks like an HLL, the sparse representation is
+// only checked while decoding it.
+func IsHLL(b []byte) bool {
+	if len(b) < hllHeaderSize || string(b[:4]) != "HYLL" {
+		return false
+	}
+	switch b[4] {
+	case HLLDense:
+		return len(b) == HLLDenseSize
+	case HLLSparse:
+		return true
+	}
+	return false
+}
+
+// HLLEncoding returns the encoding of the HLL b.
+func HLLEncoding(b []byte) int {
+	return int(b[4])
+}
+
+func hllInvalidateCache(b []byte) {
+	b[15] |= 1 << 7
+}
+
+// HLLCachedCount returns the cardinality cached in the header of b, if it
+// is still valid.
+func HLLCachedCount(b []byte) (uint64, bool) {
+	if b[15]&(1<<7) != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(b[8:16]), true
+}
+
+// murmurHash64A is the hash function of the elements, which must be the
+// same as Redis to produce the same HLLs.
+func murmurHash64A(key string, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ (uint64(len(key)) * m)
+	n := len(key) - len(key)&7
+	for i := 0; i < n; i += 8 {
+		k := uint64(key[i]) | uint64(key[i+1])<<8 | uint64(key[i+2])<<16 | uint64(key[i+3])<<24 |
+			uint64(key[i+4])<<32 | uint64(key[i+5])<<40 | uint64(key[i+6])<<48 | uint64(key[i+7])<<56
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	if rest := key[n:]; len(rest) > 0 {
+		for i := len(rest) - 1; i >= 0; i-- {
+			h ^= uint64(rest[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register of the element, and the length of the
+// pattern 000..1 of the rest of its hash, which is the value the register
+// is set to if larger.
+func hllPatLen(ele string) (int, uint8) {
+	hash := murmurHash64A(ele, 0xadc83b19)
+	index := int(hash & hllPMask)
+	// the bit hllQ makes sure the count is at most hllQ+1
+	hash = hash>>hllP | 1<<hllQ
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+func hllDenseGet(regs []byte, i int) uint8 {
+	idx, fb := i*hllBits/8, uint(i*hllBits&7)
+	v := uint(regs[idx]) >> fb
+	if idx+1 < len(regs) {
+		v |= uint(regs[idx+1]) << (8 - fb)
+	}
+	return uint8(v & hllRegMax)
+}
+
+func hllDenseSet(regs []byte, i int, v uint8) {
+	idx, fb := i*hllBits/8, uint(i*hllBits&7)
+	regs[idx] &^= byte(hllRegMax << fb)
+	regs[idx] |= v << fb
+	if idx+1 < len(regs) {
+		regs[idx+1] &^= byte(hllRegMax >> (8 - fb))
+		regs[idx+1] |= v >> (8 - fb)
+	}
+}
+
+// hllSparseDecode calls fn for every run of registers set to the same
+// value of the sparse HLL b.
+func hllSparseDecode(b []byte, fn func(start, runlen int, v uint8)) error {
+	idx := 0
+	for p := hllHeaderSize; p < len(b); {
+		op := b[p]
+		var runlen int
+		var v uint8
+		switch op & 0xc0 {
+		case 0x00:
+			runlen = int(op&0x3f) + 1
+			p++
+		case 0x40:
+			if p+1 >= len(b) {
+				return ErrBadHLL
+			}
+			runlen = (int(op&0x3f)<<8 | int(b[p+1])) + 1
+			p += 2
+		default:
+			v = (op>>2)&0x1f + 1
+			runlen = int(op&0x3) + 1
+			p++
+		}
+		if idx+runlen > HLLRegisters {
+			return ErrBadHLL
+		}
+		fn(idx, runlen, v)
+		idx += runlen
+	}
+	if idx != HLLRegisters {
+		return ErrBadHLL
+	}
+	return nil
+}
+
+func appendHLLZeros(b []byte, runlen int) []byte {
+	for runlen > 0 {
+		if runlen > hllSparseZeroMax {
+			n := runlen
+			if n > hllSparseXZeroMax {
+				n = hllSparseXZeroMax
+			}
+			b = append(b, 0x40|byte((n-1)>>8), byte(n-1))
+			runlen -= n
+		} else {
+			b = append(b, byte(runlen-1))
+			runlen = 0
+		}
+	}
+	return b
+}
+
+// hllSparseEncode encodes the registers in the sparse encoding after the
+// header of b, it fails if a register is too large.
+func hllSparseEncode(header []byte, regs []uint8) ([]byte, bool) {
+	b := make([]byte, hllHeaderSize)
+	copy(b, header)
+	b[4] = HLLSparse
+	for i := 0; i < len(regs); {
+		v := regs[i]
+		if v > hllSparseValMax {
+			return nil, false
+		}
+		j := i + 1
+		for j < len(regs) && regs[j] == v {
+			j++
+		}
+		if v == 0 {
+			b = appendHLLZeros(b, j-i)
+		} else {
+			for runlen := j - i; runlen > 0; runlen -= hllSparseValMaxLen {
+				n := runlen
+				if n > hllSparseValMaxLen {
+					n = hllSparseValMaxLen
+				}
+				b = append(b, 0x80|(v-1)<<2|byte(n-1))
+			}
+		}
+		i = j
+	}
+	return b, true
+}
+
+func hllDenseEncode(header []byte, regs []uint8) []byte {
+	b := make([]byte, HLLDenseSize)
+	copy(b, header[:hllHeaderSize])
+	b[4] = HLLDense
+	for i, v := range regs {
+		if v != 0 {
+			hllDenseSet(b[hllHeaderSize:], i, v)
+		}
+	}
+	return b
+}
+
+// HLLMergeRegisters sets every register of regs to the max between itself
+// and the same register of the HLL b.
+func HLLMergeRegisters(regs []uint8, b []byte) error {
+	if HLLEncoding(b) == HLLDense {
+		for i := range regs {
+			if v := hllDenseGet(b[hllHeaderSize:], i); v > regs[i] {
+				regs[i] = v
+			}
+		}
+		return nil
+	}
+	return hllSparseDecode(b, func(start, runlen int, v uint8) {
+		for i := start; i < start+runlen; i++ {
+			if v > regs[i] {
+				regs[i] = v
+			}
+		}
+	})
+}
+
+// HLLFromRegisters creates an HLL from the registers, which is sparse
+// unless dense is set, or it can't fit in sparseMaxBytes.
+func HLLFromRegisters(regs []uint8, dense bool, sparseMaxBytes int) []byte {
+	header := NewHLL()[:hllHeaderSize]
+	hllInvalidateCache(header)
+	if !dense {
+		if b, ok := hllSparseEncode(header, regs); ok && len(b) <= sparseMaxBytes {
+			return b
+		}
+	}
+	return hllDenseEncode(header, regs)
+}
+
+// HLLAdd adds the elements to the HLL b, and reports whether a register
+// was updated. A sparse HLL is reencoded, and converted to the dense
+// encoding when needed, so the returned HLL must replace b.
+func HLLAdd(b []byte, elements []string, sparseMaxBytes int) ([]byte, bool, error) {
+	updated := false
+	if HLLEncoding(b) == HLLDense {
+		regs := b[hllHeaderSize:]
+		for _, ele := range elements {
+			i, count := hllPatLen(ele)
+			if count > hllDenseGet(regs, i) {
+				hllDenseSet(regs, i, count)
+				updated = true
+			}
+		}
+	} else {
+		regs := make([]uint8, HLLRegisters)
+		if err := HLLMergeRegisters(regs, b); err != nil {
+			return b, false, err
+		}
+		for _, ele := range elements {
+			i, count := hllPatLen(ele)
+			if count > regs[i] {
+				regs[i] = count
+				updated = true
+			}
+		}
+		if updated {
+			sparse, ok := hllSparseEncode(b, regs)
+			if ok && len(sparse) <= sparseMaxBytes {
+				b = sparse
+			} else {
+				b = hllDenseEncode(b, regs)
+			}
+		}
+	}
+
+	if updated {
+		hllInvalidateCache(b)
+	}
+	return b, updated, nil
+}
+
+// HLLCount returns the estimated cardinality of the HLL b, and caches it in
+// the header of b.
+func HLLCount(b []byte) (uint64, error) {
+	regs := make([]uint8, HLLRegisters)
+	if err := HLLMergeRegisters(regs, b); err != nil {
+		return 0, err
+	}
+	card := HLLCountRegisters(regs)
+	binary.LittleEndian.PutUint64(b[8:16], card)
+	return card, nil
+}
+
+// HLLCountRegisters returns the estimated cardinality from the registers,
+// using the improved estimator of Otmar Ertl, which is accurate for both
+// the small and the large cardinalities.
+func HLLCountRegisters(regs []uint8) uint64 {
+	var histo [hllRegMax + 1]int
+	for _, v := range regs {
+		histo[v]++
+	}
+
+	m := float64(HLLRegisters)
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package dt
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHLLEncodings(t *testing.T) {
+	hll := NewHLL()
+	assert.True(t, IsHLL(hll))
+	assert.Equal(t, HLLSparse, HLLEncoding(hll))
+	card, ok := HLLCachedCount(hll)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), card)
+
+	hll, updated, err := HLLAdd(hll, []string{"a", "b", "c"}, 3000)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	_, ok = HLLCachedCount(hll)
+	assert.False(t, ok)
+	_, updated, _ = HLLAdd(hll, []string{"a"}, 3000)
+	assert.False(t, updated)
+
+	sparse := make([]uint8, HLLRegisters)
+	assert.Nil(t, HLLMergeRegisters(sparse, hll))
+
+	// the same registers in the dense encoding
+	dense, _, err := HLLAdd(hll, []string{"d"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, HLLDense, HLLEncoding(dense))
+	assert.Equal(t, HLLDenseSize, len(dense))
+	assert.True(t, IsHLL(dense))
+	regs := make([]uint8, HLLRegisters)
+	assert.Nil(t, HLLMergeRegisters(regs, dense))
+	i, count := hllPatLen("d")
+	if count > sparse[i] {
+		sparse[i] = count
+	}
+	assert.Equal(t, sparse, regs)
+
+	card, err = HLLCount(dense)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), card)
+	cached, ok := HLLCachedCount(dense)
+	assert.True(t, ok)
+	assert.Equal(t, card, cached)
+
+	assert.False(t, IsHLL([]byte("HYLL")))
+	assert.False(t, IsHLL(dense[:HLLDenseSize-1]))
+	assert.NotNil(t, HLLMergeRegisters(regs, hll[:len(hll)-1]))
+}
+
+func TestHLLError(t *testing.T) {
+	hll := NewHLL()
+	regs := make([]uint8, HLLRegisters)
+	for n := 1; n <= 100000; n++ {
+		hll, _, _ = HLLAdd(hll, []string{"ele:" + strconv.Itoa(n)}, 3000)
+		if n%1000 == 0 {
+			card, err := HLLCount(hll)
+			assert.Nil(t, err)
+			// about 5 standard errors
+			assert.InEpsilon(t, n, card, 0.04, strconv.Itoa(n))
+		}
+	}
+	assert.Equal(t, HLLDense, HLLEncoding(hll))
+
+	// the registers can be reencoded in the sparse encoding if small enough
+	small := NewHLL()
+	small, _, _ = HLLAdd(small, []string{"x", "y", "z"}, 3000)
+	regs = make([]uint8, HLLRegisters)
+	assert.Nil(t, HLLMergeRegisters(regs, small))
+	b := HLLFromRegisters(regs, false, 3000)
+	assert.Equal(t, HLLSparse, HLLEncoding(b))
+	assert.Equal(t, small[hllHeaderSize:], b[hllHeaderSize:])
+	card, _ := HLLCount(b)
+	assert.Equal(t, uint64(3), card)
+}
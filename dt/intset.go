@@ -0,0 +1,216 @@
+package dt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+)
+
+// intset encodings, which are the size in bytes of every integer
+const (
+	IntsetEncInt16 = 2
+	IntsetEncInt32 = 4
+	IntsetEncInt64 = 8
+)
+
+// Intset is a sorted array of unique integers. All the integers share the
+// smallest encoding able to represent every one of them, and the whole set
+// is upgraded to a larger encoding when a bigger integer is added.
+type Intset struct {
+	encoding int
+	contents []byte
+}
+
+var errBadIntset = errors.New("corrupted intset")
+
+// NewIntset .
+func NewIntset() *Intset {
+	return &Intset{encoding: IntsetEncInt16}
+}
+
+// IntsetFromBytes creates an intset upon a blob returned by Bytes.
+func IntsetFromBytes(b []byte) (*Intset, error) {
+	if len(b) < 1 {
+		return nil, errBadIntset
+	}
+	is := &Intset{encoding: int(b[0]), contents: b[1:]}
+	switch is.encoding {
+	case IntsetEncInt16, IntsetEncInt32, IntsetEncInt64:
+	default:
+		return nil, errBadIntset
+	}
+	if len(is.contents)%is.encoding != 0 {
+		return nil, errBadIntset
+	}
+	for i := 1; i < is.Len(); i++ {
+		if is.get(i-1) >= is.get(i) {
+			return nil, errBadIntset
+		}
+	}
+	return is, nil
+}
+
+func intsetValueEncoding(v int64) int {
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return IntsetEncInt64
+	} else if v < math.MinInt16 || v > math.MaxInt16 {
+		return IntsetEncInt32
+	}
+	return IntsetEncInt16
+}
+
+// Len returns the number of integers.
+func (is *Intset) Len() int {
+	return len(is.contents) / is.encoding
+}
+
+// BlobLen returns the number of bytes used by the integers.
+func (is *Intset) BlobLen() int {
+	return len(is.contents)
+}
+
+// Bytes serializes the intset, the encoding byte is followed by the
+// little endian integers.
+func (is *Intset) Bytes() []byte {
+	return append([]byte{byte(is.encoding)}, is.contents...)
+}
+
+func (is *Intset) get(i int) int64 {
+	b := is.contents[i*is.encoding:]
+	switch is.encoding {
+	case IntsetEncInt64:
+		return int64(binary.LittleEndian.Uint64(b))
+	case IntsetEncInt32:
+		return int64(int32(binary.LittleEndian.Uint32(b)))
+	default:
+		return int64(int16(binary.LittleEndian.Uint16(b)))
+	}
+}
+
+func (is *Intset) set(i int, v int64) {
+	b := is.contents[i*is.encoding:]
+	switch is.encoding {
+	case IntsetEncInt64:
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	case IntsetEncInt32:
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	default:
+		binary.LittleEndian.PutUint16(b, uint16(v))
+	}
+}
+
+// search returns the position of v, or the position where v should be
+// inserted together with false.
+func (is *Intset) search(v int64) (int, bool) {
+	lo, hi := 0, is.Len()-1
+	for lo <= hi {
+		mid := int(uint(lo+hi) >> 1)
+		cur := is.get(mid)
+		if cur == v {
+			return mid, true
+		} else if cur < v {
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, false
+}
+
+// upgradeAndAdd widens the encoding to fit v, which is out of the range
+// of the current encoding, so it's either the new head or the new tail.
+func (is *Intset) upgradeAndAdd(v int64) {
+	n := is.Len()
+	old := &Intset{encoding: is.encoding, contents: is.contents}
+
+	is.encoding = intsetValueEncoding(v)
+	is.contents = make([]byte, (n+1)*is.encoding)
+
+	prepend := 0
+	if v < 0 {
+		prepend = 1
+	}
+	for i := 0; i < n; i++ {
+		is.set(i+prepend, old.get(i))
+	}
+	if prepend == 1 {
+		is.set(0, v)
+	} else {
+		is.set(n, v)
+	}
+}
+
+// Add inserts v, and returns false if it already exists.
+func (is *Intset) Add(v int64) bool {
+	if intsetValueEncoding(v) > is.encoding {
+		is.upgradeAndAdd(v)
+		return true
+	}
+
+	pos, found := is.search(v)
+	if found {
+		return false
+	}
+
+	is.contents = append(is.contents, make([]byte, is.encoding)...)
+	off := pos * is.encoding
+	copy(is.contents[off+is.encoding:], is.contents[off:len(is.contents)-is.encoding])
+	is.set(pos, v)
+	return true
+}
+
+// Remove deletes v, and returns false if it doesn't exist.
+func (is *Intset) Remove(v int64) bool {
+	if intsetValueEncoding(v) > is.encoding {
+		return false
+	}
+
+	pos, found := is.search(v)
+	if !found {
+		return false
+	}
+
+	off := pos * is.encoding
+	is.contents = append(is.contents[:off], is.contents[off+is.encoding:]...)
+	return true
+}
+
+// Find reports whether v is in the intset.
+func (is *Intset) Find(v int64) bool {
+	if intsetValueEncoding(v) > is.encoding {
+		return false
+	}
+	_, found := is.search(v)
+	return found
+}
+
+// Get returns the integer at position i.
+func (is *Intset) Get(i int) (int64, bool) {
+	if i < 0 || i >= is.Len() {
+		return 0, false
+	}
+	return is.get(i), true
+}
+
+// Random returns a random integer, the intset must not be empty.
+func (is *Intset) Random() int64 {
+	return is.get(rand.Intn(is.Len()))
+}
+
+// Iterate calls fn for every integer in ascending order until fn returns false.
+func (is *Intset) Iterate(fn func(v int64) bool) {
+	for i := 0; i < is.Len(); i++ {
+		if !fn(is.get(i)) {
+			return
+		}
+	}
+}
+
+// Dup returns a copy of the intset.
+func (is *Intset) Dup() *Intset {
+	return &Intset{
+		encoding: is.encoding,
+		contents: append([]byte(nil), is.contents...),
+	}
+}
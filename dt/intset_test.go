@@ -0,0 +1,62 @@
+package dt
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func intsetValues(is *Intset) []int64 {
+	var values []int64
+	is.Iterate(func(v int64) bool {
+		values = append(values, v)
+		return true
+	})
+	return values
+}
+
+func TestIntsetOperations(t *testing.T) {
+	is := NewIntset()
+	assert.True(t, is.Add(5))
+	assert.True(t, is.Add(-3))
+	assert.True(t, is.Add(10))
+	assert.False(t, is.Add(5))
+	assert.Equal(t, []int64{-3, 5, 10}, intsetValues(is))
+	assert.Equal(t, IntsetEncInt16, is.encoding)
+
+	assert.True(t, is.Find(10))
+	assert.False(t, is.Find(11))
+	assert.False(t, is.Find(math.MaxInt64))
+
+	assert.True(t, is.Remove(5))
+	assert.False(t, is.Remove(5))
+	assert.Equal(t, []int64{-3, 10}, intsetValues(is))
+}
+
+func TestIntsetUpgrade(t *testing.T) {
+	is := NewIntset()
+	is.Add(1)
+	is.Add(2)
+
+	is.Add(math.MaxInt32 + 1)
+	assert.Equal(t, IntsetEncInt64, is.encoding)
+	assert.Equal(t, []int64{1, 2, math.MaxInt32 + 1}, intsetValues(is))
+
+	is.Add(math.MinInt64)
+	is.Add(math.MinInt16 - 1)
+	assert.Equal(t, []int64{math.MinInt64, math.MinInt16 - 1, 1, 2, math.MaxInt32 + 1}, intsetValues(is))
+
+	v, ok := is.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(math.MinInt16-1), v)
+	_, ok = is.Get(5)
+	assert.False(t, ok)
+
+	dup, err := IntsetFromBytes(is.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, intsetValues(is), intsetValues(dup))
+
+	_, err = IntsetFromBytes([]byte{IntsetEncInt32, 1, 2})
+	assert.NotNil(t, err)
+}
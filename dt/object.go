@@ -1,6 +1,9 @@
 package dt
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
 
 // Object .
 type Object struct {
@@ -16,6 +19,8 @@ const (
 	ObjList
 	ObjZSet
 	ObjHash
+	ObjSet
+	ObjStream
 )
 
 // objects encoding
@@ -23,10 +28,33 @@ const (
 	ObjEncodingRaw = iota
 	ObjEncodingInt
 	ObjEncodingHt
-	ObjEncodingList
+	ObjEncodingQuicklist
 	ObjEncodingSkiplist
+	ObjEncodingZiplist
+	ObjEncodingIntset
+	ObjEncodingEmbstr
+	ObjEncodingStream
+)
+
+const (
+	// ObjSharedIntegers is the number of the shared integer objects,
+	// from 0 to ObjSharedIntegers-1.
+	ObjSharedIntegers = 10000
+
+	// ObjEmbstrSizeLimit is the max length of the embstr encoded strings.
+	ObjEmbstrSizeLimit = 44
 )
 
+// SharedIntegers are the string objects of the small integers, which can
+// be referenced by several keys instead of allocating an object for each.
+var SharedIntegers [ObjSharedIntegers]*Object
+
+func init() {
+	for i := range SharedIntegers {
+		SharedIntegers[i] = NewIntObject(int64(i))
+	}
+}
+
 // NewObj .
 func NewObj(t uint8, v interface{}) *Object {
 	return &Object{
@@ -37,9 +65,136 @@ func NewObj(t uint8, v interface{}) *Object {
 	}
 }
 
-// NewList .
-func NewList(t uint8, v []string) *Object {
-	obj := NewObj(t, v)
-	obj.Encoding = ObjEncodingList
+// NewStringObject creates a string object holding s as it is, short strings
+// use the embstr encoding.
+func NewStringObject(s string) *Object {
+	obj := NewObj(ObjString, s)
+	if len(s) <= ObjEmbstrSizeLimit {
+		obj.Encoding = ObjEncodingEmbstr
+	}
+	return obj
+}
+
+// NewBytesObject creates a raw string object holding b, which can be
+// modified in place.
+func NewBytesObject(b []byte) *Object {
+	return NewObj(ObjString, b)
+}
+
+// NewIntObject creates a string object holding the integer v.
+func NewIntObject(v int64) *Object {
+	obj := NewObj(ObjString, v)
+	obj.Encoding = ObjEncodingInt
+	return obj
+}
+
+// TryStringEncoding creates a string object for s, using the int encoding
+// if s is the canonical representation of a 64 bit integer. The small
+// integers return one of the SharedIntegers when shared is true.
+func TryStringEncoding(s string, shared bool) *Object {
+	v, ok := StringToInt64(s)
+	if !ok {
+		return NewStringObject(s)
+	}
+	if shared && v >= 0 && v < ObjSharedIntegers {
+		return SharedIntegers[v]
+	}
+	return NewIntObject(v)
+}
+
+// StringToInt64 parses s if it's the canonical representation of a 64 bit
+// integer, without sign, spaces or leading zeros which would be lost.
+func StringToInt64(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != s {
+		return 0, false
+	}
+	return v, true
+}
+
+// StringValue returns the value of a string object, decoding the int
+// encoding.
+func (o *Object) StringValue() string {
+	switch v := o.Ptr.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case []byte:
+		return string(v)
+	}
+	return o.Ptr.(string)
+}
+
+// StringLen returns the length of the value of a string object.
+func (o *Object) StringLen() int {
+	switch v := o.Ptr.(type) {
+	case []byte:
+		return len(v)
+	case string:
+		return len(v)
+	}
+	return len(o.StringValue())
+}
+
+// NewHash creates an empty hash object, which starts as a ziplist
+// of field, value pairs.
+func NewHash() *Object {
+	obj := NewObj(ObjHash, NewZiplist())
+	obj.Encoding = ObjEncodingZiplist
+	return obj
+}
+
+// NewSet creates an empty set object backed by a dict, the members are
+// the keys and the values are nil.
+func NewSet() *Object {
+	obj := NewObj(ObjSet, NewDict())
+	obj.Encoding = ObjEncodingHt
+	return obj
+}
+
+// NewIntsetObject creates an empty set object which can only hold integers.
+func NewIntsetObject() *Object {
+	obj := NewObj(ObjSet, NewIntset())
+	obj.Encoding = ObjEncodingIntset
 	return obj
 }
+
+// NewQuicklistObject creates an empty list object, fill limits the size
+// of the quicklist nodes.
+func NewQuicklistObject(fill int) *Object {
+	obj := NewObj(ObjList, NewQuicklist(fill))
+	obj.Encoding = ObjEncodingQuicklist
+	return obj
+}
+
+// Dup returns a copy of the object that shares no mutable state with it.
+func (o *Object) Dup() *Object {
+	dup := *o
+	switch o.ObjType {
+	case ObjString:
+		if b, ok := o.Ptr.([]byte); ok {
+			dup.Ptr = append([]byte(nil), b...)
+		}
+	case ObjList:
+		dup.Ptr = o.Ptr.(*Quicklist).Dup()
+	case ObjHash:
+		if o.Encoding == ObjEncodingZiplist {
+			dup.Ptr = o.Ptr.(*Ziplist).Dup()
+		} else {
+			dup.Ptr = o.Ptr.(*Dict).Dup()
+		}
+	case ObjSet:
+		if o.Encoding == ObjEncodingIntset {
+			dup.Ptr = o.Ptr.(*Intset).Dup()
+		} else {
+			dup.Ptr = o.Ptr.(*Dict).Dup()
+		}
+	case ObjZSet:
+		dup.Ptr = o.Ptr.(*SortedSet).Dup()
+	case ObjStream:
+		dup.Ptr = o.Ptr.(*Stream).Dup()
+	}
+	return &dup
+}
@@ -0,0 +1,35 @@
+package dt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTryStringEncoding(t *testing.T) {
+	testCases := []struct {
+		s        string
+		encoding uint8
+	}{
+		{"0", ObjEncodingInt},
+		{"-42", ObjEncodingInt},
+		{"9223372036854775807", ObjEncodingInt},
+		{"9223372036854775808", ObjEncodingEmbstr},
+		{"+1", ObjEncodingEmbstr},
+		{"007", ObjEncodingEmbstr},
+		{"-0", ObjEncodingEmbstr},
+		{" 1", ObjEncodingEmbstr},
+		{"", ObjEncodingEmbstr},
+		{"hello", ObjEncodingEmbstr},
+		{string(make([]byte, ObjEmbstrSizeLimit+1)), ObjEncodingRaw},
+	}
+	for _, tC := range testCases {
+		o := TryStringEncoding(tC.s, false)
+		assert.Equal(t, tC.encoding, o.Encoding, tC.s)
+		assert.Equal(t, tC.s, o.StringValue())
+	}
+
+	assert.True(t, TryStringEncoding("42", true) == SharedIntegers[42])
+	assert.False(t, TryStringEncoding("42", false) == SharedIntegers[42])
+	assert.False(t, TryStringEncoding("10000", true) == TryStringEncoding("10000", true))
+}
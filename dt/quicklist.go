@@ -0,0 +1,372 @@
+package dt
+
+// Quicklist is a doubly linked list of ziplists, so that pushing and
+// popping at both ends is O(1) while most of the memory is kept in
+// compact nodes.
+type Quicklist struct {
+	head  *quicklistNode
+	tail  *quicklistNode
+	count int
+	len   int
+
+	// fill limits the size of every node: a positive fill is the maximum
+	// number of entries, and -1 to -5 limit the node to 4, 8, 16, 32 or
+	// 64 KB.
+	fill int
+}
+
+type quicklistNode struct {
+	prev *quicklistNode
+	next *quicklistNode
+	zl   *Ziplist
+}
+
+var quicklistSizeLimits = [...]int{4096, 8192, 16384, 32768, 65536}
+
+// safety limit for nodes when fill is positive, so big entries are not
+// accumulated in a single node.
+const quicklistSizeSafetyLimit = 8192
+
+// NewQuicklist .
+func NewQuicklist(fill int) *Quicklist {
+	if fill < -len(quicklistSizeLimits) {
+		fill = -len(quicklistSizeLimits)
+	} else if fill == 0 {
+		fill = 1
+	}
+	return &Quicklist{fill: fill}
+}
+
+// Len returns the number of entries.
+func (ql *Quicklist) Len() int {
+	return ql.count
+}
+
+// Nodes returns the number of ziplist nodes.
+func (ql *Quicklist) Nodes() int {
+	return ql.len
+}
+
+// allowInsert reports whether v can be added to the node without
+// exceeding the fill limit.
+func (ql *Quicklist) allowInsert(node *quicklistNode, v string) bool {
+	if node == nil {
+		return false
+	}
+	return !ql.exceedsLimit(node.zl.Len()+1, node.zl.BlobLen()+len(v))
+}
+
+func (ql *Quicklist) exceedsLimit(entries, size int) bool {
+	if ql.fill > 0 {
+		return entries > ql.fill || (entries > 1 && size > quicklistSizeSafetyLimit)
+	}
+	return entries > 1 && size > quicklistSizeLimits[-ql.fill-1]
+}
+
+func (ql *Quicklist) insertNode(old, node *quicklistNode, after bool) {
+	if old == nil {
+		ql.head, ql.tail = node, node
+	} else if after {
+		node.prev, node.next = old, old.next
+		if old.next != nil {
+			old.next.prev = node
+		} else {
+			ql.tail = node
+		}
+		old.next = node
+	} else {
+		node.prev, node.next = old.prev, old
+		if old.prev != nil {
+			old.prev.next = node
+		} else {
+			ql.head = node
+		}
+		old.prev = node
+	}
+	ql.len++
+}
+
+func (ql *Quicklist) deleteNode(node *quicklistNode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		ql.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		ql.tail = node.prev
+	}
+	ql.count -= node.zl.Len()
+	ql.len--
+}
+
+// PushHead inserts v at the head.
+func (ql *Quicklist) PushHead(v string) {
+	if ql.allowInsert(ql.head, v) {
+		ql.head.zl.Insert(0, v)
+	} else {
+		node := &quicklistNode{zl: NewZiplist()}
+		node.zl.Push(v)
+		ql.insertNode(ql.head, node, false)
+	}
+	ql.count++
+}
+
+// PushTail appends v at the tail.
+func (ql *Quicklist) PushTail(v string) {
+	if ql.allowInsert(ql.tail, v) {
+		ql.tail.zl.Push(v)
+	} else {
+		node := &quicklistNode{zl: NewZiplist()}
+		node.zl.Push(v)
+		ql.insertNode(ql.tail, node, true)
+	}
+	ql.count++
+}
+
+// PopHead removes and returns the head entry.
+func (ql *Quicklist) PopHead() (string, bool) {
+	if ql.count == 0 {
+		return "", false
+	}
+	v, _ := ql.head.zl.Index(0)
+	ql.delEntry(ql.head, 0)
+	return v, true
+}
+
+// PopTail removes and returns the tail entry.
+func (ql *Quicklist) PopTail() (string, bool) {
+	if ql.count == 0 {
+		return "", false
+	}
+	v, _ := ql.tail.zl.Index(-1)
+	ql.delEntry(ql.tail, ql.tail.zl.Len()-1)
+	return v, true
+}
+
+// delEntry deletes the entry at offset of node, and returns true if the
+// node was deleted because it became empty.
+func (ql *Quicklist) delEntry(node *quicklistNode, offset int) bool {
+	node.zl.Delete(offset, 1)
+	ql.count--
+	if node.zl.Len() == 0 {
+		ql.deleteNode(node)
+		return true
+	}
+	return false
+}
+
+// lookup returns the node holding the entry at index i together with the
+// offset of the entry in the node, negative indexes start from the tail.
+func (ql *Quicklist) lookup(i int) (*quicklistNode, int) {
+	if i < 0 {
+		i += ql.count
+	}
+	if i < 0 || i >= ql.count {
+		return nil, 0
+	}
+
+	if i < ql.count/2 {
+		for node := ql.head; node != nil; node = node.next {
+			if i < node.zl.Len() {
+				return node, i
+			}
+			i -= node.zl.Len()
+		}
+	} else {
+		i = ql.count - 1 - i
+		for node := ql.tail; node != nil; node = node.prev {
+			if i < node.zl.Len() {
+				return node, node.zl.Len() - 1 - i
+			}
+			i -= node.zl.Len()
+		}
+	}
+	return nil, 0
+}
+
+// Index returns the entry at index i, negative indexes start from the tail.
+func (ql *Quicklist) Index(i int) (string, bool) {
+	node, offset := ql.lookup(i)
+	if node == nil {
+		return "", false
+	}
+	return node.zl.Index(offset)
+}
+
+// Replace replaces the entry at index i, and returns false if i is out of range.
+func (ql *Quicklist) Replace(i int, v string) bool {
+	node, offset := ql.lookup(i)
+	if node == nil {
+		return false
+	}
+	node.zl.Replace(offset, v)
+	if ql.exceedsLimit(node.zl.Len(), node.zl.BlobLen()) {
+		ql.split(node)
+	}
+	return true
+}
+
+// Insert inserts v before the entry at index i, or after it when after is set.
+func (ql *Quicklist) Insert(i int, v string, after bool) bool {
+	node, offset := ql.lookup(i)
+	if node == nil {
+		return false
+	}
+	if after {
+		offset++
+	}
+	node.zl.Insert(offset, v)
+	ql.count++
+	if ql.exceedsLimit(node.zl.Len(), node.zl.BlobLen()) {
+		ql.split(node)
+	}
+	return true
+}
+
+// split moves the second half of the entries of node into a new node.
+func (ql *Quicklist) split(node *quicklistNode) {
+	n := node.zl.Len()
+	if n < 2 {
+		return
+	}
+
+	mid := n / 2
+	next := &quicklistNode{zl: NewZiplist()}
+	node.zl.Iterate(func(i int, v string) bool {
+		if i >= mid {
+			next.zl.Push(v)
+		}
+		return true
+	})
+	node.zl.Delete(mid, n-mid)
+	ql.insertNode(node, next, true)
+}
+
+// DelRange deletes count entries starting at index start, and returns the
+// number of deleted entries.
+func (ql *Quicklist) DelRange(start, count int) int {
+	node, offset := ql.lookup(start)
+	deleted := 0
+	for node != nil && deleted < count {
+		next := node.next
+		n := node.zl.Len() - offset
+		if n > count-deleted {
+			n = count - deleted
+		}
+
+		if offset == 0 && n == node.zl.Len() {
+			ql.deleteNode(node)
+		} else {
+			node.zl.Delete(offset, n)
+			ql.count -= n
+		}
+		deleted += n
+		node, offset = next, 0
+	}
+	return deleted
+}
+
+// Dup returns a copy of the quicklist.
+func (ql *Quicklist) Dup() *Quicklist {
+	dup := NewQuicklist(ql.fill)
+	for node := ql.head; node != nil; node = node.next {
+		dup.insertNode(dup.tail, &quicklistNode{zl: node.zl.Dup()}, true)
+	}
+	dup.count = ql.count
+	return dup
+}
+
+// AppendZiplist appends all the entries of zl as a new node, it is used to
+// load lists from the disk.
+func (ql *Quicklist) AppendZiplist(zl *Ziplist) {
+	if zl.Len() == 0 {
+		return
+	}
+	ql.insertNode(ql.tail, &quicklistNode{zl: zl}, true)
+	ql.count += zl.Len()
+}
+
+// IterateNodes calls fn with the ziplist of every node from head to tail
+// until fn returns false, the ziplists must not be modified.
+func (ql *Quicklist) IterateNodes(fn func(zl *Ziplist) bool) {
+	for node := ql.head; node != nil; node = node.next {
+		if !fn(node.zl) {
+			return
+		}
+	}
+}
+
+// QuicklistIter iterates over the entries of a quicklist in either
+// direction, and allows deleting the entries while iterating.
+type QuicklistIter struct {
+	ql      *Quicklist
+	node    *quicklistNode
+	offset  int
+	reverse bool
+	current *quicklistNode
+}
+
+// Iterator returns an iterator starting at index start, which moves to
+// the head when reverse is set.
+func (ql *Quicklist) Iterator(start int, reverse bool) *QuicklistIter {
+	node, offset := ql.lookup(start)
+	return &QuicklistIter{ql: ql, node: node, offset: offset, reverse: reverse}
+}
+
+// Next returns the next entry, or false at the end of the list.
+func (it *QuicklistIter) Next() (string, bool) {
+	for it.node != nil && (it.offset < 0 || it.offset >= it.node.zl.Len()) {
+		if it.reverse {
+			it.node = it.node.prev
+			if it.node != nil {
+				it.offset = it.node.zl.Len() - 1
+			}
+		} else {
+			it.node = it.node.next
+			it.offset = 0
+		}
+	}
+	if it.node == nil {
+		it.current = nil
+		return "", false
+	}
+
+	v, _ := it.node.zl.Index(it.offset)
+	it.current = it.node
+	if it.reverse {
+		it.offset--
+	} else {
+		it.offset++
+	}
+	return v, true
+}
+
+// Delete deletes the entry last returned by Next.
+func (it *QuicklistIter) Delete() {
+	if it.current == nil {
+		return
+	}
+
+	offset := it.offset - 1
+	if it.reverse {
+		offset = it.offset + 1
+	}
+	node := it.current
+	it.current = nil
+
+	next, prev := node.next, node.prev
+	if it.ql.delEntry(node, offset) {
+		if it.reverse {
+			it.node = prev
+			if prev != nil {
+				it.offset = prev.zl.Len() - 1
+			}
+		} else {
+			it.node, it.offset = next, 0
+		}
+	} else if !it.reverse {
+		it.offset--
+	}
+}
@@ -0,0 +1,103 @@
+package dt
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func quicklistValues(ql *Quicklist) []string {
+	var values []string
+	it := ql.Iterator(0, false)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestQuicklistPushPop(t *testing.T) {
+	ql := NewQuicklist(4)
+	for i := 0; i < 10; i++ {
+		ql.PushTail(strconv.Itoa(i))
+	}
+	ql.PushHead("h")
+	assert.Equal(t, 11, ql.Len())
+	assert.Equal(t, 4, ql.Nodes())
+
+	v, ok := ql.PopHead()
+	assert.True(t, ok)
+	assert.Equal(t, "h", v)
+	v, _ = ql.PopTail()
+	assert.Equal(t, "9", v)
+
+	v, _ = ql.Index(-1)
+	assert.Equal(t, "8", v)
+	v, _ = ql.Index(5)
+	assert.Equal(t, "5", v)
+	_, ok = ql.Index(9)
+	assert.False(t, ok)
+
+	for ql.Len() > 0 {
+		ql.PopHead()
+	}
+	assert.Equal(t, 0, ql.Nodes())
+	_, ok = ql.PopTail()
+	assert.False(t, ok)
+}
+
+func TestQuicklistInsertAndDelete(t *testing.T) {
+	ql := NewQuicklist(2)
+	for i := 0; i < 6; i++ {
+		ql.PushTail(strconv.Itoa(i))
+	}
+
+	assert.True(t, ql.Insert(2, "a", false))
+	assert.True(t, ql.Insert(-1, "z", true))
+	assert.True(t, ql.Replace(0, "r"))
+	assert.Equal(t, []string{"r", "1", "a", "2", "3", "4", "5", "z"}, quicklistValues(ql))
+
+	assert.Equal(t, 3, ql.DelRange(1, 3))
+	assert.Equal(t, []string{"r", "3", "4", "5", "z"}, quicklistValues(ql))
+	assert.Equal(t, 5, ql.Len())
+
+	dup := ql.Dup()
+	dup.PushHead("x")
+	assert.Equal(t, 5, ql.Len())
+	assert.Equal(t, 6, dup.Len())
+}
+
+func TestQuicklistIteratorDelete(t *testing.T) {
+	ql := NewQuicklist(3)
+	for i := 0; i < 10; i++ {
+		ql.PushTail(strconv.Itoa(i % 2))
+	}
+
+	it := ql.Iterator(0, false)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		if v == "1" {
+			it.Delete()
+		}
+	}
+	assert.Equal(t, []string{"0", "0", "0", "0", "0"}, quicklistValues(ql))
+
+	var values []string
+	it = ql.Iterator(-1, true)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		values = append(values, v)
+		if len(values)%2 == 1 {
+			it.Delete()
+		}
+	}
+	assert.Equal(t, 5, len(values))
+	assert.Equal(t, 2, ql.Len())
+}
+
+func TestQuicklistSizeLimit(t *testing.T) {
+	ql := NewQuicklist(-1)
+	big := string(make([]byte, 3000))
+	ql.PushTail(big)
+	ql.PushTail(big)
+	ql.PushTail("small")
+	assert.Equal(t, 2, ql.Nodes())
+}
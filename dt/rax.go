@@ -0,0 +1,254 @@
+package dt
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Rax is a radix tree mapping byte strings to values, and keeping them in
+// lexicographic order. The chains of nodes with a single child and no
+// value are compressed in a single node, so the depth of the tree depends
+// on the number of keys sharing a prefix rather than on the key length.
+type Rax struct {
+	root *raxNode
+	len  int
+}
+
+type raxNode struct {
+	prefix   []byte // the label of the edge leading to the node
+	children []*raxNode
+	isKey    bool
+	value    interface{}
+}
+
+// NewRax .
+func NewRax() *Rax {
+	return &Rax{root: &raxNode{}}
+}
+
+// Len returns the number of keys.
+func (r *Rax) Len() int {
+	return r.len
+}
+
+// Nodes returns the number of nodes of the tree.
+func (r *Rax) Nodes() int {
+	return r.root.count()
+}
+
+func (n *raxNode) count() int {
+	nodes := 1
+	for _, child := range n.children {
+		nodes += child.count()
+	}
+	return nodes
+}
+
+// childIndex returns the index of the child whose prefix starts with c,
+// or the index where such a child would be inserted.
+func (n *raxNode) childIndex(c byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].prefix[0] >= c
+	})
+	return i, i < len(n.children) && n.children[i].prefix[0] == c
+}
+
+// Find returns the value of the key.
+func (r *Rax) Find(key []byte) (interface{}, bool) {
+	n := r.root
+	for len(key) > 0 {
+		i, ok := n.childIndex(key[0])
+		if !ok || !bytes.HasPrefix(key, n.children[i].prefix) {
+			return nil, false
+		}
+		n = n.children[i]
+		key = key[len(n.prefix):]
+	}
+	return n.value, n.isKey
+}
+
+// Insert sets the value of the key, and returns true if the key is new.
+func (r *Rax) Insert(key []byte, v interface{}) bool {
+	n := r.root
+	for len(key) > 0 {
+		i, ok := n.childIndex(key[0])
+		if !ok {
+			child := &raxNode{prefix: append([]byte(nil), key...), isKey: true, value: v}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = child
+			r.len++
+			return true
+		}
+
+		child := n.children[i]
+		common := 0
+		for common < len(key) && common < len(child.prefix) && key[common] == child.prefix[common] {
+			common++
+		}
+		// split the edge where the key diverges
+		if common < len(child.prefix) {
+			split := &raxNode{
+				prefix:   append([]byte(nil), child.prefix[:common]...),
+				children: []*raxNode{child},
+			}
+			child.prefix = child.prefix[common:]
+			n.children[i] = split
+			child = split
+		}
+		n = child
+		key = key[common:]
+	}
+
+	isNew := !n.isKey
+	n.isKey, n.value = true, v
+	if isNew {
+		r.len++
+	}
+	return isNew
+}
+
+// Remove deletes the key, and returns its value.
+func (r *Rax) Remove(key []byte) (interface{}, bool) {
+	var parent, grandparent *raxNode
+	n := r.root
+	for len(key) > 0 {
+		i, ok := n.childIndex(key[0])
+		if !ok || !bytes.HasPrefix(key, n.children[i].prefix) {
+			return nil, false
+		}
+		grandparent, parent = parent, n
+		n = n.children[i]
+		key = key[len(n.prefix):]
+	}
+	if !n.isKey {
+		return nil, false
+	}
+
+	v := n.value
+	n.isKey, n.value = false, nil
+	r.len--
+
+	// removing the node may leave its parent with a single child, which
+	// is then merged with it.
+	if parent != nil {
+		parent.compress(n)
+		if grandparent != nil {
+			grandparent.compress(parent)
+		}
+	}
+	return v, true
+}
+
+// compress removes the child if it has no value and no children, or merges
+// it with its only child.
+func (n *raxNode) compress(child *raxNode) {
+	if child.isKey || len(child.children) > 1 {
+		return
+	}
+	i, _ := n.childIndex(child.prefix[0])
+	if len(child.children) == 0 {
+		n.children = append(n.children[:i], n.children[i+1:]...)
+		return
+	}
+	only := child.children[0]
+	only.prefix = append(append([]byte(nil), child.prefix...), only.prefix...)
+	n.children[i] = only
+}
+
+// Ascend calls fn for every key >= from in ascending order until fn returns
+// false, a nil from starts from the first key. The key passed to fn is only
+// valid during the call, and the tree must not be modified by fn.
+func (r *Rax) Ascend(from []byte, fn func(key []byte, v interface{}) bool) {
+	r.root.ascend(nil, from, from != nil, fn)
+}
+
+func (n *raxNode) ascend(key, from []byte, bounded bool, fn func(key []byte, v interface{}) bool) bool {
+	key = append(key, n.prefix...)
+	if bounded {
+		l := len(key)
+		if len(from) < l {
+			l = len(from)
+		}
+		switch bytes.Compare(key[:l], from[:l]) {
+		case -1:
+			// the whole subtree is before from
+			return true
+		case 1:
+			bounded = false
+		default:
+			bounded = len(key) < len(from)
+		}
+	}
+
+	// a key which is still bounded is a strict prefix of from
+	if n.isKey && !bounded && !fn(key, n.value) {
+		return false
+	}
+	for _, child := range n.children {
+		if !child.ascend(key, from, bounded, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// Descend calls fn for every key <= from in descending order until fn
+// returns false, a nil from starts from the last key.
+func (r *Rax) Descend(from []byte, fn func(key []byte, v interface{}) bool) {
+	r.root.descend(nil, from, from != nil, fn)
+}
+
+func (n *raxNode) descend(key, from []byte, bounded bool, fn func(key []byte, v interface{}) bool) bool {
+	key = append(key, n.prefix...)
+	if bounded {
+		l := len(key)
+		if len(from) < l {
+			l = len(from)
+		}
+		switch bytes.Compare(key[:l], from[:l]) {
+		case 1:
+			// the whole subtree is after from
+			return true
+		case -1:
+			bounded = false
+		default:
+			if len(key) > len(from) {
+				return true
+			} else if len(key) == len(from) {
+				return !n.isKey || fn(key, n.value)
+			}
+		}
+	}
+
+	for i := len(n.children) - 1; i >= 0; i-- {
+		if !n.children[i].descend(key, from, bounded, fn) {
+			return false
+		}
+	}
+	return !n.isKey || fn(key, n.value)
+}
+
+// First returns the smallest key and its value.
+func (r *Rax) First() ([]byte, interface{}, bool) {
+	var key []byte
+	var value interface{}
+	found := false
+	r.Ascend(nil, func(k []byte, v interface{}) bool {
+		key, value, found = append([]byte(nil), k...), v, true
+		return false
+	})
+	return key, value, found
+}
+
+// Last returns the largest key and its value.
+func (r *Rax) Last() ([]byte, interface{}, bool) {
+	var key []byte
+	var value interface{}
+	found := false
+	r.Descend(nil, func(k []byte, v interface{}) bool {
+		key, value, found = append([]byte(nil), k...), v, true
+		return false
+	})
+	return key, value, found
+}
@@ -0,0 +1,96 @@
+package dt
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func raxKeys(t *testing.T, r *Rax, from []byte, reverse bool) []string {
+	var keys []string
+	fn := func(key []byte, v interface{}) bool {
+		assert.Equal(t, string(key), v)
+		keys = append(keys, string(key))
+		return true
+	}
+	if reverse {
+		r.Descend(from, fn)
+	} else {
+		r.Ascend(from, fn)
+	}
+	return keys
+}
+
+func TestRaxOperations(t *testing.T) {
+	r := NewRax()
+	for _, k := range []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus", "rom", ""} {
+		assert.True(t, r.Insert([]byte(k), k))
+	}
+	assert.False(t, r.Insert([]byte("rom"), "rom"))
+	assert.Equal(t, 9, r.Len())
+
+	v, ok := r.Find([]byte("ruber"))
+	assert.True(t, ok)
+	assert.Equal(t, "ruber", v)
+	_, ok = r.Find([]byte("rube"))
+	assert.False(t, ok)
+	_, ok = r.Find([]byte("rubicons"))
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{"", "rom", "romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus"}, raxKeys(t, r, nil, false))
+	assert.Equal(t, []string{"romulus", "rubens", "ruber", "rubicon", "rubicundus"}, raxKeys(t, r, []byte("romo"), false))
+	assert.Equal(t, []string{"rubicon", "rubicundus"}, raxKeys(t, r, []byte("rubicon"), false))
+	assert.Equal(t, []string{"romanus", "romane", "rom", ""}, raxKeys(t, r, []byte("romanz"), true))
+	assert.Equal(t, []string{"rom", ""}, raxKeys(t, r, []byte("rom"), true))
+	assert.Equal(t, []string{""}, raxKeys(t, r, []byte("ro"), true))
+
+	_, ok = r.Remove([]byte("rub"))
+	assert.False(t, ok)
+	v, ok = r.Remove([]byte("rubicon"))
+	assert.True(t, ok)
+	assert.Equal(t, "rubicon", v)
+	r.Remove([]byte("rom"))
+	r.Remove([]byte(""))
+	assert.Equal(t, []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicundus"}, raxKeys(t, r, nil, false))
+	assert.Equal(t, 6, r.Len())
+
+	first, _, ok := r.First()
+	assert.True(t, ok)
+	assert.Equal(t, "romane", string(first))
+	last, _, _ := r.Last()
+	assert.Equal(t, "rubicundus", string(last))
+}
+
+func TestRaxRandom(t *testing.T) {
+	r := NewRax()
+	keys := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		k := strconv.Itoa(rand.Intn(2000))
+		if rand.Intn(3) == 0 {
+			_, ok := r.Remove([]byte(k))
+			assert.Equal(t, keys[k], ok)
+			delete(keys, k)
+		} else {
+			assert.Equal(t, !keys[k], r.Insert([]byte(k), k))
+			keys[k] = true
+		}
+	}
+
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	assert.Equal(t, len(sorted), r.Len())
+	assert.Equal(t, sorted, raxKeys(t, r, nil, false))
+
+	i := sort.SearchStrings(sorted, "5")
+	assert.Equal(t, sorted[i:], raxKeys(t, r, []byte("5"), false))
+	reversed := raxKeys(t, r, []byte("5"), true)
+	for j := range reversed {
+		assert.Equal(t, sorted[len(reversed)-1-j], reversed[j])
+	}
+}
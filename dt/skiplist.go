@@ -0,0 +1,402 @@
+package dt
+
+import "math/rand"
+
+const (
+	SkiplistMaxLevel = 32
+	SkiplistP        = 0.25
+)
+
+// SkiplistNode .
+type SkiplistNode struct {
+	Member   string
+	Score    float64
+	backward *SkiplistNode
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *SkiplistNode
+	span    int64
+}
+
+// Skiplist keeps the members ordered by score, then lexicographically.
+// Every level records the number of nodes it jumps over, so that the rank
+// of a node can be computed while traversing the list.
+type Skiplist struct {
+	header *SkiplistNode
+	tail   *SkiplistNode
+	length int64
+	level  int
+}
+
+// NewSkiplist .
+func NewSkiplist() *Skiplist {
+	return &Skiplist{
+		header: newSkiplistNode(SkiplistMaxLevel, 0, ""),
+		level:  1,
+	}
+}
+
+func newSkiplistNode(level int, score float64, member string) *SkiplistNode {
+	return &SkiplistNode{
+		Member: member,
+		Score:  score,
+		level:  make([]skiplistLevel, level),
+	}
+}
+
+// randomLevel returns a level between 1 and SkiplistMaxLevel with
+// a powerlaw-alike distribution where higher levels are less likely.
+func randomLevel() int {
+	level := 1
+	for level < SkiplistMaxLevel && rand.Float64() < SkiplistP {
+		level++
+	}
+	return level
+}
+
+// Next returns the following node, or nil at the tail.
+func (n *SkiplistNode) Next() *SkiplistNode {
+	return n.level[0].forward
+}
+
+// Prev returns the preceding node, or nil at the head.
+func (n *SkiplistNode) Prev() *SkiplistNode {
+	return n.backward
+}
+
+// less reports whether the node sorts before the element (score, member).
+func (n *SkiplistNode) less(score float64, member string) bool {
+	return n.Score < score || (n.Score == score && n.Member < member)
+}
+
+// Len .
+func (sl *Skiplist) Len() int64 {
+	return sl.length
+}
+
+// First returns the node with the lowest score.
+func (sl *Skiplist) First() *SkiplistNode {
+	return sl.header.level[0].forward
+}
+
+// Last returns the node with the highest score.
+func (sl *Skiplist) Last() *SkiplistNode {
+	return sl.tail
+}
+
+// Insert inserts a new node, the member must not already exist.
+func (sl *Skiplist) Insert(score float64, member string) *SkiplistNode {
+	var update [SkiplistMaxLevel]*SkiplistNode
+	var rank [SkiplistMaxLevel]int64
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		// store rank that is crossed to reach the insert position
+		if i != sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = newSkiplistNode(level, score, member)
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		// update span covered by update[i] as x is inserted here
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+
+	// increment span for untouched levels
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	return x
+}
+
+func (sl *Skiplist) deleteNode(x *SkiplistNode, update []*SkiplistNode) {
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+// findUpdate fills update with the rightmost node of every level which
+// sorts before the element, and returns the node following it at level 0.
+func (sl *Skiplist) findUpdate(score float64, member string, update []*SkiplistNode) *SkiplistNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.less(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return x.level[0].forward
+}
+
+// Delete deletes the element, and returns false if it was not found.
+func (sl *Skiplist) Delete(score float64, member string) bool {
+	var update [SkiplistMaxLevel]*SkiplistNode
+	x := sl.findUpdate(score, member, update[:])
+	if x != nil && x.Score == score && x.Member == member {
+		sl.deleteNode(x, update[:])
+		return true
+	}
+	return false
+}
+
+// UpdateScore changes the score of an existing element, the node is
+// moved only when its position in the list changes.
+func (sl *Skiplist) UpdateScore(curscore float64, member string, newscore float64) *SkiplistNode {
+	var update [SkiplistMaxLevel]*SkiplistNode
+	x := sl.findUpdate(curscore, member, update[:])
+
+	if (x.backward == nil || x.backward.Score < newscore) &&
+		(x.level[0].forward == nil || x.level[0].forward.Score > newscore) {
+		x.Score = newscore
+		return x
+	}
+
+	sl.deleteNode(x, update[:])
+	return sl.Insert(newscore, member)
+}
+
+// Rank returns the 1-based rank of the element, or 0 if it was not found.
+func (sl *Skiplist) Rank(score float64, member string) int64 {
+	var rank int64
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.less(score, member) ||
+				(x.level[i].forward.Score == score && x.level[i].forward.Member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if x != sl.header && x.Member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// ByRank returns the node at the 1-based rank.
+func (sl *Skiplist) ByRank(rank int64) *SkiplistNode {
+	var traversed int64
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank && x != sl.header {
+			return x
+		}
+	}
+	return nil
+}
+
+// ZRangeSpec is an interval of scores, the bounds are inclusive
+// unless MinEx or MaxEx are set.
+type ZRangeSpec struct {
+	Min, Max     float64
+	MinEx, MaxEx bool
+}
+
+// GteMin reports whether v is above the lower bound.
+func (r *ZRangeSpec) GteMin(v float64) bool {
+	if r.MinEx {
+		return v > r.Min
+	}
+	return v >= r.Min
+}
+
+// LteMax reports whether v is below the upper bound.
+func (r *ZRangeSpec) LteMax(v float64) bool {
+	if r.MaxEx {
+		return v < r.Max
+	}
+	return v <= r.Max
+}
+
+func (sl *Skiplist) isInRange(r *ZRangeSpec) bool {
+	if r.Min > r.Max || (r.Min == r.Max && (r.MinEx || r.MaxEx)) {
+		return false
+	}
+	if sl.tail == nil || !r.GteMin(sl.tail.Score) {
+		return false
+	}
+	first := sl.First()
+	return first != nil && r.LteMax(first.Score)
+}
+
+// FirstInRange returns the first node in the range, or nil.
+func (sl *Skiplist) FirstInRange(r *ZRangeSpec) *SkiplistNode {
+	if !sl.isInRange(r) {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.GteMin(x.level[i].forward.Score) {
+			x = x.level[i].forward
+		}
+	}
+
+	// this is an inner range, so the next node cannot be nil
+	x = x.level[0].forward
+	if !r.LteMax(x.Score) {
+		return nil
+	}
+	return x
+}
+
+// LastInRange returns the last node in the range, or nil.
+func (sl *Skiplist) LastInRange(r *ZRangeSpec) *SkiplistNode {
+	if !sl.isInRange(r) {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.LteMax(x.level[i].forward.Score) {
+			x = x.level[i].forward
+		}
+	}
+
+	if !r.GteMin(x.Score) {
+		return nil
+	}
+	return x
+}
+
+// ZLexRangeSpec is a lexicographic interval of members, MinInf and MaxInf
+// are set to -1 for "-" and to 1 for "+", which are respectively lower and
+// higher than every string.
+type ZLexRangeSpec struct {
+	Min, Max       string
+	MinEx, MaxEx   bool
+	MinInf, MaxInf int
+}
+
+func compareLex(a string, ainf int, b string, binf int) int {
+	if ainf != 0 || binf != 0 {
+		return ainf - binf
+	}
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// GteMin reports whether v is above the lower bound.
+func (r *ZLexRangeSpec) GteMin(v string) bool {
+	cmp := compareLex(v, 0, r.Min, r.MinInf)
+	if r.MinEx {
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// LteMax reports whether v is below the upper bound.
+func (r *ZLexRangeSpec) LteMax(v string) bool {
+	cmp := compareLex(v, 0, r.Max, r.MaxInf)
+	if r.MaxEx {
+		return cmp < 0
+	}
+	return cmp <= 0
+}
+
+func (sl *Skiplist) isInLexRange(r *ZLexRangeSpec) bool {
+	cmp := compareLex(r.Min, r.MinInf, r.Max, r.MaxInf)
+	if cmp > 0 || (cmp == 0 && (r.MinEx || r.MaxEx)) {
+		return false
+	}
+	if sl.tail == nil || !r.GteMin(sl.tail.Member) {
+		return false
+	}
+	first := sl.First()
+	return first != nil && r.LteMax(first.Member)
+}
+
+// FirstInLexRange returns the first node in the range, or nil.
+func (sl *Skiplist) FirstInLexRange(r *ZLexRangeSpec) *SkiplistNode {
+	if !sl.isInLexRange(r) {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.GteMin(x.level[i].forward.Member) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if !r.LteMax(x.Member) {
+		return nil
+	}
+	return x
+}
+
+// LastInLexRange returns the last node in the range, or nil.
+func (sl *Skiplist) LastInLexRange(r *ZLexRangeSpec) *SkiplistNode {
+	if !sl.isInLexRange(r) {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.LteMax(x.level[i].forward.Member) {
+			x = x.level[i].forward
+		}
+	}
+
+	if !r.GteMin(x.Member) {
+		return nil
+	}
+	return x
+}
@@ -0,0 +1,84 @@
+package dt
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func skiplistMembers(sl *Skiplist) []string {
+	var members []string
+	for x := sl.First(); x != nil; x = x.Next() {
+		members = append(members, x.Member)
+	}
+	return members
+}
+
+func TestSkiplistOrder(t *testing.T) {
+	zs := NewSortedSet()
+	n := 1000
+	scores := make(map[string]float64)
+	for i := 0; i < n; i++ {
+		member := strconv.Itoa(i)
+		scores[member] = float64(rand.Intn(100))
+		zs.Add(member, scores[member])
+	}
+	// update half of the scores, and delete a quarter of the members
+	for i := 0; i < n; i += 2 {
+		member := strconv.Itoa(i)
+		scores[member] = float64(rand.Intn(100))
+		zs.Add(member, scores[member])
+	}
+	for i := 0; i < n; i += 4 {
+		member := strconv.Itoa(i)
+		assert.True(t, zs.Delete(member))
+		delete(scores, member)
+	}
+
+	var expected []string
+	for member := range scores {
+		expected = append(expected, member)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		a, b := expected[i], expected[j]
+		return scores[a] < scores[b] || (scores[a] == scores[b] && a < b)
+	})
+
+	sl := zs.Skiplist()
+	assert.Equal(t, int64(len(expected)), zs.Len())
+	assert.Equal(t, expected, skiplistMembers(sl))
+	for i, member := range expected {
+		rank, ok := zs.Rank(member, false)
+		assert.True(t, ok)
+		assert.Equal(t, int64(i), rank)
+		assert.Equal(t, member, sl.ByRank(int64(i+1)).Member)
+	}
+	assert.Equal(t, expected[len(expected)-1], sl.Last().Member)
+}
+
+func TestSkiplistRanges(t *testing.T) {
+	zs := NewSortedSet()
+	for i, member := range []string{"a", "b", "c", "d", "e"} {
+		zs.Add(member, float64(i))
+	}
+	sl := zs.Skiplist()
+
+	r := &ZRangeSpec{Min: 1, Max: 3, MinEx: true}
+	assert.Equal(t, "c", sl.FirstInRange(r).Member)
+	assert.Equal(t, "d", sl.LastInRange(r).Member)
+	assert.Nil(t, sl.FirstInRange(&ZRangeSpec{Min: 5, Max: 10}))
+	assert.Nil(t, sl.FirstInRange(&ZRangeSpec{Min: 2, Max: 2, MaxEx: true}))
+
+	lex := &ZLexRangeSpec{MinInf: -1, Max: "c", MaxEx: true}
+	assert.Equal(t, "a", sl.FirstInLexRange(lex).Member)
+	assert.Equal(t, "b", sl.LastInLexRange(lex).Member)
+	assert.Nil(t, sl.FirstInLexRange(&ZLexRangeSpec{MinInf: 1, MaxInf: 1}))
+
+	assert.Equal(t, int64(2), zs.DeleteRangeByScore(r))
+	assert.Equal(t, int64(1), zs.DeleteRangeByLex(&ZLexRangeSpec{Min: "e", MaxInf: 1}))
+	assert.Equal(t, int64(1), zs.DeleteRangeByRank(1, 5))
+	assert.Equal(t, []string{"a"}, skiplistMembers(sl))
+}
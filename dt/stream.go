@@ -0,0 +1,766 @@
+package dt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// StreamID identifies an entry of a stream, by the unix time in ms it was
+// added at and a sequence number among the entries of the same ms.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// MaxStreamID is the largest possible ID.
+var MaxStreamID = StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// Compare returns -1, 0 or 1 if id is lower, equal or greater than other.
+func (id StreamID) Compare(other StreamID) int {
+	switch {
+	case id.Ms < other.Ms:
+		return -1
+	case id.Ms > other.Ms:
+		return 1
+	case id.Seq < other.Seq:
+		return -1
+	case id.Seq > other.Seq:
+		return 1
+	}
+	return 0
+}
+
+// IsZero reports whether id is 0-0.
+func (id StreamID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+// Incr returns the ID following id, it fails if id is the largest ID.
+func (id StreamID) Incr() (StreamID, bool) {
+	if id.Seq == math.MaxUint64 {
+		if id.Ms == math.MaxUint64 {
+			return id, false
+		}
+		return StreamID{Ms: id.Ms + 1}, true
+	}
+	return StreamID{Ms: id.Ms, Seq: id.Seq + 1}, true
+}
+
+// Decr returns the ID preceding id, it fails if id is 0-0.
+func (id StreamID) Decr() (StreamID, bool) {
+	if id.Seq == 0 {
+		if id.Ms == 0 {
+			return id, false
+		}
+		return StreamID{Ms: id.Ms - 1, Seq: math.MaxUint64}, true
+	}
+	return StreamID{Ms: id.Ms, Seq: id.Seq - 1}, true
+}
+
+// bytes encodes the ID as 128 bits big endian, so that the encoded IDs
+// have the same order as the IDs.
+func (id StreamID) bytes() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, id.Ms)
+	binary.BigEndian.PutUint64(b[8:], id.Seq)
+	return b
+}
+
+func streamIDFromBytes(b []byte) StreamID {
+	return StreamID{Ms: binary.BigEndian.Uint64(b), Seq: binary.BigEndian.Uint64(b[8:])}
+}
+
+// Stream is an append only log of entries made of field, value pairs. The
+// entries are stored in blocks, which are ziplists indexed in a radix tree
+// by the ID of their first entry, the master ID. A block starts with the
+// master entry:
+//
+//	count deleted num-fields field_1 ... field_N 0
+//
+// where count is the number of valid entries of the block and deleted the
+// number of entries marked as deleted. Every entry follows as:
+//
+//	flags ms-diff seq-diff num-fields field_1 value_1 ... field_N value_N
+//
+// or, when it has the same fields as the master entry, as:
+//
+//	flags ms-diff seq-diff value_1 ... value_N
+//
+// The IDs are stored as differences with the master ID, which keeps them
+// short. A deleted entry is only flagged, and the block is removed once
+// all its entries are deleted.
+type Stream struct {
+	rax    *Rax // master ID -> *Ziplist
+	length int64
+	groups *Rax // name -> *StreamCG
+
+	LastID       StreamID // the ID of the last entry ever added
+	FirstID      StreamID // the ID of the first entry, 0-0 if empty
+	MaxDeletedID StreamID // the largest ID deleted with Delete
+	EntriesAdded int64    // the number of entries ever added
+}
+
+const (
+	streamItemFlagDeleted = 1 << iota
+	streamItemFlagSameFields
+)
+
+// StreamEntriesReadInvalid is the logical counter of an entry which can't
+// be known, because of the entries deleted before it.
+const StreamEntriesReadInvalid = -1
+
+var errBadStreamBlock = errors.New("corrupted stream block")
+
+// NewStream .
+func NewStream() *Stream {
+	return &Stream{rax: NewRax(), groups: NewRax()}
+}
+
+// NewStreamObject creates an empty stream object.
+func NewStreamObject() *Object {
+	obj := NewObj(ObjStream, NewStream())
+	obj.Encoding = ObjEncodingStream
+	return obj
+}
+
+// Len returns the number of entries.
+func (s *Stream) Len() int64 {
+	return s.length
+}
+
+// Blocks returns the number of blocks.
+func (s *Stream) Blocks() int {
+	return s.rax.Len()
+}
+
+// RaxNodes returns the number of nodes of the radix tree of the blocks.
+func (s *Stream) RaxNodes() int {
+	return s.rax.Nodes()
+}
+
+func zlInt(v string) int64 {
+	n, _ := strconv.ParseInt(v, 10, 64)
+	return n
+}
+
+// streamEntry is an entry decoded from a block.
+type streamEntry struct {
+	id      StreamID
+	flags   int64
+	flagsAt int      // the index in the ziplist of the flags
+	fields  []string // field, value pairs
+}
+
+// streamBlockHeader returns the counters and the fields of the master
+// entry of the block.
+func streamBlockHeader(zl *Ziplist) (count, deleted int64, fields []string) {
+	nfields := int64(-1)
+	zl.Iterate(func(i int, v string) bool {
+		switch i {
+		case 0:
+			count = zlInt(v)
+		case 1:
+			deleted = zlInt(v)
+		case 2:
+			nfields = zlInt(v)
+		default:
+			if int64(len(fields)) == nfields {
+				return false
+			}
+			fields = append(fields, v)
+		}
+		return true
+	})
+	return count, deleted, fields
+}
+
+// streamBlockEntries decodes every entry of the block, including the
+// deleted ones.
+func streamBlockEntries(master StreamID, zl *Ziplist) (count, deleted int64, entries []streamEntry, err error) {
+	items := make([]string, 0, zl.Len())
+	zl.Iterate(func(i int, v string) bool {
+		items = append(items, v)
+		return true
+	})
+
+	if len(items) < 3 {
+		return 0, 0, nil, errBadStreamBlock
+	}
+	count, deleted = zlInt(items[0]), zlInt(items[1])
+	nfields := int(zlInt(items[2]))
+	if nfields < 0 || 3+nfields >= len(items) {
+		return 0, 0, nil, errBadStreamBlock
+	}
+	masterFields := items[3 : 3+nfields]
+
+	for p := 4 + nfields; p < len(items); {
+		if p+3 > len(items) {
+			return 0, 0, nil, errBadStreamBlock
+		}
+		e := streamEntry{flags: zlInt(items[p]), flagsAt: p}
+		msdiff, _ := strconv.ParseUint(items[p+1], 10, 64)
+		seqdiff := zlInt(items[p+2])
+		e.id = StreamID{Ms: master.Ms + msdiff, Seq: master.Seq + uint64(seqdiff)}
+		p += 3
+
+		if e.flags&streamItemFlagSameFields != 0 {
+			if p+nfields > len(items) {
+				return 0, 0, nil, errBadStreamBlock
+			}
+			e.fields = make([]string, 0, 2*nfields)
+			for j, f := range masterFields {
+				e.fields = append(e.fields, f, items[p+j])
+			}
+			p += nfields
+		} else {
+			if p >= len(items) {
+				return 0, 0, nil, errBadStreamBlock
+			}
+			n := int(zlInt(items[p]))
+			if n < 0 || p+1+2*n > len(items) {
+				return 0, 0, nil, errBadStreamBlock
+			}
+			e.fields = items[p+1 : p+1+2*n]
+			p += 1 + 2*n
+		}
+		entries = append(entries, e)
+	}
+	return count, deleted, entries, nil
+}
+
+// setBlockCounters updates the counters of the master entry.
+func setBlockCounters(zl *Ziplist, count, deleted int64) {
+	zl.Replace(0, strconv.FormatInt(count, 10))
+	zl.Replace(1, strconv.FormatInt(deleted, 10))
+}
+
+// Append adds an entry with the field, value pairs, id must be greater
+// than LastID. A new block is started when the last one holds maxEntries
+// entries, or would reach maxBytes, 0 meaning no limit.
+func (s *Stream) Append(id StreamID, fields []string, maxBytes, maxEntries int) {
+	var master StreamID
+	var zl *Ziplist
+	if key, v, ok := s.rax.Last(); ok {
+		master, zl = streamIDFromBytes(key), v.(*Ziplist)
+		size := 0
+		for _, f := range fields {
+			size += len(f)
+		}
+		count, deleted, _ := streamBlockHeader(zl)
+		if (maxBytes > 0 && zl.BlobLen()+size >= maxBytes) || (maxEntries > 0 && count+deleted >= int64(maxEntries)) {
+			zl = nil
+		}
+	}
+	if zl == nil {
+		master = id
+		zl = NewZiplist()
+		zl.Push("0")
+		zl.Push("0")
+		zl.Push(strconv.Itoa(len(fields) / 2))
+		for i := 0; i < len(fields); i += 2 {
+			zl.Push(fields[i])
+		}
+		zl.Push("0")
+		s.rax.Insert(id.bytes(), zl)
+	}
+
+	count, deleted, masterFields := streamBlockHeader(zl)
+	same := len(masterFields) == len(fields)/2
+	for i := 0; same && i < len(masterFields); i++ {
+		same = masterFields[i] == fields[2*i]
+	}
+
+	flags := 0
+	if same {
+		flags |= streamItemFlagSameFields
+	}
+	zl.Push(strconv.Itoa(flags))
+	zl.Push(strconv.FormatUint(id.Ms-master.Ms, 10))
+	zl.Push(strconv.FormatInt(int64(id.Seq-master.Seq), 10))
+	if same {
+		for i := 1; i < len(fields); i += 2 {
+			zl.Push(fields[i])
+		}
+	} else {
+		zl.Push(strconv.Itoa(len(fields) / 2))
+		for _, f := range fields {
+			zl.Push(f)
+		}
+	}
+	setBlockCounters(zl, count+1, deleted)
+
+	s.length++
+	s.EntriesAdded++
+	s.LastID = id
+	if s.length == 1 {
+		s.FirstID = id
+	}
+}
+
+// Range calls fn for the entries from start to end inclusive, in reverse
+// order if rev is set, until fn returns false. The stream must not be
+// modified by fn.
+func (s *Stream) Range(start, end StreamID, rev bool, fn func(id StreamID, fields []string) bool) {
+	if start.Compare(end) > 0 {
+		return
+	}
+
+	if rev {
+		s.rax.Descend(end.bytes(), func(key []byte, v interface{}) bool {
+			master := streamIDFromBytes(key)
+			_, _, entries, _ := streamBlockEntries(master, v.(*Ziplist))
+			for i := len(entries) - 1; i >= 0; i-- {
+				e := &entries[i]
+				if e.flags&streamItemFlagDeleted != 0 || e.id.Compare(end) > 0 {
+					continue
+				}
+				if e.id.Compare(start) < 0 || !fn(e.id, e.fields) {
+					return false
+				}
+			}
+			return master.Compare(start) > 0
+		})
+		return
+	}
+
+	// the block holding start begins before it
+	from := start.bytes()
+	s.rax.Descend(from, func(key []byte, v interface{}) bool {
+		from = append([]byte(nil), key...)
+		return false
+	})
+	s.rax.Ascend(from, func(key []byte, v interface{}) bool {
+		_, _, entries, _ := streamBlockEntries(streamIDFromBytes(key), v.(*Ziplist))
+		for i := range entries {
+			e := &entries[i]
+			if e.flags&streamItemFlagDeleted != 0 || e.id.Compare(start) < 0 {
+				continue
+			}
+			if e.id.Compare(end) > 0 || !fn(e.id, e.fields) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Get returns the fields of the entry.
+func (s *Stream) Get(id StreamID) ([]string, bool) {
+	var fields []string
+	found := false
+	s.Range(id, id, false, func(_ StreamID, f []string) bool {
+		fields, found = f, true
+		return false
+	})
+	return fields, found
+}
+
+// blockOf returns the block which may hold the entry.
+func (s *Stream) blockOf(id StreamID) ([]byte, *Ziplist) {
+	var key []byte
+	var zl *Ziplist
+	s.rax.Descend(id.bytes(), func(k []byte, v interface{}) bool {
+		key, zl = append([]byte(nil), k...), v.(*Ziplist)
+		return false
+	})
+	return key, zl
+}
+
+// Delete removes the entry, and returns false if it doesn't exist.
+func (s *Stream) Delete(id StreamID) bool {
+	key, zl := s.blockOf(id)
+	if zl == nil {
+		return false
+	}
+	count, deleted, entries, _ := streamBlockEntries(streamIDFromBytes(key), zl)
+	for _, e := range entries {
+		if e.id != id || e.flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+
+		if count == 1 {
+			s.rax.Remove(key)
+		} else {
+			zl.Replace(e.flagsAt, strconv.FormatInt(e.flags|streamItemFlagDeleted, 10))
+			setBlockCounters(zl, count-1, deleted+1)
+		}
+		s.length--
+		if id.Compare(s.MaxDeletedID) > 0 {
+			s.MaxDeletedID = id
+		}
+		if id == s.FirstID {
+			s.updateFirstID()
+		}
+		return true
+	}
+	return false
+}
+
+func (s *Stream) updateFirstID() {
+	s.FirstID = StreamID{}
+	s.Range(StreamID{}, MaxStreamID, false, func(id StreamID, _ []string) bool {
+		s.FirstID = id
+		return false
+	})
+}
+
+// LastValidID returns the ID of the last entry, which is LastID unless it
+// was deleted, or 0-0 if the stream is empty.
+func (s *Stream) LastValidID() StreamID {
+	var last StreamID
+	s.Range(StreamID{}, MaxStreamID, true, func(id StreamID, _ []string) bool {
+		last = id
+		return false
+	})
+	return last
+}
+
+// TrimByLen removes the first entries until the stream has maxlen entries,
+// see trim.
+func (s *Stream) TrimByLen(maxlen int64, approx bool, limit int64) int64 {
+	return s.trim(maxlen, nil, approx, limit)
+}
+
+// TrimByID removes the entries with an ID lower than minid, see trim.
+func (s *Stream) TrimByID(minid StreamID, approx bool, limit int64) int64 {
+	return s.trim(0, &minid, approx, limit)
+}
+
+// trim removes the first entries, only whole blocks when approx is set,
+// and stops once limit entries are removed unless limit is 0. It returns
+// the number of entries removed.
+func (s *Stream) trim(maxlen int64, minid *StreamID, approx bool, limit int64) int64 {
+	var removed int64
+	for limit == 0 || removed < limit {
+		if minid == nil && s.length <= maxlen {
+			break
+		}
+		key, v, ok := s.rax.First()
+		if !ok {
+			break
+		}
+		zl := v.(*Ziplist)
+		count, deleted, entries, _ := streamBlockEntries(streamIDFromBytes(key), zl)
+
+		var whole bool
+		if minid == nil {
+			whole = s.length-count >= maxlen
+		} else {
+			whole = entries[len(entries)-1].id.Compare(*minid) < 0
+		}
+		if whole {
+			s.rax.Remove(key)
+			s.length -= count
+			removed += count
+			continue
+		}
+		if approx {
+			break
+		}
+
+		// the last entries to remove are in this block
+		for _, e := range entries {
+			if e.flags&streamItemFlagDeleted != 0 {
+				continue
+			}
+			if (minid == nil && s.length <= maxlen) || (minid != nil && e.id.Compare(*minid) >= 0) {
+				break
+			}
+			zl.Replace(e.flagsAt, strconv.FormatInt(e.flags|streamItemFlagDeleted, 10))
+			count--
+			deleted++
+			s.length--
+			removed++
+		}
+		setBlockCounters(zl, count, deleted)
+		break
+	}
+
+	if removed > 0 {
+		s.updateFirstID()
+	}
+	return removed
+}
+
+// IterateBlocks calls fn for every block with its master ID, until fn
+// returns false. The blocks must not be modified.
+func (s *Stream) IterateBlocks(fn func(master StreamID, zl *Ziplist) bool) {
+	s.rax.Ascend(nil, func(key []byte, v interface{}) bool {
+		return fn(streamIDFromBytes(key), v.(*Ziplist))
+	})
+}
+
+// AppendBlock adds a block returned by IterateBlocks, the blocks must be
+// added in order. The IDs and counters of the stream are left to the
+// caller.
+func (s *Stream) AppendBlock(master StreamID, zl *Ziplist) error {
+	count, _, _, err := streamBlockEntries(master, zl)
+	if err != nil {
+		return err
+	}
+	s.rax.Insert(master.bytes(), zl)
+	s.length += count
+	return nil
+}
+
+// EstimateDistance returns the logical counter of the entry id, which is
+// the number of entries added up to it, or StreamEntriesReadInvalid if it
+// can't be known.
+func (s *Stream) EstimateDistance(id StreamID) int64 {
+	// the counter of any ID in a never used stream is 0
+	if s.EntriesAdded == 0 {
+		return 0
+	}
+	cmpLast := id.Compare(s.LastID)
+	if s.length == 0 && cmpLast <= 0 {
+		return s.EntriesAdded
+	}
+	if cmpLast == 0 {
+		return s.EntriesAdded
+	} else if cmpLast > 0 {
+		// the counter of a future ID is unknown
+		return StreamEntriesReadInvalid
+	}
+
+	// without deleted entries after the first one, the counters follow
+	// the entries
+	if s.MaxDeletedID.IsZero() || s.MaxDeletedID.Compare(s.FirstID) < 0 {
+		switch id.Compare(s.FirstID) {
+		case -1:
+			return s.EntriesAdded - s.length
+		case 0:
+			return s.EntriesAdded - s.length + 1
+		}
+	}
+	return StreamEntriesReadInvalid
+}
+
+// RangeHasTombstones reports whether entries between start and end may
+// have been deleted.
+func (s *Stream) RangeHasTombstones(start, end StreamID) bool {
+	if s.length == 0 || s.MaxDeletedID.IsZero() {
+		return false
+	}
+	if s.FirstID.Compare(s.MaxDeletedID) > 0 {
+		return false
+	}
+	return start.Compare(s.MaxDeletedID) <= 0 && s.MaxDeletedID.Compare(end) <= 0
+}
+
+// StreamCG is a consumer group, which delivers every entry to one of its
+// consumers, and tracks the entries delivered but not acknowledged in its
+// pending entries list.
+type StreamCG struct {
+	LastID      StreamID // the last entry delivered to the consumers
+	EntriesRead int64    // the logical counter of LastID
+	pel         *Rax     // entry ID -> *StreamNACK
+	consumers   *Rax     // name -> *StreamConsumer
+}
+
+// StreamConsumer is a consumer of a group.
+type StreamConsumer struct {
+	Name       string
+	SeenTime   int64 // the last time in ms the consumer read or claimed
+	ActiveTime int64 // the last time in ms entries were delivered, or -1
+	pel        *Rax  // the entries pending for the consumer, shared with the group
+}
+
+// StreamNACK is an entry delivered to a consumer but not acknowledged.
+type StreamNACK struct {
+	DeliveryTime  int64
+	DeliveryCount int64
+	Consumer      *StreamConsumer
+}
+
+// CreateGroup creates a consumer group, it returns nil if it exists.
+func (s *Stream) CreateGroup(name string, id StreamID, entriesRead int64) *StreamCG {
+	if _, ok := s.groups.Find([]byte(name)); ok {
+		return nil
+	}
+	cg := &StreamCG{LastID: id, EntriesRead: entriesRead, pel: NewRax(), consumers: NewRax()}
+	s.groups.Insert([]byte(name), cg)
+	return cg
+}
+
+// Group returns the consumer group, or nil.
+func (s *Stream) Group(name string) *StreamCG {
+	if v, ok := s.groups.Find([]byte(name)); ok {
+		return v.(*StreamCG)
+	}
+	return nil
+}
+
+// DeleteGroup removes the consumer group, and returns false if it didn't
+// exist.
+func (s *Stream) DeleteGroup(name string) bool {
+	_, ok := s.groups.Remove([]byte(name))
+	return ok
+}
+
+// GroupsLen returns the number of consumer groups.
+func (s *Stream) GroupsLen() int {
+	return s.groups.Len()
+}
+
+// Groups calls fn for every consumer group ordered by name, until fn
+// returns false.
+func (s *Stream) Groups(fn func(name string, cg *StreamCG) bool) {
+	s.groups.Ascend(nil, func(key []byte, v interface{}) bool {
+		return fn(string(key), v.(*StreamCG))
+	})
+}
+
+// Consumer returns the consumer, or nil.
+func (cg *StreamCG) Consumer(name string) *StreamConsumer {
+	if v, ok := cg.consumers.Find([]byte(name)); ok {
+		return v.(*StreamConsumer)
+	}
+	return nil
+}
+
+// CreateConsumer creates a consumer seen at now, it returns nil if it
+// exists.
+func (cg *StreamCG) CreateConsumer(name string, now int64) *StreamConsumer {
+	if cg.Consumer(name) != nil {
+		return nil
+	}
+	consumer := &StreamConsumer{Name: name, SeenTime: now, ActiveTime: -1, pel: NewRax()}
+	cg.consumers.Insert([]byte(name), consumer)
+	return consumer
+}
+
+// DeleteConsumer removes the consumer and its pending entries, and returns
+// the number of entries which were pending.
+func (cg *StreamCG) DeleteConsumer(name string) (int64, bool) {
+	consumer := cg.Consumer(name)
+	if consumer == nil {
+		return 0, false
+	}
+	pending := int64(consumer.pel.Len())
+	consumer.pel.Ascend(nil, func(key []byte, v interface{}) bool {
+		cg.pel.Remove(key)
+		return true
+	})
+	cg.consumers.Remove([]byte(name))
+	return pending, true
+}
+
+// ConsumersLen returns the number of consumers.
+func (cg *StreamCG) ConsumersLen() int {
+	return cg.consumers.Len()
+}
+
+// Consumers calls fn for every consumer ordered by name, until fn returns
+// false.
+func (cg *StreamCG) Consumers(fn func(consumer *StreamConsumer) bool) {
+	cg.consumers.Ascend(nil, func(key []byte, v interface{}) bool {
+		return fn(v.(*StreamConsumer))
+	})
+}
+
+// PendingLen returns the number of entries pending in the group.
+func (cg *StreamCG) PendingLen() int {
+	return cg.pel.Len()
+}
+
+// Pending returns the pending entry, or nil.
+func (cg *StreamCG) Pending(id StreamID) *StreamNACK {
+	if v, ok := cg.pel.Find(id.bytes()); ok {
+		return v.(*StreamNACK)
+	}
+	return nil
+}
+
+// PendingRange calls fn for the entries pending in the group from start to
+// end inclusive, until fn returns false. The group must not be modified by
+// fn.
+func (cg *StreamCG) PendingRange(start, end StreamID, fn func(id StreamID, nack *StreamNACK) bool) {
+	pelRange(cg.pel, start, end, fn)
+}
+
+func pelRange(pel *Rax, start, end StreamID, fn func(id StreamID, nack *StreamNACK) bool) {
+	pel.Ascend(start.bytes(), func(key []byte, v interface{}) bool {
+		id := streamIDFromBytes(key)
+		return id.Compare(end) <= 0 && fn(id, v.(*StreamNACK))
+	})
+}
+
+// Deliver adds the entry to the pending entries of the consumer, as
+// delivered once at now. An entry already pending is moved to the
+// consumer.
+func (cg *StreamCG) Deliver(id StreamID, consumer *StreamConsumer, now int64) *StreamNACK {
+	nack := cg.Pending(id)
+	if nack == nil {
+		nack = &StreamNACK{}
+		cg.pel.Insert(id.bytes(), nack)
+	}
+	cg.Claim(id, nack, consumer)
+	nack.DeliveryTime = now
+	nack.DeliveryCount = 1
+	return nack
+}
+
+// Claim moves the pending entry to the consumer.
+func (cg *StreamCG) Claim(id StreamID, nack *StreamNACK, consumer *StreamConsumer) {
+	if nack.Consumer == consumer {
+		return
+	}
+	if nack.Consumer != nil {
+		nack.Consumer.pel.Remove(id.bytes())
+	}
+	nack.Consumer = consumer
+	consumer.pel.Insert(id.bytes(), nack)
+}
+
+// Ack removes the entry from the pending entries, and returns false if it
+// wasn't pending.
+func (cg *StreamCG) Ack(id StreamID) bool {
+	v, ok := cg.pel.Remove(id.bytes())
+	if ok {
+		v.(*StreamNACK).Consumer.pel.Remove(id.bytes())
+	}
+	return ok
+}
+
+// PendingLen returns the number of entries pending for the consumer.
+func (consumer *StreamConsumer) PendingLen() int {
+	return consumer.pel.Len()
+}
+
+// PendingRange calls fn for the entries pending for the consumer from
+// start to end inclusive, until fn returns false.
+func (consumer *StreamConsumer) PendingRange(start, end StreamID, fn func(id StreamID, nack *StreamNACK) bool) {
+	pelRange(consumer.pel, start, end, fn)
+}
+
+// Dup returns a copy of the stream and of its consumer groups.
+func (s *Stream) Dup() *Stream {
+	dup := *s
+	dup.rax = NewRax()
+	s.rax.Ascend(nil, func(key []byte, v interface{}) bool {
+		dup.rax.Insert(key, v.(*Ziplist).Dup())
+		return true
+	})
+
+	dup.groups = NewRax()
+	s.Groups(func(name string, cg *StreamCG) bool {
+		dupcg := dup.CreateGroup(name, cg.LastID, cg.EntriesRead)
+		cg.Consumers(func(consumer *StreamConsumer) bool {
+			dc := dupcg.CreateConsumer(consumer.Name, consumer.SeenTime)
+			dc.ActiveTime = consumer.ActiveTime
+			consumer.PendingRange(StreamID{}, MaxStreamID, func(id StreamID, nack *StreamNACK) bool {
+				dupcg.Deliver(id, dc, nack.DeliveryTime).DeliveryCount = nack.DeliveryCount
+				return true
+			})
+			return true
+		})
+		return true
+	})
+	return &dup
+}
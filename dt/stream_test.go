@@ -0,0 +1,119 @@
+package dt
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func streamIDs(s *Stream, start, end StreamID, rev bool) []StreamID {
+	var ids []StreamID
+	s.Range(start, end, rev, func(id StreamID, fields []string) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+func TestStreamAppendAndRange(t *testing.T) {
+	s := NewStream()
+	var all []StreamID
+	for i := 1; i <= 25; i++ {
+		id := StreamID{Ms: uint64(i / 3), Seq: uint64(i % 3)}
+		fields := []string{"a", strconv.Itoa(i), "b", "x"}
+		if i%5 == 0 {
+			fields = []string{"c", strconv.Itoa(i)}
+		}
+		s.Append(id, fields, 0, 4)
+		all = append(all, id)
+	}
+	assert.Equal(t, int64(25), s.Len())
+	assert.Equal(t, 7, s.Blocks())
+	assert.Equal(t, all[0], s.FirstID)
+	assert.Equal(t, all[24], s.LastID)
+
+	assert.Equal(t, all, streamIDs(s, StreamID{}, MaxStreamID, false))
+	assert.Equal(t, all[5:13], streamIDs(s, all[5], all[12], false))
+	rev := streamIDs(s, all[5], all[12], true)
+	assert.Len(t, rev, 8)
+	assert.Equal(t, all[12], rev[0])
+	assert.Equal(t, all[5], rev[7])
+
+	fields, ok := s.Get(all[9])
+	assert.True(t, ok)
+	assert.Equal(t, []string{"c", "10"}, fields)
+	fields, _ = s.Get(all[10])
+	assert.Equal(t, []string{"a", "11", "b", "x"}, fields)
+
+	assert.True(t, s.Delete(all[0]))
+	assert.False(t, s.Delete(all[0]))
+	assert.Equal(t, all[1], s.FirstID)
+	assert.Equal(t, all[0], s.MaxDeletedID)
+	for _, id := range all[1:4] {
+		s.Delete(id)
+	}
+	assert.Equal(t, 6, s.Blocks())
+	assert.Equal(t, all[4:], streamIDs(s, StreamID{}, MaxStreamID, false))
+	_, ok = s.Get(all[2])
+	assert.False(t, ok)
+}
+
+func TestStreamTrim(t *testing.T) {
+	s := NewStream()
+	for i := 1; i <= 20; i++ {
+		s.Append(StreamID{Ms: uint64(i)}, []string{"f", "v"}, 0, 5)
+	}
+
+	// only whole blocks are removed when approx
+	assert.Equal(t, int64(5), s.TrimByLen(12, true, 0))
+	assert.Equal(t, int64(15), s.Len())
+	assert.Equal(t, StreamID{Ms: 6}, s.FirstID)
+	assert.Equal(t, int64(3), s.TrimByLen(12, false, 0))
+	assert.Equal(t, StreamID{Ms: 9}, s.FirstID)
+
+	// the block 6-10 only has 9 and 10 left
+	assert.Equal(t, int64(2), s.TrimByID(StreamID{Ms: 12}, true, 0))
+	assert.Equal(t, int64(1), s.TrimByID(StreamID{Ms: 12}, false, 0))
+	assert.Equal(t, StreamID{Ms: 12}, s.FirstID)
+	// the limit is checked between the blocks
+	assert.Equal(t, int64(4), s.TrimByID(StreamID{Ms: 17}, false, 1))
+	assert.Equal(t, int64(5), s.Len())
+	assert.Equal(t, int64(20), s.EntriesAdded)
+}
+
+func TestStreamGroups(t *testing.T) {
+	s := NewStream()
+	for i := 1; i <= 5; i++ {
+		s.Append(StreamID{Ms: uint64(i)}, []string{"f", "v"}, 0, 0)
+	}
+	cg := s.CreateGroup("g", StreamID{}, 0)
+	assert.NotNil(t, cg)
+	assert.Nil(t, s.CreateGroup("g", StreamID{}, 0))
+	alice := cg.CreateConsumer("alice", 100)
+	bob := cg.CreateConsumer("bob", 100)
+
+	cg.Deliver(StreamID{Ms: 1}, alice, 100)
+	cg.Deliver(StreamID{Ms: 2}, alice, 100)
+	cg.Deliver(StreamID{Ms: 3}, bob, 100)
+	assert.Equal(t, 3, cg.PendingLen())
+	assert.Equal(t, 2, alice.PendingLen())
+
+	nack := cg.Pending(StreamID{Ms: 2})
+	cg.Claim(StreamID{Ms: 2}, nack, bob)
+	assert.Equal(t, 1, alice.PendingLen())
+	assert.Equal(t, 2, bob.PendingLen())
+
+	dup := s.Dup()
+	assert.True(t, cg.Ack(StreamID{Ms: 3}))
+	assert.False(t, cg.Ack(StreamID{Ms: 3}))
+	pending, ok := cg.DeleteConsumer("bob")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), pending)
+	assert.Equal(t, 1, cg.PendingLen())
+
+	dupcg := dup.Group("g")
+	assert.Equal(t, 3, dupcg.PendingLen())
+	assert.Equal(t, 2, dupcg.Consumer("bob").PendingLen())
+	assert.Equal(t, "bob", dupcg.Pending(StreamID{Ms: 2}).Consumer.Name)
+}
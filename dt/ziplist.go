@@ -0,0 +1,173 @@
+package dt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Ziplist is a compact list of strings stored in a single byte slice,
+// every entry is prefixed by its uvarint encoded length. Most operations
+// are O(N), so it is only used to encode small collections.
+type Ziplist struct {
+	buf []byte
+	len int
+}
+
+var errBadZiplist = errors.New("corrupted ziplist")
+
+// NewZiplist .
+func NewZiplist() *Ziplist {
+	return &Ziplist{}
+}
+
+// ZiplistFromBytes creates a ziplist upon a blob returned by Bytes.
+func ZiplistFromBytes(b []byte) (*Ziplist, error) {
+	zl := &Ziplist{buf: b}
+	for off := 0; off < len(b); {
+		n, sz := binary.Uvarint(b[off:])
+		if sz <= 0 || n > uint64(len(b)-off-sz) {
+			return nil, errBadZiplist
+		}
+		off += sz + int(n)
+		zl.len++
+	}
+	return zl, nil
+}
+
+// Len returns the number of entries.
+func (zl *Ziplist) Len() int {
+	return zl.len
+}
+
+// BlobLen returns the number of bytes used by the entries.
+func (zl *Ziplist) BlobLen() int {
+	return len(zl.buf)
+}
+
+// Bytes returns the underlying blob, it must not be modified.
+func (zl *Ziplist) Bytes() []byte {
+	return zl.buf
+}
+
+// entry decodes the entry at byte offset off, and returns its value
+// together with the offset of the next entry.
+func (zl *Ziplist) entry(off int) ([]byte, int) {
+	n, sz := binary.Uvarint(zl.buf[off:])
+	start := off + sz
+	return zl.buf[start : start+int(n)], start + int(n)
+}
+
+// offset returns the byte offset of the i-th entry, or the length of
+// the blob when i is out of range.
+func (zl *Ziplist) offset(i int) int {
+	if i >= zl.len {
+		return len(zl.buf)
+	}
+	off := 0
+	for ; i > 0; i-- {
+		_, off = zl.entry(off)
+	}
+	return off
+}
+
+func (zl *Ziplist) index(i int) int {
+	if i < 0 {
+		i += zl.len
+	}
+	return i
+}
+
+// Index returns the entry at index i, negative indexes start from the tail.
+func (zl *Ziplist) Index(i int) (string, bool) {
+	i = zl.index(i)
+	if i < 0 || i >= zl.len {
+		return "", false
+	}
+	v, _ := zl.entry(zl.offset(i))
+	return string(v), true
+}
+
+// Iterate calls fn with the index and value of every entry from head to
+// tail until fn returns false.
+func (zl *Ziplist) Iterate(fn func(i int, v string) bool) {
+	off := 0
+	for i := 0; i < zl.len; i++ {
+		var v []byte
+		v, off = zl.entry(off)
+		if !fn(i, string(v)) {
+			return
+		}
+	}
+}
+
+// Find returns the index of the first entry equal to v, starting at index
+// start and skipping skip entries between each comparison, or -1.
+func (zl *Ziplist) Find(v string, start, skip int) int {
+	off := zl.offset(start)
+	for i := start; i < zl.len; i++ {
+		var e []byte
+		e, off = zl.entry(off)
+		if (i-start)%(skip+1) == 0 && string(e) == v {
+			return i
+		}
+	}
+	return -1
+}
+
+func encodeZiplistEntry(v string) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(v))
+	n := binary.PutUvarint(buf, uint64(len(v)))
+	copy(buf[n:], v)
+	return buf[:n+len(v)]
+}
+
+// Push appends v at the tail.
+func (zl *Ziplist) Push(v string) {
+	zl.buf = append(zl.buf, encodeZiplistEntry(v)...)
+	zl.len++
+}
+
+// Insert inserts v before the entry at index i, i can be Len() to append.
+func (zl *Ziplist) Insert(i int, v string) {
+	off := zl.offset(zl.index(i))
+	e := encodeZiplistEntry(v)
+
+	zl.buf = append(zl.buf, e...)
+	copy(zl.buf[off+len(e):], zl.buf[off:len(zl.buf)-len(e)])
+	copy(zl.buf[off:], e)
+	zl.len++
+}
+
+// Replace replaces the value of the entry at index i.
+func (zl *Ziplist) Replace(i int, v string) {
+	i = zl.index(i)
+	zl.Delete(i, 1)
+	zl.Insert(i, v)
+}
+
+// Delete removes count entries starting at index i.
+func (zl *Ziplist) Delete(i, count int) {
+	i = zl.index(i)
+	if i < 0 || i >= zl.len || count <= 0 {
+		return
+	}
+	if i+count > zl.len {
+		count = zl.len - i
+	}
+
+	start := zl.offset(i)
+	end := start
+	for j := 0; j < count; j++ {
+		_, end = zl.entry(end)
+	}
+	zl.buf = append(zl.buf[:start], zl.buf[end:]...)
+	zl.len -= count
+}
+
+// Dup returns a copy of the ziplist.
+func (zl *Ziplist) Dup() *Ziplist {
+	return &Ziplist{
+		buf: append([]byte(nil), zl.buf...),
+		len: zl.len,
+	}
+}
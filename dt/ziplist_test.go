@@ -0,0 +1,65 @@
+package dt
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ziplistValues(zl *Ziplist) []string {
+	var values []string
+	zl.Iterate(func(i int, v string) bool {
+		values = append(values, v)
+		return true
+	})
+	return values
+}
+
+func TestZiplistOperations(t *testing.T) {
+	zl := NewZiplist()
+	zl.Push("a")
+	zl.Push("")
+	zl.Push(string(make([]byte, 300)))
+	zl.Insert(0, "head")
+	zl.Insert(zl.Len(), "tail")
+	assert.Equal(t, 5, zl.Len())
+
+	v, ok := zl.Index(-1)
+	assert.True(t, ok)
+	assert.Equal(t, "tail", v)
+	v, _ = zl.Index(2)
+	assert.Equal(t, "", v)
+	_, ok = zl.Index(5)
+	assert.False(t, ok)
+
+	zl.Replace(3, "c")
+	zl.Delete(1, 2)
+	assert.Equal(t, []string{"head", "c", "tail"}, ziplistValues(zl))
+
+	assert.Equal(t, 1, zl.Find("c", 0, 0))
+	assert.Equal(t, -1, zl.Find("c", 0, 1))
+	assert.Equal(t, 2, zl.Find("tail", 0, 1))
+
+	loaded, err := ZiplistFromBytes(zl.Dup().Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, ziplistValues(zl), ziplistValues(loaded))
+
+	_, err = ZiplistFromBytes([]byte{10, 'a'})
+	assert.NotNil(t, err)
+	// lengths which overflow an int
+	_, err = ZiplistFromBytes([]byte{0xf6, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 'a'})
+	assert.NotNil(t, err)
+	_, err = ZiplistFromBytes([]byte{1, 'a', 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	assert.NotNil(t, err)
+}
+
+func TestZiplistDeleteRange(t *testing.T) {
+	zl := NewZiplist()
+	for i := 0; i < 10; i++ {
+		zl.Push(strconv.Itoa(i))
+	}
+	zl.Delete(-3, 10)
+	zl.Delete(0, 2)
+	assert.Equal(t, []string{"2", "3", "4", "5", "6"}, ziplistValues(zl))
+}
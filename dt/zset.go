@@ -0,0 +1,136 @@
+package dt
+
+// SortedSet pairs a dict mapping members to scores, for O(1) lookups,
+// with a skiplist ordering the members by score.
+type SortedSet struct {
+	dict *Dict
+	zsl  *Skiplist
+}
+
+// NewSortedSet .
+func NewSortedSet() *SortedSet {
+	return &SortedSet{
+		dict: NewDict(),
+		zsl:  NewSkiplist(),
+	}
+}
+
+// NewZSet creates an empty sorted set object.
+func NewZSet() *Object {
+	obj := NewObj(ObjZSet, NewSortedSet())
+	obj.Encoding = ObjEncodingSkiplist
+	return obj
+}
+
+// Len .
+func (zs *SortedSet) Len() int64 {
+	return zs.zsl.Len()
+}
+
+// Dict returns the member -> score dict, the values are float64.
+func (zs *SortedSet) Dict() *Dict {
+	return zs.dict
+}
+
+// Skiplist returns the skiplist ordering the members.
+func (zs *SortedSet) Skiplist() *Skiplist {
+	return zs.zsl
+}
+
+// Score returns the score of the member.
+func (zs *SortedSet) Score(member string) (float64, bool) {
+	de := zs.dict.Get(member)
+	if de == nil {
+		return 0, false
+	}
+	return de.Value.(float64), true
+}
+
+// Add adds the member, or updates its score if it already exists.
+// It returns true when the member is new.
+func (zs *SortedSet) Add(member string, score float64) bool {
+	if de := zs.dict.Get(member); de != nil {
+		cur := de.Value.(float64)
+		if cur != score {
+			zs.zsl.UpdateScore(cur, member, score)
+			de.Value = score
+		}
+		return false
+	}
+
+	zs.zsl.Insert(score, member)
+	zs.dict.Add(member, score)
+	return true
+}
+
+// Delete removes the member, and returns false if it didn't exist.
+func (zs *SortedSet) Delete(member string) bool {
+	score, ok := zs.Score(member)
+	if !ok {
+		return false
+	}
+	zs.dict.Delete(member)
+	zs.zsl.Delete(score, member)
+	return true
+}
+
+// Rank returns the 0-based rank of the member, ordered from the highest
+// score when reverse is set.
+func (zs *SortedSet) Rank(member string, reverse bool) (int64, bool) {
+	score, ok := zs.Score(member)
+	if !ok {
+		return 0, false
+	}
+
+	rank := zs.zsl.Rank(score, member)
+	if reverse {
+		return zs.Len() - rank, true
+	}
+	return rank - 1, true
+}
+
+// DeleteRangeByScore removes the members in the range, and returns how
+// many were removed.
+func (zs *SortedSet) DeleteRangeByScore(r *ZRangeSpec) int64 {
+	var removed int64
+	for x := zs.zsl.FirstInRange(r); x != nil && r.LteMax(x.Score); removed++ {
+		next := x.Next()
+		zs.Delete(x.Member)
+		x = next
+	}
+	return removed
+}
+
+// DeleteRangeByLex removes the members in the range, and returns how
+// many were removed.
+func (zs *SortedSet) DeleteRangeByLex(r *ZLexRangeSpec) int64 {
+	var removed int64
+	for x := zs.zsl.FirstInLexRange(r); x != nil && r.LteMax(x.Member); removed++ {
+		next := x.Next()
+		zs.Delete(x.Member)
+		x = next
+	}
+	return removed
+}
+
+// DeleteRangeByRank removes the members with a 0-based rank between start
+// and end inclusive, and returns how many were removed.
+func (zs *SortedSet) DeleteRangeByRank(start, end int64) int64 {
+	var removed int64
+	x := zs.zsl.ByRank(start + 1)
+	for ; x != nil && removed <= end-start; removed++ {
+		next := x.Next()
+		zs.Delete(x.Member)
+		x = next
+	}
+	return removed
+}
+
+// Dup returns a copy of the sorted set.
+func (zs *SortedSet) Dup() *SortedSet {
+	dup := NewSortedSet()
+	for x := zs.zsl.First(); x != nil; x = x.Next() {
+		dup.Add(x.Member, x.Score)
+	}
+	return dup
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"flag"
+
 	"github.com/kzinglzy/godis/server"
 )
 
+var databases = flag.Int("databases", server.DefaultDBNum, "number of databases")
+
 func main() {
-	s, err := server.MakeServer(":7777")
+	flag.Parse()
+
+	s, err := server.MakeServer(":7777", *databases)
 	if err != nil {
 		panic("failed to create godis server: " + err.Error())
 	}
@@ -1,35 +1,48 @@
 package server
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"strconv"
 	"strings"
 
+	"github.com/kzinglzy/godis/dt"
 	"github.com/kzinglzy/godis/server/protocol"
 )
 
+var errAOFRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+
 func feedAppendOnlyFile(r *protocol.Request) {
-	// translate SETEX to SET and EXPIREAT
-	if r.CommandName() == CmdNameSet && r.ArgvAt(3) != "" && r.ArgvAt(3) != FlagSetNX {
-		setArgv := []string{CmdNameSet, r.ArgvAt(1), r.ArgvAt(2)}
-		catAppendOnlyCommand(3, setArgv)
-
-		ex, _ := strconv.ParseInt(r.ArgvAt(3), 10, 64)
-		when := ex*1000 + mstime()
-		expireArgv := []string{CmdNameExpireAt, r.ArgvAt(1), fmt.Sprintf("%d", when)}
-		catAppendOnlyCommand(3, expireArgv)
-	} else if r.CommandName() == CmdNameExpire {
-		ex, _ := strconv.ParseInt(r.ArgvAt(2), 10, 64)
-		when := ex*1000 + mstime()
-		expireArgv := []string{CmdNameExpireAt, r.ArgvAt(1), fmt.Sprintf("%d", when)}
-		catAppendOnlyCommand(3, expireArgv)
-	} else {
-		catAppendOnlyCommand(r.ArgCount(), r.Argv())
+	catAppendOnlyCommand(r.ArgCount(), r.Argv())
+}
+
+// feedSelectIfNeed emits a SELECT when the command to append runs in
+// another DB than the previous one.
+func feedSelectIfNeed(id int) {
+	if godisServer.aofSelectedDB == id {
+		return
 	}
+	argv := []string{CmdNameSelect, strconv.Itoa(id)}
+	catAppendOnlyCommand(len(argv), argv)
+	godisServer.aofSelectedDB = id
 }
 
 func catAppendOnlyCommand(argc int, argv []string) {
+	cmd := formatCommand(argc, argv)
+	godisServer.aofBuf = append(godisServer.aofBuf, cmd...)
+
+	// accumulate the differences between the child DB and the current one
+	// in a buffer, so that when the rewrite is done we can append them.
+	if godisServer.aofRewriteInProgress() {
+		godisServer.aofRewriteBuf = append(godisServer.aofRewriteBuf, cmd...)
+	}
+}
+
+func formatCommand(argc int, argv []string) string {
 	var buf strings.Builder
 
 	buf.WriteString(fmt.Sprintf("*%d", argc))
@@ -42,7 +55,7 @@ func catAppendOnlyCommand(argc int, argv []string) {
 		buf.WriteString("\r\n")
 	}
 
-	godisServer.aofBuf = append(godisServer.aofBuf, []byte(buf.String())...)
+	return buf.String()
 }
 
 func flushAppendOnlyFile(force bool) {
@@ -63,18 +76,309 @@ func flushAppendOnlyFile(force bool) {
 	if err != nil || n != len(godisServer.aofBuf) {
 		panic("Can't recover from AOF write error, Exiting...")
 	}
+	godisServer.aofCurrentSize += int64(n)
 
 	godisServer.resetAofState()
 	if godisServer.aofFsyncPolicy == AOFFsyncAlways {
 		godisServer.aof.Sync()
 	} else {
-		if !godisServer.aofFlushInProgress {
+		if !godisServer.aofFlushInProgress() {
 			log.Printf("do fsync")
-			go godisServer.aofFsync()
+			godisServer.aofFsyncDone = make(chan struct{})
+			go aofFsync(godisServer.aof, godisServer.aofFsyncDone)
 		}
 	}
 }
 
+// rewriteAOFBackgroundIfNeed starts a rewrite when the AOF is bigger than
+// AOFRewriteMinSize and grew more than AOFRewritePerc since the last rewrite.
 func rewriteAOFBackgroundIfNeed() {
-	// TODO
+	s := godisServer
+	if s.aofRewriteInProgress() || s.aofCurrentSize < AOFRewriteMinSize {
+		return
+	}
+
+	base := s.aofRewriteBaseSize
+	if base == 0 {
+		base = 1
+	}
+	growth := s.aofCurrentSize*100/base - 100
+	if growth >= AOFRewritePerc {
+		log.Printf("starting automatic rewriting of AOF on %d%% growth", growth)
+		rewriteAppendOnlyFileBackground()
+	}
+}
+
+// rewriteAppendOnlyFileBackground starts a snapshot of the keyspace, which is
+// written to a temp file by another goroutine as it's copied. Commands executed
+// in the meantime are accumulated in aofRewriteBuf and appended by
+// backgroundRewriteDoneHandler.
+func rewriteAppendOnlyFileBackground() error {
+	s := godisServer
+	if s.aofRewriteInProgress() {
+		return errAOFRewriteInProgress
+	}
+
+	ks := s.startSnapshot()
+	functions := s.functionsSnapshot()
+	tmpfile := fmt.Sprintf(AOFRewriteTempFileName, os.Getpid())
+	done := make(chan error, 1)
+	s.aofRewriteDone = done
+	s.aofRewriteBuf = []byte{}
+	// the next command appended to the rewrite buffer must select its DB,
+	// as the rewritten file may end with any of them selected.
+	s.aofSelectedDB = -1
+
+	log.Printf("background append only file rewriting started")
+	go func() {
+		defer ks.stop()
+		done <- rewriteAppendOnlyFile(tmpfile, ks, functions)
+	}()
+	return nil
+}
+
+func rewriteAppendOnlyFile(filename string, ks *keyspaceSnapshot, functions []string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, code := range functions {
+		argv := []string{CmdNameFunction, "LOAD", code}
+		if _, err := w.WriteString(formatCommand(len(argv), argv)); err != nil {
+			return err
+		}
+	}
+	selected := -1
+	for e, ok := ks.next(); ok; e, ok = ks.next() {
+		if e.db != selected {
+			argv := []string{CmdNameSelect, strconv.Itoa(e.db)}
+			if _, err := w.WriteString(formatCommand(len(argv), argv)); err != nil {
+				return err
+			}
+			selected = e.db
+		}
+
+		if err := rewriteObject(w, e.key, e.val); err != nil {
+			return err
+		}
+		if e.expire != -1 {
+			argv := []string{CmdNamePExpireAt, e.key, strconv.FormatInt(e.expire, 10)}
+			if _, err := w.WriteString(formatCommand(len(argv), argv)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// rewriteObject emits the commands needed to rebuild the object.
+func rewriteObject(w *bufio.Writer, key string, o *dt.Object) error {
+	var cmds [][]string
+
+	switch o.ObjType {
+	case dt.ObjString:
+		cmds = append(cmds, []string{CmdNameSet, key, o.StringValue()})
+	case dt.ObjList:
+		argv := []string{CmdNameRPush, key}
+		it := o.Ptr.(*dt.Quicklist).Iterator(0, false)
+		for v, ok := it.Next(); ok; v, ok = it.Next() {
+			argv = append(argv, v)
+			if len(argv)-2 >= AOFRewriteItemsPerCmd {
+				cmds = append(cmds, argv)
+				argv = []string{CmdNameRPush, key}
+			}
+		}
+		if len(argv) > 2 {
+			cmds = append(cmds, argv)
+		}
+	case dt.ObjHash:
+		argv := []string{CmdNameHSet, key}
+		hashTypeIterate(o, func(field, value string) bool {
+			argv = append(argv, field, value)
+			if len(argv)-2 >= AOFRewriteItemsPerCmd {
+				cmds = append(cmds, argv)
+				argv = []string{CmdNameHSet, key}
+			}
+			return true
+		})
+		if len(argv) > 2 {
+			cmds = append(cmds, argv)
+		}
+	case dt.ObjSet:
+		argv := []string{CmdNameSAdd, key}
+		setTypeIterate(o, func(member string) bool {
+			argv = append(argv, member)
+			if len(argv)-2 >= AOFRewriteItemsPerCmd {
+				cmds = append(cmds, argv)
+				argv = []string{CmdNameSAdd, key}
+			}
+			return true
+		})
+		if len(argv) > 2 {
+			cmds = append(cmds, argv)
+		}
+	case dt.ObjZSet:
+		argv := []string{CmdNameZAdd, key}
+		for ln := o.Ptr.(*dt.SortedSet).Skiplist().First(); ln != nil; ln = ln.Next() {
+			argv = append(argv, formatScore(ln.Score), ln.Member)
+			if len(argv)-2 >= AOFRewriteItemsPerCmd {
+				cmds = append(cmds, argv)
+				argv = []string{CmdNameZAdd, key}
+			}
+		}
+		if len(argv) > 2 {
+			cmds = append(cmds, argv)
+		}
+	case dt.ObjStream:
+		cmds = rewriteStreamObject(key, o.Ptr.(*dt.Stream))
+	default:
+		return fmt.Errorf("unknown object type %d", o.ObjType)
+	}
+
+	for _, argv := range cmds {
+		if _, err := w.WriteString(formatCommand(len(argv), argv)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteStreamObject returns the commands rebuilding the stream: an XADD
+// per entry, then XSETID restores the IDs and counters which don't follow
+// from the entries, and the groups are created with their consumers and
+// pending entries.
+func rewriteStreamObject(key string, s *dt.Stream) [][]string {
+	var cmds [][]string
+	if s.Len() > 0 {
+		s.Range(dt.StreamID{}, dt.MaxStreamID, false, func(id dt.StreamID, fields []string) bool {
+			cmds = append(cmds, append([]string{CmdNameXAdd, key, id.String()}, fields...))
+			return true
+		})
+	} else {
+		// an empty stream is created by trimming its only entry
+		cmds = append(cmds, []string{CmdNameXAdd, key, "MAXLEN", "0", "0-1", "x", "y"})
+	}
+	cmds = append(cmds, []string{CmdNameXSetID, key, s.LastID.String(),
+		"ENTRIESADDED", strconv.FormatInt(s.EntriesAdded, 10),
+		"MAXDELETEDID", s.MaxDeletedID.String()})
+
+	s.Groups(func(name string, cg *dt.StreamCG) bool {
+		cmds = append(cmds, []string{CmdNameXGroup, "CREATE", key, name, cg.LastID.String(),
+			"ENTRIESREAD", strconv.FormatInt(cg.EntriesRead, 10)})
+		cg.Consumers(func(consumer *dt.StreamConsumer) bool {
+			if consumer.PendingLen() == 0 {
+				cmds = append(cmds, []string{CmdNameXGroup, "CREATECONSUMER", key, name, consumer.Name})
+				return true
+			}
+			consumer.PendingRange(dt.StreamID{}, dt.MaxStreamID, func(id dt.StreamID, nack *dt.StreamNACK) bool {
+				cmds = append(cmds, []string{CmdNameXClaim, key, name, consumer.Name, "0", id.String(),
+					"TIME", strconv.FormatInt(nack.DeliveryTime, 10),
+					"RETRYCOUNT", strconv.FormatInt(nack.DeliveryCount, 10),
+					"JUSTID", "FORCE"})
+				return true
+			})
+			return true
+		})
+		return true
+	})
+	return cmds
+}
+
+// aofLegacyCommands are the commands of the former list type, which are
+// only read back from the AOFs written before they were removed.
+var aofLegacyCommands = map[string]string{
+	"push": CmdNameRPush,
+	"pop":  CmdNameRPop,
+}
+
+// loadAppendOnlyFile replays the commands of the AOF read from reader.
+func (s *Server) loadAppendOnlyFile(reader io.Reader) error {
+	s.loading = true
+	defer func() {
+		s.loading = false
+		s.dirty = 0
+	}()
+
+	fakeClient := NewFakeClient(reader, s.db[0])
+	for req := range fakeClient.Requests() {
+		if name, ok := aofLegacyCommands[strings.ToLower(req.CommandName())]; ok {
+			req = protocol.NewRequest(append([]string{name}, req.Argv()[1:]...)...)
+		}
+		cmd := LoopupCommand(req.CommandName())
+		if cmd == unknownCommandInfo {
+			return fmt.Errorf("unknown command '%s' reading the append only file", req.CommandName())
+		}
+		if fakeClient.multi && !isTransactionCommand(req.CommandName()) {
+			queueMultiCommand(fakeClient, req)
+			continue
+		}
+		cmd.Exec(fakeClient, req)
+	}
+	// the AOF was truncated in the middle of a transaction
+	if fakeClient.multi {
+		log.Printf("revert incomplete MULTI/EXEC transaction in AOF file")
+		discardTransaction(fakeClient)
+	}
+	return nil
+}
+
+// backgroundRewriteDoneHandler appends the commands accumulated during the
+// rewrite to the new file and replaces the old AOF with it.
+func backgroundRewriteDoneHandler(err error) {
+	s := godisServer
+	tmpfile := fmt.Sprintf(AOFRewriteTempFileName, os.Getpid())
+	defer func() {
+		s.aofRewriteDone = nil
+		s.aofRewriteBuf = nil
+	}()
+
+	if err != nil {
+		log.Printf("background append only file rewriting error: %v", err)
+		os.Remove(tmpfile)
+		return
+	}
+
+	fd, err := os.OpenFile(tmpfile, os.O_RDWR|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		log.Printf("unable to open the temporary AOF produced by the rewrite: %v", err)
+		os.Remove(tmpfile)
+		return
+	}
+
+	_, err = fd.Write(s.aofRewriteBuf)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, AOFFileName)
+	}
+	if err != nil {
+		log.Printf("failed to finish the AOF rewrite: %v", err)
+		fd.Close()
+		os.Remove(tmpfile)
+		return
+	}
+
+	// the old file may still be fsynced in background
+	s.waitAofFsync()
+	old := s.aof
+	s.aof = fd
+	old.Close()
+
+	if info, err := fd.Stat(); err == nil {
+		s.aofCurrentSize = info.Size()
+		s.aofRewriteBaseSize = info.Size()
+	}
+
+	// the regular AOF buffer was just written to the new file
+	// as part of the rewrite buffer.
+	s.resetAofState()
+	log.Printf("background AOF rewrite finished successfully")
 }
@@ -0,0 +1,609 @@
+package server
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdSetBit struct{}
+type cmdGetBit struct{}
+type cmdBitCount struct{}
+type cmdBitPos struct{}
+type cmdBitOp struct{}
+type cmdBitField struct{}
+type cmdBitFieldRO struct{}
+
+// Bitmaps are plain strings, the bit 0 is the most significant bit of the
+// first byte. The commands writing bits convert the string to raw bytes
+// which are modified in place, and grow it with zero bytes as needed.
+
+var errBitOffset = "bit offset is not an integer or out of range"
+
+// parseBitOffset parses the offset of a bit, or of a bitfield of the given
+// width if hash is true, where "#N" means the N-th field of this width.
+func parseBitOffset(s string, hash bool, width int64) (int64, bool) {
+	mul := int64(1)
+	if hash && strings.HasPrefix(s, "#") {
+		s = s[1:]
+		mul = width
+	}
+
+	offset, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || offset < 0 || offset > math.MaxInt64/mul {
+		return 0, false
+	}
+	offset *= mul
+	if offset>>3 >= StringMaxSize {
+		return 0, false
+	}
+	return offset, true
+}
+
+// SETBIT key offset value
+func (*cmdSetBit) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	offset, ok := parseBitOffset(r.ArgvAt(2), false, 0)
+	if !ok {
+		return c.ReplyError(errBitOffset)
+	}
+	on := r.ArgvAt(3)
+	if on != "0" && on != "1" {
+		return c.ReplyError("bit is not an integer or out of range")
+	}
+	o, msg := getString(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	o = lookupStringForWrite(c.db, key, o, offset>>3+1)
+	buf := o.Ptr.([]byte)
+	idx, bit := offset>>3, 7-uint(offset&7)
+	old := int64(buf[idx]>>bit) & 1
+	if on == "1" {
+		buf[idx] |= 1 << bit
+	} else {
+		buf[idx] &^= 1 << bit
+	}
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyString, "setbit", key, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(old)
+}
+
+// GETBIT key offset
+func (*cmdGetBit) Exec(c *Client, r *protocol.Request) error {
+	offset, ok := parseBitOffset(r.ArgvAt(2), false, 0)
+	if !ok {
+		return c.ReplyError(errBitOffset)
+	}
+	o, msg := getString(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	buf := stringBytes(o)
+	if offset>>3 >= int64(len(buf)) {
+		return c.ReplyInt(0)
+	}
+	return c.ReplyInt(int64(buf[offset>>3]>>(7-uint(offset&7))) & 1)
+}
+
+// bitRange normalizes the start and end of a BYTE or BIT range of a string
+// of n bytes like GETRANGE, and returns the range in bits. The range is
+// empty if start > end.
+func bitRange(start, end, n int64, isbit bool) (int64, int64) {
+	if start < 0 && end < 0 && start > end {
+		return 0, -1
+	}
+	total := n
+	if isbit {
+		total = n * 8
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if !isbit {
+		start, end = start*8, end*8+7
+	}
+	return start, end
+}
+
+// parseBitRange parses the start, end and unit arguments starting from the
+// i-th argument, unit is BYTE if missing.
+func parseBitRange(r *protocol.Request, i int) (start, end int64, isbit bool, msg string) {
+	start, err := strconv.ParseInt(r.ArgvAt(i), 10, 64)
+	if err != nil {
+		return 0, 0, false, ReplyNotInteger
+	}
+	end, err = strconv.ParseInt(r.ArgvAt(i+1), 10, 64)
+	if err != nil {
+		return 0, 0, false, ReplyNotInteger
+	}
+	if i+2 < r.ArgCount() {
+		switch strings.ToLower(r.ArgvAt(i + 2)) {
+		case "byte":
+		case "bit":
+			isbit = true
+		default:
+			return 0, 0, false, ReplySyntaxErr
+		}
+	}
+	return start, end, isbit, ""
+}
+
+// BITCOUNT key [start end [BYTE|BIT]]
+func (*cmdBitCount) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	if argc == 3 || argc > 5 {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	var start, end int64
+	var isbit bool
+	if argc > 2 {
+		var msg string
+		if start, end, isbit, msg = parseBitRange(r, 2); msg != "" {
+			return c.ReplyError(msg)
+		}
+	}
+	o, msg := getString(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	buf := stringBytes(o)
+	if argc == 2 {
+		start, end = 0, int64(len(buf))*8-1
+	} else {
+		start, end = bitRange(start, end, int64(len(buf)), isbit)
+	}
+	return c.ReplyInt(countBits(buf, start, end))
+}
+
+// countBits returns the number of bits set in the bits from start to end.
+func countBits(buf []byte, start, end int64) int64 {
+	if start > end {
+		return 0
+	}
+
+	var count int
+	for i := start >> 3; i <= end>>3; i++ {
+		count += bits.OnesCount8(buf[i])
+	}
+	// don't count the bits of the first and last bytes out of the range
+	first, last := buf[start>>3], buf[end>>3]
+	count -= bits.OnesCount8(first >> (8 - uint(start&7)))
+	count -= bits.OnesCount8(last << (uint(end&7) + 1))
+	return int64(count)
+}
+
+// BITPOS key bit [start [end [BYTE|BIT]]]
+func (*cmdBitPos) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	if argc > 6 {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	bit := r.ArgvAt(2)
+	if bit != "0" && bit != "1" {
+		return c.ReplyError("The bit argument must be 1 or 0.")
+	}
+
+	var start, end int64
+	var isbit bool
+	endGiven := argc > 4
+	if argc > 3 {
+		var err error
+		if start, err = strconv.ParseInt(r.ArgvAt(3), 10, 64); err != nil {
+			return c.ReplyError(ReplyNotInteger)
+		}
+		end = -1
+		if endGiven {
+			var msg string
+			if start, end, isbit, msg = parseBitRange(r, 3); msg != "" {
+				return c.ReplyError(msg)
+			}
+		}
+	}
+	o, msg := getString(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if o == nil {
+		// a missing key is an empty string, which is zero padded
+		if bit == "1" {
+			return c.ReplyInt(-1)
+		}
+		return c.ReplyInt(0)
+	}
+
+	buf := stringBytes(o)
+	if argc == 3 {
+		start, end = 0, int64(len(buf))*8-1
+	} else {
+		start, end = bitRange(start, end, int64(len(buf)), isbit)
+	}
+	if start > end {
+		return c.ReplyInt(-1)
+	}
+
+	pos := searchBit(buf, start, end, bit == "1")
+	// when looking for a clear bit without an end, the string is
+	// considered padded with zeros on the right.
+	if pos == -1 && bit == "0" && !endGiven {
+		return c.ReplyInt(end + 1)
+	}
+	return c.ReplyInt(pos)
+}
+
+// searchBit returns the position of the first bit set to on between the
+// bits start and end, or -1 if there's none.
+func searchBit(buf []byte, start, end int64, on bool) int64 {
+	skip := byte(0)
+	if !on {
+		skip = 0xff
+	}
+	for pos := start; pos <= end; {
+		// skip the whole bytes which can't match
+		if pos&7 == 0 && pos+7 <= end && buf[pos>>3] == skip {
+			pos += 8
+			continue
+		}
+		if (buf[pos>>3]>>(7-uint(pos&7)))&1 == 1 == on {
+			return pos
+		}
+		pos++
+	}
+	return -1
+}
+
+// BITOP AND|OR|XOR|NOT destkey key [key ...]
+func (*cmdBitOp) Exec(c *Client, r *protocol.Request) error {
+	op := strings.ToLower(r.ArgvAt(1))
+	if op != "and" && op != "or" && op != "xor" && op != "not" {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+	if op == "not" && r.ArgCount() != 4 {
+		return c.ReplyError("BITOP NOT must be called with a single source key.")
+	}
+
+	// the missing keys are empty strings
+	var srcs [][]byte
+	maxlen := 0
+	for i := 3; i < r.ArgCount(); i++ {
+		o, msg := getString(c, r.ArgvAt(i))
+		if msg != "" {
+			return c.ReplyError(msg)
+		}
+		buf := stringBytes(o)
+		srcs = append(srcs, buf)
+		if len(buf) > maxlen {
+			maxlen = len(buf)
+		}
+	}
+
+	// the shorter strings are zero padded
+	res := make([]byte, maxlen)
+	copy(res, srcs[0])
+	for _, src := range srcs[1:] {
+		for j := range res {
+			var b byte
+			if j < len(src) {
+				b = src[j]
+			}
+			switch op {
+			case "and":
+				res[j] &= b
+			case "or":
+				res[j] |= b
+			case "xor":
+				res[j] ^= b
+			}
+		}
+	}
+	if op == "not" {
+		for j := range res {
+			res[j] = ^res[j]
+		}
+	}
+
+	destkey := r.ArgvAt(2)
+	if maxlen > 0 {
+		c.db.Set(destkey, dt.NewBytesObject(res))
+		notifyKeyspaceEvent(NotifyString, "set", destkey, c.db.id)
+	} else if c.db.lookupKey(destkey, false) != nil {
+		c.db.deleteKey(destkey)
+		notifyKeyspaceEvent(NotifyGeneric, "del", destkey, c.db.id)
+	}
+	signalModifiedKey(c.db, destkey)
+	godisServer.dirty++
+	return c.ReplyInt(int64(maxlen))
+}
+
+const (
+	bitfieldGet = iota
+	bitfieldSet
+	bitfieldIncrBy
+)
+
+const (
+	overflowWrap = iota
+	overflowSat
+	overflowFail
+)
+
+type bitfieldOp struct {
+	offset   int64
+	value    int64
+	opcode   int
+	overflow int
+	width    uint
+	signed   bool
+}
+
+// parseBitfieldType parses a type like i8 or u16, u64 isn't supported as
+// the values are returned as signed integers.
+func parseBitfieldType(s string) (uint, bool, bool) {
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u' && s[0] != 'I' && s[0] != 'U') {
+		return 0, false, false
+	}
+	signed := s[0] == 'i' || s[0] == 'I'
+	width, err := strconv.Atoi(s[1:])
+	if err != nil || width < 1 || (signed && width > 64) || (!signed && width > 63) {
+		return 0, false, false
+	}
+	return uint(width), signed, true
+}
+
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL] ...
+func (*cmdBitField) Exec(c *Client, r *protocol.Request) error {
+	return bitfieldGeneric(c, r, false)
+}
+
+// BITFIELD_RO key [GET type offset ...]
+func (*cmdBitFieldRO) Exec(c *Client, r *protocol.Request) error {
+	return bitfieldGeneric(c, r, true)
+}
+
+func bitfieldGeneric(c *Client, r *protocol.Request, readonly bool) error {
+	var ops []bitfieldOp
+	overflow := overflowWrap
+	writes := false
+	var maxbit int64
+	for i := 2; i < r.ArgCount(); i++ {
+		sub := strings.ToLower(r.ArgvAt(i))
+		remaining := r.ArgCount() - i - 1
+		var op bitfieldOp
+		switch {
+		case sub == "get" && remaining >= 2:
+			op.opcode = bitfieldGet
+		case sub == "set" && remaining >= 3:
+			op.opcode = bitfieldSet
+		case sub == "incrby" && remaining >= 3:
+			op.opcode = bitfieldIncrBy
+		case sub == "overflow" && remaining >= 1:
+			switch strings.ToLower(r.ArgvAt(i + 1)) {
+			case "wrap":
+				overflow = overflowWrap
+			case "sat":
+				overflow = overflowSat
+			case "fail":
+				overflow = overflowFail
+			default:
+				return c.ReplyError("Invalid OVERFLOW type specified")
+			}
+			i++
+			continue
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+
+		width, signed, ok := parseBitfieldType(r.ArgvAt(i + 1))
+		if !ok {
+			return c.ReplyError("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+		}
+		offset, ok := parseBitOffset(r.ArgvAt(i+2), true, int64(width))
+		if !ok || (offset+int64(width)-1)>>3 >= StringMaxSize {
+			return c.ReplyError(errBitOffset)
+		}
+		if op.opcode != bitfieldGet {
+			v, err := strconv.ParseInt(r.ArgvAt(i+3), 10, 64)
+			if err != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			op.value = v
+			writes = true
+			if end := offset + int64(width) - 1; end > maxbit {
+				maxbit = end
+			}
+			i++
+		}
+		op.offset, op.width, op.signed, op.overflow = offset, width, signed, overflow
+		ops = append(ops, op)
+		i += 2
+	}
+
+	if readonly && writes {
+		return c.ReplyError("BITFIELD_RO only supports the GET subcommand")
+	}
+
+	key := r.ArgvAt(1)
+	o, msg := getString(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	var buf []byte
+	if writes {
+		o = lookupStringForWrite(c.db, key, o, maxbit>>3+1)
+		buf = o.Ptr.([]byte)
+	} else {
+		buf = stringBytes(o)
+	}
+
+	changes := 0
+	reply := make([]interface{}, 0, len(ops))
+	for _, op := range ops {
+		if op.opcode == bitfieldGet {
+			if op.signed {
+				reply = append(reply, getSignedBitfield(buf, op.offset, op.width))
+			} else {
+				reply = append(reply, int64(getUnsignedBitfield(buf, op.offset, op.width)))
+			}
+			continue
+		}
+
+		var old, value int64
+		var overflowed bool
+		if op.signed {
+			old = getSignedBitfield(buf, op.offset, op.width)
+			base, incr := old, op.value
+			if op.opcode == bitfieldSet {
+				base, incr = op.value, 0
+			}
+			value, overflowed = checkSignedBitfieldOverflow(base, incr, op.width, op.overflow)
+		} else {
+			uold := getUnsignedBitfield(buf, op.offset, op.width)
+			base, incr := uold, op.value
+			if op.opcode == bitfieldSet {
+				base, incr = uint64(op.value), 0
+			}
+			var uvalue uint64
+			uvalue, overflowed = checkUnsignedBitfieldOverflow(base, incr, op.width, op.overflow)
+			old, value = int64(uold), int64(uvalue)
+		}
+
+		if overflowed && op.overflow == overflowFail {
+			reply = append(reply, nil)
+			continue
+		}
+		setUnsignedBitfield(buf, op.offset, op.width, uint64(value))
+		changes++
+		if op.opcode == bitfieldSet {
+			reply = append(reply, old)
+		} else {
+			reply = append(reply, value)
+		}
+	}
+
+	if changes > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyString, "setbit", key, c.db.id)
+	}
+	godisServer.dirty += int64(changes)
+	return c.ReplyBulk(reply...)
+}
+
+func getUnsignedBitfield(buf []byte, offset int64, width uint) uint64 {
+	var value uint64
+	for j := uint(0); j < width; j++ {
+		var bit uint64
+		if idx := offset >> 3; idx < int64(len(buf)) {
+			bit = uint64(buf[idx]>>(7-uint(offset&7))) & 1
+		}
+		value = value<<1 | bit
+		offset++
+	}
+	return value
+}
+
+func getSignedBitfield(buf []byte, offset int64, width uint) int64 {
+	value := getUnsignedBitfield(buf, offset, width)
+	// extend the sign bit to the higher bits
+	if width < 64 && value&(1<<(width-1)) != 0 {
+		value |= math.MaxUint64 << width
+	}
+	return int64(value)
+}
+
+func setUnsignedBitfield(buf []byte, offset int64, width uint, value uint64) {
+	for j := uint(0); j < width; j++ {
+		idx, bit := offset>>3, 7-uint(offset&7)
+		if value&(1<<(width-1-j)) != 0 {
+			buf[idx] |= 1 << bit
+		} else {
+			buf[idx] &^= 1 << bit
+		}
+		offset++
+	}
+}
+
+// checkUnsignedBitfieldOverflow adds incr to value, and returns the result
+// according to the overflow behavior and whether it overflowed.
+func checkUnsignedBitfieldOverflow(value uint64, incr int64, width uint, overflow int) (uint64, bool) {
+	max := uint64(1)<<width - 1
+	maxincr := int64(max - value)
+	minincr := -int64(value)
+
+	if value > max || (incr > 0 && incr > maxincr) {
+		if overflow == overflowSat {
+			return max, true
+		}
+		return (value + uint64(incr)) & max, true
+	} else if incr < 0 && incr < minincr {
+		if overflow == overflowSat {
+			return 0, true
+		}
+		return (value + uint64(incr)) & max, true
+	}
+	return value + uint64(incr), false
+}
+
+// checkSignedBitfieldOverflow is like checkUnsignedBitfieldOverflow for
+// the signed bitfields.
+func checkSignedBitfieldOverflow(value, incr int64, width uint, overflow int) (int64, bool) {
+	max := int64(math.MaxInt64)
+	if width < 64 {
+		max = int64(1)<<(width-1) - 1
+	}
+	min := -max - 1
+
+	// maxincr and minincr may overflow, but they are only used once value
+	// is known to be in range, where they don't.
+	maxincr := max - value
+	minincr := min - value
+
+	if value > max || (width != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr) {
+		if overflow == overflowSat {
+			return max, true
+		}
+		return wrapSignedBitfield(value, incr, width), true
+	} else if value < min || (width != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr) {
+		if overflow == overflowSat {
+			return min, true
+		}
+		return wrapSignedBitfield(value, incr, width), true
+	}
+	return value + incr, false
+}
+
+// wrapSignedBitfield returns value+incr truncated to width bits, with the
+// sign bit extended to the higher bits.
+func wrapSignedBitfield(value, incr int64, width uint) int64 {
+	res := uint64(value) + uint64(incr)
+	if width < 64 {
+		mask := uint64(math.MaxUint64) << width
+		if res&(1<<(width-1)) != 0 {
+			res |= mask
+		} else {
+			res &^= mask
+		}
+	}
+	return int64(res)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/dt"
+)
+
+// A client executing a blocking command on keys which can't serve it is
+// blocked: the command is not replied, and the following requests of the
+// client are queued until it's unblocked. Every key with blocked clients
+// is signaled as ready when a value is added to it, and the clients are
+// then served in FIFO order by executing their command again.
+
+// blockingState is the state of a blocked client.
+type blockingState struct {
+	btype   uint8 // the type of the keys the client waits for
+	keys    []string
+	timeout int64 // unix time in ms, or 0 to block forever
+	event   *IOEvent
+
+	// XREAD waits for entries after the IDs of the keys, and XREADGROUP
+	// for entries not yet delivered to the group
+	streamIDs []dt.StreamID
+	group     string
+	readGroup bool
+}
+
+type readyKey struct {
+	db  *Database
+	key string
+}
+
+var (
+	errTimeoutNotFloat   = errors.New("timeout is not a float or out of range")
+	errTimeoutNotInteger = errors.New("timeout is not an integer or out of range")
+	errTimeoutNegative   = errors.New("timeout is negative")
+)
+
+// parseTimeout parses a timeout in seconds, and returns the absolute unix
+// time in ms at which the client is unblocked, or 0 to block forever.
+func parseTimeout(s string) (int64, error) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return 0, errTimeoutNotFloat
+	}
+	if secs < 0 {
+		return 0, errTimeoutNegative
+	}
+
+	// a positive timeout blocks for at least 1 ms, rather than forever
+	ms := int64(math.Ceil(secs * 1000))
+	if ms == 0 {
+		return 0, nil
+	}
+	return mstime() + ms, nil
+}
+
+// parseBlockTimeout parses a timeout in ms as parseTimeout, for the BLOCK
+// option of the stream commands.
+func parseBlockTimeout(s string) (int64, error) {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errTimeoutNotInteger
+	}
+	if ms < 0 {
+		return 0, errTimeoutNegative
+	}
+
+	if ms == 0 {
+		return 0, nil
+	}
+	return mstime() + ms, nil
+}
+
+// blockForKeys blocks the client until one of the keys of type btype is
+// ready or the timeout is reached.
+func blockForKeys(c *Client, btype uint8, keys []string, timeout int64) {
+	c.blocked = true
+	c.bstate = blockingState{btype: btype, keys: keys, timeout: timeout}
+	for _, key := range keys {
+		c.db.blockingKeys[key] = append(c.db.blockingKeys[key], c)
+	}
+	godisServer.blockedClients[c] = true
+}
+
+// unblockClient removes the client from the blocking keys, and returns the
+// event of the blocking command.
+func unblockClient(c *Client) *IOEvent {
+	for _, key := range c.bstate.keys {
+		clients := c.db.blockingKeys[key]
+		for i, bc := range clients {
+			if bc == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(c.db.blockingKeys, key)
+		} else {
+			c.db.blockingKeys[key] = clients
+		}
+	}
+	delete(godisServer.blockedClients, c)
+
+	e := c.bstate.event
+	c.blocked = false
+	c.bstate = blockingState{}
+	return e
+}
+
+// signalKeyAsReady marks the key as ready to serve the clients blocked on
+// it, they are served once the current command returns.
+func signalKeyAsReady(db *Database, key string) {
+	if _, ok := db.blockingKeys[key]; !ok || db.readyKeys[key] {
+		return
+	}
+	db.readyKeys[key] = true
+	godisServer.readyKeys = append(godisServer.readyKeys, &readyKey{db: db, key: key})
+}
+
+// keyIsReady reports whether the key can serve the blocked client.
+func keyIsReady(c *Client, key string, o *dt.Object) bool {
+	if o.ObjType != c.bstate.btype {
+		return false
+	}
+	if o.ObjType != dt.ObjStream {
+		return true
+	}
+
+	s := o.Ptr.(*dt.Stream)
+	if c.bstate.readGroup {
+		// the client gets an error once the group is destroyed
+		cg := s.Group(c.bstate.group)
+		return cg == nil || s.LastValidID().Compare(cg.LastID) > 0
+	}
+	for i, k := range c.bstate.keys {
+		if k == key {
+			return s.LastValidID().Compare(c.bstate.streamIDs[i]) > 0
+		}
+	}
+	return false
+}
+
+// handleClientsBlockedOnKeys serves the clients blocked on the keys which
+// received new values, as long as the keys can serve them.
+func (s *Server) handleClientsBlockedOnKeys() {
+	for len(s.readyKeys) > 0 {
+		keys := s.readyKeys
+		s.readyKeys = nil
+
+		for _, rk := range keys {
+			delete(rk.db.readyKeys, rk.key)
+
+			// copy the clients, as they are removed from the list when unblocked
+			clients := append([]*Client(nil), rk.db.blockingKeys[rk.key]...)
+			for _, c := range clients {
+				o := rk.db.lookupKey(rk.key, false)
+				if o == nil {
+					break
+				}
+				if !keyIsReady(c, rk.key, o) {
+					continue
+				}
+
+				e := unblockClient(c)
+				s.processCommand(e)
+				s.processPendingCommands(c)
+			}
+		}
+	}
+}
+
+// handleBlockedClientsTimeout unblocks the clients whose timeout is reached.
+func (s *Server) handleBlockedClientsTimeout() {
+	if len(s.blockedClients) == 0 {
+		return
+	}
+
+	now := mstime()
+	for c := range s.blockedClients {
+		if c.bstate.timeout == 0 || c.bstate.timeout > now {
+			continue
+		}
+
+		e := unblockClient(c)
+		switch strings.ToLower(e.r.CommandName()) {
+		case CmdNameBLMove, CmdNameBRPopLPush:
+			c.ReplyEmpty()
+		default:
+			c.ReplyNullArray()
+		}
+		e.c.wg.Done()
+		s.processPendingCommands(c)
+	}
+}
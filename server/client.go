@@ -5,26 +5,56 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/kzinglzy/godis/server/protocol"
 )
 
 // Client .
 type Client struct {
+	id     int64
+	name   string
 	db     *Database
 	conn   net.Conn
+	out    *outputBuffer // nil when the replies are written to the sink directly
 	parser *protocol.Parser
 	writer *protocol.Writer
 	wg     *sync.WaitGroup
 	fake   bool
+
+	// commands to write to the AOF instead of the executed one
+	propagated [][]string
+
+	// blocking operations
+	blocked bool
+	bstate  blockingState
+	pending []*IOEvent
+
+	// transactions
+	multi       bool
+	dirtyCAS    bool // a watched key was modified
+	dirtyExec   bool // a command couldn't be queued
+	mstate      multiState
+	watchedKeys []*watchedKey
+
+	// pubsub
+	pubsubChannels      []string
+	pubsubPatterns      []string
+	pubsubShardChannels []string
 }
 
+// nextClientID is the id of the next connected client.
+var nextClientID int64
+
 func NewClient(conn net.Conn, db *Database) *Client {
+	out := newOutputBuffer(conn)
 	return &Client{
+		id:     atomic.AddInt64(&nextClientID, 1),
 		db:     db,
 		conn:   conn,
+		out:    out,
 		parser: protocol.NewParser(conn),
-		writer: protocol.NewWriter(conn),
+		writer: protocol.NewWriter(out),
 		wg:     new(sync.WaitGroup),
 	}
 }
@@ -40,10 +70,137 @@ func NewFakeClient(reader io.Reader, db *Database) *Client {
 	}
 }
 
+// Close writes the replies left and closes the connection.
 func (c *Client) Close() error {
+	if c.out != nil {
+		c.out.close(false)
+		<-c.out.done
+	}
 	return c.conn.Close()
 }
 
+// closeASAP disconnects the client right away, the replies left are
+// dropped. The client is freed once its requests end.
+func (c *Client) closeASAP() {
+	if c.out != nil {
+		c.out.dropped = true
+		c.out.reply = nil
+		c.out.close(true)
+	}
+	c.conn.Close()
+}
+
+// outputBuffer queues the replies of a client, which are written to the
+// connection by a goroutine of its own, so that the event loop never waits
+// for a slow client.
+type outputBuffer struct {
+	conn net.Conn
+	wake chan struct{}
+	done chan struct{}
+
+	// the replies written by the event loop, which are queued once they're
+	// complete by handleClientsWithPendingWrites
+	reply   []byte
+	pending bool
+	dropped bool // the client is closed by the event loop
+
+	mu     sync.Mutex
+	buf    []byte
+	closed bool
+}
+
+func newOutputBuffer(conn net.Conn) *outputBuffer {
+	out := &outputBuffer{
+		conn: conn,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go out.writeLoop()
+	return out
+}
+
+// Write appends p to the reply in progress, it's only called by the event
+// loop.
+func (out *outputBuffer) Write(p []byte) (int, error) {
+	if out.dropped {
+		return len(p), nil
+	}
+	if !out.pending {
+		out.pending = true
+		godisServer.clientsPendingWrite = append(godisServer.clientsPendingWrite, out)
+	}
+	out.reply = append(out.reply, p...)
+	return len(p), nil
+}
+
+// commit queues the replies written by the event loop.
+func (out *outputBuffer) commit() {
+	out.pending = false
+	if len(out.reply) == 0 {
+		return
+	}
+	out.writeReply(out.reply)
+	out.reply = nil
+}
+
+// writeReply queues a complete reply, which is never interleaved with the
+// other ones. It's dropped once the buffer is closed.
+func (out *outputBuffer) writeReply(p []byte) {
+	out.mu.Lock()
+	if !out.closed {
+		out.buf = append(out.buf, p...)
+	}
+	out.mu.Unlock()
+	out.signal()
+}
+
+// size returns the number of bytes not written yet, it's only called by
+// the event loop.
+func (out *outputBuffer) size() int {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	return len(out.buf) + len(out.reply)
+}
+
+// close stops queuing the replies, the ones queued are still written
+// unless drop is true.
+func (out *outputBuffer) close(drop bool) {
+	out.mu.Lock()
+	out.closed = true
+	if drop {
+		out.buf = nil
+	}
+	out.mu.Unlock()
+	out.signal()
+}
+
+func (out *outputBuffer) signal() {
+	select {
+	case out.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (out *outputBuffer) writeLoop() {
+	defer close(out.done)
+	for range out.wake {
+		out.mu.Lock()
+		data, closed := out.buf, out.closed
+		out.buf = nil
+		out.mu.Unlock()
+
+		if len(data) > 0 {
+			if _, err := out.conn.Write(data); err != nil {
+				out.close(true)
+				return
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
 // Requests .
 func (c *Client) Requests() <-chan *protocol.Request {
 	return c.parser.Requests()
@@ -53,6 +210,18 @@ func (c *Client) SetDatabase(db *Database) {
 	c.db = db
 }
 
+// protocol returns the protocol version negotiated by HELLO, RESP2 by
+// default.
+func (c *Client) protocol() int {
+	return c.writer.Protocol()
+}
+
+// propagate records a command to write to the AOF in place of the one
+// executed, for commands whose effects can't be replayed as they are.
+func (c *Client) propagate(argv ...string) {
+	c.propagated = append(c.propagated, argv)
+}
+
 func (c *Client) ReplyEmpty() error {
 	if c.fake {
 		return nil
@@ -75,6 +244,17 @@ func (c *Client) Reply(s string) error {
 	return err
 }
 
+func (c *Client) ReplyBulkString(s string) error {
+	if c.fake {
+		return nil
+	}
+	err := c.writer.WriteBulkString(s)
+	if err != nil {
+		log.Printf("failed to write bulk string %v", err)
+	}
+	return err
+}
+
 func (c *Client) ReplyBulk(v ...interface{}) error {
 	if c.fake {
 		return nil
@@ -86,6 +266,32 @@ func (c *Client) ReplyBulk(v ...interface{}) error {
 	return err
 }
 
+// ReplyNullArray replies a nil array, which is returned by the commands
+// replying an array when the key doesn't exist.
+func (c *Client) ReplyNullArray() error {
+	if c.fake {
+		return nil
+	}
+	err := c.writer.WriteObjects()
+	if err != nil {
+		log.Printf("failed to write null array %v", err)
+	}
+	return err
+}
+
+// ReplyArrayLen replies the length of an array, whose elements are replied
+// next, like the replies of the commands of a transaction.
+func (c *Client) ReplyArrayLen(n int) error {
+	if c.fake {
+		return nil
+	}
+	err := c.writer.WriteArrayLen(n)
+	if err != nil {
+		log.Printf("failed to write array length %v", err)
+	}
+	return err
+}
+
 func (c *Client) ReplyError(s string) error {
 	if c.fake {
 		return nil
@@ -108,9 +314,95 @@ func (c *Client) ReplyList(list []string) error {
 	if c.fake {
 		return nil
 	}
-	var bts [][]byte
+	bts := make([][]byte, 0, len(list))
 	for _, e := range list {
 		bts = append(bts, []byte(e))
 	}
 	return c.writer.WriteBulksSlice(bts)
 }
+
+// ReplyMap replies the fields and the values in the list as a map, or as
+// a flat array in RESP2.
+func (c *Client) ReplyMap(list []string) error {
+	if c.fake {
+		return nil
+	}
+	if err := c.writer.WriteMapLen(len(list) / 2); err != nil {
+		return err
+	}
+	for _, e := range list {
+		if err := c.writer.WriteBulkString(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplyMapLen replies the number of pairs of a map, whose keys and values
+// are replied next.
+func (c *Client) ReplyMapLen(n int) error {
+	if c.fake {
+		return nil
+	}
+	return c.writer.WriteMapLen(n)
+}
+
+// ReplySet replies the members of a set, or an array in RESP2.
+func (c *Client) ReplySet(list []string) error {
+	if c.fake {
+		return nil
+	}
+	if err := c.writer.WriteSetLen(len(list)); err != nil {
+		return err
+	}
+	for _, e := range list {
+		if err := c.writer.WriteBulkString(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplyDouble replies a floating point number, or a bulk string in RESP2.
+func (c *Client) ReplyDouble(f float64) error {
+	if c.fake {
+		return nil
+	}
+	return c.writer.WriteDouble(formatScore(f))
+}
+
+// ReplyBool replies a boolean, or the integer 1 or 0 in RESP2.
+func (c *Client) ReplyBool(b bool) error {
+	if c.fake {
+		return nil
+	}
+	return c.writer.WriteBool(b)
+}
+
+// ReplyVerbatim replies a text with its format, or a bulk string in RESP2.
+func (c *Client) ReplyVerbatim(s, format string) error {
+	if c.fake {
+		return nil
+	}
+	return c.writer.WriteVerbatim(format, s)
+}
+
+// ReplyPush replies an out of band message, like the messages of pubsub,
+// or an array in RESP2.
+func (c *Client) ReplyPush(v ...interface{}) error {
+	if c.fake {
+		return nil
+	}
+	// the messages of a subscriber which doesn't read them fast enough are
+	// bounded, it's disconnected rather than buffering them forever
+	if c.out != nil && c.out.size() > godisServer.clientOutputBufferLimitPubsub {
+		log.Printf("client %d closed for overcoming of output buffer limits", c.id)
+		c.closeASAP()
+		return nil
+	}
+	err := c.writer.WritePush(v...)
+	if err != nil {
+		log.Printf("failed to write push %v, %v", v, err)
+	}
+	return err
+}
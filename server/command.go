@@ -1,241 +1,709 @@
 package server
 
 import (
+	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kzinglzy/godis/dt"
 	"github.com/kzinglzy/godis/server/protocol"
 )
 
-// CommandTable .
-var CommandTable = map[string]Command{
-	CmdNamePing:     new(cmdPing),
-	CmdNameGet:      new(cmdGet),
-	CmdNameSet:      new(cmdSet),
-	CmdNameTTL:      new(cmdTTL),
-	CmdNameExpire:   new(cmdExpire),
-	CmdNameExpireAt: new(cmdExpireAt),
-	CmdNamePush:     new(cmdPush),
-	CmdNamePop:      new(cmdPop),
-	CmdNameRange:    new(cmdRange),
+// CommandTable maps the names to the commands, with the arity, the flags
+// and the positions of the keys of each one.
+var CommandTable = map[string]*CommandInfo{
+	CmdNamePing:    newCommand(new(cmdPing), -1, "fast", 0, 0, 0),
+	CmdNameHello:   newCommand(new(cmdHello), -1, "noscript fast", 0, 0, 0),
+	CmdNameCommand: newCommand(new(cmdCommand), -1, "", 0, 0, 0),
+
+	CmdNameBgRewriteAOF: newCommand(new(cmdBgRewriteAOF), 1, "admin noscript", 0, 0, 0),
+	CmdNameSave:         newCommand(new(cmdSave), 1, "admin noscript", 0, 0, 0),
+	CmdNameBgSave:       newCommand(new(cmdBgSave), 1, "admin noscript", 0, 0, 0),
+	CmdNameLastSave:     newCommand(new(cmdLastSave), 1, "fast", 0, 0, 0),
+	CmdNameObject:       newCommand(new(cmdObject), -2, "readonly", 2, 2, 1),
+	CmdNameConfig:       newCommand(new(cmdConfig), -2, "admin noscript", 0, 0, 0),
+
+	CmdNameSelect:   newCommand(new(cmdSelect), 2, "fast", 0, 0, 0),
+	CmdNameMove:     newCommand(new(cmdMove), 3, "write fast", 1, 1, 1),
+	CmdNameSwapDB:   newCommand(new(cmdSwapDB), 3, "write fast", 0, 0, 0),
+	CmdNameFlushDB:  newCommand(new(cmdFlushDB), -1, "write", 0, 0, 0),
+	CmdNameFlushAll: newCommand(new(cmdFlushAll), -1, "write", 0, 0, 0),
+	CmdNameDBSize:   newCommand(new(cmdDBSize), 1, "readonly fast", 0, 0, 0),
+	CmdNameScan:     newCommand(new(cmdScan), -2, "readonly", 0, 0, 0),
+	CmdNameKeys:     newCommand(new(cmdKeys), 2, "readonly", 0, 0, 0),
+
+	CmdNameGet:    newCommand(new(cmdGet), 2, "readonly fast", 1, 1, 1),
+	CmdNameSet:    newCommand(new(cmdSet), -3, "write denyoom", 1, 1, 1),
+	CmdNameSetEX:  newCommand(new(cmdSetEX), 4, "write denyoom", 1, 1, 1),
+	CmdNamePSetEX: newCommand(new(cmdPSetEX), 4, "write denyoom", 1, 1, 1),
+	CmdNameSetNX:  newCommand(new(cmdSetNX), 3, "write denyoom fast", 1, 1, 1),
+	CmdNameGetSet: newCommand(new(cmdGetSet), 3, "write denyoom fast", 1, 1, 1),
+	CmdNameGetDel: newCommand(new(cmdGetDel), 2, "write fast", 1, 1, 1),
+	CmdNameGetEx:  newCommand(new(cmdGetEx), -2, "write fast", 1, 1, 1),
+
+	CmdNameIncr:        newCommand(new(cmdIncr), 2, "write denyoom fast", 1, 1, 1),
+	CmdNameDecr:        newCommand(new(cmdDecr), 2, "write denyoom fast", 1, 1, 1),
+	CmdNameIncrBy:      newCommand(new(cmdIncrBy), 3, "write denyoom fast", 1, 1, 1),
+	CmdNameDecrBy:      newCommand(new(cmdDecrBy), 3, "write denyoom fast", 1, 1, 1),
+	CmdNameIncrByFloat: newCommand(new(cmdIncrByFloat), 3, "write denyoom fast", 1, 1, 1),
+
+	CmdNameMGet:     newCommand(new(cmdMGet), -2, "readonly fast", 1, -1, 1),
+	CmdNameMSet:     newCommand(new(cmdMSet), -3, "write denyoom", 1, -1, 2),
+	CmdNameMSetNX:   newCommand(new(cmdMSetNX), -3, "write denyoom", 1, -1, 2),
+	CmdNameAppend:   newCommand(new(cmdAppend), 3, "write denyoom fast", 1, 1, 1),
+	CmdNameStrLen:   newCommand(new(cmdStrLen), 2, "readonly fast", 1, 1, 1),
+	CmdNameGetRange: newCommand(new(cmdGetRange), 4, "readonly", 1, 1, 1),
+	CmdNameSetRange: newCommand(new(cmdSetRange), 4, "write denyoom", 1, 1, 1),
+	CmdNameLCS:      newCommand(new(cmdLCS), -3, "readonly", 1, 2, 1),
+
+	CmdNameSetBit:     newCommand(new(cmdSetBit), 4, "write denyoom", 1, 1, 1),
+	CmdNameGetBit:     newCommand(new(cmdGetBit), 3, "readonly fast", 1, 1, 1),
+	CmdNameBitCount:   newCommand(new(cmdBitCount), -2, "readonly", 1, 1, 1),
+	CmdNameBitPos:     newCommand(new(cmdBitPos), -3, "readonly", 1, 1, 1),
+	CmdNameBitOp:      newCommand(new(cmdBitOp), -4, "write denyoom", 2, -1, 1),
+	CmdNameBitField:   newCommand(new(cmdBitField), -2, "write denyoom", 1, 1, 1),
+	CmdNameBitFieldRO: newCommand(new(cmdBitFieldRO), -2, "readonly fast", 1, 1, 1),
+
+	CmdNamePFAdd:   newCommand(new(cmdPFAdd), -2, "write denyoom fast", 1, 1, 1),
+	CmdNamePFCount: newCommand(new(cmdPFCount), -2, "readonly", 1, -1, 1),
+	CmdNamePFMerge: newCommand(new(cmdPFMerge), -2, "write denyoom", 1, -1, 1),
+
+	CmdNameDel:       newCommand(new(cmdDel), -2, "write", 1, -1, 1),
+	CmdNameUnlink:    newCommand(new(cmdUnlink), -2, "write fast", 1, -1, 1),
+	CmdNameExists:    newCommand(new(cmdExists), -2, "readonly fast", 1, -1, 1),
+	CmdNameType:      newCommand(new(cmdType), 2, "readonly fast", 1, 1, 1),
+	CmdNameRename:    newCommand(new(cmdRename), 3, "write", 1, 2, 1),
+	CmdNameRenameNX:  newCommand(new(cmdRenameNX), 3, "write fast", 1, 2, 1),
+	CmdNameCopy:      newCommand(new(cmdCopy), -3, "write denyoom", 1, 2, 1),
+	CmdNameRandomKey: newCommand(new(cmdRandomKey), 1, "readonly", 0, 0, 0),
+	CmdNameTouch:     newCommand(new(cmdTouch), -2, "readonly fast", 1, -1, 1),
+
+	CmdNameExpire:      newCommand(new(cmdExpire), -3, "write fast", 1, 1, 1),
+	CmdNamePExpire:     newCommand(new(cmdPExpire), -3, "write fast", 1, 1, 1),
+	CmdNameExpireAt:    newCommand(new(cmdExpireAt), -3, "write fast", 1, 1, 1),
+	CmdNamePExpireAt:   newCommand(new(cmdPExpireAt), -3, "write fast", 1, 1, 1),
+	CmdNameTTL:         newCommand(new(cmdTTL), 2, "readonly fast", 1, 1, 1),
+	CmdNamePTTL:        newCommand(new(cmdPTTL), 2, "readonly fast", 1, 1, 1),
+	CmdNameExpireTime:  newCommand(new(cmdExpireTime), 2, "readonly fast", 1, 1, 1),
+	CmdNamePExpireTime: newCommand(new(cmdPExpireTime), 2, "readonly fast", 1, 1, 1),
+	CmdNamePersist:     newCommand(new(cmdPersist), 2, "write fast", 1, 1, 1),
+
+	CmdNameMulti:   newCommand(new(cmdMulti), 1, "noscript fast", 0, 0, 0),
+	CmdNameExec:    newCommand(new(cmdExec), 1, "noscript", 0, 0, 0),
+	CmdNameDiscard: newCommand(new(cmdDiscard), 1, "noscript fast", 0, 0, 0),
+	CmdNameWatch:   newCommand(new(cmdWatch), -2, "noscript fast", 1, -1, 1),
+	CmdNameUnwatch: newCommand(new(cmdUnwatch), 1, "noscript fast", 0, 0, 0),
+
+	CmdNameSubscribe:    newCommand(new(cmdSubscribe), -2, "pubsub noscript", 0, 0, 0),
+	CmdNameUnsubscribe:  newCommand(new(cmdUnsubscribe), -1, "pubsub noscript", 0, 0, 0),
+	CmdNamePSubscribe:   newCommand(new(cmdPSubscribe), -2, "pubsub noscript", 0, 0, 0),
+	CmdNamePUnsubscribe: newCommand(new(cmdPUnsubscribe), -1, "pubsub noscript", 0, 0, 0),
+	CmdNamePublish:      newCommand(new(cmdPublish), 3, "pubsub fast", 0, 0, 0),
+	CmdNameSSubscribe:   newCommand(new(cmdSSubscribe), -2, "pubsub noscript", 0, 0, 0),
+	CmdNameSUnsubscribe: newCommand(new(cmdSUnsubscribe), -1, "pubsub noscript", 0, 0, 0),
+	CmdNameSPublish:     newCommand(new(cmdSPublish), 3, "pubsub fast", 0, 0, 0),
+	CmdNamePubsub:       newCommand(new(cmdPubsub), -2, "pubsub", 0, 0, 0),
+
+	CmdNameEval:      newCommand(new(cmdEval), -3, "noscript", 0, 0, 0).withKeyNum(2),
+	CmdNameEvalSha:   newCommand(new(cmdEvalSha), -3, "noscript", 0, 0, 0).withKeyNum(2),
+	CmdNameEvalRO:    newCommand(new(cmdEvalRO), -3, "readonly noscript", 0, 0, 0).withKeyNum(2),
+	CmdNameEvalShaRO: newCommand(new(cmdEvalShaRO), -3, "readonly noscript", 0, 0, 0).withKeyNum(2),
+	CmdNameScript:    newCommand(new(cmdScript), -2, "noscript", 0, 0, 0),
+	CmdNameFunction:  newCommand(new(cmdFunction), -2, "noscript", 0, 0, 0),
+	CmdNameFCall:     newCommand(new(cmdFCall), -3, "noscript", 0, 0, 0).withKeyNum(2),
+	CmdNameFCallRO:   newCommand(new(cmdFCallRO), -3, "readonly noscript", 0, 0, 0).withKeyNum(2),
+
+	CmdNameHSet:         newCommand(new(cmdHSet), -4, "write denyoom fast", 1, 1, 1),
+	CmdNameHMSet:        newCommand(new(cmdHMSet), -4, "write denyoom fast", 1, 1, 1),
+	CmdNameHSetNX:       newCommand(new(cmdHSetNX), 4, "write denyoom fast", 1, 1, 1),
+	CmdNameHGet:         newCommand(new(cmdHGet), 3, "readonly fast", 1, 1, 1),
+	CmdNameHMGet:        newCommand(new(cmdHMGet), -3, "readonly fast", 1, 1, 1),
+	CmdNameHDel:         newCommand(new(cmdHDel), -3, "write fast", 1, 1, 1),
+	CmdNameHExists:      newCommand(new(cmdHExists), 3, "readonly fast", 1, 1, 1),
+	CmdNameHLen:         newCommand(new(cmdHLen), 2, "readonly fast", 1, 1, 1),
+	CmdNameHStrLen:      newCommand(new(cmdHStrLen), 3, "readonly fast", 1, 1, 1),
+	CmdNameHKeys:        newCommand(new(cmdHKeys), 2, "readonly", 1, 1, 1),
+	CmdNameHVals:        newCommand(new(cmdHVals), 2, "readonly", 1, 1, 1),
+	CmdNameHGetAll:      newCommand(new(cmdHGetAll), 2, "readonly", 1, 1, 1),
+	CmdNameHIncrBy:      newCommand(new(cmdHIncrBy), 4, "write denyoom fast", 1, 1, 1),
+	CmdNameHIncrByFloat: newCommand(new(cmdHIncrByFloat), 4, "write denyoom fast", 1, 1, 1),
+	CmdNameHRandField:   newCommand(new(cmdHRandField), -2, "readonly", 1, 1, 1),
+	CmdNameHScan:        newCommand(new(cmdHScan), -3, "readonly", 1, 1, 1),
+
+	CmdNameLPush:      newCommand(new(cmdLPush), -3, "write denyoom fast", 1, 1, 1),
+	CmdNameRPush:      newCommand(new(cmdRPush), -3, "write denyoom fast", 1, 1, 1),
+	CmdNameLPushX:     newCommand(new(cmdLPushX), -3, "write denyoom fast", 1, 1, 1),
+	CmdNameRPushX:     newCommand(new(cmdRPushX), -3, "write denyoom fast", 1, 1, 1),
+	CmdNameLPop:       newCommand(new(cmdLPop), -2, "write fast", 1, 1, 1),
+	CmdNameRPop:       newCommand(new(cmdRPop), -2, "write fast", 1, 1, 1),
+	CmdNameLLen:       newCommand(new(cmdLLen), 2, "readonly fast", 1, 1, 1),
+	CmdNameLIndex:     newCommand(new(cmdLIndex), 3, "readonly", 1, 1, 1),
+	CmdNameLSet:       newCommand(new(cmdLSet), 4, "write denyoom", 1, 1, 1),
+	CmdNameLRange:     newCommand(new(cmdLRange), 4, "readonly", 1, 1, 1),
+	CmdNameLInsert:    newCommand(new(cmdLInsert), 5, "write denyoom", 1, 1, 1),
+	CmdNameLRem:       newCommand(new(cmdLRem), 4, "write", 1, 1, 1),
+	CmdNameLTrim:      newCommand(new(cmdLTrim), 4, "write", 1, 1, 1),
+	CmdNameLPos:       newCommand(new(cmdLPos), -3, "readonly", 1, 1, 1),
+	CmdNameLMove:      newCommand(new(cmdLMove), 5, "write denyoom", 1, 2, 1),
+	CmdNameRPopLPush:  newCommand(new(cmdRPopLPush), 3, "write denyoom", 1, 2, 1),
+	CmdNameLMPop:      newCommand(new(cmdLMPop), -4, "write", 0, 0, 0).withKeyNum(1),
+	CmdNameBLPop:      newCommand(new(cmdBLPop), -3, "write", 1, -2, 1),
+	CmdNameBRPop:      newCommand(new(cmdBRPop), -3, "write", 1, -2, 1),
+	CmdNameBLMove:     newCommand(new(cmdBLMove), 6, "write denyoom", 1, 2, 1),
+	CmdNameBRPopLPush: newCommand(new(cmdBRPopLPush), 4, "write denyoom", 1, 2, 1),
+	CmdNameBLMPop:     newCommand(new(cmdBLMPop), -5, "write", 0, 0, 0).withKeyNum(2),
+
+	CmdNameSAdd:        newCommand(new(cmdSAdd), -3, "write denyoom fast", 1, 1, 1),
+	CmdNameSRem:        newCommand(new(cmdSRem), -3, "write fast", 1, 1, 1),
+	CmdNameSIsMember:   newCommand(new(cmdSIsMember), 3, "readonly fast", 1, 1, 1),
+	CmdNameSMIsMember:  newCommand(new(cmdSMIsMember), -3, "readonly fast", 1, 1, 1),
+	CmdNameSCard:       newCommand(new(cmdSCard), 2, "readonly fast", 1, 1, 1),
+	CmdNameSMembers:    newCommand(new(cmdSMembers), 2, "readonly", 1, 1, 1),
+	CmdNameSPop:        newCommand(new(cmdSPop), -2, "write fast", 1, 1, 1),
+	CmdNameSRandMember: newCommand(new(cmdSRandMember), -2, "readonly", 1, 1, 1),
+	CmdNameSMove:       newCommand(new(cmdSMove), 4, "write fast", 1, 2, 1),
+	CmdNameSInter:      newCommand(new(cmdSInter), -2, "readonly", 1, -1, 1),
+	CmdNameSInterStore: newCommand(new(cmdSInterStore), -3, "write denyoom", 1, -1, 1),
+	CmdNameSInterCard:  newCommand(new(cmdSInterCard), -3, "readonly", 0, 0, 0).withKeyNum(1),
+	CmdNameSUnion:      newCommand(new(cmdSUnion), -2, "readonly", 1, -1, 1),
+	CmdNameSUnionStore: newCommand(new(cmdSUnionStore), -3, "write denyoom", 1, -1, 1),
+	CmdNameSDiff:       newCommand(new(cmdSDiff), -2, "readonly", 1, -1, 1),
+	CmdNameSDiffStore:  newCommand(new(cmdSDiffStore), -3, "write denyoom", 1, -1, 1),
+	CmdNameSScan:       newCommand(new(cmdSScan), -3, "readonly", 1, 1, 1),
+
+	CmdNameZAdd:             newCommand(new(cmdZAdd), -4, "write denyoom fast", 1, 1, 1),
+	CmdNameZIncrBy:          newCommand(new(cmdZIncrBy), 4, "write denyoom fast", 1, 1, 1),
+	CmdNameZRem:             newCommand(new(cmdZRem), -3, "write fast", 1, 1, 1),
+	CmdNameZScore:           newCommand(new(cmdZScore), 3, "readonly fast", 1, 1, 1),
+	CmdNameZMScore:          newCommand(new(cmdZMScore), -3, "readonly fast", 1, 1, 1),
+	CmdNameZCard:            newCommand(new(cmdZCard), 2, "readonly fast", 1, 1, 1),
+	CmdNameZCount:           newCommand(new(cmdZCount), 4, "readonly fast", 1, 1, 1),
+	CmdNameZLexCount:        newCommand(new(cmdZLexCount), 4, "readonly fast", 1, 1, 1),
+	CmdNameZRank:            newCommand(new(cmdZRank), -3, "readonly fast", 1, 1, 1),
+	CmdNameZRevRank:         newCommand(new(cmdZRevRank), -3, "readonly fast", 1, 1, 1),
+	CmdNameZRange:           newCommand(new(cmdZRange), -4, "readonly", 1, 1, 1),
+	CmdNameZRangeStore:      newCommand(new(cmdZRangeStore), -5, "write denyoom", 1, 2, 1),
+	CmdNameZRevRange:        newCommand(new(cmdZRevRange), -4, "readonly", 1, 1, 1),
+	CmdNameZRangeByScore:    newCommand(new(cmdZRangeByScore), -4, "readonly", 1, 1, 1),
+	CmdNameZRevRangeByScore: newCommand(new(cmdZRevRangeByScore), -4, "readonly", 1, 1, 1),
+	CmdNameZRangeByLex:      newCommand(new(cmdZRangeByLex), -4, "readonly", 1, 1, 1),
+	CmdNameZRevRangeByLex:   newCommand(new(cmdZRevRangeByLex), -4, "readonly", 1, 1, 1),
+	CmdNameZPopMin:          newCommand(new(cmdZPopMin), -2, "write fast", 1, 1, 1),
+	CmdNameZPopMax:          newCommand(new(cmdZPopMax), -2, "write fast", 1, 1, 1),
+	CmdNameZRemRangeByRank:  newCommand(new(cmdZRemRangeByRank), 4, "write", 1, 1, 1),
+	CmdNameZRemRangeByScore: newCommand(new(cmdZRemRangeByScore), 4, "write", 1, 1, 1),
+	CmdNameZRemRangeByLex:   newCommand(new(cmdZRemRangeByLex), 4, "write", 1, 1, 1),
+	CmdNameZScan:            newCommand(new(cmdZScan), -3, "readonly", 1, 1, 1),
+
+	CmdNameGeoAdd:         newCommand(new(cmdGeoAdd), -5, "write denyoom", 1, 1, 1),
+	CmdNameGeoPos:         newCommand(new(cmdGeoPos), -2, "readonly", 1, 1, 1),
+	CmdNameGeoDist:        newCommand(new(cmdGeoDist), -4, "readonly", 1, 1, 1),
+	CmdNameGeoHash:        newCommand(new(cmdGeoHash), -2, "readonly", 1, 1, 1),
+	CmdNameGeoSearch:      newCommand(new(cmdGeoSearch), -7, "readonly", 1, 1, 1),
+	CmdNameGeoSearchStore: newCommand(new(cmdGeoSearchStore), -8, "write denyoom", 1, 2, 1),
+
+	CmdNameXAdd:       newCommand(new(cmdXAdd), -5, "write denyoom fast", 1, 1, 1),
+	CmdNameXLen:       newCommand(new(cmdXLen), 2, "readonly fast", 1, 1, 1),
+	CmdNameXRange:     newCommand(new(cmdXRange), -4, "readonly", 1, 1, 1),
+	CmdNameXRevRange:  newCommand(new(cmdXRevRange), -4, "readonly", 1, 1, 1),
+	CmdNameXRead:      newCommand(new(cmdXRead), -4, "readonly", 0, 0, 0).withKeyword("STREAMS"),
+	CmdNameXDel:       newCommand(new(cmdXDel), -3, "write fast", 1, 1, 1),
+	CmdNameXTrim:      newCommand(new(cmdXTrim), -4, "write", 1, 1, 1),
+	CmdNameXSetID:     newCommand(new(cmdXSetID), -3, "write denyoom fast", 1, 1, 1),
+	CmdNameXGroup:     newCommand(new(cmdXGroup), -2, "write", 2, 2, 1),
+	CmdNameXReadGroup: newCommand(new(cmdXReadGroup), -7, "write", 0, 0, 0).withKeyword("STREAMS"),
+	CmdNameXAck:       newCommand(new(cmdXAck), -4, "write fast", 1, 1, 1),
+	CmdNameXPending:   newCommand(new(cmdXPending), -3, "readonly", 1, 1, 1),
+	CmdNameXClaim:     newCommand(new(cmdXClaim), -6, "write fast", 1, 1, 1),
+	CmdNameXAutoClaim: newCommand(new(cmdXAutoClaim), -6, "write fast", 1, 1, 1),
+	CmdNameXInfo:      newCommand(new(cmdXInfo), -2, "readonly", 2, 2, 1),
 }
 
 type unknownCommand struct{}
 type cmdPing struct{}
-type cmdGet struct{}
-type cmdSet struct{}
-type cmdTTL struct{}
-type cmdExpire struct{}
-type cmdExpireAt struct{}
-type cmdPush struct{}
-type cmdPop struct{}
-type cmdRange struct{}
+type cmdHello struct{}
+type cmdBgRewriteAOF struct{}
+type cmdSave struct{}
+type cmdBgSave struct{}
+type cmdLastSave struct{}
+type cmdObject struct{}
+type cmdScan struct{}
+type cmdKeys struct{}
 
 // Command .
 type Command interface {
 	Exec(*Client, *protocol.Request) error
 }
 
-// LoopupCommand .
-func LoopupCommand(name string) Command {
-	name = strings.ToLower(name)
-	cmd, ok := CommandTable[name]
-	if !ok {
-		return new(unknownCommand)
-	}
-	return cmd
+// CommandInfo is an entry of the command table. The arity counts the name
+// of the command, it's the minimum number of arguments when negative. The
+// keys are the arguments from firstKey to lastKey every keyStep, lastKey is
+// counted from the end when negative, except for the movablekeys commands.
+type CommandInfo struct {
+	Command
+
+	name     string
+	arity    int
+	flags    int
+	firstKey int
+	lastKey  int
+	keyStep  int
+
+	// movablekeys: the keys follow their number given at keyNumIndex, or
+	// the keyword and split the arguments left with the IDs
+	keyNumIndex int
+	keyword     string
 }
 
-func (*unknownCommand) Exec(c *Client, r *protocol.Request) error {
-	return c.ReplyError("unknown command")
+var commandFlagNames = []struct {
+	name string
+	flag int
+}{
+	{"write", CmdFlagWrite},
+	{"readonly", CmdFlagReadonly},
+	{"denyoom", CmdFlagDenyOOM},
+	{"admin", CmdFlagAdmin},
+	{"pubsub", CmdFlagPubsub},
+	{"noscript", CmdFlagNoScript},
+	{"fast", CmdFlagFast},
+	{"movablekeys", CmdFlagMovableKeys},
 }
 
-func (*cmdGet) Exec(c *Client, r *protocol.Request) error {
-	v := c.db.Get(r.ArgvAt(1))
-	if v == nil {
-		return c.ReplyEmpty()
-	}
+var unknownCommandInfo = &CommandInfo{Command: new(unknownCommand)}
 
-	if v.ObjType != dt.ObjString {
-		return c.Reply("key holding a wrong kind of value")
+func init() {
+	for name, cmd := range CommandTable {
+		cmd.name = name
 	}
-	return c.Reply(v.Ptr.(string))
 }
 
-// SET key value [EX <seconds>] [nx]
-func (*cmdSet) Exec(c *Client, r *protocol.Request) error {
-	if r.ArgCount() < 3 {
-		return c.ReplyError("wrong number of arguments for 'set' command")
+// newCommand returns the entry of the command table, flags are the names
+// of the flags separated by spaces.
+func newCommand(cmd Command, arity int, flags string, firstKey, lastKey, keyStep int) *CommandInfo {
+	info := &CommandInfo{
+		Command:  cmd,
+		arity:    arity,
+		firstKey: firstKey,
+		lastKey:  lastKey,
+		keyStep:  keyStep,
+	}
+	for _, name := range strings.Fields(flags) {
+		flag := 0
+		for _, f := range commandFlagNames {
+			if f.name == name {
+				flag = f.flag
+			}
+		}
+		if flag == 0 {
+			panic("unknown command flag " + name)
+		}
+		info.flags |= flag
 	}
+	return info
+}
 
-	key, value, expire := r.ArgvAt(1), r.ArgvAt(2), r.ArgvAt(3)
+// withKeyNum sets the index of the number of keys, which are given next.
+func (cmd *CommandInfo) withKeyNum(index int) *CommandInfo {
+	cmd.keyNumIndex = index
+	cmd.flags |= CmdFlagMovableKeys
+	return cmd
+}
 
-	if (r.ArgvAt(3) == FlagSetNX || r.ArgvAt(4) == FlagSetNX) && c.db.Get(key) != nil {
-		return c.ReplyEmpty()
+// withKeyword sets the keyword followed by the keys and as many IDs.
+func (cmd *CommandInfo) withKeyword(keyword string) *CommandInfo {
+	cmd.keyword = keyword
+	cmd.flags |= CmdFlagMovableKeys
+	return cmd
+}
+
+// LoopupCommand .
+func LoopupCommand(name string) *CommandInfo {
+	name = strings.ToLower(name)
+	cmd, ok := CommandTable[name]
+	if !ok {
+		return unknownCommandInfo
 	}
+	return cmd
+}
 
-	obj := dt.NewObj(dt.ObjString, value)
-	c.db.Set(key, obj)
-	godisServer.dirty++
+func (cmd *CommandInfo) checkArity(argc int) bool {
+	if cmd.arity < 0 {
+		return argc >= -cmd.arity
+	}
+	return argc == cmd.arity
+}
 
-	if ex, err := strconv.ParseInt(expire, 10, 64); ex != 0 && err == nil {
-		when := mstime() + ex*1000
-		c.db.setExpire(key, when)
+// getKeys returns the positions of the keys in the arguments, or nil when
+// the movable keys can't be found. The request has the right number of
+// arguments.
+func (cmd *CommandInfo) getKeys(r *protocol.Request) []int {
+	keys := []int{}
+	argc := r.ArgCount()
+	switch {
+	case cmd.keyNumIndex > 0:
+		numkeys, err := strconv.Atoi(r.ArgvAt(cmd.keyNumIndex))
+		if err != nil || numkeys < 0 || numkeys > argc-cmd.keyNumIndex-1 {
+			return nil
+		}
+		for i := 1; i <= numkeys; i++ {
+			keys = append(keys, cmd.keyNumIndex+i)
+		}
+	case cmd.keyword != "":
+		start := 0
+		for i := 1; i < argc; i++ {
+			if strings.EqualFold(r.ArgvAt(i), cmd.keyword) {
+				start = i + 1
+				break
+			}
+		}
+		if start == 0 || (argc-start)%2 != 0 {
+			return nil
+		}
+		for i := start; i < start+(argc-start)/2; i++ {
+			keys = append(keys, i)
+		}
+	case cmd.firstKey > 0:
+		last := cmd.lastKey
+		if last < 0 {
+			last += argc
+		}
+		for i := cmd.firstKey; i <= last && i < argc; i += cmd.keyStep {
+			keys = append(keys, i)
+		}
 	}
+	return keys
+}
 
-	return c.Reply("OK")
+// commandRejected returns the error of a request which can't be executed
+// or queued in a transaction.
+func commandRejected(cmd *CommandInfo, r *protocol.Request) string {
+	if cmd == unknownCommandInfo {
+		return "unknown command"
+	}
+	if !cmd.checkArity(r.ArgCount()) {
+		return "wrong number of arguments for '" + cmd.name + "' command"
+	}
+	if cmd.flags&CmdFlagDenyOOM != 0 && maxMemoryToFree() > 0 {
+		return ReplyOOM
+	}
+	return functionDenyCall(r)
 }
 
-func (*cmdTTL) Exec(c *Client, r *protocol.Request) error {
-	key := r.ArgvAt(1)
-	return c.ReplyInt(c.db.ttl(key))
+func (*unknownCommand) Exec(c *Client, r *protocol.Request) error {
+	return c.ReplyError("unknown command")
 }
 
 func (*cmdPing) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() > 2 {
+		return c.ReplyError("wrong number of arguments for 'ping' command")
+	}
+	// a subscriber can't tell a simple string from a message in RESP2, so
+	// the reply is in the format of the pushed messages
+	if c.isSubscriber() && c.protocol() == protocol.RESP2 {
+		message := ""
+		if r.ArgCount() == 2 {
+			message = r.ArgvAt(1)
+		}
+		return c.ReplyBulk("pong", message)
+	}
+	if r.ArgCount() == 2 {
+		return c.ReplyBulkString(r.ArgvAt(1))
+	}
 	return c.Reply("PONG")
 }
 
-func (*cmdExpire) Exec(c *Client, r *protocol.Request) error {
-	if r.ArgCount() != 3 {
-		return c.ReplyError("wrong number of arguments for 'expire' command")
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (*cmdHello) Exec(c *Client, r *protocol.Request) error {
+	proto := c.protocol()
+	if r.ArgCount() >= 2 {
+		ver, err := strconv.ParseInt(r.ArgvAt(1), 10, 64)
+		if err != nil {
+			return c.ReplyError("Protocol version is not an integer or out of range")
+		}
+		if ver != protocol.RESP2 && ver != protocol.RESP3 {
+			return c.ReplyError("NOPROTO unsupported protocol version")
+		}
+		proto = int(ver)
 	}
 
-	key, expire := r.ArgvAt(1), r.ArgvAt(2)
-	if c.db.Get(key) == nil {
-		return c.ReplyInt(0)
+	var name string
+	for i := 2; i < r.ArgCount(); i++ {
+		moreargs := r.ArgCount() - i - 1
+		switch opt := strings.ToLower(r.ArgvAt(i)); {
+		case opt == "auth" && moreargs >= 2:
+			// there are no passwords, any credentials authenticate the
+			// default user
+			i += 2
+		case opt == "setname" && moreargs >= 1:
+			name = r.ArgvAt(i + 1)
+			if strings.ContainsAny(name, " \n") {
+				return c.ReplyError("Client names cannot contain spaces, newlines or special characters.")
+			}
+			i++
+		default:
+			return c.ReplyError("Syntax error in HELLO option '" + r.ArgvAt(i) + "'")
+		}
 	}
 
-	ex, err := strconv.ParseInt(expire, 10, 64)
-	if err != nil {
-		return c.Reply("wrong type of expire argument")
+	if name != "" {
+		c.name = name
 	}
-	when := ex*1000 + mstime()
-	if when < mstime() {
-		c.db.deleteKey(key)
-	} else {
-		c.db.setExpire(key, when)
-	}
-	godisServer.dirty++
-	return c.ReplyInt(1)
+	c.writer.SetProtocol(proto)
+
+	c.ReplyMapLen(7)
+	c.ReplyBulkString("server")
+	c.ReplyBulkString("godis")
+	c.ReplyBulkString("version")
+	c.ReplyBulkString(GodisVersion)
+	c.ReplyBulkString("proto")
+	c.ReplyInt(int64(proto))
+	c.ReplyBulkString("id")
+	c.ReplyInt(c.id)
+	c.ReplyBulkString("mode")
+	c.ReplyBulkString("standalone")
+	c.ReplyBulkString("role")
+	c.ReplyBulkString("master")
+	c.ReplyBulkString("modules")
+	return c.ReplyArrayLen(0)
 }
 
-func (*cmdExpireAt) Exec(c *Client, r *protocol.Request) error {
-	if r.ArgCount() != 3 {
-		return c.ReplyError("wrong number of arguments for 'expireat' command")
+func (*cmdBgRewriteAOF) Exec(c *Client, r *protocol.Request) error {
+	if err := rewriteAppendOnlyFileBackground(); err != nil {
+		return c.ReplyError(err.Error())
 	}
+	return c.Reply("Background append only file rewriting started")
+}
 
-	key, ms := r.ArgvAt(1), r.ArgvAt(2)
-	if c.db.Get(key) == nil {
-		return c.ReplyInt(0)
+func (*cmdSave) Exec(c *Client, r *protocol.Request) error {
+	if godisServer.rdbSaveInProgress() {
+		return c.ReplyError(errRDBSaveInProgress.Error())
 	}
 
-	when, err := strconv.ParseInt(ms, 10, 64)
-	if err != nil {
-		return c.Reply("wrong type of expireat argument")
+	if err := rdbSave(RDBFileName, godisServer.snapshot(), godisServer.functionsSnapshot()); err != nil {
+		log.Printf("failed saving the DB: %v", err)
+		return c.ReplyError("failed saving the DB")
 	}
+	godisServer.dirty = 0
+	godisServer.lastsave = time.Now().Unix()
+	return c.Reply("OK")
+}
 
-	if when < mstime() {
-		c.db.deleteKey(key)
-	} else {
-		c.db.setExpire(key, when)
+func (*cmdBgSave) Exec(c *Client, r *protocol.Request) error {
+	if err := rdbSaveBackground(); err != nil {
+		return c.ReplyError(err.Error())
 	}
-	godisServer.dirty++
-	return c.ReplyInt(1)
+	return c.Reply("Background saving started")
 }
 
-func (*cmdPush) Exec(c *Client, r *protocol.Request) error {
-	if r.ArgCount() < 3 {
-		return c.ReplyError("wrong number of arguments for 'push' command")
-	}
+func (*cmdLastSave) Exec(c *Client, r *protocol.Request) error {
+	return c.ReplyInt(godisServer.lastsave)
+}
 
-	key := r.ArgvAt(1)
-	obj := c.db.Get(key)
-	if obj != nil && obj.ObjType != dt.ObjList {
-		return c.ReplyError("key holding a wrong kind of value")
+// strEncoding returns the name of the encoding reported by OBJECT ENCODING.
+func strEncoding(encoding uint8) string {
+	switch encoding {
+	case dt.ObjEncodingRaw:
+		return "raw"
+	case dt.ObjEncodingInt:
+		return "int"
+	case dt.ObjEncodingEmbstr:
+		return "embstr"
+	case dt.ObjEncodingHt:
+		return "hashtable"
+	case dt.ObjEncodingQuicklist:
+		return "quicklist"
+	case dt.ObjEncodingSkiplist:
+		return "skiplist"
+	case dt.ObjEncodingZiplist:
+		return "ziplist"
+	case dt.ObjEncodingIntset:
+		return "intset"
+	case dt.ObjEncodingStream:
+		return "stream"
 	}
+	return "unknown"
+}
 
-	list := []string{}
-	if obj != nil {
-		list = obj.Ptr.([]string)
+// typeName returns the name of the type of the object, as reported by TYPE.
+func typeName(o *dt.Object) string {
+	switch o.ObjType {
+	case dt.ObjString:
+		return "string"
+	case dt.ObjList:
+		return "list"
+	case dt.ObjSet:
+		return "set"
+	case dt.ObjZSet:
+		return "zset"
+	case dt.ObjHash:
+		return "hash"
+	case dt.ObjStream:
+		return "stream"
 	}
+	return "unknown"
+}
 
-	var pushed int64
-	for i := 2; i < r.ArgCount(); i++ {
-		list = append(list, r.ArgvAt(i))
-		pushed++
+func isTypeName(name string) bool {
+	switch name {
+	case "string", "list", "set", "zset", "hash", "stream":
+		return true
 	}
-
-	obj = dt.NewList(dt.ObjList, list)
-	c.db.Add(key, obj)
-	godisServer.dirty += pushed
-	return c.ReplyInt(pushed)
+	return false
 }
 
-func (*cmdRange) Exec(c *Client, r *protocol.Request) error {
-	start, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
-	if err != nil {
-		return c.ReplyError("value is not an illegal integer")
-	}
-	end, err := strconv.ParseInt(r.ArgvAt(3), 10, 64)
-	if err != nil {
-		return c.ReplyError("value is not an illegal integer")
+// OBJECT ENCODING key
+func (*cmdObject) Exec(c *Client, r *protocol.Request) error {
+	switch strings.ToLower(r.ArgvAt(1)) {
+	case "encoding":
+		if r.ArgCount() != 3 {
+			return c.ReplyError("wrong number of arguments for 'object|encoding' command")
+		}
+		o := c.db.lookupKey(r.ArgvAt(2), false)
+		if o == nil {
+			return c.ReplyEmpty()
+		}
+		return c.ReplyBulkString(strEncoding(o.Encoding))
+	default:
+		return c.ReplyError("unknown subcommand '" + r.ArgvAt(1) + "'. Try OBJECT HELP.")
 	}
+}
 
-	var ret []string
+func parseScanCursor(s string) (uint64, error) {
+	return strconv.ParseUint(s, 10, 64)
+}
 
-	key := r.ArgvAt(1)
-	old := c.db.Get(key)
-	if old == nil {
-		return c.ReplyList(ret)
-	}
-	if old.ObjType != dt.ObjList {
-		return c.ReplyError("key holding a wrong kind of value")
+// scanDict scans d from cursor until about count entries are found, and
+// returns the cursor of the next call. The dict may be sparse, so the number
+// of visited buckets is limited too, to avoid blocking for too long.
+func scanDict(d *dt.Dict, cursor uint64, count int64, fn func(de *dt.Entry)) uint64 {
+	maxiterations := count * 10
+	var found int64
+	for {
+		cursor = d.Scan(cursor, func(de *dt.Entry) {
+			fn(de)
+			found++
+		})
+		maxiterations--
+		if cursor == 0 || maxiterations <= 0 || found >= count {
+			return cursor
+		}
 	}
+}
 
-	list := old.Ptr.([]string)
-	length := int64(len(list))
-	if start < 0 {
-		start = length + start
-		if start < 0 {
-			start = 0
+// scanGenericCommand implements the SCAN family of commands on the
+// collection o, or on the keyspace of the client's DB if o is nil. The
+// options are parsed starting from the i-th argument.
+func scanGenericCommand(c *Client, r *protocol.Request, o *dt.Object, cursor uint64, i int) error {
+	count := int64(10)
+	pattern := ""
+	typ := ""
+	novalues := false
+
+	for ; i < r.ArgCount(); i++ {
+		opt := strings.ToLower(r.ArgvAt(i))
+		more := i+1 < r.ArgCount()
+		switch {
+		case opt == "count" && more:
+			n, err := strconv.ParseInt(r.ArgvAt(i+1), 10, 64)
+			if err != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			if n < 1 {
+				return c.ReplyError(ReplySyntaxErr)
+			}
+			count = n
+			i++
+		case opt == "match" && more:
+			pattern = r.ArgvAt(i + 1)
+			i++
+		case opt == "type" && more && o == nil:
+			typ = strings.ToLower(r.ArgvAt(i + 1))
+			if !isTypeName(typ) {
+				return c.ReplyError("unknown type name '" + r.ArgvAt(i+1) + "'")
+			}
+			i++
+		case opt == "novalues" && o != nil && o.ObjType == dt.ObjHash:
+			novalues = true
+		default:
+			return c.ReplyError(ReplySyntaxErr)
 		}
 	}
-	if end < 0 {
-		end = length + end
-	}
 
-	if start > end || start >= length {
-		return c.ReplyList(ret)
-	}
-	if end >= length {
-		end = length - 1
+	// hashes return field, value pairs and sorted sets member, score pairs
+	step := 1
+	if o != nil && (o.ObjType == dt.ObjHash || o.ObjType == dt.ObjZSet) {
+		step = 2
 	}
 
-	for i := start; i <= end; i++ {
-		ret = append(ret, list[i])
-	}
-	return c.ReplyList(ret)
-}
-
-func (s *cmdPop) Exec(c *Client, r *protocol.Request) error {
-	if r.ArgCount() != 2 {
-		return c.ReplyError("wrong number of arguments for 'pop' command")
+	var items []string
+	if o == nil {
+		cursor = scanDict(c.db.store, cursor, count, func(de *dt.Entry) {
+			items = append(items, de.Key)
+		})
+	} else if o.ObjType == dt.ObjZSet {
+		cursor = scanDict(o.Ptr.(*dt.SortedSet).Dict(), cursor, count, func(de *dt.Entry) {
+			items = append(items, de.Key, formatScore(de.Value.(float64)))
+		})
+	} else if o.Encoding == dt.ObjEncodingHt {
+		cursor = scanDict(o.Ptr.(*dt.Dict), cursor, count, func(de *dt.Entry) {
+			items = append(items, de.Key)
+			if step == 2 {
+				items = append(items, de.Value.(string))
+			}
+		})
+	} else {
+		// the compact encodings are small, return everything at once.
+		if o.ObjType == dt.ObjSet {
+			items = setTypeMembers(o)
+		} else {
+			hashTypeIterate(o, func(field, value string) bool {
+				items = append(items, field, value)
+				return true
+			})
+		}
+		cursor = 0
 	}
 
-	key := r.ArgvAt(1)
-	obj := c.db.Get(key)
-	if obj == nil {
-		return c.ReplyEmpty()
+	reply := []string{}
+	for j := 0; j < len(items); j += step {
+		if pattern != "" && !stringMatch(pattern, items[j], false) {
+			continue
+		}
+		if o == nil {
+			// skip the keys which are expired, or of another type
+			ko := c.db.lookupKey(items[j], false)
+			if ko == nil || (typ != "" && typeName(ko) != typ) {
+				continue
+			}
+		}
+		reply = append(reply, items[j])
+		if step == 2 && !novalues {
+			reply = append(reply, items[j+1])
+		}
 	}
+	return c.ReplyBulk(strconv.FormatUint(cursor, 10), reply)
+}
 
-	list, ok := obj.Ptr.([]string)
-	if len(list) == 0 || !ok {
-		return c.ReplyEmpty()
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (*cmdScan) Exec(c *Client, r *protocol.Request) error {
+	cursor, err := parseScanCursor(r.ArgvAt(1))
+	if err != nil {
+		return c.ReplyError("invalid cursor")
 	}
+	return scanGenericCommand(c, r, nil, cursor, 2)
+}
 
-	v, list := list[len(list)-1], list[:len(list)-1]
-	c.db.Add(key, dt.NewList(dt.ObjList, list))
-	godisServer.dirty++
-	return c.Reply(v)
+// KEYS pattern
+func (*cmdKeys) Exec(c *Client, r *protocol.Request) error {
+	pattern := r.ArgvAt(1)
+	all := pattern == "*"
+	keys := []string{}
+	c.db.store.Iterate(func(de *dt.Entry) bool {
+		if (all || stringMatch(pattern, de.Key, false)) && !c.db.keyIsExpired(de.Key) {
+			keys = append(keys, de.Key)
+		}
+		return true
+	})
+	return c.ReplyList(keys)
 }
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdConfig struct{}
+
+// configParam is a server parameter which can be read and changed at
+// runtime with CONFIG GET and CONFIG SET.
+type configParam struct {
+	name string
+	get  func(s *Server) string
+	set  func(s *Server, v string) error
+}
+
+var errConfigNotInteger = errors.New("argument couldn't be parsed into an integer")
+
+// intConfig returns a config parameter bound to an int field of the server,
+// the accepted values are between min and max.
+func intConfig(name string, field func(s *Server) *int, min, max int) configParam {
+	return configParam{
+		name: name,
+		get: func(s *Server) string {
+			return strconv.Itoa(*field(s))
+		},
+		set: func(s *Server, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return errConfigNotInteger
+			}
+			if n < min || n > max {
+				return errors.New("argument must be between " + strconv.Itoa(min) + " and " + strconv.Itoa(max) + " inclusive")
+			}
+			*field(s) = n
+			return nil
+		},
+	}
+}
+
+// protoLimitConfig returns a config parameter bound to a limit of the
+// requests, which is read by the parsers of the clients.
+func protoLimitConfig(name string, get func(l *protocol.Limits) int64, set func(l *protocol.Limits, n int64), min, max int64) configParam {
+	return configParam{
+		name: name,
+		get: func(s *Server) string {
+			return strconv.FormatInt(get(s.protoLimits), 10)
+		},
+		set: func(s *Server, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return errConfigNotInteger
+			}
+			if n < min || n > max {
+				return errors.New("argument must be between " + strconv.FormatInt(min, 10) + " and " + strconv.FormatInt(max, 10) + " inclusive")
+			}
+			set(s.protoLimits, n)
+			return nil
+		},
+	}
+}
+
+const maxIntConfig = 1<<31 - 1
+
+var configTable = []configParam{
+	intConfig("hash-max-ziplist-entries", func(s *Server) *int { return &s.hashMaxZiplistEntries }, 0, maxIntConfig),
+	intConfig("hash-max-ziplist-value", func(s *Server) *int { return &s.hashMaxZiplistValue }, 0, maxIntConfig),
+	intConfig("list-max-ziplist-size", func(s *Server) *int { return &s.listMaxZiplistSize }, -5, maxIntConfig),
+	intConfig("set-max-intset-entries", func(s *Server) *int { return &s.setMaxIntsetEntries }, 0, maxIntConfig),
+	intConfig("hll-sparse-max-bytes", func(s *Server) *int { return &s.hllSparseMaxBytes }, 0, maxIntConfig),
+	intConfig("stream-node-max-bytes", func(s *Server) *int { return &s.streamNodeMaxBytes }, 0, maxIntConfig),
+	intConfig("stream-node-max-entries", func(s *Server) *int { return &s.streamNodeMaxEntries }, 0, maxIntConfig),
+	intConfig("lua-time-limit", func(s *Server) *int { return &s.luaTimeLimit }, 0, maxIntConfig),
+	protoLimitConfig("proto-max-bulk-len", (*protocol.Limits).MaxBulkLen, (*protocol.Limits).SetMaxBulkLen, 1024*1024, math.MaxInt64),
+	protoLimitConfig("proto-max-multibulk-len", (*protocol.Limits).MaxMultibulkLen, (*protocol.Limits).SetMaxMultibulkLen, 1, maxIntConfig),
+	{
+		name: "notify-keyspace-events",
+		get: func(s *Server) string {
+			return keyspaceEventsFlagsToString(s.notifyKeyspaceEvents)
+		},
+		set: func(s *Server, v string) error {
+			flags, err := keyspaceEventsStringToFlags(v)
+			if err != nil {
+				return err
+			}
+			s.notifyKeyspaceEvents = flags
+			return nil
+		},
+	},
+}
+
+func lookupConfig(name string) *configParam {
+	for i := range configTable {
+		if configTable[i].name == name {
+			return &configTable[i]
+		}
+	}
+	return nil
+}
+
+// CONFIG GET parameter [parameter ...]
+// CONFIG SET parameter value [parameter value ...]
+func (*cmdConfig) Exec(c *Client, r *protocol.Request) error {
+	switch sub := strings.ToLower(r.ArgvAt(1)); sub {
+	case "get":
+		if r.ArgCount() < 3 {
+			return c.ReplyError("wrong number of arguments for 'config|get' command")
+		}
+		return configGetCommand(c, r)
+	case "set":
+		if r.ArgCount() < 4 || r.ArgCount()%2 != 0 {
+			return c.ReplyError("wrong number of arguments for 'config|set' command")
+		}
+		return configSetCommand(c, r)
+	default:
+		return c.ReplyError("unknown subcommand '" + r.ArgvAt(1) + "'. Try CONFIG HELP.")
+	}
+}
+
+func configGetCommand(c *Client, r *protocol.Request) error {
+	list := []string{}
+	matched := make(map[string]bool)
+	for i := 2; i < r.ArgCount(); i++ {
+		pattern := strings.ToLower(r.ArgvAt(i))
+		for _, param := range configTable {
+			if !matched[param.name] && stringMatch(pattern, param.name, true) {
+				matched[param.name] = true
+				list = append(list, param.name, param.get(godisServer))
+			}
+		}
+	}
+	return c.ReplyMap(list)
+}
+
+func configSetCommand(c *Client, r *protocol.Request) error {
+	// validate every parameter before applying any of them, so that the
+	// command either fully succeeds or leaves the config untouched.
+	params := make([]*configParam, 0, (r.ArgCount()-2)/2)
+	for i := 2; i < r.ArgCount(); i += 2 {
+		name := strings.ToLower(r.ArgvAt(i))
+		param := lookupConfig(name)
+		if param == nil {
+			return c.ReplyError("Unknown option or number of arguments for CONFIG SET - '" + r.ArgvAt(i) + "'")
+		}
+		for _, p := range params {
+			if p == param {
+				return c.ReplyError("duplicate parameter - '" + r.ArgvAt(i) + "'")
+			}
+		}
+		params = append(params, param)
+	}
+
+	olds := make([]string, len(params))
+	for i, param := range params {
+		olds[i] = param.get(godisServer)
+		if err := param.set(godisServer, r.ArgvAt(2+i*2+1)); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				params[j].set(godisServer, olds[j])
+			}
+			return c.ReplyError("CONFIG SET failed (possibly related to argument '" + r.ArgvAt(2+i*2) + "') - " + err.Error())
+		}
+	}
+	return c.Reply("OK")
+}
@@ -2,14 +2,36 @@ package server
 
 // server
 const (
+	GodisVersion       = "1.0.0"
 	MaxIOEventsPerLoop = 10
 	AOFFileName        = "godis.aof"
+	DefaultDBNum       = 16
 )
 
 // db
 const (
 	ActiveExpireCycleLookupsPerLoop = 20
 	MaxCycleTimeLimitUSPerLoop      = 25000 // us
+	SnapshotKeysPerLoop             = 1000
+)
+
+// keyspace notification classes
+const (
+	NotifyKeyspace = 1 << iota // K
+	NotifyKeyevent             // E
+	NotifyGeneric              // g
+	NotifyString               // $
+	NotifyList                 // l
+	NotifySet                  // s
+	NotifyHash                 // h
+	NotifyZset                 // z
+	NotifyExpired              // x
+	NotifyEvicted              // e
+	NotifyStream               // t
+	NotifyNew                  // n, not included in A
+
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash |
+		NotifyZset | NotifyExpired | NotifyEvicted | NotifyStream // A
 )
 
 // maxmemory strategies
@@ -26,26 +48,314 @@ const (
 	EvPoolSize = 15
 )
 
+// command flags
+const (
+	CmdFlagWrite = 1 << iota
+	CmdFlagReadonly
+	CmdFlagDenyOOM
+	CmdFlagAdmin
+	CmdFlagPubsub
+	CmdFlagNoScript
+	CmdFlagFast
+	CmdFlagMovableKeys
+)
+
 // command
 const (
-	CmdNameSet      = "set"
-	CmdNameGet      = "get"
-	CmdNamePing     = "ping"
-	CmdNameTTL      = "ttl"
-	CmdNameExpire   = "expire"
-	CmdNameExpireAt = "expireat"
-	CmdNamePush     = "push"
-	CmdNamePop      = "pop"
-	CmdNameRange    = "range"
-	// CmdNameZadd     = "zset"
+	CmdNamePing  = "ping"
+	CmdNameHello = "hello"
+
+	CmdNameBgRewriteAOF = "bgrewriteaof"
+	CmdNameSave         = "save"
+	CmdNameBgSave       = "bgsave"
+	CmdNameLastSave     = "lastsave"
+	CmdNameObject       = "object"
+	CmdNameConfig       = "config"
+	CmdNameCommand      = "command"
+
+	CmdNameSelect   = "select"
+	CmdNameMove     = "move"
+	CmdNameSwapDB   = "swapdb"
+	CmdNameFlushDB  = "flushdb"
+	CmdNameFlushAll = "flushall"
+	CmdNameDBSize   = "dbsize"
+	CmdNameScan     = "scan"
+	CmdNameKeys     = "keys"
+
+	CmdNameGet    = "get"
+	CmdNameSet    = "set"
+	CmdNameSetEX  = "setex"
+	CmdNamePSetEX = "psetex"
+	CmdNameSetNX  = "setnx"
+	CmdNameGetSet = "getset"
+	CmdNameGetDel = "getdel"
+	CmdNameGetEx  = "getex"
+
+	CmdNameIncr        = "incr"
+	CmdNameDecr        = "decr"
+	CmdNameIncrBy      = "incrby"
+	CmdNameDecrBy      = "decrby"
+	CmdNameIncrByFloat = "incrbyfloat"
+
+	CmdNameMGet     = "mget"
+	CmdNameMSet     = "mset"
+	CmdNameMSetNX   = "msetnx"
+	CmdNameAppend   = "append"
+	CmdNameStrLen   = "strlen"
+	CmdNameGetRange = "getrange"
+	CmdNameSetRange = "setrange"
+	CmdNameLCS      = "lcs"
+
+	CmdNameSetBit     = "setbit"
+	CmdNameGetBit     = "getbit"
+	CmdNameBitCount   = "bitcount"
+	CmdNameBitPos     = "bitpos"
+	CmdNameBitOp      = "bitop"
+	CmdNameBitField   = "bitfield"
+	CmdNameBitFieldRO = "bitfield_ro"
+
+	CmdNamePFAdd   = "pfadd"
+	CmdNamePFCount = "pfcount"
+	CmdNamePFMerge = "pfmerge"
+
+	HLLSparseMaxBytes = 3000
 
-	FlagSetNX = "nx"
+	StringMaxSize = 512 * 1024 * 1024
+
+	CmdNameDel       = "del"
+	CmdNameUnlink    = "unlink"
+	CmdNameExists    = "exists"
+	CmdNameType      = "type"
+	CmdNameRename    = "rename"
+	CmdNameRenameNX  = "renamenx"
+	CmdNameCopy      = "copy"
+	CmdNameRandomKey = "randomkey"
+	CmdNameTouch     = "touch"
+
+	CmdNameExpire      = "expire"
+	CmdNamePExpire     = "pexpire"
+	CmdNameExpireAt    = "expireat"
+	CmdNamePExpireAt   = "pexpireat"
+	CmdNameTTL         = "ttl"
+	CmdNamePTTL        = "pttl"
+	CmdNameExpireTime  = "expiretime"
+	CmdNamePExpireTime = "pexpiretime"
+	CmdNamePersist     = "persist"
+
+	CmdNameMulti   = "multi"
+	CmdNameExec    = "exec"
+	CmdNameDiscard = "discard"
+	CmdNameWatch   = "watch"
+	CmdNameUnwatch = "unwatch"
+)
+
+// pubsub commands
+const (
+	CmdNameSubscribe    = "subscribe"
+	CmdNameUnsubscribe  = "unsubscribe"
+	CmdNamePSubscribe   = "psubscribe"
+	CmdNamePUnsubscribe = "punsubscribe"
+	CmdNamePublish      = "publish"
+	CmdNameSSubscribe   = "ssubscribe"
+	CmdNameSUnsubscribe = "sunsubscribe"
+	CmdNameSPublish     = "spublish"
+	CmdNamePubsub       = "pubsub"
+
+	ClientOutputBufferLimitPubsub = 32 * 1024 * 1024
+)
+
+// scripting commands
+const (
+	CmdNameEval      = "eval"
+	CmdNameEvalSha   = "evalsha"
+	CmdNameEvalRO    = "eval_ro"
+	CmdNameEvalShaRO = "evalsha_ro"
+	CmdNameScript    = "script"
+	CmdNameFunction  = "function"
+	CmdNameFCall     = "fcall"
+	CmdNameFCallRO   = "fcall_ro"
+
+	LuaTimeLimit        = 5000 // ms
+	FunctionLoadTimeout = 500  // ms
+)
+
+// hash commands
+const (
+	CmdNameHSet         = "hset"
+	CmdNameHMSet        = "hmset"
+	CmdNameHSetNX       = "hsetnx"
+	CmdNameHGet         = "hget"
+	CmdNameHMGet        = "hmget"
+	CmdNameHDel         = "hdel"
+	CmdNameHExists      = "hexists"
+	CmdNameHLen         = "hlen"
+	CmdNameHStrLen      = "hstrlen"
+	CmdNameHKeys        = "hkeys"
+	CmdNameHVals        = "hvals"
+	CmdNameHGetAll      = "hgetall"
+	CmdNameHIncrBy      = "hincrby"
+	CmdNameHIncrByFloat = "hincrbyfloat"
+	CmdNameHRandField   = "hrandfield"
+	CmdNameHScan        = "hscan"
+
+	HashMaxZiplistEntries = 128
+	HashMaxZiplistValue   = 64
+)
+
+// list commands
+const (
+	CmdNameLPush      = "lpush"
+	CmdNameRPush      = "rpush"
+	CmdNameLPushX     = "lpushx"
+	CmdNameRPushX     = "rpushx"
+	CmdNameLPop       = "lpop"
+	CmdNameRPop       = "rpop"
+	CmdNameLLen       = "llen"
+	CmdNameLIndex     = "lindex"
+	CmdNameLSet       = "lset"
+	CmdNameLRange     = "lrange"
+	CmdNameLInsert    = "linsert"
+	CmdNameLRem       = "lrem"
+	CmdNameLTrim      = "ltrim"
+	CmdNameLPos       = "lpos"
+	CmdNameLMove      = "lmove"
+	CmdNameRPopLPush  = "rpoplpush"
+	CmdNameLMPop      = "lmpop"
+	CmdNameBLPop      = "blpop"
+	CmdNameBRPop      = "brpop"
+	CmdNameBLMove     = "blmove"
+	CmdNameBRPopLPush = "brpoplpush"
+	CmdNameBLMPop     = "blmpop"
+
+	ListMaxZiplistSize = -2
+)
+
+// set commands
+const (
+	CmdNameSAdd        = "sadd"
+	CmdNameSRem        = "srem"
+	CmdNameSIsMember   = "sismember"
+	CmdNameSMIsMember  = "smismember"
+	CmdNameSCard       = "scard"
+	CmdNameSMembers    = "smembers"
+	CmdNameSPop        = "spop"
+	CmdNameSRandMember = "srandmember"
+	CmdNameSMove       = "smove"
+	CmdNameSInter      = "sinter"
+	CmdNameSInterStore = "sinterstore"
+	CmdNameSInterCard  = "sintercard"
+	CmdNameSUnion      = "sunion"
+	CmdNameSUnionStore = "sunionstore"
+	CmdNameSDiff       = "sdiff"
+	CmdNameSDiffStore  = "sdiffstore"
+	CmdNameSScan       = "sscan"
+
+	SetMaxIntsetEntries = 512
+)
+
+// sorted set commands
+const (
+	CmdNameZAdd             = "zadd"
+	CmdNameZIncrBy          = "zincrby"
+	CmdNameZRem             = "zrem"
+	CmdNameZScore           = "zscore"
+	CmdNameZMScore          = "zmscore"
+	CmdNameZCard            = "zcard"
+	CmdNameZCount           = "zcount"
+	CmdNameZLexCount        = "zlexcount"
+	CmdNameZRank            = "zrank"
+	CmdNameZRevRank         = "zrevrank"
+	CmdNameZRange           = "zrange"
+	CmdNameZRangeStore      = "zrangestore"
+	CmdNameZRevRange        = "zrevrange"
+	CmdNameZRangeByScore    = "zrangebyscore"
+	CmdNameZRevRangeByScore = "zrevrangebyscore"
+	CmdNameZRangeByLex      = "zrangebylex"
+	CmdNameZRevRangeByLex   = "zrevrangebylex"
+	CmdNameZPopMin          = "zpopmin"
+	CmdNameZPopMax          = "zpopmax"
+	CmdNameZRemRangeByRank  = "zremrangebyrank"
+	CmdNameZRemRangeByScore = "zremrangebyscore"
+	CmdNameZRemRangeByLex   = "zremrangebylex"
+	CmdNameZScan            = "zscan"
+)
+
+// geo commands
+const (
+	CmdNameGeoAdd         = "geoadd"
+	CmdNameGeoPos         = "geopos"
+	CmdNameGeoDist        = "geodist"
+	CmdNameGeoHash        = "geohash"
+	CmdNameGeoSearch      = "geosearch"
+	CmdNameGeoSearchStore = "geosearchstore"
+)
+
+// stream commands
+const (
+	CmdNameXAdd       = "xadd"
+	CmdNameXLen       = "xlen"
+	CmdNameXRange     = "xrange"
+	CmdNameXRevRange  = "xrevrange"
+	CmdNameXRead      = "xread"
+	CmdNameXDel       = "xdel"
+	CmdNameXTrim      = "xtrim"
+	CmdNameXSetID     = "xsetid"
+	CmdNameXGroup     = "xgroup"
+	CmdNameXReadGroup = "xreadgroup"
+	CmdNameXAck       = "xack"
+	CmdNameXPending   = "xpending"
+	CmdNameXClaim     = "xclaim"
+	CmdNameXAutoClaim = "xautoclaim"
+	CmdNameXInfo      = "xinfo"
+
+	StreamNodeMaxBytes   = 4096
+	StreamNodeMaxEntries = 100
+)
+
+// error replies
+const (
+	ReplyWrongType  = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	ReplySyntaxErr  = "syntax error"
+	ReplyNotInteger = "value is not an integer or out of range"
+	ReplyNotFloat   = "value is not a valid float"
+	ReplyOverflow   = "increment or decrement would overflow"
+	ReplyOOM        = "OOM command not allowed when used memory > 'maxmemory'."
 )
 
 // aof
 const (
-	AOFRewriteMinSize = 64 * 1024 * 1024
+	AOFRewriteMinSize      = 64 * 1024 * 1024
+	AOFRewritePerc         = 100
+	AOFRewriteItemsPerCmd  = 16
+	AOFRewriteTempFileName = "temp-rewriteaof-bg-%d.aof"
 
 	AOFFsyncEverysec = 1
 	AOFFsyncAlways   = 2
 )
+
+// rdb
+const (
+	RDBFileName     = "dump.rdb"
+	RDBTempFileName = "temp-%d.rdb"
+	RDBVersion      = 1
+
+	RDB6BitLen  = 0
+	RDB14BitLen = 1
+	RDB32BitLen = 0x80
+	RDB64BitLen = 0x81
+
+	RDBTypeString        = 0
+	RDBTypeList          = 1
+	RDBTypeSet           = 2
+	RDBTypeHash          = 4
+	RDBTypeZSet          = 5
+	RDBTypeSetIntset     = 11
+	RDBTypeHashZiplist   = 13
+	RDBTypeListQuicklist = 14
+	RDBTypeStream        = 15
+
+	RDBOpcodeFunction     = 0xf5
+	RDBOpcodeExpireTimeMs = 0xfc
+	RDBOpcodeSelectDB     = 0xfe
+	RDBOpcodeEOF          = 0xff
+)
@@ -2,14 +2,46 @@ package server
 
 import (
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
 )
 
+type cmdSelect struct{}
+type cmdMove struct{}
+type cmdSwapDB struct{}
+type cmdFlushDB struct{}
+type cmdFlushAll struct{}
+type cmdDBSize struct{}
+type cmdDel struct{}
+type cmdUnlink struct{}
+type cmdExists struct{}
+type cmdType struct{}
+type cmdRename struct{}
+type cmdRenameNX struct{}
+type cmdCopy struct{}
+type cmdRandomKey struct{}
+type cmdTouch struct{}
+
 // Database implements the kv service
 type Database struct {
+	id      int
 	store   *dt.Dict
 	expires *dt.Dict
+
+	// elements counts the members of all the collections in the database,
+	// which is part of the memory usage estimated by usedmemory.
+	elements int64
+
+	// the clients blocked on every key, and the keys which can serve them
+	blockingKeys map[string][]*Client
+	readyKeys    map[string]bool
+
+	// the clients watching every key
+	watchedKeys map[string][]*Client
 }
 
 // NewDatabase .
@@ -17,6 +49,10 @@ func NewDatabase() *Database {
 	return &Database{
 		store:   dt.NewDict(),
 		expires: dt.NewDict(),
+
+		blockingKeys: make(map[string][]*Client),
+		readyKeys:    make(map[string]bool),
+		watchedKeys:  make(map[string][]*Client),
 	}
 }
 
@@ -49,26 +85,64 @@ func (db *Database) expireIfNeeded(key string) bool {
 	}
 
 	db.deleteKey(key)
+	signalModifiedKey(db, key)
+	notifyKeyspaceEvent(NotifyExpired, "expired", key, db.id)
 	return true
 }
 
+// Add adds the key to the database, overwriting the old value if any.
 func (db *Database) Add(key string, obj *dt.Object) {
+	godisServer.snapshotKey(db, key)
+	de := db.store.Get(key)
+	if de != nil {
+		db.elements -= objectElements(de.Value.(*dt.Object))
+	}
 	db.store.Add(key, obj)
+	db.elements += objectElements(obj)
+	if de == nil {
+		notifyKeyspaceEvent(NotifyNew, "new", key, db.id)
+	}
+
+	if obj.ObjType == dt.ObjList || obj.ObjType == dt.ObjStream {
+		signalKeyAsReady(db, key)
+	}
 }
 
+// signalModifiedKey is called every time a key of the database is modified,
+// so that the transactions watching it fail.
+func signalModifiedKey(db *Database, key string) {
+	touchWatchedKey(db, key)
+}
+
+// Set sets the key to a new value, the old TTL is discarded.
 func (db *Database) Set(key string, obj *dt.Object) {
-	old := db.lookupKey(key, true)
-	if old == nil {
-		db.store.Add(key, obj)
-	} else {
-		old.Ptr = obj.Ptr
-		db.expires.Delete(key)
-	}
+	db.Add(key, obj)
+	db.expires.Delete(key)
 }
 
 func (db *Database) deleteKey(key string) {
+	godisServer.snapshotKey(db, key)
 	db.expires.Delete(key)
-	db.store.Delete(key)
+	if v := db.store.Delete(key); v != nil {
+		db.elements -= objectElements(v.(*dt.Object))
+	}
+}
+
+// objectElements returns the number of members of a collection.
+func objectElements(o *dt.Object) int64 {
+	switch o.ObjType {
+	case dt.ObjList:
+		return listTypeLength(o)
+	case dt.ObjHash:
+		return hashTypeLength(o)
+	case dt.ObjSet:
+		return setTypeSize(o)
+	case dt.ObjZSet:
+		return zsetLength(o)
+	case dt.ObjStream:
+		return o.Ptr.(*dt.Stream).Len()
+	}
+	return 0
 }
 
 func (db *Database) keyIsExpired(key string) bool {
@@ -89,25 +163,50 @@ func (db *Database) getExpire(key string) int64 {
 }
 
 func (db *Database) setExpire(key string, when int64) {
+	godisServer.snapshotKey(db, key)
 	db.expires.Add(key, when)
 }
 
+func (db *Database) removeExpire(key string) bool {
+	godisServer.snapshotKey(db, key)
+	return db.expires.Delete(key) != nil
+}
+
+// ttl returns the remaining time to live of the key in seconds, -2 if the
+// key doesn't exist and -1 if it has no TTL.
 func (db *Database) ttl(key string) int64 {
+	ttl := db.pttl(key)
+	if ttl < 0 {
+		return ttl
+	}
+	return (ttl + 500) / 1000
+}
+
+// pttl is like ttl, but returns the remaining time in milliseconds.
+func (db *Database) pttl(key string) int64 {
 	if db.lookupKey(key, false) == nil {
 		return -2
 	}
 
-	var ttl int64
 	expire := db.getExpire(key)
-	if expire != -1 {
-		ttl = expire - mstime()
-		if ttl < 0 {
-			ttl = 0
-		}
-		return (ttl + 500) / 1000
+	if expire == -1 {
+		return -1
 	}
+	ttl := expire - mstime()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl
+}
 
-	return -1
+// flush removes every key of the database, and returns the number of keys
+// removed.
+func (db *Database) flush() int64 {
+	removed := db.store.Used()
+	db.store = dt.NewDict()
+	db.expires = dt.NewDict()
+	db.elements = 0
+	return removed
 }
 
 func (db *Database) showInfo() {
@@ -146,6 +245,8 @@ func (db *Database) doExpireCycle() {
 			if ttl <= 0 {
 				log.Print("expire key ", de.Key)
 				db.deleteKey(de.Key)
+				signalModifiedKey(db, de.Key)
+				notifyKeyspaceEvent(NotifyExpired, "expired", de.Key, db.id)
 				expired++
 			}
 		}
@@ -174,3 +275,338 @@ func (db *Database) incrementallyRehash() bool {
 
 	return false
 }
+
+// selectDB parses a DB index, and returns the database or the error to
+// reply.
+func selectDB(s string) (*Database, string) {
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, ReplyNotInteger
+	}
+	if id < 0 || id >= len(godisServer.db) {
+		return nil, "DB index is out of range"
+	}
+	return godisServer.db[id], ""
+}
+
+// SELECT index
+func (*cmdSelect) Exec(c *Client, r *protocol.Request) error {
+	db, msg := selectDB(r.ArgvAt(1))
+	if db == nil {
+		return c.ReplyError(msg)
+	}
+	c.SetDatabase(db)
+	return c.Reply("OK")
+}
+
+// MOVE key db
+func (*cmdMove) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	dst, msg := selectDB(r.ArgvAt(2))
+	if dst == nil {
+		return c.ReplyError(msg)
+	}
+	if dst == c.db {
+		return c.ReplyError("source and destination objects are the same")
+	}
+
+	o := c.db.lookupKey(key, true)
+	if o == nil || dst.lookupKey(key, false) != nil {
+		return c.ReplyInt(0)
+	}
+
+	expire := c.db.getExpire(key)
+	dst.Add(key, o)
+	if expire != -1 {
+		dst.setExpire(key, expire)
+	}
+	c.db.deleteKey(key)
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyGeneric, "move_from", key, c.db.id)
+	signalModifiedKey(dst, key)
+	notifyKeyspaceEvent(NotifyGeneric, "move_to", key, dst.id)
+	godisServer.dirty++
+	return c.ReplyInt(1)
+}
+
+// SWAPDB index1 index2
+func (*cmdSwapDB) Exec(c *Client, r *protocol.Request) error {
+	id1, err := strconv.Atoi(r.ArgvAt(1))
+	if err != nil {
+		return c.ReplyError("invalid first DB index")
+	}
+	id2, err := strconv.Atoi(r.ArgvAt(2))
+	if err != nil {
+		return c.ReplyError("invalid second DB index")
+	}
+	if id1 < 0 || id1 >= len(godisServer.db) || id2 < 0 || id2 >= len(godisServer.db) {
+		return c.ReplyError("DB index is out of range")
+	}
+
+	if id1 != id2 {
+		db1, db2 := godisServer.db[id1], godisServer.db[id2]
+		touchAllWatchedKeysInDB(db1, db2)
+		touchAllWatchedKeysInDB(db2, db1)
+		swapDatabases(db1, db2)
+	}
+	godisServer.dirty++
+	return c.Reply("OK")
+}
+
+// swapDatabases swaps the keys of the databases, the clients connected or
+// blocked on them stay where they are and see the keys of the other one.
+func swapDatabases(db1, db2 *Database) {
+	db1.store, db2.store = db2.store, db1.store
+	db1.expires, db2.expires = db2.expires, db1.expires
+	db1.elements, db2.elements = db2.elements, db1.elements
+
+	// the swapped in lists and streams may serve the clients blocked on the
+	// databases
+	for _, db := range []*Database{db1, db2} {
+		for key := range db.blockingKeys {
+			if o := db.lookupKey(key, false); o != nil && (o.ObjType == dt.ObjList || o.ObjType == dt.ObjStream) {
+				signalKeyAsReady(db, key)
+			}
+		}
+	}
+}
+
+// parseFlushFlags checks the optional ASYNC or SYNC argument of FLUSHDB and
+// FLUSHALL, the keys are always freed synchronously.
+func parseFlushFlags(r *protocol.Request) bool {
+	if r.ArgCount() == 1 {
+		return true
+	}
+	if r.ArgCount() > 2 {
+		return false
+	}
+	flag := strings.ToLower(r.ArgvAt(1))
+	return flag == "async" || flag == "sync"
+}
+
+// FLUSHDB [ASYNC|SYNC]
+func (*cmdFlushDB) Exec(c *Client, r *protocol.Request) error {
+	if !parseFlushFlags(r) {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	touchAllWatchedKeysInDB(c.db, nil)
+	godisServer.dirty += c.db.flush()
+	return c.Reply("OK")
+}
+
+// FLUSHALL [ASYNC|SYNC]
+func (*cmdFlushAll) Exec(c *Client, r *protocol.Request) error {
+	if !parseFlushFlags(r) {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	s := godisServer
+	for _, db := range s.db {
+		touchAllWatchedKeysInDB(db, nil)
+		s.dirty += db.flush()
+	}
+
+	// persist the empty dataset right away when snapshots are enabled, the
+	// dirty counter is kept so that the command is still propagated, even
+	// inside a transaction.
+	if len(s.saveParams) > 0 && !s.rdbSaveInProgress() && !c.fake {
+		if err := rdbSave(RDBFileName, s.snapshot(), s.functionsSnapshot()); err != nil {
+			log.Printf("failed saving the DB: %v", err)
+		} else {
+			s.lastsave = time.Now().Unix()
+		}
+	}
+
+	// always propagate the command, even if no key was removed
+	s.dirty++
+	return c.Reply("OK")
+}
+
+// DBSIZE
+func (*cmdDBSize) Exec(c *Client, r *protocol.Request) error {
+	return c.ReplyInt(c.db.store.Used())
+}
+
+// DEL key [key ...]
+func (*cmdDel) Exec(c *Client, r *protocol.Request) error {
+	return delGenericCommand(c, r)
+}
+
+// UNLINK key [key ...]
+func (*cmdUnlink) Exec(c *Client, r *protocol.Request) error {
+	return delGenericCommand(c, r)
+}
+
+// delGenericCommand implements DEL and UNLINK, the values are always freed
+// synchronously.
+func delGenericCommand(c *Client, r *protocol.Request) error {
+	var deleted int64
+	for i := 1; i < r.ArgCount(); i++ {
+		key := r.ArgvAt(i)
+		if c.db.lookupKey(key, false) == nil {
+			continue
+		}
+		c.db.deleteKey(key)
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+		deleted++
+	}
+	godisServer.dirty += deleted
+	return c.ReplyInt(deleted)
+}
+
+// EXISTS key [key ...]
+func (*cmdExists) Exec(c *Client, r *protocol.Request) error {
+	var count int64
+	for i := 1; i < r.ArgCount(); i++ {
+		if c.db.lookupKey(r.ArgvAt(i), false) != nil {
+			count++
+		}
+	}
+	return c.ReplyInt(count)
+}
+
+// TYPE key
+func (*cmdType) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.lookupKey(r.ArgvAt(1), false)
+	if o == nil {
+		return c.Reply("none")
+	}
+	return c.Reply(typeName(o))
+}
+
+// RENAME key newkey
+func (*cmdRename) Exec(c *Client, r *protocol.Request) error {
+	return renameGenericCommand(c, r, false)
+}
+
+// RENAMENX key newkey
+func (*cmdRenameNX) Exec(c *Client, r *protocol.Request) error {
+	return renameGenericCommand(c, r, true)
+}
+
+func renameGenericCommand(c *Client, r *protocol.Request, nx bool) error {
+	key, newkey := r.ArgvAt(1), r.ArgvAt(2)
+	o := c.db.lookupKey(key, true)
+	if o == nil {
+		return c.ReplyError("no such key")
+	}
+
+	if key == newkey {
+		if nx {
+			return c.ReplyInt(0)
+		}
+		return c.Reply("OK")
+	}
+
+	if c.db.lookupKey(newkey, false) != nil && nx {
+		return c.ReplyInt(0)
+	}
+
+	expire := c.db.getExpire(key)
+	c.db.Set(newkey, o)
+	if expire != -1 {
+		c.db.setExpire(newkey, expire)
+	}
+	c.db.deleteKey(key)
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyGeneric, "rename_from", key, c.db.id)
+	signalModifiedKey(c.db, newkey)
+	notifyKeyspaceEvent(NotifyGeneric, "rename_to", newkey, c.db.id)
+	godisServer.dirty++
+
+	if nx {
+		return c.ReplyInt(1)
+	}
+	return c.Reply("OK")
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+func (*cmdCopy) Exec(c *Client, r *protocol.Request) error {
+	src, dst := r.ArgvAt(1), r.ArgvAt(2)
+	dstdb := c.db
+	replace := false
+	for i := 3; i < r.ArgCount(); i++ {
+		opt := strings.ToLower(r.ArgvAt(i))
+		switch {
+		case opt == "replace":
+			replace = true
+		case opt == "db" && i+1 < r.ArgCount():
+			db, msg := selectDB(r.ArgvAt(i + 1))
+			if db == nil {
+				return c.ReplyError(msg)
+			}
+			dstdb = db
+			i++
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+
+	if src == dst && dstdb == c.db {
+		return c.ReplyError("source and destination objects are the same")
+	}
+
+	o := c.db.lookupKey(src, false)
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if dstdb.lookupKey(dst, false) != nil && !replace {
+		return c.ReplyInt(0)
+	}
+
+	expire := c.db.getExpire(src)
+	dstdb.Set(dst, o.Dup())
+	if expire != -1 {
+		dstdb.setExpire(dst, expire)
+	}
+	signalModifiedKey(dstdb, dst)
+	notifyKeyspaceEvent(NotifyGeneric, "copy_to", dst, dstdb.id)
+	godisServer.dirty++
+	return c.ReplyInt(1)
+}
+
+// RANDOMKEY
+func (*cmdRandomKey) Exec(c *Client, r *protocol.Request) error {
+	key, ok := c.db.randomKey()
+	if !ok {
+		return c.ReplyEmpty()
+	}
+	return c.ReplyBulkString(key)
+}
+
+// randomKey returns a random key, the expired keys found are deleted.
+func (db *Database) randomKey() (string, bool) {
+	// when all the keys are volatile, they may be all expired, so give up
+	// after a while and return an expired key rather than loop forever.
+	maxtries := 100
+	allvolatile := db.expires.Used() == db.store.Used()
+	for {
+		de := db.store.RandomEntry()
+		if de == nil {
+			return "", false
+		}
+		if allvolatile {
+			maxtries--
+			if maxtries == 0 {
+				return de.Key, true
+			}
+		}
+		if db.expireIfNeeded(de.Key) {
+			continue
+		}
+		return de.Key, true
+	}
+}
+
+// TOUCH key [key ...]
+func (*cmdTouch) Exec(c *Client, r *protocol.Request) error {
+	var count int64
+	for i := 1; i < r.ArgCount(); i++ {
+		if c.db.Get(r.ArgvAt(i)) != nil {
+			count++
+		}
+	}
+	return c.ReplyInt(count)
+}
@@ -9,6 +9,7 @@ import (
 type EvPoolEntry struct {
 	idle int64
 	key  string
+	db   *Database
 }
 
 var EvPool [EvPoolSize]EvPoolEntry
@@ -31,38 +32,62 @@ func freeMemoryIfNeed() bool {
 	log.Printf("start free memory %d", toFree)
 	var freed int64
 	for freed < toFree {
+		if godisServer.dbsize() == 0 {
+			break
+		}
+
 		bestkey := ""
+		var bestdb *Database
 
 		if godisServer.memPolicyLru() {
 			for bestkey == "" {
-				populateEvictionPool(godisServer.db.store)
+				for _, db := range godisServer.db {
+					if db.store.Used() > 0 {
+						populateEvictionPool(db)
+					}
+				}
 				for k := EvPoolSize - 1; k >= 0; k-- {
 					key := EvPool[k].key
 					if key == "" {
 						continue
 					}
-					EvPool[k].key = ""
-					EvPool[k].idle = 0
+					bestdb = EvPool[k].db
+					EvPool[k] = EvPoolEntry{}
+					// the key may be already deleted since it was sampled
+					if bestdb.store.Get(key) == nil {
+						continue
+					}
 					bestkey = key
 					break
 				}
 			}
 		} else if godisServer.memPolicyRandom() {
-			if e := godisServer.db.store.RandomEntry(); e != nil {
-				bestkey = e.Key
+			// visit the databases in turn, so that every one of them is evicted
+			for i := 0; i < len(godisServer.db) && bestkey == ""; i++ {
+				db := godisServer.db[evictionNextDB%len(godisServer.db)]
+				evictionNextDB++
+				if e := db.store.RandomEntry(); e != nil {
+					bestkey = e.Key
+					bestdb = db
+				}
 			}
 		}
 
 		preMem := usedmemory()
 		if bestkey != "" {
-			log.Printf("evict key %s to free memory", bestkey)
-			godisServer.db.deleteKey(bestkey)
+			log.Printf("evict key %s of DB %d to free memory", bestkey, bestdb.id)
+			bestdb.deleteKey(bestkey)
+			signalModifiedKey(bestdb, bestkey)
+			notifyKeyspaceEvent(NotifyEvicted, "evicted", bestkey, bestdb.id)
 		}
 		freed += preMem - usedmemory()
 	}
 	return true
 }
 
+// evictionNextDB is the next database where a random key is evicted.
+var evictionNextDB int
+
 func maxMemoryToFree() int64 {
 	used := usedmemory()
 	if godisServer.maxmemory == 0 || used <= godisServer.maxmemory {
@@ -71,8 +96,8 @@ func maxMemoryToFree() int64 {
 	return used - godisServer.maxmemory
 }
 
-func populateEvictionPool(sampledict *dt.Dict) {
-	entries := sampledict.SomeEntries(MaxmemorySamples)
+func populateEvictionPool(db *Database) {
+	entries := db.store.SomeEntries(MaxmemorySamples)
 	for _, e := range entries {
 		o := e.Value.(*dt.Object)
 		idle := mstime() - o.Lru
@@ -111,6 +136,7 @@ func populateEvictionPool(sampledict *dt.Dict) {
 
 		EvPool[k].idle = idle
 		EvPool[k].key = e.Key
+		EvPool[k].db = db
 	}
 }
 
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdExpire struct{}
+type cmdPExpire struct{}
+type cmdExpireAt struct{}
+type cmdPExpireAt struct{}
+type cmdTTL struct{}
+type cmdPTTL struct{}
+type cmdExpireTime struct{}
+type cmdPExpireTime struct{}
+type cmdPersist struct{}
+
+// Every command setting a TTL is written to the AOF as a PEXPIREAT with the
+// absolute unix time in ms, so the keys expire at the same time when the
+// file is replayed, or as a DEL when the time is already in the past.
+
+const (
+	expireNX = 1 << iota
+	expireXX
+	expireGT
+	expireLT
+)
+
+// parseExpireFlags parses the NX, XX, GT and LT options of the EXPIRE
+// family starting from the i-th argument.
+func parseExpireFlags(r *protocol.Request, i int) (int, string) {
+	flags := 0
+	for ; i < r.ArgCount(); i++ {
+		switch opt := strings.ToLower(r.ArgvAt(i)); opt {
+		case "nx":
+			flags |= expireNX
+		case "xx":
+			flags |= expireXX
+		case "gt":
+			flags |= expireGT
+		case "lt":
+			flags |= expireLT
+		default:
+			return 0, "Unsupported option " + r.ArgvAt(i)
+		}
+	}
+
+	if flags&expireNX != 0 && flags&(expireXX|expireGT|expireLT) != 0 {
+		return 0, "NX and XX, GT or LT options at the same time are not compatible"
+	}
+	if flags&expireGT != 0 && flags&expireLT != 0 {
+		return 0, "GT and LT options at the same time are not compatible"
+	}
+	return flags, ""
+}
+
+// expireGenericCommand implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT.
+// The time argument is relative to basetime, or absolute when basetime is
+// 0, and is in seconds or milliseconds according to unit.
+func expireGenericCommand(c *Client, r *protocol.Request, basetime int64, unit int64) error {
+	key := r.ArgvAt(1)
+	when, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+	flags, msg := parseExpireFlags(r, 3)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	// the time in ms must fit in an int64, including the base time
+	if when > math.MaxInt64/unit || when < math.MinInt64/unit {
+		return c.ReplyError("invalid expire time in '" + strings.ToLower(r.CommandName()) + "' command")
+	}
+	when *= unit
+	if (when > 0 && basetime > math.MaxInt64-when) || (when < 0 && basetime < math.MinInt64-when) {
+		return c.ReplyError("invalid expire time in '" + strings.ToLower(r.CommandName()) + "' command")
+	}
+	when += basetime
+
+	if c.db.lookupKey(key, false) == nil {
+		return c.ReplyInt(0)
+	}
+
+	if flags != 0 {
+		current := c.db.getExpire(key)
+		switch {
+		case flags&expireNX != 0 && current != -1:
+			return c.ReplyInt(0)
+		case flags&expireXX != 0 && current == -1:
+			return c.ReplyInt(0)
+		// a key without TTL has an infinite TTL
+		case flags&expireGT != 0 && (current == -1 || when <= current):
+			return c.ReplyInt(0)
+		case flags&expireLT != 0 && current != -1 && when >= current:
+			return c.ReplyInt(0)
+		}
+	}
+
+	signalModifiedKey(c.db, key)
+	godisServer.dirty++
+	if when <= mstime() && !c.fake {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+		c.propagate(CmdNameDel, key)
+		return c.ReplyInt(1)
+	}
+
+	c.db.setExpire(key, when)
+	notifyKeyspaceEvent(NotifyGeneric, "expire", key, c.db.id)
+	c.propagate(CmdNamePExpireAt, key, strconv.FormatInt(when, 10))
+	return c.ReplyInt(1)
+}
+
+// EXPIRE key seconds [NX|XX|GT|LT]
+func (*cmdExpire) Exec(c *Client, r *protocol.Request) error {
+	return expireGenericCommand(c, r, mstime(), 1000)
+}
+
+// PEXPIRE key milliseconds [NX|XX|GT|LT]
+func (*cmdPExpire) Exec(c *Client, r *protocol.Request) error {
+	return expireGenericCommand(c, r, mstime(), 1)
+}
+
+// EXPIREAT key unix-time-seconds [NX|XX|GT|LT]
+func (*cmdExpireAt) Exec(c *Client, r *protocol.Request) error {
+	return expireGenericCommand(c, r, 0, 1000)
+}
+
+// PEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT]
+func (*cmdPExpireAt) Exec(c *Client, r *protocol.Request) error {
+	return expireGenericCommand(c, r, 0, 1)
+}
+
+// ttlGenericCommand implements the TTL family of commands, which reply the
+// remaining time, or the absolute unix time of the expiration.
+func ttlGenericCommand(c *Client, r *protocol.Request, ms bool, absolute bool) error {
+	key := r.ArgvAt(1)
+	if !absolute {
+		if ms {
+			return c.ReplyInt(c.db.pttl(key))
+		}
+		return c.ReplyInt(c.db.ttl(key))
+	}
+
+	if c.db.lookupKey(key, false) == nil {
+		return c.ReplyInt(-2)
+	}
+	expire := c.db.getExpire(key)
+	if expire == -1 {
+		return c.ReplyInt(-1)
+	}
+	if !ms {
+		expire /= 1000
+	}
+	return c.ReplyInt(expire)
+}
+
+// TTL key
+func (*cmdTTL) Exec(c *Client, r *protocol.Request) error {
+	return ttlGenericCommand(c, r, false, false)
+}
+
+// PTTL key
+func (*cmdPTTL) Exec(c *Client, r *protocol.Request) error {
+	return ttlGenericCommand(c, r, true, false)
+}
+
+// EXPIRETIME key
+func (*cmdExpireTime) Exec(c *Client, r *protocol.Request) error {
+	return ttlGenericCommand(c, r, false, true)
+}
+
+// PEXPIRETIME key
+func (*cmdPExpireTime) Exec(c *Client, r *protocol.Request) error {
+	return ttlGenericCommand(c, r, true, true)
+}
+
+// PERSIST key
+func (*cmdPersist) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	if c.db.lookupKey(key, false) == nil || !c.db.removeExpire(key) {
+		return c.ReplyInt(0)
+	}
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyGeneric, "persist", key, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(1)
+}
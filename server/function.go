@@ -0,0 +1,522 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kzinglzy/godis/server/protocol"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type cmdFunction struct{}
+type cmdFCall struct{}
+type cmdFCallRO struct{}
+
+// function flags
+const (
+	functionFlagNoWrites = 1 << iota
+	functionFlagAllowOOM
+)
+
+var functionFlagNames = []struct {
+	name string
+	flag int
+}{
+	{"no-writes", functionFlagNoWrites},
+	{"allow-oom", functionFlagAllowOOM},
+}
+
+// functionLib is a library loaded by FUNCTION LOAD, the functions it
+// registers are called by FCALL.
+type functionLib struct {
+	name      string
+	code      string
+	functions map[string]*functionInfo
+}
+
+type functionInfo struct {
+	name  string
+	lib   *functionLib
+	fn    *lua.LFunction
+	flags int
+}
+
+// functionsInit creates the Lua interpreter of the libraries, which is
+// separated from the one of the scripts.
+func functionsInit(s *Server) {
+	L := luaCreateState()
+	redis := L.GetGlobal("redis").(*lua.LTable)
+	redis.RawSetString("register_function", L.NewFunction(luaRegisterFunction))
+
+	s.functionsLua = L
+	s.functionLibs = make(map[string]*functionLib)
+	s.functions = make(map[string]*functionInfo)
+}
+
+// isValidFunctionName reports whether the name of a library or a function
+// only has letters, numbers and underscores.
+func isValidFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// redis.register_function(name, callback)
+// redis.register_function{function_name=name, callback=callback, flags={flag, ...}}
+func luaRegisterFunction(L *lua.LState) int {
+	lib := godisServer.functionLoading
+	if lib == nil {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+	}
+
+	var name lua.LValue
+	var callback lua.LValue
+	flags := 0
+	switch L.GetTop() {
+	case 1:
+		tbl := L.CheckTable(1)
+		name = tbl.RawGetString("function_name")
+		callback = tbl.RawGetString("callback")
+		switch v := tbl.RawGetString("flags").(type) {
+		case *lua.LNilType:
+		case *lua.LTable:
+			for i := 1; i <= v.Len(); i++ {
+				flag := functionFlagByName(v.RawGetInt(i).String())
+				if flag == 0 {
+					L.RaiseError("unknown flag given")
+				}
+				flags |= flag
+			}
+		default:
+			L.RaiseError("flags argument to redis.register_function must be a table representing function flags")
+		}
+	case 2:
+		name = L.Get(1)
+		callback = L.Get(2)
+	default:
+		L.RaiseError("wrong number of arguments to redis.register_function")
+	}
+
+	fname, ok := name.(lua.LString)
+	if !ok {
+		L.RaiseError("function name argument given to redis.register_function must be a string")
+	}
+	fn, ok := callback.(*lua.LFunction)
+	if !ok {
+		L.RaiseError("callback argument given to redis.register_function must be a function")
+	}
+	if !isValidFunctionName(string(fname)) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if lib.functions[string(fname)] != nil {
+		L.RaiseError("Function already exists in the library")
+	}
+
+	lib.functions[string(fname)] = &functionInfo{
+		name:  string(fname),
+		lib:   lib,
+		fn:    fn,
+		flags: flags,
+	}
+	return 0
+}
+
+func functionFlagByName(name string) int {
+	for _, f := range functionFlagNames {
+		if f.name == name {
+			return f.flag
+		}
+	}
+	return 0
+}
+
+// functionParseMetadata returns the library name given by the shebang
+// line of the code, like "#!lua name=mylib".
+func functionParseMetadata(code string) (string, string) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "Missing library metadata"
+	}
+	line := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		line = code[:i]
+	}
+
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 || fields[0] != "lua" {
+		engine := ""
+		if len(fields) > 0 {
+			engine = fields[0]
+		}
+		return "", "Engine '" + engine + "' not found"
+	}
+	name := ""
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "name=") {
+			return "", "Invalid metadata value given: " + field
+		}
+		name = field[len("name="):]
+	}
+	if name == "" {
+		return "", "Library name was not given"
+	}
+	if !isValidFunctionName(name) {
+		return "", "Library names can only contain letters, numbers, or underscores(_) and must be at least one character long"
+	}
+	return name, ""
+}
+
+// functionsCreateLibrary loads the library, which replaces the one with the
+// same name if replace is set.
+func functionsCreateLibrary(code string, replace bool) (string, string) {
+	s := godisServer
+	name, msg := functionParseMetadata(code)
+	if msg != "" {
+		return "", msg
+	}
+	old := s.functionLibs[name]
+	if old != nil && !replace {
+		return "", "Library '" + name + "' already exists"
+	}
+
+	// the shebang line is blanked, so that the errors have the right line
+	body := code[strings.IndexByte(code+"\n", '\n'):]
+	L := s.functionsLua
+	fn, err := L.Load(strings.NewReader(body), "user_function")
+	if err != nil {
+		return "", "Error compiling function: " + err.Error()
+	}
+
+	lib := &functionLib{name: name, code: code, functions: make(map[string]*functionInfo)}
+	ctx, cancel := context.WithTimeout(context.Background(), FunctionLoadTimeout*time.Millisecond)
+	s.functionLoading = lib
+	L.SetContext(ctx)
+	err = L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true})
+	L.RemoveContext()
+	s.functionLoading = nil
+	cancel()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", "FUNCTION LOAD timeout"
+		}
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			return "", "Error registering functions: " + apiErr.Object.String()
+		}
+		return "", "Error registering functions: " + err.Error()
+	}
+	if len(lib.functions) == 0 {
+		return "", "No functions registered"
+	}
+
+	for fname := range lib.functions {
+		if f := s.functions[fname]; f != nil && f.lib != old {
+			return "", "Function " + fname + " already exists"
+		}
+	}
+	if old != nil {
+		functionsDeleteLibrary(old)
+	}
+	s.functionLibs[name] = lib
+	for fname, f := range lib.functions {
+		s.functions[fname] = f
+	}
+	return name, ""
+}
+
+func functionsDeleteLibrary(lib *functionLib) {
+	for fname := range lib.functions {
+		delete(godisServer.functions, fname)
+	}
+	delete(godisServer.functionLibs, lib.name)
+}
+
+// functionsSnapshot returns the code of the libraries, sorted by their
+// names.
+func (s *Server) functionsSnapshot() []string {
+	names := make([]string, 0, len(s.functionLibs))
+	for name := range s.functionLibs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	codes := make([]string, 0, len(names))
+	for _, name := range names {
+		codes = append(codes, s.functionLibs[name].code)
+	}
+	return codes
+}
+
+// functionDenyCall returns the error of a FCALL which isn't allowed by the
+// flags of the function, it's checked before the call is executed or
+// queued in a transaction.
+func functionDenyCall(r *protocol.Request) string {
+	name := strings.ToLower(r.CommandName())
+	if (name != CmdNameFCall && name != CmdNameFCallRO) || r.ArgCount() < 2 {
+		return ""
+	}
+	f := godisServer.functions[r.ArgvAt(1)]
+	if f == nil {
+		return ""
+	}
+
+	if name == CmdNameFCallRO && f.flags&functionFlagNoWrites == 0 {
+		return "Can not execute a script with write flag using *_ro command."
+	}
+	if f.flags&(functionFlagNoWrites|functionFlagAllowOOM) == 0 && maxMemoryToFree() > 0 {
+		return ReplyOOM
+	}
+	return ""
+}
+
+// FCALL function numkeys [key [key ...]] [arg [arg ...]]
+func (*cmdFCall) Exec(c *Client, r *protocol.Request) error {
+	return fcallCommandGeneric(c, r, false)
+}
+
+// FCALL_RO function numkeys [key [key ...]] [arg [arg ...]]
+func (*cmdFCallRO) Exec(c *Client, r *protocol.Request) error {
+	return fcallCommandGeneric(c, r, true)
+}
+
+func fcallCommandGeneric(c *Client, r *protocol.Request, readonly bool) error {
+	keys, args, msg := scriptGetKeys(r)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	f := godisServer.functions[r.ArgvAt(1)]
+	if f == nil {
+		return c.ReplyError("Function not found")
+	}
+
+	L := godisServer.functionsLua
+	readonly = readonly || f.flags&functionFlagNoWrites != 0
+	luaArgs := []lua.LValue{luaStringsTable(L, keys), luaStringsTable(L, args)}
+	return luaCallFunction(c, L, f.fn, luaArgs, readonly, f.name, CmdNameFunction)
+}
+
+// functionsDump serializes the libraries like the snapshot file, followed
+// by the version and the crc64 of the payload.
+func functionsDump(codes []string) []byte {
+	var buf bytes.Buffer
+	e := &rdbEncoder{w: bufio.NewWriter(&buf)}
+	for _, code := range codes {
+		e.writeByte(RDBOpcodeFunction)
+		e.writeString(code)
+	}
+	e.w.Flush()
+
+	var footer [10]byte
+	binary.LittleEndian.PutUint16(footer[:2], RDBVersion)
+	buf.Write(footer[:2])
+	binary.LittleEndian.PutUint64(footer[2:], crc64.Checksum(buf.Bytes(), rdbCrcTable))
+	buf.Write(footer[2:])
+	return buf.Bytes()
+}
+
+// functionsRestoreDecode returns the code of the libraries dumped by
+// functionsDump.
+func functionsRestoreDecode(payload []byte) ([]string, string) {
+	if len(payload) < 10 {
+		return nil, "payload version or checksum are wrong"
+	}
+	data, footer := payload[:len(payload)-8], payload[len(payload)-8:]
+	version := binary.LittleEndian.Uint16(data[len(data)-2:])
+	if version > RDBVersion || binary.LittleEndian.Uint64(footer) != crc64.Checksum(data, rdbCrcTable) {
+		return nil, "payload version or checksum are wrong"
+	}
+
+	var codes []string
+	d := &rdbDecoder{r: bytes.NewReader(data[:len(data)-2]), left: int64(len(data) - 2)}
+	for {
+		t := d.readByte()
+		if d.err == io.EOF {
+			return codes, ""
+		}
+		if t != RDBOpcodeFunction {
+			return nil, "given type is not a function"
+		}
+		code := d.readString()
+		if d.err != nil {
+			return nil, "payload version or checksum are wrong"
+		}
+		codes = append(codes, code)
+	}
+}
+
+// functionsRestore loads the libraries with the policy of FUNCTION
+// RESTORE, the libraries are left unchanged when one of them fails.
+func functionsRestore(codes []string, policy string) string {
+	s := godisServer
+	libs := make(map[string]*functionLib, len(s.functionLibs))
+	for name, lib := range s.functionLibs {
+		libs[name] = lib
+	}
+	functions := make(map[string]*functionInfo, len(s.functions))
+	for name, f := range s.functions {
+		functions[name] = f
+	}
+
+	if policy == "flush" {
+		s.functionLibs = make(map[string]*functionLib)
+		s.functions = make(map[string]*functionInfo)
+	}
+	for _, code := range codes {
+		if _, msg := functionsCreateLibrary(code, policy == "replace"); msg != "" {
+			s.functionLibs = libs
+			s.functions = functions
+			return msg
+		}
+	}
+	return ""
+}
+
+// FUNCTION LOAD [REPLACE] code
+// FUNCTION DELETE library
+// FUNCTION LIST [WITHCODE] [LIBRARYNAME pattern]
+// FUNCTION DUMP
+// FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE]
+// FUNCTION FLUSH [ASYNC|SYNC]
+// FUNCTION KILL
+func (*cmdFunction) Exec(c *Client, r *protocol.Request) error {
+	s := godisServer
+	switch sub := strings.ToLower(r.ArgvAt(1)); sub {
+	case "load":
+		replace := r.ArgCount() == 4 && strings.ToLower(r.ArgvAt(2)) == "replace"
+		if r.ArgCount() != 3 && !replace {
+			return c.ReplyError("wrong number of arguments for 'function|load' command")
+		}
+		name, msg := functionsCreateLibrary(r.ArgvAt(r.ArgCount()-1), replace)
+		if msg != "" {
+			return c.ReplyError(msg)
+		}
+		s.dirty++
+		return c.ReplyBulkString(name)
+	case "delete":
+		if r.ArgCount() != 3 {
+			return c.ReplyError("wrong number of arguments for 'function|delete' command")
+		}
+		lib := s.functionLibs[r.ArgvAt(2)]
+		if lib == nil {
+			return c.ReplyError("Library not found")
+		}
+		functionsDeleteLibrary(lib)
+		s.dirty++
+		return c.Reply("OK")
+	case "list":
+		return functionListCommand(c, r)
+	case "dump":
+		if r.ArgCount() != 2 {
+			return c.ReplyError("wrong number of arguments for 'function|dump' command")
+		}
+		return c.ReplyBulkString(string(functionsDump(s.functionsSnapshot())))
+	case "restore":
+		if r.ArgCount() != 3 && r.ArgCount() != 4 {
+			return c.ReplyError("wrong number of arguments for 'function|restore' command")
+		}
+		policy := "append"
+		if r.ArgCount() == 4 {
+			policy = strings.ToLower(r.ArgvAt(3))
+			if policy != "flush" && policy != "append" && policy != "replace" {
+				return c.ReplyError("Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+			}
+		}
+		codes, msg := functionsRestoreDecode([]byte(r.ArgvAt(2)))
+		if msg == "" {
+			msg = functionsRestore(codes, policy)
+		}
+		if msg != "" {
+			return c.ReplyError(msg)
+		}
+		s.dirty++
+		return c.Reply("OK")
+	case "flush":
+		if r.ArgCount() > 3 {
+			return c.ReplyError("wrong number of arguments for 'function|flush' command")
+		}
+		if r.ArgCount() == 3 {
+			if mode := strings.ToLower(r.ArgvAt(2)); mode != "async" && mode != "sync" {
+				return c.ReplyError("FUNCTION FLUSH only supports SYNC|ASYNC option")
+			}
+		}
+		s.functionsLua.Close()
+		functionsInit(s)
+		s.dirty++
+		return c.Reply("OK")
+	case "kill":
+		if r.ArgCount() != 2 {
+			return c.ReplyError("wrong number of arguments for 'function|kill' command")
+		}
+		// a running function is killed by the watchdog, as the event loop
+		// is busy with it.
+		return c.ReplyError(replyNotBusy)
+	default:
+		return c.ReplyError("unknown subcommand '" + r.ArgvAt(1) + "'. Try FUNCTION HELP.")
+	}
+}
+
+// FUNCTION LIST [WITHCODE] [LIBRARYNAME pattern]
+func functionListCommand(c *Client, r *protocol.Request) error {
+	withCode := false
+	pattern := ""
+	for i := 2; i < r.ArgCount(); i++ {
+		switch arg := strings.ToLower(r.ArgvAt(i)); {
+		case arg == "withcode" && !withCode:
+			withCode = true
+		case arg == "libraryname" && pattern == "" && i+1 < r.ArgCount():
+			i++
+			pattern = r.ArgvAt(i)
+		default:
+			return c.ReplyError(fmt.Sprintf("Unknown argument %s", r.ArgvAt(i)))
+		}
+	}
+
+	s := godisServer
+	names := make([]string, 0, len(s.functionLibs))
+	for name := range s.functionLibs {
+		if pattern == "" || stringMatch(pattern, name, false) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	reply := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		lib := s.functionLibs[name]
+		fnames := make([]string, 0, len(lib.functions))
+		for fname := range lib.functions {
+			fnames = append(fnames, fname)
+		}
+		sort.Strings(fnames)
+
+		functions := make([]interface{}, 0, len(fnames))
+		for _, fname := range fnames {
+			flags := []string{}
+			for _, f := range functionFlagNames {
+				if lib.functions[fname].flags&f.flag != 0 {
+					flags = append(flags, f.name)
+				}
+			}
+			functions = append(functions, []interface{}{"name", fname, "description", nil, "flags", flags})
+		}
+
+		info := []interface{}{"library_name", name, "engine", "LUA", "functions", functions}
+		if withCode {
+			info = append(info, "library_code", lib.code)
+		}
+		reply = append(reply, info)
+	}
+	return c.ReplyBulk(reply...)
+}
@@ -0,0 +1,491 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdGeoAdd struct{}
+type cmdGeoPos struct{}
+type cmdGeoDist struct{}
+type cmdGeoHash struct{}
+type cmdGeoSearch struct{}
+type cmdGeoSearchStore struct{}
+
+// The geo sets are sorted sets whose scores are the geohashes of the
+// members, see dt/geohash.go, so they are saved and rewritten like every
+// other sorted set.
+
+// geoUnit returns the number of meters of a unit, or -1.
+func geoUnit(s string) float64 {
+	switch strings.ToLower(s) {
+	case "m":
+		return 1
+	case "km":
+		return 1000
+	case "ft":
+		return 0.3048
+	case "mi":
+		return 1609.34
+	}
+	return -1
+}
+
+const replyGeoUnit = "unsupported unit provided. please use M, KM, FT, MI"
+
+// parseLongLat parses a pair of coordinates, and returns an error message
+// if they are invalid.
+func parseLongLat(long, lat string) (float64, float64, string) {
+	longitude, err1 := parseFloat(long)
+	latitude, err2 := parseFloat(lat)
+	if err1 != nil || err2 != nil {
+		return 0, 0, ReplyNotFloat
+	}
+	if longitude < dt.GeoLongMin || longitude > dt.GeoLongMax ||
+		latitude < dt.GeoLatMin || latitude > dt.GeoLatMax {
+		return 0, 0, fmt.Sprintf("invalid longitude,latitude pair %f,%f", longitude, latitude)
+	}
+	return longitude, latitude, ""
+}
+
+// geoFormatCoord formats a coordinate with 17 decimals at most.
+func geoFormatCoord(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func geoFormatDist(f float64) string {
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
+
+// getGeoSet returns the sorted set of the key, or an error message if the
+// key isn't a sorted set.
+func getGeoSet(c *Client, key string) (*dt.SortedSet, string) {
+	o := c.db.Get(key)
+	if o == nil {
+		return nil, ""
+	}
+	if o.ObjType != dt.ObjZSet {
+		return nil, ReplyWrongType
+	}
+	return o.Ptr.(*dt.SortedSet), ""
+}
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func (*cmdGeoAdd) Exec(c *Client, r *protocol.Request) error {
+	flags := 0
+	i := 2
+options:
+	for ; i < r.ArgCount(); i++ {
+		switch strings.ToLower(r.ArgvAt(i)) {
+		case "nx":
+			flags |= zaddNX
+		case "xx":
+			flags |= zaddXX
+		case "ch":
+			flags |= zaddCH
+		default:
+			break options
+		}
+	}
+	if (r.ArgCount()-i)%3 != 0 || (flags&zaddNX != 0 && flags&zaddXX != 0) {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	// the coordinates are all checked before adding anything
+	elements := (r.ArgCount() - i) / 3
+	scores := make([]float64, elements)
+	for j := 0; j < elements; j++ {
+		longitude, latitude, msg := parseLongLat(r.ArgvAt(i+j*3), r.ArgvAt(i+j*3+1))
+		if msg != "" {
+			return c.ReplyError(msg)
+		}
+		scores[j], _ = dt.GeoEncode(longitude, latitude)
+	}
+
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o != nil && o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if o == nil {
+		if flags&zaddXX != 0 {
+			return c.ReplyInt(0)
+		}
+		o = dt.NewZSet()
+		c.db.Add(key, o)
+	}
+
+	zs := o.Ptr.(*dt.SortedSet)
+	var added, updated int64
+	for j := 0; j < elements; j++ {
+		switch res, _ := zsetAdd(zs, scores[j], r.ArgvAt(i+j*3+2), flags); res {
+		case zaddAdded:
+			added++
+		case zaddUpdated:
+			updated++
+		}
+	}
+
+	c.db.elements += added
+	if added+updated > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyZset, "zadd", key, c.db.id)
+	}
+	godisServer.dirty += added + updated
+	if zs.Len() == 0 {
+		c.db.deleteKey(key)
+	}
+	if flags&zaddCH != 0 {
+		return c.ReplyInt(added + updated)
+	}
+	return c.ReplyInt(added)
+}
+
+// GEOPOS key [member [member ...]]
+func (*cmdGeoPos) Exec(c *Client, r *protocol.Request) error {
+	zs, msg := getGeoSet(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	reply := make([]interface{}, 0, r.ArgCount()-2)
+	for i := 2; i < r.ArgCount(); i++ {
+		var score float64
+		ok := false
+		if zs != nil {
+			score, ok = zs.Score(r.ArgvAt(i))
+		}
+		if !ok {
+			reply = append(reply, []interface{}(nil))
+			continue
+		}
+		longitude, latitude := dt.GeoDecode(score)
+		reply = append(reply, []string{geoFormatCoord(longitude), geoFormatCoord(latitude)})
+	}
+	return c.ReplyBulk(reply...)
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI]
+func (*cmdGeoDist) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() > 5 {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	unit := 1.0
+	if r.ArgCount() == 5 {
+		if unit = geoUnit(r.ArgvAt(4)); unit < 0 {
+			return c.ReplyError(replyGeoUnit)
+		}
+	}
+
+	zs, msg := getGeoSet(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if zs == nil {
+		return c.ReplyEmpty()
+	}
+	score1, ok1 := zs.Score(r.ArgvAt(2))
+	score2, ok2 := zs.Score(r.ArgvAt(3))
+	if !ok1 || !ok2 {
+		return c.ReplyEmpty()
+	}
+
+	long1, lat1 := dt.GeoDecode(score1)
+	long2, lat2 := dt.GeoDecode(score2)
+	return c.ReplyBulkString(geoFormatDist(dt.GeoDistance(long1, lat1, long2, lat2) / unit))
+}
+
+// GEOHASH key [member [member ...]]
+func (*cmdGeoHash) Exec(c *Client, r *protocol.Request) error {
+	zs, msg := getGeoSet(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	reply := make([]interface{}, 0, r.ArgCount()-2)
+	for i := 2; i < r.ArgCount(); i++ {
+		var score float64
+		ok := false
+		if zs != nil {
+			score, ok = zs.Score(r.ArgvAt(i))
+		}
+		if !ok {
+			reply = append(reply, nil)
+			continue
+		}
+		reply = append(reply, dt.GeoHashString(score))
+	}
+	return c.ReplyBulk(reply...)
+}
+
+// geoPoint is a member found by a search.
+type geoPoint struct {
+	member              string
+	score               float64
+	dist                float64
+	longitude, latitude float64
+}
+
+// geoMembersInShape appends the members of the cells covering the shape
+// which are inside the shape, stopping after limit members if not 0.
+func geoMembersInShape(zs *dt.SortedSet, shape *dt.GeoShape, limit int) []geoPoint {
+	var points []geoPoint
+	var last dt.GeoHashBits
+	for i, hash := range shape.Areas().Cells() {
+		if hash.IsZero() {
+			continue
+		}
+		// the neighbors of a large radius may be the same cell
+		if i > 0 && hash == last {
+			continue
+		}
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+		last = hash
+
+		min, max := hash.ScoreRange()
+		spec := &dt.ZRangeSpec{Min: float64(min), Max: float64(max), MaxEx: true}
+		for ln := zs.Skiplist().FirstInRange(spec); ln != nil && spec.LteMax(ln.Score); ln = ln.Next() {
+			if limit > 0 && len(points) >= limit {
+				break
+			}
+			longitude, latitude := dt.GeoDecode(ln.Score)
+			dist, ok := shape.Contains(longitude, latitude)
+			if !ok {
+				continue
+			}
+			points = append(points, geoPoint{
+				member:    ln.Member,
+				score:     ln.Score,
+				dist:      dist,
+				longitude: longitude,
+				latitude:  latitude,
+			})
+		}
+	}
+	return points
+}
+
+// GEOSEARCH key <FROMMEMBER member | FROMLONLAT longitude latitude>
+// <BYRADIUS radius unit | BYBOX width height unit> [ASC|DESC]
+// [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func (*cmdGeoSearch) Exec(c *Client, r *protocol.Request) error {
+	return geosearchGenericCommand(c, r, 1, "")
+}
+
+// GEOSEARCHSTORE destination source <FROMMEMBER member | FROMLONLAT
+// longitude latitude> <BYRADIUS radius unit | BYBOX width height unit>
+// [ASC|DESC] [COUNT count [ANY]] [STOREDIST]
+func (*cmdGeoSearchStore) Exec(c *Client, r *protocol.Request) error {
+	return geosearchGenericCommand(c, r, 2, r.ArgvAt(1))
+}
+
+// search orders
+const (
+	geoSortNone = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+func geosearchGenericCommand(c *Client, r *protocol.Request, srcIdx int, dstkey string) error {
+	zs, msg := getGeoSet(c, r.ArgvAt(srcIdx))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	shape := new(dt.GeoShape)
+	unit := 1.0
+	var withdist, withhash, withcoord, storedist, anyMatch bool
+	var frommember, fromloc, byradius, bybox bool
+	sortOrder := geoSortNone
+	var count int64
+	for i := srcIdx + 1; i < r.ArgCount(); i++ {
+		leftargs := r.ArgCount() - i - 1
+		switch arg := strings.ToLower(r.ArgvAt(i)); {
+		case arg == "withdist":
+			withdist = true
+		case arg == "withhash":
+			withhash = true
+		case arg == "withcoord":
+			withcoord = true
+		case dstkey != "" && arg == "storedist":
+			storedist = true
+		case arg == "any":
+			anyMatch = true
+		case arg == "asc":
+			sortOrder = geoSortAsc
+		case arg == "desc":
+			sortOrder = geoSortDesc
+		case arg == "count" && leftargs >= 1:
+			var err error
+			if count, err = strconv.ParseInt(r.ArgvAt(i+1), 10, 64); err != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			if count <= 0 {
+				return c.ReplyError("COUNT must be > 0")
+			}
+			i++
+		case arg == "frommember" && leftargs >= 1:
+			// a missing source is reported after parsing all the arguments
+			if zs != nil {
+				score, ok := zs.Score(r.ArgvAt(i + 1))
+				if !ok {
+					return c.ReplyError("could not decode requested zset member")
+				}
+				shape.Longitude, shape.Latitude = dt.GeoDecode(score)
+			}
+			frommember = true
+			i++
+		case arg == "fromlonlat" && leftargs >= 2:
+			var msg string
+			shape.Longitude, shape.Latitude, msg = parseLongLat(r.ArgvAt(i+1), r.ArgvAt(i+2))
+			if msg != "" {
+				return c.ReplyError(msg)
+			}
+			fromloc = true
+			i += 2
+		case arg == "byradius" && leftargs >= 2:
+			radius, err := parseFloat(r.ArgvAt(i + 1))
+			if err != nil {
+				return c.ReplyError("need numeric radius")
+			}
+			if radius < 0 {
+				return c.ReplyError("radius cannot be negative")
+			}
+			if unit = geoUnit(r.ArgvAt(i + 2)); unit < 0 {
+				return c.ReplyError(replyGeoUnit)
+			}
+			shape.Box, shape.Radius = false, radius*unit
+			byradius = true
+			i += 2
+		case arg == "bybox" && leftargs >= 3:
+			width, err := parseFloat(r.ArgvAt(i + 1))
+			if err != nil {
+				return c.ReplyError("need numeric width")
+			}
+			height, err := parseFloat(r.ArgvAt(i + 2))
+			if err != nil {
+				return c.ReplyError("need numeric height")
+			}
+			if width < 0 || height < 0 {
+				return c.ReplyError("height or width cannot be negative")
+			}
+			if unit = geoUnit(r.ArgvAt(i + 3)); unit < 0 {
+				return c.ReplyError(replyGeoUnit)
+			}
+			shape.Box, shape.Width, shape.Height = true, width*unit, height*unit
+			bybox = true
+			i += 3
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+
+	if dstkey != "" && (withdist || withhash || withcoord) {
+		return c.ReplyError("GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	}
+	cmd := strings.ToLower(r.CommandName())
+	if frommember == fromloc {
+		return c.ReplyError("exactly one of FROMMEMBER or FROMLONLAT can be specified for " + cmd)
+	}
+	if byradius == bybox {
+		return c.ReplyError("exactly one of BYRADIUS and BYBOX can be specified for " + cmd)
+	}
+	if anyMatch && count == 0 {
+		return c.ReplyError("the ANY argument requires COUNT argument")
+	}
+
+	if zs == nil {
+		if dstkey == "" {
+			return c.ReplyList(nil)
+		}
+		if c.db.Get(dstkey) != nil {
+			c.db.deleteKey(dstkey)
+			signalModifiedKey(c.db, dstkey)
+			notifyKeyspaceEvent(NotifyGeneric, "del", dstkey, c.db.id)
+			godisServer.dirty++
+		}
+		return c.ReplyInt(0)
+	}
+
+	// the closest members are returned when there is a COUNT, unless ANY
+	// members are wanted.
+	if count != 0 && sortOrder == geoSortNone && !anyMatch {
+		sortOrder = geoSortAsc
+	}
+
+	limit := 0
+	if anyMatch {
+		limit = int(count)
+	}
+	points := geoMembersInShape(zs, shape, limit)
+	switch sortOrder {
+	case geoSortAsc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case geoSortDesc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+	if count != 0 && int64(len(points)) > count {
+		points = points[:count]
+	}
+
+	if dstkey != "" {
+		if len(points) == 0 {
+			if c.db.Get(dstkey) != nil {
+				c.db.deleteKey(dstkey)
+				signalModifiedKey(c.db, dstkey)
+				notifyKeyspaceEvent(NotifyGeneric, "del", dstkey, c.db.id)
+				godisServer.dirty++
+			}
+			return c.ReplyInt(0)
+		}
+
+		o := dt.NewZSet()
+		dst := o.Ptr.(*dt.SortedSet)
+		for _, p := range points {
+			if storedist {
+				dst.Add(p.member, p.dist/unit)
+			} else {
+				dst.Add(p.member, p.score)
+			}
+		}
+		c.db.Set(dstkey, o)
+		signalModifiedKey(c.db, dstkey)
+		notifyKeyspaceEvent(NotifyZset, "geosearchstore", dstkey, c.db.id)
+		godisServer.dirty += int64(len(points))
+		return c.ReplyInt(int64(len(points)))
+	}
+
+	if !withdist && !withhash && !withcoord {
+		members := make([]string, 0, len(points))
+		for _, p := range points {
+			members = append(members, p.member)
+		}
+		return c.ReplyList(members)
+	}
+
+	reply := make([]interface{}, 0, len(points))
+	for _, p := range points {
+		item := []interface{}{p.member}
+		if withdist {
+			item = append(item, geoFormatDist(p.dist/unit))
+		}
+		if withhash {
+			item = append(item, int64(p.score))
+		}
+		if withcoord {
+			item = append(item, []string{geoFormatCoord(p.longitude), geoFormatCoord(p.latitude)})
+		}
+		reply = append(reply, item)
+	}
+	return c.ReplyBulk(reply...)
+}
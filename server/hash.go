@@ -0,0 +1,541 @@
+package server
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdHSet struct{}
+type cmdHMSet struct{}
+type cmdHSetNX struct{}
+type cmdHGet struct{}
+type cmdHMGet struct{}
+type cmdHDel struct{}
+type cmdHExists struct{}
+type cmdHLen struct{}
+type cmdHStrLen struct{}
+type cmdHKeys struct{}
+type cmdHVals struct{}
+type cmdHGetAll struct{}
+type cmdHIncrBy struct{}
+type cmdHIncrByFloat struct{}
+type cmdHRandField struct{}
+type cmdHScan struct{}
+
+// A hash is encoded as a ziplist of field, value pairs while it's small,
+// and is converted to a dict of field -> value when it grows beyond
+// hashMaxZiplistEntries, or when a field or value is longer than
+// hashMaxZiplistValue.
+
+func hashTypeLength(o *dt.Object) int64 {
+	if o.Encoding == dt.ObjEncodingZiplist {
+		return int64(o.Ptr.(*dt.Ziplist).Len() / 2)
+	}
+	return o.Ptr.(*dt.Dict).Used()
+}
+
+func hashTypeGet(o *dt.Object, field string) (string, bool) {
+	if o.Encoding == dt.ObjEncodingZiplist {
+		zl := o.Ptr.(*dt.Ziplist)
+		i := zl.Find(field, 0, 1)
+		if i == -1 {
+			return "", false
+		}
+		return zl.Index(i + 1)
+	}
+
+	de := o.Ptr.(*dt.Dict).Get(field)
+	if de == nil {
+		return "", false
+	}
+	return de.Value.(string), true
+}
+
+// hashTypeSet sets the field to value, and returns true if the field is new.
+func hashTypeSet(o *dt.Object, field, value string) bool {
+	if o.Encoding == dt.ObjEncodingZiplist {
+		if len(field) > godisServer.hashMaxZiplistValue || len(value) > godisServer.hashMaxZiplistValue {
+			hashTypeConvert(o)
+		}
+	}
+
+	if o.Encoding == dt.ObjEncodingZiplist {
+		zl := o.Ptr.(*dt.Ziplist)
+		if i := zl.Find(field, 0, 1); i != -1 {
+			zl.Replace(i+1, value)
+			return false
+		}
+
+		zl.Push(field)
+		zl.Push(value)
+		if zl.Len()/2 > godisServer.hashMaxZiplistEntries {
+			hashTypeConvert(o)
+		}
+		return true
+	}
+
+	d := o.Ptr.(*dt.Dict)
+	update := d.Get(field) != nil
+	d.Add(field, value)
+	return !update
+}
+
+func hashTypeDelete(o *dt.Object, field string) bool {
+	if o.Encoding == dt.ObjEncodingZiplist {
+		zl := o.Ptr.(*dt.Ziplist)
+		i := zl.Find(field, 0, 1)
+		if i == -1 {
+			return false
+		}
+		zl.Delete(i, 2)
+		return true
+	}
+
+	return o.Ptr.(*dt.Dict).Delete(field) != nil
+}
+
+// hashTypeIterate calls fn for every field of the hash until fn returns false.
+func hashTypeIterate(o *dt.Object, fn func(field, value string) bool) {
+	if o.Encoding == dt.ObjEncodingZiplist {
+		var field string
+		o.Ptr.(*dt.Ziplist).Iterate(func(i int, v string) bool {
+			if i%2 == 0 {
+				field = v
+				return true
+			}
+			return fn(field, v)
+		})
+		return
+	}
+
+	o.Ptr.(*dt.Dict).Iterate(func(de *dt.Entry) bool {
+		return fn(de.Key, de.Value.(string))
+	})
+}
+
+func hashTypeRandomElement(o *dt.Object) (string, string) {
+	if o.Encoding == dt.ObjEncodingZiplist {
+		zl := o.Ptr.(*dt.Ziplist)
+		i := rand.Intn(zl.Len()/2) * 2
+		field, _ := zl.Index(i)
+		value, _ := zl.Index(i + 1)
+		return field, value
+	}
+
+	de := o.Ptr.(*dt.Dict).RandomEntry()
+	return de.Key, de.Value.(string)
+}
+
+func hashTypeConvert(o *dt.Object) {
+	d := dt.NewDict()
+	hashTypeIterate(o, func(field, value string) bool {
+		d.Add(field, value)
+		return true
+	})
+	o.Ptr = d
+	o.Encoding = dt.ObjEncodingHt
+}
+
+// hashTypeLookupWriteOrCreate returns the hash stored at key, creating it
+// if it doesn't exist. It returns nil when the key holds another type.
+func hashTypeLookupWriteOrCreate(c *Client, key string) *dt.Object {
+	o := c.db.Get(key)
+	if o == nil {
+		o = dt.NewHash()
+		c.db.Add(key, o)
+	} else if o.ObjType != dt.ObjHash {
+		return nil
+	}
+	return o
+}
+
+// HSET key field value [field value ...]
+func (*cmdHSet) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() < 4 || r.ArgCount()%2 != 0 {
+		return c.ReplyError("wrong number of arguments for 'hset' command")
+	}
+
+	created, err := hsetGeneric(c, r)
+	if err != nil {
+		return err
+	}
+	return c.ReplyInt(created)
+}
+
+// HMSET key field value [field value ...]
+func (*cmdHMSet) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() < 4 || r.ArgCount()%2 != 0 {
+		return c.ReplyError("wrong number of arguments for 'hmset' command")
+	}
+
+	if _, err := hsetGeneric(c, r); err != nil {
+		return err
+	}
+	return c.Reply("OK")
+}
+
+func hsetGeneric(c *Client, r *protocol.Request) (int64, error) {
+	key := r.ArgvAt(1)
+	o := hashTypeLookupWriteOrCreate(c, key)
+	if o == nil {
+		return 0, c.ReplyError(ReplyWrongType)
+	}
+
+	var created int64
+	for i := 2; i < r.ArgCount(); i += 2 {
+		if hashTypeSet(o, r.ArgvAt(i), r.ArgvAt(i+1)) {
+			created++
+		}
+	}
+	c.db.elements += created
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyHash, "hset", key, c.db.id)
+	godisServer.dirty += int64(r.ArgCount()-2) / 2
+	return created, nil
+}
+
+func (*cmdHSetNX) Exec(c *Client, r *protocol.Request) error {
+	key, field := r.ArgvAt(1), r.ArgvAt(2)
+	o := hashTypeLookupWriteOrCreate(c, key)
+	if o == nil {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if _, ok := hashTypeGet(o, field); ok {
+		return c.ReplyInt(0)
+	}
+
+	hashTypeSet(o, field, r.ArgvAt(3))
+	c.db.elements++
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyHash, "hset", key, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(1)
+}
+
+func (*cmdHGet) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyEmpty()
+	}
+	if o.ObjType != dt.ObjHash {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	value, ok := hashTypeGet(o, r.ArgvAt(2))
+	if !ok {
+		return c.ReplyEmpty()
+	}
+	return c.ReplyBulkString(value)
+}
+
+func (*cmdHMGet) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjHash {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	values := make([]interface{}, 0, r.ArgCount()-2)
+	for i := 2; i < r.ArgCount(); i++ {
+		if o == nil {
+			values = append(values, nil)
+		} else if value, ok := hashTypeGet(o, r.ArgvAt(i)); ok {
+			values = append(values, value)
+		} else {
+			values = append(values, nil)
+		}
+	}
+	return c.ReplyBulk(values...)
+}
+
+func (*cmdHDel) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjHash {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	var deleted int64
+	for i := 2; i < r.ArgCount(); i++ {
+		if hashTypeDelete(o, r.ArgvAt(i)) {
+			deleted++
+		}
+	}
+	c.db.elements -= deleted
+	if deleted > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyHash, "hdel", key, c.db.id)
+	}
+	if hashTypeLength(o) == 0 {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+	}
+	godisServer.dirty += deleted
+	return c.ReplyInt(deleted)
+}
+
+func (*cmdHExists) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjHash {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	if _, ok := hashTypeGet(o, r.ArgvAt(2)); ok {
+		return c.ReplyInt(1)
+	}
+	return c.ReplyInt(0)
+}
+
+func (*cmdHLen) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjHash {
+		return c.ReplyError(ReplyWrongType)
+	}
+	return c.ReplyInt(hashTypeLength(o))
+}
+
+func (*cmdHStrLen) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjHash {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	value, _ := hashTypeGet(o, r.ArgvAt(2))
+	return c.ReplyInt(int64(len(value)))
+}
+
+const (
+	hashGetKeys = 1 << iota
+	hashGetValues
+)
+
+func hgetallGeneric(c *Client, r *protocol.Request, flags int) error {
+	// the fields with their values are a map in RESP3
+	reply := c.ReplyList
+	if flags == hashGetKeys|hashGetValues {
+		reply = c.ReplyMap
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return reply(nil)
+	}
+	if o.ObjType != dt.ObjHash {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	var list []string
+	hashTypeIterate(o, func(field, value string) bool {
+		if flags&hashGetKeys != 0 {
+			list = append(list, field)
+		}
+		if flags&hashGetValues != 0 {
+			list = append(list, value)
+		}
+		return true
+	})
+	return reply(list)
+}
+
+func (*cmdHKeys) Exec(c *Client, r *protocol.Request) error {
+	return hgetallGeneric(c, r, hashGetKeys)
+}
+
+func (*cmdHVals) Exec(c *Client, r *protocol.Request) error {
+	return hgetallGeneric(c, r, hashGetValues)
+}
+
+func (*cmdHGetAll) Exec(c *Client, r *protocol.Request) error {
+	return hgetallGeneric(c, r, hashGetKeys|hashGetValues)
+}
+
+func (*cmdHIncrBy) Exec(c *Client, r *protocol.Request) error {
+	key, field := r.ArgvAt(1), r.ArgvAt(2)
+	incr, err := strconv.ParseInt(r.ArgvAt(3), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+
+	o := hashTypeLookupWriteOrCreate(c, key)
+	if o == nil {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	var value int64
+	old, exists := hashTypeGet(o, field)
+	if exists {
+		if value, err = strconv.ParseInt(old, 10, 64); err != nil {
+			return c.ReplyError("hash value is not an integer")
+		}
+	}
+	if addOverflows(value, incr) {
+		return c.ReplyError(ReplyOverflow)
+	}
+
+	value += incr
+	hashTypeSet(o, field, strconv.FormatInt(value, 10))
+	if !exists {
+		c.db.elements++
+	}
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyHash, "hincrby", key, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(value)
+}
+
+func (*cmdHIncrByFloat) Exec(c *Client, r *protocol.Request) error {
+	key, field := r.ArgvAt(1), r.ArgvAt(2)
+	incr, err := parseFloat(r.ArgvAt(3))
+	if err != nil {
+		return c.ReplyError(ReplyNotFloat)
+	}
+
+	o := hashTypeLookupWriteOrCreate(c, key)
+	if o == nil {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	var value float64
+	old, exists := hashTypeGet(o, field)
+	if exists {
+		if value, err = parseFloat(old); err != nil {
+			return c.ReplyError("hash value is not a float")
+		}
+	}
+
+	value += incr
+	if isNaNOrInf(value) {
+		return c.ReplyError("increment would produce NaN or Infinity")
+	}
+
+	s := formatFloat(value)
+	hashTypeSet(o, field, s)
+	if !exists {
+		c.db.elements++
+	}
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyHash, "hincrbyfloat", key, c.db.id)
+	godisServer.dirty++
+
+	// always replicate HINCRBYFLOAT as an HSET with the final value, so
+	// float precision or formatting differences can't create discrepancies.
+	c.propagate(CmdNameHSet, key, field, s)
+	return c.ReplyBulkString(s)
+}
+
+// HRANDFIELD key [count [WITHVALUES]]
+func (*cmdHRandField) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	if argc < 2 || argc > 4 {
+		return c.ReplyError("wrong number of arguments for 'hrandfield' command")
+	}
+
+	withvalues := false
+	if argc == 4 {
+		if !strings.EqualFold(r.ArgvAt(3), "withvalues") {
+			return c.ReplyError(ReplySyntaxErr)
+		}
+		withvalues = true
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjHash {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	if argc == 2 {
+		if o == nil {
+			return c.ReplyEmpty()
+		}
+		field, _ := hashTypeRandomElement(o)
+		return c.ReplyBulkString(field)
+	}
+
+	count, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+	if o == nil || count == 0 {
+		return c.ReplyList(nil)
+	}
+
+	var list []string
+	add := func(field, value string) {
+		list = append(list, field)
+		if withvalues {
+			list = append(list, value)
+		}
+	}
+
+	// a negative count allows the same field to be returned multiple times
+	if count < 0 {
+		for i := count; i < 0; i++ {
+			add(hashTypeRandomElement(o))
+		}
+		return c.ReplyList(list)
+	}
+
+	size := hashTypeLength(o)
+	if count*3 > size || o.Encoding == dt.ObjEncodingZiplist {
+		var fields, values []string
+		hashTypeIterate(o, func(field, value string) bool {
+			fields = append(fields, field)
+			values = append(values, value)
+			return true
+		})
+		if count > size {
+			count = size
+		}
+		for i := int64(0); i < count; i++ {
+			j := i + rand.Int63n(size-i)
+			fields[i], fields[j] = fields[j], fields[i]
+			values[i], values[j] = values[j], values[i]
+			add(fields[i], values[i])
+		}
+		return c.ReplyList(list)
+	}
+
+	// the count is small compared to the size of the hash, pick random
+	// elements until we have enough distinct ones.
+	picked := make(map[string]bool, count)
+	for int64(len(picked)) < count {
+		field, value := hashTypeRandomElement(o)
+		if !picked[field] {
+			picked[field] = true
+			add(field, value)
+		}
+	}
+	return c.ReplyList(list)
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES]
+func (*cmdHScan) Exec(c *Client, r *protocol.Request) error {
+	cursor, err := parseScanCursor(r.ArgvAt(2))
+	if err != nil {
+		return c.ReplyError("invalid cursor")
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjHash {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if o == nil {
+		return c.ReplyBulk("0", []string{})
+	}
+	return scanGenericCommand(c, r, o, cursor, 3)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdPFAdd struct{}
+type cmdPFCount struct{}
+type cmdPFMerge struct{}
+
+// The HLLs are strings, so they are saved and rewritten like every other
+// string, see dt/hyperloglog.go for their layout.
+
+const (
+	replyNotHLL     = "WRONGTYPE Key is not a valid HyperLogLog string value."
+	replyCorruptHLL = "INVALIDOBJ Corrupted HLL object detected"
+)
+
+// getHLL returns the HLL object of the key, or an error message if the
+// key isn't an HLL.
+func getHLL(c *Client, key string) (*dt.Object, string) {
+	o, msg := getString(c, key)
+	if msg != "" {
+		return nil, msg
+	}
+	if o != nil && !dt.IsHLL(stringBytes(o)) {
+		return nil, replyNotHLL
+	}
+	return o, ""
+}
+
+// PFADD key [element [element ...]]
+func (*cmdPFAdd) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	o, msg := getHLL(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	created := false
+	if o == nil {
+		o = dt.NewBytesObject(dt.NewHLL())
+		c.db.Add(key, o)
+		created = true
+	} else {
+		o = unshareStringValue(c.db, key, o)
+	}
+
+	hll, updated, err := dt.HLLAdd(o.Ptr.([]byte), r.Argv()[2:], godisServer.hllSparseMaxBytes)
+	if err != nil {
+		return c.ReplyError(replyCorruptHLL)
+	}
+	o.Ptr = hll
+	if !created && !updated {
+		return c.ReplyInt(0)
+	}
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyString, "pfadd", key, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(1)
+}
+
+// PFCOUNT key [key ...]
+func (*cmdPFCount) Exec(c *Client, r *protocol.Request) error {
+	// the union of several HLLs is computed on the fly
+	if r.ArgCount() > 2 {
+		regs := make([]uint8, dt.HLLRegisters)
+		for i := 1; i < r.ArgCount(); i++ {
+			o, msg := getHLL(c, r.ArgvAt(i))
+			if msg != "" {
+				return c.ReplyError(msg)
+			}
+			if o == nil {
+				continue
+			}
+			if err := dt.HLLMergeRegisters(regs, stringBytes(o)); err != nil {
+				return c.ReplyError(replyCorruptHLL)
+			}
+		}
+		return c.ReplyInt(int64(dt.HLLCountRegisters(regs)))
+	}
+
+	key := r.ArgvAt(1)
+	o, msg := getHLL(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if card, ok := dt.HLLCachedCount(stringBytes(o)); ok {
+		return c.ReplyInt(int64(card))
+	}
+
+	// the cardinality is cached in the HLL, which is modified
+	o = unshareStringValue(c.db, key, o)
+	card, err := dt.HLLCount(o.Ptr.([]byte))
+	if err != nil {
+		return c.ReplyError(replyCorruptHLL)
+	}
+	signalModifiedKey(c.db, key)
+	godisServer.dirty++
+	return c.ReplyInt(int64(card))
+}
+
+// PFMERGE destkey [sourcekey [sourcekey ...]]
+func (*cmdPFMerge) Exec(c *Client, r *protocol.Request) error {
+	// the destination is merged too, the result stays sparse unless one of
+	// the HLLs is dense.
+	regs := make([]uint8, dt.HLLRegisters)
+	dense := false
+	for i := 1; i < r.ArgCount(); i++ {
+		o, msg := getHLL(c, r.ArgvAt(i))
+		if msg != "" {
+			return c.ReplyError(msg)
+		}
+		if o == nil {
+			continue
+		}
+		hll := stringBytes(o)
+		if dt.HLLEncoding(hll) == dt.HLLDense {
+			dense = true
+		}
+		if err := dt.HLLMergeRegisters(regs, hll); err != nil {
+			return c.ReplyError(replyCorruptHLL)
+		}
+	}
+
+	hll := dt.HLLFromRegisters(regs, dense, godisServer.hllSparseMaxBytes)
+	c.db.Add(r.ArgvAt(1), dt.NewBytesObject(hll))
+	signalModifiedKey(c.db, r.ArgvAt(1))
+	notifyKeyspaceEvent(NotifyString, "pfadd", r.ArgvAt(1), c.db.id)
+	godisServer.dirty++
+	return c.Reply("OK")
+}
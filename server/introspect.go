@@ -0,0 +1,404 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdCommand struct{}
+
+// commandDoc is the documentation of a command replied by COMMAND DOCS.
+type commandDoc struct {
+	group   string
+	summary string
+}
+
+// commandDocs are the documentation of the commands, by name.
+var commandDocs = map[string]commandDoc{
+	CmdNamePing:    {"connection", "Returns the server's liveliness response."},
+	CmdNameHello:   {"connection", "Handshakes with the Redis server."},
+	CmdNameCommand: {"server", "Returns detailed information about all commands."},
+
+	CmdNameBgRewriteAOF: {"server", "Asynchronously rewrites the append-only file to disk."},
+	CmdNameSave:         {"server", "Synchronously saves the database(s) to disk."},
+	CmdNameBgSave:       {"server", "Asynchronously saves the database(s) to disk."},
+	CmdNameLastSave:     {"server", "Returns the Unix timestamp of the last successful save to disk."},
+	CmdNameObject:       {"generic", "Returns the internal encoding of a Redis object."},
+	CmdNameConfig:       {"server", "Gets or sets the values of the configuration parameters."},
+
+	CmdNameSelect:   {"connection", "Changes the selected database."},
+	CmdNameMove:     {"generic", "Moves a key to another database."},
+	CmdNameSwapDB:   {"server", "Swaps two Redis databases."},
+	CmdNameFlushDB:  {"server", "Removes all keys from the current database."},
+	CmdNameFlushAll: {"server", "Removes all keys from all databases."},
+	CmdNameDBSize:   {"server", "Returns the number of keys in the database."},
+	CmdNameScan:     {"generic", "Iterates over the key names in the database."},
+	CmdNameKeys:     {"generic", "Returns all key names that match a pattern."},
+
+	CmdNameGet:    {"string", "Returns the string value of a key."},
+	CmdNameSet:    {"string", "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist."},
+	CmdNameSetEX:  {"string", "Sets the string value and expiration time of a key. Creates the key if it doesn't exist."},
+	CmdNamePSetEX: {"string", "Sets both string value and expiration time in milliseconds of a key. The key is created if it doesn't exist."},
+	CmdNameSetNX:  {"string", "Set the string value of a key only when the key doesn't exist."},
+	CmdNameGetSet: {"string", "Returns the previous string value of a key after setting it to a new value."},
+	CmdNameGetDel: {"string", "Returns the string value of a key after deleting the key."},
+	CmdNameGetEx:  {"string", "Returns the string value of a key after setting its expiration time."},
+
+	CmdNameIncr:        {"string", "Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist."},
+	CmdNameDecr:        {"string", "Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist."},
+	CmdNameIncrBy:      {"string", "Increments the integer value of a key by a number. Uses 0 as initial value if the key doesn't exist."},
+	CmdNameDecrBy:      {"string", "Decrements a number from the integer value of a key. Uses 0 as initial value if the key doesn't exist."},
+	CmdNameIncrByFloat: {"string", "Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist."},
+
+	CmdNameMGet:     {"string", "Atomically returns the string values of one or more keys."},
+	CmdNameMSet:     {"string", "Atomically creates or modifies the string values of one or more keys."},
+	CmdNameMSetNX:   {"string", "Atomically modifies the string values of one or more keys only when all keys don't exist."},
+	CmdNameAppend:   {"string", "Appends a string to the value of a key. Creates the key if it doesn't exist."},
+	CmdNameStrLen:   {"string", "Returns the length of a string value."},
+	CmdNameGetRange: {"string", "Returns a substring of the string stored at a key."},
+	CmdNameSetRange: {"string", "Overwrites a part of a string value with another by an offset. Creates the key if it doesn't exist."},
+	CmdNameLCS:      {"string", "Finds the longest common substring."},
+
+	CmdNameSetBit:     {"bitmap", "Sets or clears the bit at offset of the string value. Creates the key if it doesn't exist."},
+	CmdNameGetBit:     {"bitmap", "Returns a bit value by offset."},
+	CmdNameBitCount:   {"bitmap", "Counts the number of set bits (population counting) in a string."},
+	CmdNameBitPos:     {"bitmap", "Finds the first set (1) or clear (0) bit in a string."},
+	CmdNameBitOp:      {"bitmap", "Performs bitwise operations on multiple strings, and stores the result."},
+	CmdNameBitField:   {"bitmap", "Performs arbitrary bitfield integer operations on strings."},
+	CmdNameBitFieldRO: {"bitmap", "Performs arbitrary read-only bitfield integer operations on strings."},
+
+	CmdNamePFAdd:   {"hyperloglog", "Adds elements to a HyperLogLog key. Creates the key if it doesn't exist."},
+	CmdNamePFCount: {"hyperloglog", "Returns the approximated cardinality of the set(s) observed by the HyperLogLog key(s)."},
+	CmdNamePFMerge: {"hyperloglog", "Merges one or more HyperLogLog values into a single key."},
+
+	CmdNameDel:       {"generic", "Deletes one or more keys."},
+	CmdNameUnlink:    {"generic", "Asynchronously deletes one or more keys."},
+	CmdNameExists:    {"generic", "Determines whether one or more keys exist."},
+	CmdNameType:      {"generic", "Determines the type of value stored at a key."},
+	CmdNameRename:    {"generic", "Renames a key and overwrites the destination."},
+	CmdNameRenameNX:  {"generic", "Renames a key only when the target key name doesn't exist."},
+	CmdNameCopy:      {"generic", "Copies the value of a key to a new key."},
+	CmdNameRandomKey: {"generic", "Returns a random key name from the database."},
+	CmdNameTouch:     {"generic", "Returns the number of existing keys out of those specified after updating the time they were last accessed."},
+
+	CmdNameExpire:      {"generic", "Sets the expiration time of a key in seconds."},
+	CmdNamePExpire:     {"generic", "Sets the expiration time of a key in milliseconds."},
+	CmdNameExpireAt:    {"generic", "Sets the expiration time of a key to a Unix timestamp."},
+	CmdNamePExpireAt:   {"generic", "Sets the expiration time of a key to a Unix milliseconds timestamp."},
+	CmdNameTTL:         {"generic", "Returns the expiration time in seconds of a key."},
+	CmdNamePTTL:        {"generic", "Returns the expiration time in milliseconds of a key."},
+	CmdNameExpireTime:  {"generic", "Returns the expiration time of a key as a Unix timestamp."},
+	CmdNamePExpireTime: {"generic", "Returns the expiration time of a key as a Unix milliseconds timestamp."},
+	CmdNamePersist:     {"generic", "Removes the expiration time of a key."},
+
+	CmdNameMulti:   {"transactions", "Starts a transaction."},
+	CmdNameExec:    {"transactions", "Executes all commands in a transaction."},
+	CmdNameDiscard: {"transactions", "Discards a transaction."},
+	CmdNameWatch:   {"transactions", "Monitors changes to keys to determine the execution of a transaction."},
+	CmdNameUnwatch: {"transactions", "Forgets about watched keys of a transaction."},
+
+	CmdNameSubscribe:    {"pubsub", "Listens for messages published to channels."},
+	CmdNameUnsubscribe:  {"pubsub", "Stops listening to messages posted to channels."},
+	CmdNamePSubscribe:   {"pubsub", "Listens for messages published to channels that match one or more patterns."},
+	CmdNamePUnsubscribe: {"pubsub", "Stops listening to messages published to channels that match one or more patterns."},
+	CmdNamePublish:      {"pubsub", "Posts a message to a channel."},
+	CmdNameSSubscribe:   {"pubsub", "Listens for messages published to shard channels."},
+	CmdNameSUnsubscribe: {"pubsub", "Stops listening to messages posted to shard channels."},
+	CmdNameSPublish:     {"pubsub", "Post a message to a shard channel"},
+	CmdNamePubsub:       {"pubsub", "Inspects the state of the Pub/Sub subsystem."},
+
+	CmdNameEval:      {"scripting", "Executes a server-side Lua script."},
+	CmdNameEvalSha:   {"scripting", "Executes a server-side Lua script by SHA1 digest."},
+	CmdNameEvalRO:    {"scripting", "Executes a read-only server-side Lua script."},
+	CmdNameEvalShaRO: {"scripting", "Executes a read-only server-side Lua script by SHA1 digest."},
+	CmdNameScript:    {"scripting", "Manages the server-side Lua scripts."},
+	CmdNameFunction:  {"scripting", "Manages the function libraries."},
+	CmdNameFCall:     {"scripting", "Invokes a function."},
+	CmdNameFCallRO:   {"scripting", "Invokes a read-only function."},
+
+	CmdNameHSet:         {"hash", "Creates or modifies the value of a field in a hash."},
+	CmdNameHMSet:        {"hash", "Sets the values of multiple fields."},
+	CmdNameHSetNX:       {"hash", "Sets the value of a field in a hash only when the field doesn't exist."},
+	CmdNameHGet:         {"hash", "Returns the value of a field in a hash."},
+	CmdNameHMGet:        {"hash", "Returns the values of all fields in a hash."},
+	CmdNameHDel:         {"hash", "Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain."},
+	CmdNameHExists:      {"hash", "Determines whether a field exists in a hash."},
+	CmdNameHLen:         {"hash", "Returns the number of fields in a hash."},
+	CmdNameHStrLen:      {"hash", "Returns the length of the value of a field."},
+	CmdNameHKeys:        {"hash", "Returns all fields in a hash."},
+	CmdNameHVals:        {"hash", "Returns all values in a hash."},
+	CmdNameHGetAll:      {"hash", "Returns all fields and values in a hash."},
+	CmdNameHIncrBy:      {"hash", "Increments the integer value of a field in a hash by a number. Uses 0 as initial value if the field doesn't exist."},
+	CmdNameHIncrByFloat: {"hash", "Increments the floating point value of a field by a number. Uses 0 as initial value if the field doesn't exist."},
+	CmdNameHRandField:   {"hash", "Returns one or more random fields from a hash."},
+	CmdNameHScan:        {"hash", "Iterates over fields and values of a hash."},
+
+	CmdNameLPush:      {"list", "Prepends one or more elements to a list. Creates the key if it doesn't exist."},
+	CmdNameRPush:      {"list", "Appends one or more elements to a list. Creates the key if it doesn't exist."},
+	CmdNameLPushX:     {"list", "Prepends one or more elements to a list only when the list exists."},
+	CmdNameRPushX:     {"list", "Appends an element to a list only when the list exists."},
+	CmdNameLPop:       {"list", "Returns the first elements in a list after removing it. Deletes the list if the last element was popped."},
+	CmdNameRPop:       {"list", "Returns and removes the last elements of a list. Deletes the list if the last element was popped."},
+	CmdNameLLen:       {"list", "Returns the length of a list."},
+	CmdNameLIndex:     {"list", "Returns an element from a list by its index."},
+	CmdNameLSet:       {"list", "Sets the value of an element in a list by its index."},
+	CmdNameLRange:     {"list", "Returns a range of elements from a list."},
+	CmdNameLInsert:    {"list", "Inserts an element before or after another element in a list."},
+	CmdNameLRem:       {"list", "Removes elements from a list. Deletes the list if the last element was removed."},
+	CmdNameLTrim:      {"list", "Removes elements from both ends a list. Deletes the list if all elements were trimmed."},
+	CmdNameLPos:       {"list", "Returns the index of matching elements in a list."},
+	CmdNameLMove:      {"list", "Returns an element after popping it from one list and pushing it to another. Deletes the list if the last element was moved."},
+	CmdNameRPopLPush:  {"list", "Returns the last element of a list after removing and pushing it to another list. Deletes the list if the last element was popped."},
+	CmdNameLMPop:      {"list", "Returns multiple elements from a list after removing them. Deletes the list if the last element was popped."},
+	CmdNameBLPop:      {"list", "Removes and returns the first element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped."},
+	CmdNameBRPop:      {"list", "Removes and returns the last element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped."},
+	CmdNameBLMove:     {"list", "Pops an element from a list, pushes it to another list and returns it. Blocks until an element is available otherwise. Deletes the list if the last element was moved."},
+	CmdNameBRPopLPush: {"list", "Pops an element from a list, pushes it to another list and returns it. Block until an element is available otherwise. Deletes the list if the last element was popped."},
+	CmdNameBLMPop:     {"list", "Pops the first element from one of multiple lists. Blocks until an element is available otherwise. Deletes the list if the last element was popped."},
+
+	CmdNameSAdd:        {"set", "Adds one or more members to a set. Creates the key if it doesn't exist."},
+	CmdNameSRem:        {"set", "Removes one or more members from a set. Deletes the set if the last member was removed."},
+	CmdNameSIsMember:   {"set", "Determines whether a member belongs to a set."},
+	CmdNameSMIsMember:  {"set", "Determines whether multiple members belong to a set."},
+	CmdNameSCard:       {"set", "Returns the number of members in a set."},
+	CmdNameSMembers:    {"set", "Returns all members of a set."},
+	CmdNameSPop:        {"set", "Returns one or more random members from a set after removing them. Deletes the set if the last member was popped."},
+	CmdNameSRandMember: {"set", "Get one or multiple random members from a set"},
+	CmdNameSMove:       {"set", "Moves a member from one set to another."},
+	CmdNameSInter:      {"set", "Returns the intersect of multiple sets."},
+	CmdNameSInterStore: {"set", "Stores the intersect of multiple sets in a key."},
+	CmdNameSInterCard:  {"set", "Returns the number of members of the intersect of multiple sets."},
+	CmdNameSUnion:      {"set", "Returns the union of multiple sets."},
+	CmdNameSUnionStore: {"set", "Stores the union of multiple sets in a key."},
+	CmdNameSDiff:       {"set", "Returns the difference of multiple sets."},
+	CmdNameSDiffStore:  {"set", "Stores the difference of multiple sets in a key."},
+	CmdNameSScan:       {"set", "Iterates over members of a set."},
+
+	CmdNameZAdd:             {"sorted_set", "Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist."},
+	CmdNameZIncrBy:          {"sorted_set", "Increments the score of a member in a sorted set."},
+	CmdNameZRem:             {"sorted_set", "Removes one or more members from a sorted set. Deletes the sorted set if all members were removed."},
+	CmdNameZScore:           {"sorted_set", "Returns the score of a member in a sorted set."},
+	CmdNameZMScore:          {"sorted_set", "Returns the score of one or more members in a sorted set."},
+	CmdNameZCard:            {"sorted_set", "Returns the number of members in a sorted set."},
+	CmdNameZCount:           {"sorted_set", "Returns the count of members in a sorted set that have scores within a range."},
+	CmdNameZLexCount:        {"sorted_set", "Returns the number of members in a sorted set within a lexicographical range."},
+	CmdNameZRank:            {"sorted_set", "Returns the index of a member in a sorted set ordered by ascending scores."},
+	CmdNameZRevRank:         {"sorted_set", "Returns the index of a member in a sorted set ordered by descending scores."},
+	CmdNameZRange:           {"sorted_set", "Returns members in a sorted set within a range of indexes."},
+	CmdNameZRangeStore:      {"sorted_set", "Stores a range of members from sorted set in a key."},
+	CmdNameZRevRange:        {"sorted_set", "Returns members in a sorted set within a range of indexes in reverse order."},
+	CmdNameZRangeByScore:    {"sorted_set", "Returns members in a sorted set within a range of scores."},
+	CmdNameZRevRangeByScore: {"sorted_set", "Returns members in a sorted set within a range of scores in reverse order."},
+	CmdNameZRangeByLex:      {"sorted_set", "Returns members in a sorted set within a lexicographical range."},
+	CmdNameZRevRangeByLex:   {"sorted_set", "Returns members in a sorted set within a lexicographical range in reverse order."},
+	CmdNameZPopMin:          {"sorted_set", "Returns the lowest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped."},
+	CmdNameZPopMax:          {"sorted_set", "Returns the highest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped."},
+	CmdNameZRemRangeByRank:  {"sorted_set", "Removes members in a sorted set within a range of indexes. Deletes the sorted set if all members were removed."},
+	CmdNameZRemRangeByScore: {"sorted_set", "Removes members in a sorted set within a range of scores. Deletes the sorted set if all members were removed."},
+	CmdNameZRemRangeByLex:   {"sorted_set", "Removes members in a sorted set within a lexicographical range. Deletes the sorted set if all members were removed."},
+	CmdNameZScan:            {"sorted_set", "Iterates over members and scores of a sorted set."},
+
+	CmdNameGeoAdd:         {"geo", "Adds one or more members to a geospatial index. The key is created if it doesn't exist."},
+	CmdNameGeoPos:         {"geo", "Returns the longitude and latitude of members from a geospatial index."},
+	CmdNameGeoDist:        {"geo", "Returns the distance between two members of a geospatial index."},
+	CmdNameGeoHash:        {"geo", "Returns members from a geospatial index as geohash strings."},
+	CmdNameGeoSearch:      {"geo", "Queries a geospatial index for members inside an area of a box or a circle."},
+	CmdNameGeoSearchStore: {"geo", "Queries a geospatial index for members inside an area of a box or a circle, optionally stores the result."},
+
+	CmdNameXAdd:       {"stream", "Appends a new message to a stream. Creates the key if it doesn't exist."},
+	CmdNameXLen:       {"stream", "Return the number of messages in a stream."},
+	CmdNameXRange:     {"stream", "Returns the messages from a stream within a range of IDs."},
+	CmdNameXRevRange:  {"stream", "Returns the messages from a stream within a range of IDs in reverse order."},
+	CmdNameXRead:      {"stream", "Returns messages from multiple streams with IDs greater than the ones requested. Blocks until a message is available otherwise."},
+	CmdNameXDel:       {"stream", "Returns the number of messages after removing them from a stream."},
+	CmdNameXTrim:      {"stream", "Deletes messages from the beginning of a stream."},
+	CmdNameXSetID:     {"stream", "An internal command for replicating stream values."},
+	CmdNameXGroup:     {"stream", "Manages the consumer groups of streams."},
+	CmdNameXReadGroup: {"stream", "Returns new or historical messages from a stream for a consumer in a group. Blocks until a message is available otherwise."},
+	CmdNameXAck:       {"stream", "Returns the number of messages that were successfully acknowledged by the consumer group member of a stream."},
+	CmdNameXPending:   {"stream", "Returns the information and entries from a stream consumer group's pending entries list."},
+	CmdNameXClaim:     {"stream", "Changes, or acquires, ownership of a message in a consumer group, as if the message was delivered a consumer group member."},
+	CmdNameXAutoClaim: {"stream", "Changes, or acquires, ownership of messages in a consumer group, as if the messages were delivered to as consumer group member."},
+	CmdNameXInfo:      {"stream", "Returns information about a stream."},
+}
+
+// aclCategories returns the categories of the command, which follow from
+// its flags and its group.
+func (cmd *CommandInfo) aclCategories() []string {
+	var categories []string
+	switch {
+	case cmd.flags&CmdFlagWrite != 0:
+		categories = append(categories, "@write")
+	case cmd.flags&CmdFlagReadonly != 0:
+		categories = append(categories, "@read")
+	}
+	if cmd.flags&CmdFlagAdmin != 0 {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+	if cmd.flags&CmdFlagFast != 0 {
+		categories = append(categories, "@fast")
+	} else {
+		categories = append(categories, "@slow")
+	}
+
+	switch group := commandDocs[cmd.name].group; group {
+	case "generic":
+		categories = append(categories, "@keyspace")
+	case "sorted_set":
+		categories = append(categories, "@sortedset")
+	case "transactions":
+		categories = append(categories, "@transaction")
+	case "server":
+	default:
+		categories = append(categories, "@"+group)
+	}
+	return categories
+}
+
+// keySpecs returns the key specifications of the command, which tell how
+// to find its keys.
+func (cmd *CommandInfo) keySpecs() []interface{} {
+	flags := []string{}
+	switch {
+	case cmd.flags&CmdFlagWrite != 0:
+		flags = append(flags, "RW")
+	case cmd.flags&CmdFlagReadonly != 0:
+		flags = append(flags, "RO")
+	}
+
+	var begin, find []interface{}
+	switch {
+	case cmd.keyNumIndex > 0:
+		begin = []interface{}{"type", "index", "spec", []interface{}{"index", cmd.keyNumIndex}}
+		find = []interface{}{"type", "keynum", "spec", []interface{}{"keynumidx", 0, "firstkey", 1, "keystep", 1}}
+	case cmd.keyword != "":
+		begin = []interface{}{"type", "keyword", "spec", []interface{}{"keyword", cmd.keyword, "startfrom", 1}}
+		find = []interface{}{"type", "range", "spec", []interface{}{"lastkey", -1, "keystep", 1, "limit", 2}}
+	case cmd.firstKey > 0:
+		// the last key of the range is relative to the first one
+		last := cmd.lastKey
+		if last >= 0 {
+			last -= cmd.firstKey
+		}
+		begin = []interface{}{"type", "index", "spec", []interface{}{"index", cmd.firstKey}}
+		find = []interface{}{"type", "range", "spec", []interface{}{"lastkey", last, "keystep", cmd.keyStep, "limit", 0}}
+	default:
+		return []interface{}{}
+	}
+	return []interface{}{[]interface{}{"flags", flags, "begin_search", begin, "find_keys", find}}
+}
+
+// info returns the reply of COMMAND INFO for the command.
+func (cmd *CommandInfo) info() []interface{} {
+	flags := []string{}
+	for _, f := range commandFlagNames {
+		if cmd.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	return []interface{}{
+		cmd.name,
+		cmd.arity,
+		flags,
+		cmd.firstKey,
+		cmd.lastKey,
+		cmd.keyStep,
+		cmd.aclCategories(),
+		[]string{}, // tips
+		cmd.keySpecs(),
+		[]interface{}{}, // subcommands
+	}
+}
+
+// sortedCommandNames returns the names of the command table in order.
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(CommandTable))
+	for name := range CommandTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// COMMAND
+// COMMAND COUNT
+// COMMAND INFO [command-name ...]
+// COMMAND DOCS [command-name ...]
+// COMMAND GETKEYS command [arg ...]
+func (*cmdCommand) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() == 1 {
+		reply := make([]interface{}, 0, len(CommandTable))
+		for _, name := range sortedCommandNames() {
+			reply = append(reply, CommandTable[name].info())
+		}
+		return c.ReplyBulk(reply...)
+	}
+
+	switch sub := strings.ToLower(r.ArgvAt(1)); sub {
+	case "count":
+		if r.ArgCount() != 2 {
+			return c.ReplyError("wrong number of arguments for 'command|count' command")
+		}
+		return c.ReplyInt(int64(len(CommandTable)))
+	case "info":
+		names := r.Argv()[2:]
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+		reply := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			if cmd, ok := CommandTable[strings.ToLower(name)]; ok {
+				reply = append(reply, cmd.info())
+			} else {
+				reply = append(reply, nil)
+			}
+		}
+		return c.ReplyBulk(reply...)
+	case "docs":
+		names := r.Argv()[2:]
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+		documented := []string{}
+		for _, name := range names {
+			if name = strings.ToLower(name); commandDocs[name] != (commandDoc{}) {
+				documented = append(documented, name)
+			}
+		}
+		c.ReplyMapLen(len(documented))
+		for _, name := range documented {
+			doc := commandDocs[name]
+			c.ReplyBulkString(name)
+			c.ReplyMap([]string{"summary", doc.summary, "group", doc.group})
+		}
+		return nil
+	case "getkeys":
+		if r.ArgCount() < 3 {
+			return c.ReplyError("wrong number of arguments for 'command|getkeys' command")
+		}
+		cmd := LoopupCommand(r.ArgvAt(2))
+		if cmd == unknownCommandInfo {
+			return c.ReplyError("Invalid command specified")
+		}
+		args := protocol.NewRequest(r.Argv()[2:]...)
+		if !cmd.checkArity(args.ArgCount()) {
+			return c.ReplyError("Invalid number of arguments specified for command")
+		}
+		keys := cmd.getKeys(args)
+		if keys == nil {
+			return c.ReplyError("Invalid arguments specified for command")
+		}
+		if len(keys) == 0 {
+			return c.ReplyError("The command has no key arguments")
+		}
+		reply := make([]string, 0, len(keys))
+		for _, i := range keys {
+			reply = append(reply, args.ArgvAt(i))
+		}
+		return c.ReplyList(reply)
+	default:
+		return c.ReplyError("unknown subcommand '" + r.ArgvAt(1) + "'. Try COMMAND HELP.")
+	}
+}
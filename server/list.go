@@ -0,0 +1,750 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdLPush struct{}
+type cmdRPush struct{}
+type cmdLPushX struct{}
+type cmdRPushX struct{}
+type cmdLPop struct{}
+type cmdRPop struct{}
+type cmdLLen struct{}
+type cmdLIndex struct{}
+type cmdLSet struct{}
+type cmdLRange struct{}
+type cmdLInsert struct{}
+type cmdLRem struct{}
+type cmdLTrim struct{}
+type cmdLPos struct{}
+type cmdLMove struct{}
+type cmdRPopLPush struct{}
+type cmdLMPop struct{}
+type cmdBLPop struct{}
+type cmdBRPop struct{}
+type cmdBLMove struct{}
+type cmdBRPopLPush struct{}
+type cmdBLMPop struct{}
+
+// the ends of a list
+const (
+	listHead = iota
+	listTail
+)
+
+// A list is encoded as a quicklist, which is a linked list of ziplists
+// whose size is limited by listMaxZiplistSize.
+
+func listTypeCreate() *dt.Object {
+	return dt.NewQuicklistObject(godisServer.listMaxZiplistSize)
+}
+
+func listTypeLength(o *dt.Object) int64 {
+	return int64(o.Ptr.(*dt.Quicklist).Len())
+}
+
+func listTypePush(o *dt.Object, value string, where int) {
+	ql := o.Ptr.(*dt.Quicklist)
+	if where == listHead {
+		ql.PushHead(value)
+	} else {
+		ql.PushTail(value)
+	}
+}
+
+func listTypePop(o *dt.Object, where int) (string, bool) {
+	ql := o.Ptr.(*dt.Quicklist)
+	if where == listHead {
+		return ql.PopHead()
+	}
+	return ql.PopTail()
+}
+
+// parseListWhere parses the LEFT and RIGHT arguments of LMOVE.
+func parseListWhere(s string) (int, bool) {
+	if strings.EqualFold(s, "left") {
+		return listHead, true
+	} else if strings.EqualFold(s, "right") {
+		return listTail, true
+	}
+	return 0, false
+}
+
+func listWhereName(where int) string {
+	if where == listHead {
+		return "left"
+	}
+	return "right"
+}
+
+// listEventName returns the keyspace event of a push or a pop at where,
+// like lpush or rpop.
+func listEventName(op string, where int) string {
+	if where == listHead {
+		return "l" + op
+	}
+	return "r" + op
+}
+
+func (*cmdLPush) Exec(c *Client, r *protocol.Request) error {
+	return pushGenericCommand(c, r, listHead, false)
+}
+
+func (*cmdRPush) Exec(c *Client, r *protocol.Request) error {
+	return pushGenericCommand(c, r, listTail, false)
+}
+
+func (*cmdLPushX) Exec(c *Client, r *protocol.Request) error {
+	return pushGenericCommand(c, r, listHead, true)
+}
+
+func (*cmdRPushX) Exec(c *Client, r *protocol.Request) error {
+	return pushGenericCommand(c, r, listTail, true)
+}
+
+// [LR]PUSH[X] key element [element ...]
+func pushGenericCommand(c *Client, r *protocol.Request, where int, xx bool) error {
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o != nil && o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if o == nil {
+		if xx {
+			return c.ReplyInt(0)
+		}
+		o = listTypeCreate()
+		c.db.Add(key, o)
+	}
+
+	for i := 2; i < r.ArgCount(); i++ {
+		listTypePush(o, r.ArgvAt(i), where)
+	}
+
+	pushed := int64(r.ArgCount() - 2)
+	c.db.elements += pushed
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyList, listEventName("push", where), key, c.db.id)
+	godisServer.dirty += pushed
+	return c.ReplyInt(listTypeLength(o))
+}
+
+func (*cmdLPop) Exec(c *Client, r *protocol.Request) error {
+	return popGenericCommand(c, r, listHead)
+}
+
+func (*cmdRPop) Exec(c *Client, r *protocol.Request) error {
+	return popGenericCommand(c, r, listTail)
+}
+
+// [LR]POP key [count]
+func popGenericCommand(c *Client, r *protocol.Request, where int) error {
+	argc := r.ArgCount()
+	if argc != 2 && argc != 3 {
+		return c.ReplyError("wrong number of arguments for '" + strings.ToLower(r.CommandName()) + "' command")
+	}
+
+	count := int64(1)
+	if argc == 3 {
+		n, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+		if err != nil || n < 0 {
+			return c.ReplyError("value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		if argc == 2 {
+			return c.ReplyEmpty()
+		}
+		return c.ReplyNullArray()
+	}
+	if o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	list := []string{}
+	for ; count > 0; count-- {
+		value, ok := listTypePop(o, where)
+		if !ok {
+			break
+		}
+		list = append(list, value)
+	}
+
+	popped := int64(len(list))
+	c.db.elements -= popped
+	if popped > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyList, listEventName("pop", where), key, c.db.id)
+	}
+	if listTypeLength(o) == 0 {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+	}
+	godisServer.dirty += popped
+
+	if argc == 2 {
+		return c.ReplyBulkString(list[0])
+	}
+	return c.ReplyList(list)
+}
+
+func (*cmdLLen) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+	return c.ReplyInt(listTypeLength(o))
+}
+
+// LINDEX key index
+func (*cmdLIndex) Exec(c *Client, r *protocol.Request) error {
+	index, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyEmpty()
+	}
+	if o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	value, ok := o.Ptr.(*dt.Quicklist).Index(int(index))
+	if !ok {
+		return c.ReplyEmpty()
+	}
+	return c.ReplyBulkString(value)
+}
+
+// LSET key index element
+func (*cmdLSet) Exec(c *Client, r *protocol.Request) error {
+	index, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyError("no such key")
+	}
+	if o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	if !o.Ptr.(*dt.Quicklist).Replace(int(index), r.ArgvAt(3)) {
+		return c.ReplyError("index out of range")
+	}
+	signalModifiedKey(c.db, r.ArgvAt(1))
+	notifyKeyspaceEvent(NotifyList, "lset", r.ArgvAt(1), c.db.id)
+	godisServer.dirty++
+	return c.Reply("OK")
+}
+
+// listRange converts the start and end indexes of LRANGE and LTRIM, which
+// can be negative, to an inclusive range of the list. It returns false
+// when the range is empty.
+func listRange(start, end, llen int64) (int64, int64, bool) {
+	if start < 0 {
+		start += llen
+	}
+	if end < 0 {
+		end += llen
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= llen {
+		return 0, 0, false
+	}
+	if end >= llen {
+		end = llen - 1
+	}
+	return start, end, true
+}
+
+// LRANGE key start stop
+func (*cmdLRange) Exec(c *Client, r *protocol.Request) error {
+	start, err1 := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	end, err2 := strconv.ParseInt(r.ArgvAt(3), 10, 64)
+	if err1 != nil || err2 != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyList(nil)
+	}
+	if o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	start, end, ok := listRange(start, end, listTypeLength(o))
+	if !ok {
+		return c.ReplyList(nil)
+	}
+
+	list := make([]string, 0, end-start+1)
+	it := o.Ptr.(*dt.Quicklist).Iterator(int(start), false)
+	for i := start; i <= end; i++ {
+		value, _ := it.Next()
+		list = append(list, value)
+	}
+	return c.ReplyList(list)
+}
+
+// LINSERT key BEFORE|AFTER pivot element
+func (*cmdLInsert) Exec(c *Client, r *protocol.Request) error {
+	var after bool
+	if strings.EqualFold(r.ArgvAt(2), "after") {
+		after = true
+	} else if !strings.EqualFold(r.ArgvAt(2), "before") {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	ql := o.Ptr.(*dt.Quicklist)
+	pivot := r.ArgvAt(3)
+	it := ql.Iterator(0, false)
+	for i := 0; ; i++ {
+		value, ok := it.Next()
+		if !ok {
+			return c.ReplyInt(-1)
+		}
+		if value == pivot {
+			ql.Insert(i, r.ArgvAt(4), after)
+			break
+		}
+	}
+
+	c.db.elements++
+	signalModifiedKey(c.db, r.ArgvAt(1))
+	notifyKeyspaceEvent(NotifyList, "linsert", r.ArgvAt(1), c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(listTypeLength(o))
+}
+
+// LREM key count element
+func (*cmdLRem) Exec(c *Client, r *protocol.Request) error {
+	toremove, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	// a negative count removes the elements starting from the tail
+	var it *dt.QuicklistIter
+	if toremove < 0 {
+		toremove = -toremove
+		it = o.Ptr.(*dt.Quicklist).Iterator(-1, true)
+	} else {
+		it = o.Ptr.(*dt.Quicklist).Iterator(0, false)
+	}
+
+	element := r.ArgvAt(3)
+	var removed int64
+	for value, ok := it.Next(); ok; value, ok = it.Next() {
+		if value == element {
+			it.Delete()
+			removed++
+			if toremove != 0 && removed == toremove {
+				break
+			}
+		}
+	}
+
+	c.db.elements -= removed
+	if removed > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyList, "lrem", key, c.db.id)
+	}
+	if listTypeLength(o) == 0 {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+	}
+	godisServer.dirty += removed
+	return c.ReplyInt(removed)
+}
+
+// LTRIM key start stop
+func (*cmdLTrim) Exec(c *Client, r *protocol.Request) error {
+	start, err1 := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	end, err2 := strconv.ParseInt(r.ArgvAt(3), 10, 64)
+	if err1 != nil || err2 != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		return c.Reply("OK")
+	}
+	if o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	ql := o.Ptr.(*dt.Quicklist)
+	llen := listTypeLength(o)
+	ltrim, rtrim := llen, int64(0)
+	if start, end, ok := listRange(start, end, llen); ok {
+		ltrim, rtrim = start, llen-end-1
+	}
+
+	ql.DelRange(0, int(ltrim))
+	ql.DelRange(-int(rtrim), int(rtrim))
+
+	c.db.elements -= ltrim + rtrim
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyList, "ltrim", key, c.db.id)
+	if listTypeLength(o) == 0 {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+	}
+	godisServer.dirty += ltrim + rtrim
+	return c.Reply("OK")
+}
+
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func (*cmdLPos) Exec(c *Client, r *protocol.Request) error {
+	rank, count, maxlen := int64(1), int64(-1), int64(0)
+	for i := 3; i < r.ArgCount(); i += 2 {
+		opt := strings.ToLower(r.ArgvAt(i))
+		if i+1 >= r.ArgCount() {
+			return c.ReplyError(ReplySyntaxErr)
+		}
+		n, err := strconv.ParseInt(r.ArgvAt(i+1), 10, 64)
+		if err != nil {
+			return c.ReplyError(ReplyNotInteger)
+		}
+
+		switch opt {
+		case "rank":
+			if n == 0 {
+				return c.ReplyError("RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = n
+		case "count":
+			if n < 0 {
+				return c.ReplyError("COUNT can't be negative")
+			}
+			count = n
+		case "maxlen":
+			if n < 0 {
+				return c.ReplyError("MAXLEN can't be negative")
+			}
+			maxlen = n
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if o == nil {
+		if count != -1 {
+			return c.ReplyList(nil)
+		}
+		return c.ReplyEmpty()
+	}
+
+	// a negative rank searches from the tail
+	llen := listTypeLength(o)
+	reverse := rank < 0
+	var it *dt.QuicklistIter
+	if reverse {
+		rank = -rank
+		it = o.Ptr.(*dt.Quicklist).Iterator(-1, true)
+	} else {
+		it = o.Ptr.(*dt.Quicklist).Iterator(0, false)
+	}
+
+	// without COUNT only the first match is returned, and COUNT 0 means
+	// all the matches.
+	single := count == -1
+	if single {
+		count = 1
+	}
+
+	element := r.ArgvAt(2)
+	var matches []interface{}
+	var matched int64
+	for index := int64(0); maxlen == 0 || index < maxlen; index++ {
+		value, ok := it.Next()
+		if !ok {
+			break
+		}
+		if value != element {
+			continue
+		}
+		if matched++; matched < rank {
+			continue
+		}
+
+		pos := index
+		if reverse {
+			pos = llen - index - 1
+		}
+		matches = append(matches, pos)
+		if count != 0 && int64(len(matches)) == count {
+			break
+		}
+	}
+
+	if single {
+		if len(matches) == 0 {
+			return c.ReplyEmpty()
+		}
+		return c.ReplyInt(matches[0].(int64))
+	}
+	if len(matches) == 0 {
+		return c.ReplyList(nil)
+	}
+	return c.ReplyBulk(matches...)
+}
+
+func (*cmdLMove) Exec(c *Client, r *protocol.Request) error {
+	wherefrom, ok1 := parseListWhere(r.ArgvAt(3))
+	whereto, ok2 := parseListWhere(r.ArgvAt(4))
+	if !ok1 || !ok2 {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+	return lmoveGenericCommand(c, r.ArgvAt(1), r.ArgvAt(2), wherefrom, whereto)
+}
+
+// RPOPLPUSH source destination
+func (*cmdRPopLPush) Exec(c *Client, r *protocol.Request) error {
+	return lmoveGenericCommand(c, r.ArgvAt(1), r.ArgvAt(2), listTail, listHead)
+}
+
+func lmoveGenericCommand(c *Client, srckey, dstkey string, wherefrom, whereto int) error {
+	src := c.db.Get(srckey)
+	if src == nil {
+		return c.ReplyEmpty()
+	}
+	dst := c.db.Get(dstkey)
+	if src.ObjType != dt.ObjList || (dst != nil && dst.ObjType != dt.ObjList) {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	value, _ := listTypePop(src, wherefrom)
+	c.db.elements--
+
+	// push before checking whether the source is empty, as the source and
+	// the destination can be the same list.
+	lmoveHandlePush(c, dstkey, dst, value, whereto)
+	notifyKeyspaceEvent(NotifyList, listEventName("pop", wherefrom), srckey, c.db.id)
+	if listTypeLength(src) == 0 {
+		c.db.deleteKey(srckey)
+		notifyKeyspaceEvent(NotifyGeneric, "del", srckey, c.db.id)
+	}
+	signalModifiedKey(c.db, srckey)
+	signalModifiedKey(c.db, dstkey)
+	godisServer.dirty++
+
+	// BLMOVE and BRPOPLPUSH are replicated as LMOVE
+	c.propagate(CmdNameLMove, srckey, dstkey, listWhereName(wherefrom), listWhereName(whereto))
+	return c.ReplyBulkString(value)
+}
+
+func lmoveHandlePush(c *Client, dstkey string, dst *dt.Object, value string, where int) {
+	if dst == nil {
+		dst = listTypeCreate()
+		c.db.Add(dstkey, dst)
+	}
+	listTypePush(dst, value, where)
+	c.db.elements++
+	notifyKeyspaceEvent(NotifyList, listEventName("push", where), dstkey, c.db.id)
+}
+
+// LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func (*cmdLMPop) Exec(c *Client, r *protocol.Request) error {
+	return lmpopGenericCommand(c, r, 1, false)
+}
+
+// BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func (*cmdBLMPop) Exec(c *Client, r *protocol.Request) error {
+	return lmpopGenericCommand(c, r, 2, true)
+}
+
+// lmpopGenericCommand implements LMPOP and BLMPOP, numkeys is the i-th argument.
+func lmpopGenericCommand(c *Client, r *protocol.Request, i int, block bool) error {
+	if r.ArgCount() < i+3 {
+		return c.ReplyError("wrong number of arguments for '" + strings.ToLower(r.CommandName()) + "' command")
+	}
+
+	var timeout int64
+	if block {
+		var err error
+		if timeout, err = parseTimeout(r.ArgvAt(1)); err != nil {
+			return c.ReplyError(err.Error())
+		}
+	}
+
+	numkeys, err := strconv.ParseInt(r.ArgvAt(i), 10, 64)
+	if err != nil || numkeys <= 0 {
+		return c.ReplyError("numkeys should be greater than 0")
+	}
+	if numkeys > int64(r.ArgCount()-i-2) {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	keys := r.Argv()[i+1 : i+1+int(numkeys)]
+	j := i + 1 + int(numkeys)
+	where, ok := parseListWhere(r.ArgvAt(j))
+	if !ok {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	count := int64(1)
+	for j++; j < r.ArgCount(); j += 2 {
+		if !strings.EqualFold(r.ArgvAt(j), "count") || j+1 != r.ArgCount()-1 {
+			return c.ReplyError(ReplySyntaxErr)
+		}
+		count, err = strconv.ParseInt(r.ArgvAt(j+1), 10, 64)
+		if err != nil || count <= 0 {
+			return c.ReplyError("count should be greater than 0")
+		}
+	}
+
+	return blockingPopGenericCommand(c, keys, where, count, true, block, timeout)
+}
+
+func (*cmdBLPop) Exec(c *Client, r *protocol.Request) error {
+	return bpopGenericCommand(c, r, listHead)
+}
+
+func (*cmdBRPop) Exec(c *Client, r *protocol.Request) error {
+	return bpopGenericCommand(c, r, listTail)
+}
+
+// B[LR]POP key [key ...] timeout
+func bpopGenericCommand(c *Client, r *protocol.Request, where int) error {
+	argc := r.ArgCount()
+	timeout, err := parseTimeout(r.ArgvAt(argc - 1))
+	if err != nil {
+		return c.ReplyError(err.Error())
+	}
+	return blockingPopGenericCommand(c, r.Argv()[1:argc-1], where, 1, false, true, timeout)
+}
+
+// blockingPopGenericCommand pops up to count elements from the first non
+// empty list of keys, or blocks the client when they are all empty. The
+// reply is [key, element] unless multi is set, which replies
+// [key, [element ...]] as LMPOP.
+func blockingPopGenericCommand(c *Client, keys []string, where int, count int64, multi, block bool, timeout int64) error {
+	for _, key := range keys {
+		o := c.db.Get(key)
+		if o == nil {
+			continue
+		}
+		if o.ObjType != dt.ObjList {
+			return c.ReplyError(ReplyWrongType)
+		}
+
+		var list []string
+		for ; count > 0; count-- {
+			value, ok := listTypePop(o, where)
+			if !ok {
+				break
+			}
+			list = append(list, value)
+		}
+
+		popped := int64(len(list))
+		c.db.elements -= popped
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyList, listEventName("pop", where), key, c.db.id)
+		if listTypeLength(o) == 0 {
+			c.db.deleteKey(key)
+			notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+		}
+		godisServer.dirty += popped
+
+		// replicate the pop as its non blocking version, so the AOF is
+		// never replayed with blocking commands.
+		cmd := CmdNameRPop
+		if where == listHead {
+			cmd = CmdNameLPop
+		}
+		c.propagate(cmd, key, strconv.FormatInt(popped, 10))
+
+		if multi {
+			return c.ReplyBulk(key, list)
+		}
+		return c.ReplyBulk(key, list[0])
+	}
+
+	// the AOF is loaded with a fake client, and the commands of a
+	// transaction are executed at once, so they can't block
+	if !block || c.fake || c.multi {
+		return c.ReplyNullArray()
+	}
+	blockForKeys(c, dt.ObjList, keys, timeout)
+	return nil
+}
+
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func (*cmdBLMove) Exec(c *Client, r *protocol.Request) error {
+	wherefrom, ok1 := parseListWhere(r.ArgvAt(3))
+	whereto, ok2 := parseListWhere(r.ArgvAt(4))
+	if !ok1 || !ok2 {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+	timeout, err := parseTimeout(r.ArgvAt(5))
+	if err != nil {
+		return c.ReplyError(err.Error())
+	}
+	return blmoveGenericCommand(c, r.ArgvAt(1), r.ArgvAt(2), wherefrom, whereto, timeout)
+}
+
+// BRPOPLPUSH source destination timeout
+func (*cmdBRPopLPush) Exec(c *Client, r *protocol.Request) error {
+	timeout, err := parseTimeout(r.ArgvAt(3))
+	if err != nil {
+		return c.ReplyError(err.Error())
+	}
+	return blmoveGenericCommand(c, r.ArgvAt(1), r.ArgvAt(2), listTail, listHead, timeout)
+}
+
+func blmoveGenericCommand(c *Client, srckey, dstkey string, wherefrom, whereto int, timeout int64) error {
+	o := c.db.Get(srckey)
+	if o != nil && o.ObjType != dt.ObjList {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if o != nil || c.fake || c.multi {
+		return lmoveGenericCommand(c, srckey, dstkey, wherefrom, whereto)
+	}
+
+	blockForKeys(c, dt.ObjList, []string{srckey}, timeout)
+	return nil
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdMulti struct{}
+type cmdExec struct{}
+type cmdDiscard struct{}
+type cmdWatch struct{}
+type cmdUnwatch struct{}
+
+// multiState is the transaction of a client between MULTI and EXEC.
+type multiState struct {
+	commands []*protocol.Request
+
+	// MULTI was already written to the AOF by the running EXEC
+	propagated bool
+}
+
+// watchedKey is a key watched by a client, the keys which are already
+// expired when they are watched don't abort the transaction when they are
+// deleted.
+type watchedKey struct {
+	db      *Database
+	key     string
+	expired bool
+}
+
+// isTransactionCommand reports whether the command is executed right away
+// instead of being queued in a transaction.
+func isTransactionCommand(name string) bool {
+	switch strings.ToLower(name) {
+	case CmdNameExec, CmdNameDiscard, CmdNameMulti, CmdNameWatch:
+		return true
+	}
+	return false
+}
+
+// queueMultiCommand adds the request to the transaction of the client.
+func queueMultiCommand(c *Client, r *protocol.Request) error {
+	// the request is kept after the parser reads the next ones
+	c.mstate.commands = append(c.mstate.commands, r.Clone())
+	return c.Reply("QUEUED")
+}
+
+// discardTransaction resets the transaction state of the client.
+func discardTransaction(c *Client) {
+	c.mstate = multiState{}
+	c.multi = false
+	c.dirtyCAS = false
+	c.dirtyExec = false
+	unwatchAllKeys(c)
+}
+
+// MULTI
+func (*cmdMulti) Exec(c *Client, r *protocol.Request) error {
+	if c.multi {
+		return c.ReplyError("MULTI calls can not be nested")
+	}
+	c.multi = true
+	return c.Reply("OK")
+}
+
+// DISCARD
+func (*cmdDiscard) Exec(c *Client, r *protocol.Request) error {
+	if !c.multi {
+		return c.ReplyError("DISCARD without MULTI")
+	}
+	discardTransaction(c)
+	return c.Reply("OK")
+}
+
+// EXEC
+func (*cmdExec) Exec(c *Client, r *protocol.Request) error {
+	if !c.multi {
+		return c.ReplyError("EXEC without MULTI")
+	}
+	if c.dirtyExec {
+		discardTransaction(c)
+		return c.ReplyError("EXECABORT Transaction discarded because of previous errors.")
+	}
+	if c.dirtyCAS || isWatchedKeyExpired(c) {
+		discardTransaction(c)
+		return c.ReplyNullArray()
+	}
+
+	// the watched keys are modified by the transaction itself
+	unwatchAllKeys(c)
+
+	// the commands are executed while the client is still in the MULTI
+	// state, so that they can't block, and call wraps the ones modifying
+	// the dataset in MULTI/EXEC in the AOF.
+	commands := c.mstate.commands
+	c.ReplyArrayLen(len(commands))
+	for _, cmd := range commands {
+		call(c, cmd)
+	}
+
+	propagated := c.mstate.propagated
+	discardTransaction(c)
+	if propagated {
+		c.propagate(CmdNameExec)
+	}
+	return nil
+}
+
+// WATCH key [key ...]
+func (*cmdWatch) Exec(c *Client, r *protocol.Request) error {
+	if c.multi {
+		return c.ReplyError("WATCH inside MULTI is not allowed")
+	}
+
+	for i := 1; i < r.ArgCount(); i++ {
+		watchKey(c, r.ArgvAt(i))
+	}
+	return c.Reply("OK")
+}
+
+// UNWATCH
+func (*cmdUnwatch) Exec(c *Client, r *protocol.Request) error {
+	unwatchAllKeys(c)
+	c.dirtyCAS = false
+	return c.Reply("OK")
+}
+
+func watchKey(c *Client, key string) {
+	for _, wk := range c.watchedKeys {
+		if wk.db == c.db && wk.key == key {
+			return
+		}
+	}
+
+	c.db.watchedKeys[key] = append(c.db.watchedKeys[key], c)
+	c.watchedKeys = append(c.watchedKeys, &watchedKey{
+		db:      c.db,
+		key:     key,
+		expired: c.db.keyIsExpired(key),
+	})
+}
+
+func unwatchAllKeys(c *Client) {
+	for _, wk := range c.watchedKeys {
+		clients := wk.db.watchedKeys[wk.key]
+		for i, wc := range clients {
+			if wc == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(wk.db.watchedKeys, wk.key)
+		} else {
+			wk.db.watchedKeys[wk.key] = clients
+		}
+	}
+	c.watchedKeys = nil
+}
+
+// isWatchedKeyExpired reports whether a watched key expired since it was
+// watched, and wasn't deleted yet.
+func isWatchedKeyExpired(c *Client) bool {
+	for _, wk := range c.watchedKeys {
+		if !wk.expired && wk.db.keyIsExpired(wk.key) {
+			return true
+		}
+	}
+	return false
+}
+
+// touchWatchedKey flags the transactions of the clients watching the key
+// as failed.
+func touchWatchedKey(db *Database, key string) {
+	for _, c := range db.watchedKeys[key] {
+		for _, wk := range c.watchedKeys {
+			if wk.db != db || wk.key != key {
+				continue
+			}
+			// deleting a key which was already expired doesn't change it
+			if wk.expired && db.store.Get(key) == nil {
+				wk.expired = false
+				break
+			}
+			c.dirtyCAS = true
+		}
+	}
+}
+
+// touchAllWatchedKeysInDB flags the transactions watching the keys of the
+// emptied database, which exist in it or in the database swapped with it.
+func touchAllWatchedKeysInDB(emptied, replacedWith *Database) {
+	for key := range emptied.watchedKeys {
+		exists := emptied.store.Get(key) != nil
+		if replacedWith != nil && replacedWith.store.Get(key) != nil {
+			exists = true
+		}
+		if !exists {
+			continue
+		}
+		for _, c := range emptied.watchedKeys[key] {
+			c.dirtyCAS = true
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+)
+
+// notifyClasses maps the characters of notify-keyspace-events to the
+// classes of events, in the order they are formatted.
+var notifyClasses = []struct {
+	c     byte
+	class int
+}{
+	{'g', NotifyGeneric},
+	{'$', NotifyString},
+	{'l', NotifyList},
+	{'s', NotifySet},
+	{'h', NotifyHash},
+	{'z', NotifyZset},
+	{'x', NotifyExpired},
+	{'e', NotifyEvicted},
+	{'t', NotifyStream},
+	{'n', NotifyNew},
+	{'K', NotifyKeyspace},
+	{'E', NotifyKeyevent},
+}
+
+var errInvalidEventClass = errors.New("Invalid event class character. Use 'Ag$lshzxeKEtn'.")
+
+// keyspaceEventsStringToFlags parses the classes of notify-keyspace-events.
+func keyspaceEventsStringToFlags(s string) (int, error) {
+	flags := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= NotifyAll
+			continue
+		}
+		found := false
+		for _, nc := range notifyClasses {
+			if nc.c == s[i] {
+				flags |= nc.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errInvalidEventClass
+		}
+	}
+	return flags, nil
+}
+
+// keyspaceEventsFlagsToString formats the classes of notify-keyspace-events,
+// the classes included in A are replaced by it.
+func keyspaceEventsFlagsToString(flags int) string {
+	var res []byte
+	if flags&NotifyAll == NotifyAll {
+		res = append(res, 'A')
+		flags &^= NotifyAll
+	}
+	for _, nc := range notifyClasses {
+		if flags&nc.class != 0 {
+			res = append(res, nc.c)
+		}
+	}
+	return string(res)
+}
+
+// notifyKeyspaceEvent publishes the event of the key to the
+// __keyspace@<db>__:<key> and __keyevent@<db>__:<event> channels, if the
+// class of the event is enabled by notify-keyspace-events.
+func notifyKeyspaceEvent(class int, event, key string, dbid int) {
+	flags := godisServer.notifyKeyspaceEvents
+	if flags&class == 0 {
+		return
+	}
+
+	db := strconv.Itoa(dbid)
+	if flags&NotifyKeyspace != 0 {
+		pubsubPublishMessage("__keyspace@"+db+"__:"+key, event, pubsubGlobal)
+	}
+	if flags&NotifyKeyevent != 0 {
+		pubsubPublishMessage("__keyevent@"+db+"__:"+event, key, pubsubGlobal)
+	}
+}
@@ -12,6 +12,7 @@ var (
 	newLine  = []byte{'\r', '\n'}
 	nilBulk  = []byte{'$', '-', '1', '\r', '\n'}
 	nilArray = []byte{'*', '-', '1', '\r', '\n'}
+	nilRESP3 = []byte{'_', '\r', '\n'}
 )
 
 func intToString(val int64) string {
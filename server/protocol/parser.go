@@ -6,25 +6,35 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"math"
+	"sync/atomic"
 )
 
 var (
-	ExpectNumber   = &ProtocolError{"Expect Number"}
-	ExpectNewLine  = &ProtocolError{"Expect Newline"}
-	ExpectTypeChar = &ProtocolError{"Expect TypeChar"}
+	ExpectNumber   = &ProtocolError{"expected number"}
+	ExpectNewLine  = &ProtocolError{"expected newline"}
+	ExpectTypeChar = &ProtocolError{"expected '$'"}
 
-	InvalidNumArg   = errors.New("TooManyArg")
-	InvalidBulkSize = errors.New("Invalid bulk size")
-	LineTooLong     = errors.New("LineTooLong")
+	InvalidNumArg   = &ProtocolError{"invalid multibulk length"}
+	InvalidBulkSize = &ProtocolError{"invalid bulk length"}
+	LineTooLong     = &ProtocolError{"too big inline request"}
 
 	ReadBufferInitSize = 1 << 16
-	MaxNumArg          = 20
-	MaxBulkSize        = 1 << 16
-	MaxTelnetLine      = 1 << 10
+	MaxTelnetLine      = 1 << 16
 	spaceSlice         = []byte{' '}
 	emptyBulk          = [0]byte{}
 )
 
+// default limits of the requests
+const (
+	DefaultMaxBulkLen      = 512 * 1024 * 1024
+	DefaultMaxMultibulkLen = 1024 * 1024
+
+	// the arguments are preallocated up to this number, the rest are only
+	// allocated when they are received
+	maxArgvPrealloc = 1024
+)
+
 type ProtocolError struct {
 	message string
 }
@@ -33,6 +43,39 @@ func (p *ProtocolError) Error() string {
 	return p.message
 }
 
+// Limits are the maximum sizes of the requests. They are shared by the
+// parsers of the clients and changed at runtime, so they are accessed
+// atomically.
+type Limits struct {
+	maxBulkLen      int64
+	maxMultibulkLen int64
+}
+
+func NewLimits() *Limits {
+	return &Limits{
+		maxBulkLen:      DefaultMaxBulkLen,
+		maxMultibulkLen: DefaultMaxMultibulkLen,
+	}
+}
+
+// MaxBulkLen is the maximum length of an argument.
+func (l *Limits) MaxBulkLen() int64 {
+	return atomic.LoadInt64(&l.maxBulkLen)
+}
+
+func (l *Limits) SetMaxBulkLen(n int64) {
+	atomic.StoreInt64(&l.maxBulkLen, n)
+}
+
+// MaxMultibulkLen is the maximum number of arguments of a request.
+func (l *Limits) MaxMultibulkLen() int64 {
+	return atomic.LoadInt64(&l.maxMultibulkLen)
+}
+
+func (l *Limits) SetMaxMultibulkLen(n int64) {
+	atomic.StoreInt64(&l.maxMultibulkLen, n)
+}
+
 type Request struct {
 	cmd  string
 	argv [][]byte
@@ -54,6 +97,38 @@ func (c *Request) ArgvAt(index int) string {
 	return ""
 }
 
+// SetArgvAt replaces an argument, for commands executed again later.
+func (c *Request) SetArgvAt(index int, v string) {
+	if index >= 0 && index < len(c.argv) {
+		c.argv[index] = []byte(v)
+	}
+}
+
+// NewRequest returns the request of a command which isn't read from a
+// client, like the commands called by the scripts.
+func NewRequest(argv ...string) *Request {
+	req := &Request{argv: make([][]byte, len(argv))}
+	for i, a := range argv {
+		req.argv[i] = []byte(a)
+	}
+	if len(argv) > 0 {
+		req.cmd = argv[0]
+	}
+	return req
+}
+
+// Clone returns a copy of the request which doesn't share the read buffer
+// of the parser, for the requests kept after the next ones are read.
+func (c *Request) Clone() *Request {
+	argv := make([][]byte, len(c.argv))
+	for i, a := range c.argv {
+		if a != nil {
+			argv[i] = append([]byte{}, a...)
+		}
+	}
+	return &Request{cmd: c.cmd, argv: argv, last: c.last}
+}
+
 func (c *Request) CommandName() string {
 	return c.cmd
 }
@@ -79,6 +154,8 @@ type Parser struct {
 	buffer        []byte
 	parsePosition int
 	writeIndex    int
+	limits        *Limits
+	err           error
 }
 
 func max(a, b int) int {
@@ -87,8 +164,21 @@ func max(a, b int) int {
 	}
 	return b
 }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func NewParser(reader io.Reader) *Parser {
-	return &Parser{reader: reader, buffer: make([]byte, ReadBufferInitSize)}
+	return &Parser{reader: reader, buffer: make([]byte, ReadBufferInitSize), limits: NewLimits()}
+}
+
+// SetLimits replaces the default limits of the requests.
+func (r *Parser) SetLimits(limits *Limits) {
+	r.limits = limits
 }
 
 // ensure that we have enough space for writing 'req' byte
@@ -144,6 +234,9 @@ OUTTER:
 		for i := r.parsePosition; i < r.writeIndex; i++ {
 			c := r.buffer[r.parsePosition]
 			if c >= '0' && c <= '9' {
+				if num > (math.MaxInt64-uint64(c-'0'))/10 {
+					return 0, ExpectNumber
+				}
 				num = num*10 + uint64(c-'0')
 				r.parsePosition++
 			} else {
@@ -180,7 +273,9 @@ func (r *Parser) discardNewLine() error {
 func (r *Parser) parseBinary() (*Request, error) {
 	r.parsePosition++
 	numArg, err := r.readNumber()
-	if err != nil {
+	if err == ExpectNumber {
+		return nil, InvalidNumArg
+	} else if err != nil {
 		return nil, err
 	}
 	var e error
@@ -188,15 +283,15 @@ func (r *Parser) parseBinary() (*Request, error) {
 		return nil, e
 	}
 	switch {
-	case numArg == -1:
-		return nil, r.discardNewLine() // null array
 	case numArg < -1:
 		return nil, InvalidNumArg
-	case numArg > MaxNumArg:
+	case numArg <= 0:
+		return nil, nil // null or empty array, skipped by ReadRequest
+	case int64(numArg) > r.limits.MaxMultibulkLen():
 		return nil, InvalidNumArg
 	}
 
-	argv := make([][]byte, 0, numArg)
+	argv := make([][]byte, 0, min(numArg, maxArgvPrealloc))
 	for i := 0; i < numArg; i++ {
 		if e = r.requireNBytes(1); e != nil {
 			return nil, e
@@ -206,7 +301,9 @@ func (r *Parser) parseBinary() (*Request, error) {
 		}
 		r.parsePosition++
 		var plen int
-		if plen, e = r.readNumber(); e != nil {
+		if plen, e = r.readNumber(); e == ExpectNumber {
+			return nil, InvalidBulkSize
+		} else if e != nil {
 			return nil, e
 		}
 		if e = r.discardNewLine(); e != nil {
@@ -217,7 +314,13 @@ func (r *Parser) parseBinary() (*Request, error) {
 			argv = append(argv, nil) // null bulk
 		case plen == 0:
 			argv = append(argv, emptyBulk[:]) // empty bulk
-		case plen > 0 && plen <= MaxBulkSize:
+		case plen > ReadBufferInitSize && int64(plen) <= r.limits.MaxBulkLen():
+			bulk, e := r.readBigBulk(plen)
+			if e != nil {
+				return nil, e
+			}
+			argv = append(argv, bulk)
+		case plen > 0 && int64(plen) <= r.limits.MaxBulkLen():
 			if e = r.requireNBytes(plen); e != nil {
 				return nil, e
 			}
@@ -233,6 +336,30 @@ func (r *Parser) parseBinary() (*Request, error) {
 	return &Request{argv: argv}, nil
 }
 
+// readBigBulk reads a bulk larger than the read buffer into its own slice,
+// which grows with the data received rather than being allocated with the
+// announced length up front.
+func (r *Parser) readBigBulk(n int) ([]byte, error) {
+	buffered := min(r.writeIndex-r.parsePosition, n)
+	bulk := make([]byte, buffered, max(buffered, ReadBufferInitSize))
+	copy(bulk, r.buffer[r.parsePosition:])
+	r.parsePosition += buffered
+
+	for len(bulk) < n {
+		if len(bulk) == cap(bulk) {
+			grown := make([]byte, len(bulk), min(2*cap(bulk), n))
+			copy(grown, bulk)
+			bulk = grown
+		}
+		nr, err := r.reader.Read(bulk[len(bulk):min(cap(bulk), n)])
+		bulk = bulk[:len(bulk)+nr]
+		if err != nil && len(bulk) < n {
+			return nil, err
+		}
+	}
+	return bulk, nil
+}
+
 func (r *Parser) parseTelnet() (*Request, error) {
 	nlPos := -1
 	for {
@@ -258,6 +385,15 @@ func (r *Parser) reset() {
 }
 
 func (r *Parser) ReadRequest() (*Request, error) {
+	for {
+		// the null and empty arrays are ignored, like Redis does
+		if req, err := r.readRequest(); req != nil || err != nil {
+			return req, err
+		}
+	}
+}
+
+func (r *Parser) readRequest() (*Request, error) {
 	// if the buffer is empty, try to fetch some
 	if r.parsePosition >= r.writeIndex {
 		if err := r.readSome(1); err != nil {
@@ -290,10 +426,23 @@ func (r *Parser) ReadRequest() (*Request, error) {
 func (r *Parser) Requests() <-chan *Request {
 	reqs := make(chan *Request)
 	go func() {
-		for req, err := r.ReadRequest(); err == nil; req, err = r.ReadRequest() {
+		var req *Request
+		var err error
+		for req, err = r.ReadRequest(); err == nil; req, err = r.ReadRequest() {
 			reqs <- req
 		}
+		r.err = err
 		close(reqs)
 	}()
 	return reqs
 }
+
+// Err returns the protocol error which ended the requests, or nil if the
+// connection was closed. It must be called once the requests are closed.
+func (r *Parser) Err() error {
+	var perr *ProtocolError
+	if errors.As(r.err, &perr) {
+		return perr
+	}
+	return nil
+}
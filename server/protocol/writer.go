@@ -14,18 +14,46 @@ var (
 	dollar = []byte{'$'}
 	plus   = []byte{'+'}
 	subs   = []byte{'-'}
+
+	// RESP3 types
+	percent = []byte{'%'}
+	tilde   = []byte{'~'}
+	comma   = []byte{','}
+	hash    = []byte{'#'}
+	lparen  = []byte{'('}
+	equal   = []byte{'='}
+	pipe    = []byte{'|'}
+	greater = []byte{'>'}
+)
+
+// protocol versions
+const (
+	RESP2 = 2
+	RESP3 = 3
 )
 
 type Writer struct {
-	w io.Writer
+	w     io.Writer
+	proto int
 }
 
 func NewWriter(sink io.Writer) *Writer {
 	return &Writer{
-		w: sink,
+		w:     sink,
+		proto: RESP2,
 	}
 }
 
+// SetProtocol switches the protocol of the replies, the RESP3 types are
+// written as their RESP2 equivalents when the protocol is RESP2.
+func (w *Writer) SetProtocol(proto int) {
+	w.proto = proto
+}
+
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
 func (w *Writer) Write(data []byte) (int, error) {
 	return w.w.Write(data)
 }
@@ -46,8 +74,7 @@ func (w *Writer) WriteInt(val int64) error {
 
 func (w *Writer) WriteBulk(val []byte) error {
 	if val == nil {
-		_, err := w.Write(nilBulk)
-		return err
+		return w.writeNil(nilBulk)
 	}
 	w.Write(dollar)
 	w.Write([]byte(intToString(int64(len(val)))))
@@ -77,14 +104,25 @@ func (w *Writer) WriteError(s string) error {
 
 func (w *Writer) WriteObjects(objs ...interface{}) error {
 	if objs == nil {
-		_, err := w.Write(nilArray)
-		return err
+		return w.writeNil(nilArray)
 	}
 
 	w.Write(star)
 	w.Write([]byte(intToString(int64(len(objs)))))
 	w.Write(newLine)
+	return w.writeElements(objs)
+}
+
+// WritePush writes an out of band message, like the messages of pubsub,
+// which is an array in RESP2.
+func (w *Writer) WritePush(objs ...interface{}) error {
+	if err := w.WritePushLen(len(objs)); err != nil {
+		return err
+	}
+	return w.writeElements(objs)
+}
 
+func (w *Writer) writeElements(objs []interface{}) error {
 	numArg := len(objs)
 	for i := 0; i < numArg; i++ {
 		v := objs[i]
@@ -115,6 +153,20 @@ func (w *Writer) WriteObjects(objs ...interface{}) error {
 			if err := w.WriteInt(int64(v)); err != nil {
 				return err
 			}
+		case []string:
+			if err := w.WriteBulkStrings(v); err != nil {
+				return err
+			}
+		case []interface{}:
+			if v == nil {
+				if err := w.writeNil(nilArray); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := w.WriteObjects(v...); err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("value not suppport %v", v)
 		}
@@ -122,10 +174,128 @@ func (w *Writer) WriteObjects(objs ...interface{}) error {
 	return nil
 }
 
+// WriteArrayLen writes the header of an array, whose elements are written
+// by the following calls.
+func (w *Writer) WriteArrayLen(n int) error {
+	return w.writeLen(star, n)
+}
+
+// WriteMapLen writes the header of a map of n pairs, whose keys and values
+// are written by the following calls. It's a flat array of 2*n elements
+// in RESP2.
+func (w *Writer) WriteMapLen(n int) error {
+	if w.proto == RESP2 {
+		return w.writeLen(star, 2*n)
+	}
+	return w.writeLen(percent, n)
+}
+
+// WriteSetLen writes the header of a set, which is an array in RESP2.
+func (w *Writer) WriteSetLen(n int) error {
+	if w.proto == RESP2 {
+		return w.writeLen(star, n)
+	}
+	return w.writeLen(tilde, n)
+}
+
+// WritePushLen writes the header of an out of band message, like the
+// messages of pubsub, which is an array in RESP2.
+func (w *Writer) WritePushLen(n int) error {
+	if w.proto == RESP2 {
+		return w.writeLen(star, n)
+	}
+	return w.writeLen(greater, n)
+}
+
+// WriteAttributeLen writes the header of the attributes of the next reply,
+// there are no attributes in RESP2 so the caller must not write the pairs.
+func (w *Writer) WriteAttributeLen(n int) error {
+	if w.proto == RESP2 {
+		return nil
+	}
+	return w.writeLen(pipe, n)
+}
+
+// WriteNull writes a null, which is a nil bulk in RESP2.
+func (w *Writer) WriteNull() error {
+	return w.writeNil(nilBulk)
+}
+
+// WriteDouble writes a formatted floating point number, which is a bulk
+// string in RESP2.
+func (w *Writer) WriteDouble(s string) error {
+	if w.proto == RESP2 {
+		return w.WriteBulkString(s)
+	}
+	return w.writeLine(comma, s)
+}
+
+// WriteBool writes a boolean, which is the integer 1 or 0 in RESP2.
+func (w *Writer) WriteBool(b bool) error {
+	if w.proto == RESP2 {
+		if b {
+			return w.WriteInt(1)
+		}
+		return w.WriteInt(0)
+	}
+	if b {
+		return w.writeLine(hash, "t")
+	}
+	return w.writeLine(hash, "f")
+}
+
+// WriteBigNumber writes an integer out of the range of int64, which is a
+// bulk string in RESP2.
+func (w *Writer) WriteBigNumber(s string) error {
+	if w.proto == RESP2 {
+		return w.WriteBulkString(s)
+	}
+	return w.writeLine(lparen, s)
+}
+
+// WriteVerbatim writes a string with the three characters format of its
+// content, like txt or mkd, which is a bulk string in RESP2.
+func (w *Writer) WriteVerbatim(format, s string) error {
+	if w.proto == RESP2 {
+		return w.WriteBulkString(s)
+	}
+	w.Write(equal)
+	w.Write([]byte(intToString(int64(len(s) + 4))))
+	w.Write(newLine)
+	w.Write([]byte(format))
+	w.Write([]byte{':'})
+	w.Write([]byte(s))
+	_, err := w.Write(newLine)
+	return err
+}
+
+// writeNil writes the given nil of RESP2, or the null of RESP3.
+func (w *Writer) writeNil(nil2 []byte) error {
+	if w.proto == RESP2 {
+		_, err := w.Write(nil2)
+		return err
+	}
+	_, err := w.Write(nilRESP3)
+	return err
+}
+
+func (w *Writer) writeLen(prefix []byte, n int) error {
+	w.Write(prefix)
+	w.Write([]byte(intToString(int64(n))))
+	_, err := w.Write(newLine)
+	return err
+}
+
+func (w *Writer) writeLine(prefix []byte, s string) error {
+	w.Write(prefix)
+	w.Write([]byte(s))
+	_, err := w.Write(newLine)
+	return err
+}
+
 func (w *Writer) WriteBulks(bulks ...[]byte) error {
 	if bulks == nil {
-		_, err := w.Write(nilArray)
-		return err
+		return w.writeNil(nilArray)
 	}
 
 	w.Write(star)
@@ -155,8 +325,7 @@ func (w *Writer) WriteBulksSlice(args [][]byte) error {
 
 func (w *Writer) WriteBulkStrings(bulks []string) error {
 	if bulks == nil {
-		_, err := w.Write(nilArray)
-		return err
+		return w.writeNil(nilArray)
 	}
 
 	w.Write(star)
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdSubscribe struct{}
+type cmdUnsubscribe struct{}
+type cmdPSubscribe struct{}
+type cmdPUnsubscribe struct{}
+type cmdPublish struct{}
+type cmdSSubscribe struct{}
+type cmdSUnsubscribe struct{}
+type cmdSPublish struct{}
+type cmdPubsub struct{}
+
+// pubsubType describes the messages of the global channels and of the shard
+// channels, which are independent from each other.
+type pubsubType struct {
+	shard          bool
+	subscribeMsg   string
+	unsubscribeMsg string
+	messageMsg     string
+}
+
+var (
+	pubsubGlobal = &pubsubType{
+		subscribeMsg:   "subscribe",
+		unsubscribeMsg: "unsubscribe",
+		messageMsg:     "message",
+	}
+	pubsubShard = &pubsubType{
+		shard:          true,
+		subscribeMsg:   "ssubscribe",
+		unsubscribeMsg: "sunsubscribe",
+		messageMsg:     "smessage",
+	}
+)
+
+// serverChannels returns the subscribers of every channel.
+func (t *pubsubType) serverChannels() map[string][]*Client {
+	if t.shard {
+		return godisServer.pubsubShardChannels
+	}
+	return godisServer.pubsubChannels
+}
+
+// clientChannels returns the channels the client is subscribed to.
+func (t *pubsubType) clientChannels(c *Client) *[]string {
+	if t.shard {
+		return &c.pubsubShardChannels
+	}
+	return &c.pubsubChannels
+}
+
+// subscriptionCount returns the number of subscriptions of the client,
+// which is replied along the (un)subscribe messages.
+func (t *pubsubType) subscriptionCount(c *Client) int {
+	if t.shard {
+		return len(c.pubsubShardChannels)
+	}
+	return len(c.pubsubChannels) + len(c.pubsubPatterns)
+}
+
+// isSubscriber reports whether the client is in the subscriber mode, where
+// only the pubsub commands are allowed.
+func (c *Client) isSubscriber() bool {
+	return len(c.pubsubChannels)+len(c.pubsubPatterns)+len(c.pubsubShardChannels) > 0
+}
+
+// isPubsubCommand reports whether the command is allowed in the subscriber
+// mode.
+func isPubsubCommand(name string) bool {
+	switch strings.ToLower(name) {
+	case CmdNameSubscribe, CmdNameUnsubscribe, CmdNamePSubscribe, CmdNamePUnsubscribe,
+		CmdNameSSubscribe, CmdNameSUnsubscribe, CmdNamePing:
+		return true
+	}
+	return false
+}
+
+func removeSubscriber(clients []*Client, c *Client) []*Client {
+	for i, sc := range clients {
+		if sc == c {
+			return append(clients[:i], clients[i+1:]...)
+		}
+	}
+	return clients
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) ([]string, bool) {
+	for i, e := range list {
+		if e == s {
+			return append(list[:i], list[i+1:]...), true
+		}
+	}
+	return list, false
+}
+
+// pubsubSubscribeChannel subscribes the client to the channel, and replies
+// the subscribe message.
+func pubsubSubscribeChannel(c *Client, channel string, t *pubsubType) {
+	channels := t.clientChannels(c)
+	if !containsString(*channels, channel) {
+		*channels = append(*channels, channel)
+		clients := t.serverChannels()
+		clients[channel] = append(clients[channel], c)
+	}
+	c.ReplyPush(t.subscribeMsg, channel, t.subscriptionCount(c))
+}
+
+// pubsubUnsubscribeChannel unsubscribes the client from the channel, the
+// unsubscribe message is only replied when notify is set, as it's not when
+// the client is freed.
+func pubsubUnsubscribeChannel(c *Client, channel string, t *pubsubType, notify bool) {
+	channels := t.clientChannels(c)
+	var found bool
+	if *channels, found = removeString(*channels, channel); found {
+		clients := t.serverChannels()
+		if subscribers := removeSubscriber(clients[channel], c); len(subscribers) == 0 {
+			delete(clients, channel)
+		} else {
+			clients[channel] = subscribers
+		}
+	}
+	if notify {
+		c.ReplyPush(t.unsubscribeMsg, channel, t.subscriptionCount(c))
+	}
+}
+
+// pubsubUnsubscribeAllChannels unsubscribes the client from all the
+// channels, and returns the number of channels it was subscribed to.
+func pubsubUnsubscribeAllChannels(c *Client, t *pubsubType, notify bool) int {
+	channels := append([]string(nil), *t.clientChannels(c)...)
+	for _, channel := range channels {
+		pubsubUnsubscribeChannel(c, channel, t, notify)
+	}
+	// an unsubscribe message is replied even if there was no channel
+	if notify && len(channels) == 0 {
+		c.ReplyPush(t.unsubscribeMsg, nil, t.subscriptionCount(c))
+	}
+	return len(channels)
+}
+
+func pubsubSubscribePattern(c *Client, pattern string) {
+	if !containsString(c.pubsubPatterns, pattern) {
+		c.pubsubPatterns = append(c.pubsubPatterns, pattern)
+		patterns := godisServer.pubsubPatterns
+		patterns[pattern] = append(patterns[pattern], c)
+	}
+	c.ReplyPush("psubscribe", pattern, pubsubGlobal.subscriptionCount(c))
+}
+
+func pubsubUnsubscribePattern(c *Client, pattern string, notify bool) {
+	var found bool
+	if c.pubsubPatterns, found = removeString(c.pubsubPatterns, pattern); found {
+		patterns := godisServer.pubsubPatterns
+		if subscribers := removeSubscriber(patterns[pattern], c); len(subscribers) == 0 {
+			delete(patterns, pattern)
+		} else {
+			patterns[pattern] = subscribers
+		}
+	}
+	if notify {
+		c.ReplyPush("punsubscribe", pattern, pubsubGlobal.subscriptionCount(c))
+	}
+}
+
+func pubsubUnsubscribeAllPatterns(c *Client, notify bool) int {
+	patterns := append([]string(nil), c.pubsubPatterns...)
+	for _, pattern := range patterns {
+		pubsubUnsubscribePattern(c, pattern, notify)
+	}
+	if notify && len(patterns) == 0 {
+		c.ReplyPush("punsubscribe", nil, pubsubGlobal.subscriptionCount(c))
+	}
+	return len(patterns)
+}
+
+// pubsubFreeClient unsubscribes a disconnected client from everything.
+func pubsubFreeClient(c *Client) {
+	pubsubUnsubscribeAllChannels(c, pubsubGlobal, false)
+	pubsubUnsubscribeAllChannels(c, pubsubShard, false)
+	pubsubUnsubscribeAllPatterns(c, false)
+}
+
+// pubsubPublishMessage pushes the message to the subscribers of the channel,
+// and of the patterns matching it for global channels, and returns the
+// number of clients receiving it.
+func pubsubPublishMessage(channel, message string, t *pubsubType) int {
+	receivers := 0
+	for _, c := range t.serverChannels()[channel] {
+		c.ReplyPush(t.messageMsg, channel, message)
+		receivers++
+	}
+	if t.shard {
+		return receivers
+	}
+
+	for pattern, clients := range godisServer.pubsubPatterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		for _, c := range clients {
+			c.ReplyPush("pmessage", pattern, channel, message)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// SUBSCRIBE channel [channel ...]
+func (*cmdSubscribe) Exec(c *Client, r *protocol.Request) error {
+	for i := 1; i < r.ArgCount(); i++ {
+		pubsubSubscribeChannel(c, r.ArgvAt(i), pubsubGlobal)
+	}
+	return nil
+}
+
+// UNSUBSCRIBE [channel [channel ...]]
+func (*cmdUnsubscribe) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() == 1 {
+		pubsubUnsubscribeAllChannels(c, pubsubGlobal, true)
+		return nil
+	}
+	for i := 1; i < r.ArgCount(); i++ {
+		pubsubUnsubscribeChannel(c, r.ArgvAt(i), pubsubGlobal, true)
+	}
+	return nil
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+func (*cmdPSubscribe) Exec(c *Client, r *protocol.Request) error {
+	for i := 1; i < r.ArgCount(); i++ {
+		pubsubSubscribePattern(c, r.ArgvAt(i))
+	}
+	return nil
+}
+
+// PUNSUBSCRIBE [pattern [pattern ...]]
+func (*cmdPUnsubscribe) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() == 1 {
+		pubsubUnsubscribeAllPatterns(c, true)
+		return nil
+	}
+	for i := 1; i < r.ArgCount(); i++ {
+		pubsubUnsubscribePattern(c, r.ArgvAt(i), true)
+	}
+	return nil
+}
+
+// PUBLISH channel message
+func (*cmdPublish) Exec(c *Client, r *protocol.Request) error {
+	receivers := pubsubPublishMessage(r.ArgvAt(1), r.ArgvAt(2), pubsubGlobal)
+	return c.ReplyInt(int64(receivers))
+}
+
+// SSUBSCRIBE shardchannel [shardchannel ...]
+func (*cmdSSubscribe) Exec(c *Client, r *protocol.Request) error {
+	for i := 1; i < r.ArgCount(); i++ {
+		pubsubSubscribeChannel(c, r.ArgvAt(i), pubsubShard)
+	}
+	return nil
+}
+
+// SUNSUBSCRIBE [shardchannel [shardchannel ...]]
+func (*cmdSUnsubscribe) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() == 1 {
+		pubsubUnsubscribeAllChannels(c, pubsubShard, true)
+		return nil
+	}
+	for i := 1; i < r.ArgCount(); i++ {
+		pubsubUnsubscribeChannel(c, r.ArgvAt(i), pubsubShard, true)
+	}
+	return nil
+}
+
+// SPUBLISH shardchannel message
+func (*cmdSPublish) Exec(c *Client, r *protocol.Request) error {
+	receivers := pubsubPublishMessage(r.ArgvAt(1), r.ArgvAt(2), pubsubShard)
+	return c.ReplyInt(int64(receivers))
+}
+
+// PUBSUB CHANNELS [pattern]
+// PUBSUB NUMSUB [channel [channel ...]]
+// PUBSUB NUMPAT
+// PUBSUB SHARDCHANNELS [pattern]
+// PUBSUB SHARDNUMSUB [shardchannel [shardchannel ...]]
+func (*cmdPubsub) Exec(c *Client, r *protocol.Request) error {
+	subcommand := strings.ToLower(r.ArgvAt(1))
+	switch subcommand {
+	case "channels", "shardchannels":
+		if r.ArgCount() > 3 {
+			return c.ReplyError("wrong number of arguments for 'pubsub|" + subcommand + "' command")
+		}
+		t := pubsubGlobal
+		if subcommand == "shardchannels" {
+			t = pubsubShard
+		}
+		channels := []string{}
+		for channel := range t.serverChannels() {
+			if r.ArgCount() == 2 || stringMatch(r.ArgvAt(2), channel, false) {
+				channels = append(channels, channel)
+			}
+		}
+		return c.ReplyList(channels)
+	case "numsub", "shardnumsub":
+		t := pubsubGlobal
+		if subcommand == "shardnumsub" {
+			t = pubsubShard
+		}
+		reply := make([]interface{}, 0, (r.ArgCount()-2)*2)
+		for i := 2; i < r.ArgCount(); i++ {
+			channel := r.ArgvAt(i)
+			reply = append(reply, channel, len(t.serverChannels()[channel]))
+		}
+		return c.ReplyBulk(reply...)
+	case "numpat":
+		if r.ArgCount() != 2 {
+			return c.ReplyError("wrong number of arguments for 'pubsub|numpat' command")
+		}
+		return c.ReplyInt(int64(len(godisServer.pubsubPatterns)))
+	default:
+		return c.ReplyError("unknown subcommand '" + r.ArgvAt(1) + "'. Try PUBSUB HELP.")
+	}
+}
@@ -0,0 +1,676 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kzinglzy/godis/dt"
+)
+
+// The snapshot file is laid out as:
+//
+//   "GODIS" <4 digits version>
+//   [FUNCTION <library code>]
+//   ...
+//   SELECTDB <dbnum>
+//   [EXPIRETIME_MS <8 bytes ms>] <type> <key> <value>
+//   ...
+//   SELECTDB <dbnum>
+//   ...
+//   EOF <8 bytes crc64 of everything before>
+//
+// Lengths use the same variable size encoding as the Redis RDB format.
+
+var (
+	errRDBSaveInProgress = errors.New("Background save already in progress")
+	errRDBBadFormat      = errors.New("Wrong RDB file format")
+	errRDBBadChecksum    = errors.New("Wrong RDB checksum")
+
+	rdbCrcTable = crc64.MakeTable(crc64.ECMA)
+)
+
+type saveParam struct {
+	seconds int64
+	changes int64
+}
+
+func rdbSaveBackgroundIfNeed() {
+	s := godisServer
+	if s.rdbSaveInProgress() {
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, sp := range s.saveParams {
+		if s.dirty >= sp.changes && now-s.lastsave > sp.seconds {
+			log.Printf("%d changes in %d seconds. Saving...", sp.changes, sp.seconds)
+			rdbSaveBackground()
+			return
+		}
+	}
+}
+
+// rdbSaveBackground persists a consistent snapshot of the keyspace, which
+// is copied incrementally by the event loop while another goroutine encodes
+// and writes the copies.
+func rdbSaveBackground() error {
+	s := godisServer
+	if s.rdbSaveInProgress() {
+		return errRDBSaveInProgress
+	}
+
+	ks := s.startSnapshot()
+	functions := s.functionsSnapshot()
+	done := make(chan error, 1)
+	s.rdbSaveDone = done
+	s.dirtyBeforeBgsave = s.dirty
+
+	log.Printf("background saving started")
+	go func() {
+		defer ks.stop()
+		done <- rdbSave(RDBFileName, ks, functions)
+	}()
+	return nil
+}
+
+func backgroundSaveDoneHandler(err error) {
+	s := godisServer
+	s.rdbSaveDone = nil
+	if err != nil {
+		log.Printf("background saving error: %v", err)
+		return
+	}
+
+	log.Printf("background saving terminated with success")
+	s.dirty -= s.dirtyBeforeBgsave
+	s.lastsave = time.Now().Unix()
+}
+
+// rdbSave writes the function libraries and the entries of every database
+// to a temp file and renames it to filename once it is safely on disk.
+func rdbSave(filename string, ks *keyspaceSnapshot, functions []string) error {
+	tmpfile := filepath.Join(filepath.Dir(filename), fmt.Sprintf(RDBTempFileName, os.Getpid()))
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+
+	if err = rdbWrite(f, ks, functions); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+func rdbWrite(w io.Writer, ks *keyspaceSnapshot, functions []string) error {
+	crc := crc64.New(rdbCrcTable)
+	e := &rdbEncoder{w: bufio.NewWriter(io.MultiWriter(w, crc))}
+
+	e.write([]byte(fmt.Sprintf("GODIS%04d", RDBVersion)))
+	for _, code := range functions {
+		e.writeByte(RDBOpcodeFunction)
+		e.writeString(code)
+	}
+	// the keys of the databases are interleaved as they're copied
+	selected := -1
+	for entry, ok := ks.next(); ok && e.err == nil; entry, ok = ks.next() {
+		if entry.db != selected {
+			e.writeByte(RDBOpcodeSelectDB)
+			e.writeLen(uint64(entry.db))
+			selected = entry.db
+		}
+		if entry.expire != -1 {
+			e.writeByte(RDBOpcodeExpireTimeMs)
+			e.writeMillisecondTime(entry.expire)
+		}
+		e.writeObjectType(entry.val)
+		e.writeString(entry.key)
+		e.writeObject(entry.val)
+	}
+	e.writeByte(RDBOpcodeEOF)
+	if e.err != nil {
+		return e.err
+	}
+
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], crc.Sum64())
+	_, err := w.Write(sum[:])
+	return err
+}
+
+// rdbLoad loads the snapshot file into dbs, keys already expired are skipped.
+// The function libraries are loaded into the server.
+func rdbLoad(filename string, dbs []*Database) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	crc := crc64.New(rdbCrcTable)
+	d := &rdbDecoder{r: io.TeeReader(r, crc), left: fi.Size()}
+
+	header := d.read(9)
+	if d.err != nil || string(header[:5]) != "GODIS" {
+		return errRDBBadFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(string(header[5:]), "%04d", &version); err != nil || version > RDBVersion {
+		return fmt.Errorf("Can't handle RDB format version %s", header[5:])
+	}
+
+	// the file is loaded into empty databases, which replace dbs only once
+	// the checksum matches, so that a corrupt file loads nothing
+	loaded := make([]*Database, len(dbs))
+	for i := range loaded {
+		loaded[i] = NewDatabase()
+	}
+	var functions []string
+
+	now := mstime()
+	expire := int64(-1)
+	db := loaded[0]
+	for d.err == nil {
+		t := d.readByte()
+		switch t {
+		case RDBOpcodeExpireTimeMs:
+			expire = d.readMillisecondTime()
+			continue
+		case RDBOpcodeFunction:
+			functions = append(functions, d.readString())
+			continue
+		case RDBOpcodeSelectDB:
+			id := d.readLen()
+			if d.err == nil && id >= uint64(len(dbs)) {
+				return fmt.Errorf("FATAL: Data file was created with a Godis server configured to handle more than %d databases. Exiting", len(dbs))
+			}
+			if d.err == nil {
+				db = loaded[id]
+			}
+			continue
+		case RDBOpcodeEOF:
+			if d.err != nil {
+				return d.err
+			}
+			expected := crc.Sum64()
+			var sum [8]byte
+			if _, err := io.ReadFull(r, sum[:]); err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint64(sum[:]) != expected {
+				return errRDBBadChecksum
+			}
+			for _, code := range functions {
+				if _, msg := functionsCreateLibrary(code, false); msg != "" {
+					return fmt.Errorf("Failed loading library: %s", msg)
+				}
+			}
+			for i, db := range loaded {
+				dbs[i].store, dbs[i].expires, dbs[i].elements = db.store, db.expires, db.elements
+			}
+			return nil
+		}
+
+		key := d.readString()
+		val := d.readObject(t)
+		if d.err != nil {
+			break
+		}
+		if expire == -1 || expire > now {
+			db.Add(key, val)
+			if expire != -1 {
+				db.setExpire(key, expire)
+			}
+		}
+		expire = -1
+	}
+
+	if d.err == io.EOF || d.err == io.ErrUnexpectedEOF {
+		return errors.New("Short read or OOM loading DB. Unrecoverable error, aborting now")
+	}
+	return d.err
+}
+
+// rdbEncoder remembers the first error so callers can check it once at the end.
+type rdbEncoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *rdbEncoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(p)
+}
+
+func (e *rdbEncoder) writeByte(b byte) {
+	e.write([]byte{b})
+}
+
+// writeLen encodes the length in 1, 2, 5 or 9 bytes:
+// 00|6 bits, 01|14 bits, 0x80 + 32 bits and 0x81 + 64 bits big endian.
+func (e *rdbEncoder) writeLen(n uint64) {
+	var buf [9]byte
+	switch {
+	case n < 1<<6:
+		e.writeByte(byte(n) | RDB6BitLen<<6)
+	case n < 1<<14:
+		buf[0] = byte(n>>8) | RDB14BitLen<<6
+		buf[1] = byte(n)
+		e.write(buf[:2])
+	case n <= 0xffffffff:
+		buf[0] = RDB32BitLen
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		e.write(buf[:5])
+	default:
+		buf[0] = RDB64BitLen
+		binary.BigEndian.PutUint64(buf[1:], n)
+		e.write(buf[:9])
+	}
+}
+
+func (e *rdbEncoder) writeString(s string) {
+	e.writeLen(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+func (e *rdbEncoder) writeMillisecondTime(ms int64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(ms))
+	e.write(buf[:])
+}
+
+// writeDouble writes the binary representation of f.
+func (e *rdbEncoder) writeDouble(f float64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+	e.write(buf[:])
+}
+
+func (e *rdbEncoder) writeObjectType(o *dt.Object) {
+	switch o.ObjType {
+	case dt.ObjString:
+		e.writeByte(RDBTypeString)
+	case dt.ObjList:
+		e.writeByte(RDBTypeListQuicklist)
+	case dt.ObjSet:
+		if o.Encoding == dt.ObjEncodingIntset {
+			e.writeByte(RDBTypeSetIntset)
+		} else {
+			e.writeByte(RDBTypeSet)
+		}
+	case dt.ObjZSet:
+		e.writeByte(RDBTypeZSet)
+	case dt.ObjHash:
+		if o.Encoding == dt.ObjEncodingZiplist {
+			e.writeByte(RDBTypeHashZiplist)
+		} else {
+			e.writeByte(RDBTypeHash)
+		}
+	case dt.ObjStream:
+		e.writeByte(RDBTypeStream)
+	default:
+		e.err = fmt.Errorf("unknown object type %d", o.ObjType)
+	}
+}
+
+func (e *rdbEncoder) writeObject(o *dt.Object) {
+	switch o.ObjType {
+	case dt.ObjString:
+		e.writeString(o.StringValue())
+	case dt.ObjList:
+		ql := o.Ptr.(*dt.Quicklist)
+		e.writeLen(uint64(ql.Nodes()))
+		ql.IterateNodes(func(zl *dt.Ziplist) bool {
+			e.writeString(string(zl.Bytes()))
+			return true
+		})
+	case dt.ObjSet:
+		if o.Encoding == dt.ObjEncodingIntset {
+			e.writeString(string(o.Ptr.(*dt.Intset).Bytes()))
+			return
+		}
+		e.writeLen(uint64(setTypeSize(o)))
+		setTypeIterate(o, func(member string) bool {
+			e.writeString(member)
+			return true
+		})
+	case dt.ObjZSet:
+		zs := o.Ptr.(*dt.SortedSet)
+		e.writeLen(uint64(zs.Len()))
+		for ln := zs.Skiplist().First(); ln != nil; ln = ln.Next() {
+			e.writeString(ln.Member)
+			e.writeDouble(ln.Score)
+		}
+	case dt.ObjHash:
+		if o.Encoding == dt.ObjEncodingZiplist {
+			e.writeString(string(o.Ptr.(*dt.Ziplist).Bytes()))
+			return
+		}
+		e.writeLen(uint64(hashTypeLength(o)))
+		hashTypeIterate(o, func(field, value string) bool {
+			e.writeString(field)
+			e.writeString(value)
+			return true
+		})
+	case dt.ObjStream:
+		e.writeStream(o.Ptr.(*dt.Stream))
+	}
+}
+
+func (e *rdbEncoder) writeStreamID(id dt.StreamID) {
+	e.writeLen(id.Ms)
+	e.writeLen(id.Seq)
+}
+
+// writeStream writes the blocks of the stream with their master ID, its
+// IDs and counters, then every consumer group with its consumers and
+// their pending entries.
+func (e *rdbEncoder) writeStream(s *dt.Stream) {
+	e.writeLen(uint64(s.Blocks()))
+	s.IterateBlocks(func(master dt.StreamID, zl *dt.Ziplist) bool {
+		e.writeStreamID(master)
+		e.writeString(string(zl.Bytes()))
+		return true
+	})
+	e.writeStreamID(s.LastID)
+	e.writeStreamID(s.FirstID)
+	e.writeStreamID(s.MaxDeletedID)
+	e.writeLen(uint64(s.EntriesAdded))
+
+	e.writeLen(uint64(s.GroupsLen()))
+	s.Groups(func(name string, cg *dt.StreamCG) bool {
+		e.writeString(name)
+		e.writeStreamID(cg.LastID)
+		e.writeLen(uint64(cg.EntriesRead))
+		e.writeLen(uint64(cg.ConsumersLen()))
+		cg.Consumers(func(consumer *dt.StreamConsumer) bool {
+			e.writeString(consumer.Name)
+			e.writeMillisecondTime(consumer.SeenTime)
+			e.writeMillisecondTime(consumer.ActiveTime)
+			e.writeLen(uint64(consumer.PendingLen()))
+			consumer.PendingRange(dt.StreamID{}, dt.MaxStreamID, func(id dt.StreamID, nack *dt.StreamNACK) bool {
+				e.writeStreamID(id)
+				e.writeMillisecondTime(nack.DeliveryTime)
+				e.writeLen(uint64(nack.DeliveryCount))
+				return true
+			})
+			return true
+		})
+		return true
+	})
+}
+
+type rdbDecoder struct {
+	r    io.Reader
+	left int64 // the bytes left in the input, which bound the lengths read
+	err  error
+}
+
+// read reads n bytes, a length larger than the input left is a short read
+// rather than a huge allocation, as the checksum isn't verified yet.
+func (d *rdbDecoder) read(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if d.left == 0 && n > 0 {
+		d.err = io.EOF
+		return nil
+	}
+	if n < 0 || int64(n) > d.left {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	buf := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, buf)
+	d.left -= int64(n)
+	return buf
+}
+
+func (d *rdbDecoder) readByte() byte {
+	buf := d.read(1)
+	if d.err != nil {
+		return 0
+	}
+	return buf[0]
+}
+
+func (d *rdbDecoder) readLen() uint64 {
+	b := d.readByte()
+	switch b >> 6 {
+	case RDB6BitLen:
+		return uint64(b & 0x3f)
+	case RDB14BitLen:
+		return uint64(b&0x3f)<<8 | uint64(d.readByte())
+	}
+
+	switch b {
+	case RDB32BitLen:
+		buf := d.read(4)
+		if d.err == nil {
+			return uint64(binary.BigEndian.Uint32(buf))
+		}
+	case RDB64BitLen:
+		buf := d.read(8)
+		if d.err == nil {
+			return binary.BigEndian.Uint64(buf)
+		}
+	default:
+		if d.err == nil {
+			d.err = errRDBBadFormat
+		}
+	}
+	return 0
+}
+
+func (d *rdbDecoder) readString() string {
+	n := d.readLen()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(d.left) {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	return string(d.read(int(n)))
+}
+
+func (d *rdbDecoder) readMillisecondTime() int64 {
+	buf := d.read(8)
+	if d.err != nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(buf))
+}
+
+func (d *rdbDecoder) readDouble() float64 {
+	buf := d.read(8)
+	if d.err != nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf))
+}
+
+func (d *rdbDecoder) readZiplist() *dt.Ziplist {
+	blob := d.readString()
+	if d.err != nil {
+		return nil
+	}
+	zl, err := dt.ZiplistFromBytes([]byte(blob))
+	if err != nil {
+		d.err = err
+	}
+	return zl
+}
+
+func (d *rdbDecoder) readIntset() *dt.Intset {
+	blob := d.readString()
+	if d.err != nil {
+		return nil
+	}
+	is, err := dt.IntsetFromBytes([]byte(blob))
+	if err != nil {
+		d.err = err
+	}
+	return is
+}
+
+func (d *rdbDecoder) readObject(t byte) *dt.Object {
+	switch t {
+	case RDBTypeString:
+		return createStringObject(d.readString())
+	case RDBTypeList:
+		n := d.readLen()
+		o := listTypeCreate()
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			listTypePush(o, d.readString(), listTail)
+		}
+		return o
+	case RDBTypeListQuicklist:
+		n := d.readLen()
+		o := listTypeCreate()
+		ql := o.Ptr.(*dt.Quicklist)
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			if zl := d.readZiplist(); d.err == nil {
+				ql.AppendZiplist(zl)
+			}
+		}
+		return o
+	case RDBTypeSet:
+		n := d.readLen()
+		o := dt.NewSet()
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			setTypeAdd(o, d.readString())
+		}
+		return o
+	case RDBTypeSetIntset:
+		is := d.readIntset()
+		if d.err != nil {
+			return nil
+		}
+		o := dt.NewIntsetObject()
+		o.Ptr = is
+		if is.Len() > godisServer.setMaxIntsetEntries {
+			setTypeConvert(o)
+		}
+		return o
+	case RDBTypeZSet:
+		n := d.readLen()
+		o := dt.NewZSet()
+		zs := o.Ptr.(*dt.SortedSet)
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			member := d.readString()
+			zs.Add(member, d.readDouble())
+		}
+		return o
+	case RDBTypeHash:
+		n := d.readLen()
+		o := dt.NewHash()
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			hashTypeSet(o, d.readString(), d.readString())
+		}
+		return o
+	case RDBTypeHashZiplist:
+		zl := d.readZiplist()
+		if d.err != nil {
+			return nil
+		}
+		// the fields and the values alternate
+		if zl.Len()%2 != 0 {
+			d.err = errRDBBadFormat
+			return nil
+		}
+		o := dt.NewHash()
+		o.Ptr = zl
+		if zl.Len()/2 > godisServer.hashMaxZiplistEntries {
+			hashTypeConvert(o)
+		}
+		return o
+	case RDBTypeStream:
+		o := dt.NewStreamObject()
+		d.readStream(o.Ptr.(*dt.Stream))
+		return o
+	}
+
+	if d.err == nil {
+		d.err = fmt.Errorf("unknown RDB object type %d", t)
+	}
+	return nil
+}
+
+func (d *rdbDecoder) readStreamID() dt.StreamID {
+	ms := d.readLen()
+	return dt.StreamID{Ms: ms, Seq: d.readLen()}
+}
+
+// readStream reads a stream written by writeStream.
+func (d *rdbDecoder) readStream(s *dt.Stream) {
+	n := d.readLen()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		master := d.readStreamID()
+		zl := d.readZiplist()
+		if d.err == nil {
+			d.err = s.AppendBlock(master, zl)
+		}
+	}
+	s.LastID = d.readStreamID()
+	s.FirstID = d.readStreamID()
+	s.MaxDeletedID = d.readStreamID()
+	s.EntriesAdded = int64(d.readLen())
+
+	groups := d.readLen()
+	for i := uint64(0); i < groups && d.err == nil; i++ {
+		name := d.readString()
+		lastID := d.readStreamID()
+		cg := s.CreateGroup(name, lastID, int64(d.readLen()))
+		if cg == nil {
+			if d.err == nil {
+				d.err = errRDBBadFormat
+			}
+			return
+		}
+
+		consumers := d.readLen()
+		for j := uint64(0); j < consumers && d.err == nil; j++ {
+			consumer := cg.CreateConsumer(d.readString(), d.readMillisecondTime())
+			if consumer == nil {
+				if d.err == nil {
+					d.err = errRDBBadFormat
+				}
+				return
+			}
+			consumer.ActiveTime = d.readMillisecondTime()
+
+			pending := d.readLen()
+			for k := uint64(0); k < pending && d.err == nil; k++ {
+				id := d.readStreamID()
+				nack := cg.Deliver(id, consumer, d.readMillisecondTime())
+				nack.DeliveryCount = int64(d.readLen())
+			}
+		}
+	}
+}
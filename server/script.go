@@ -0,0 +1,550 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kzinglzy/godis/server/protocol"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type cmdEval struct{}
+type cmdEvalSha struct{}
+type cmdEvalRO struct{}
+type cmdEvalShaRO struct{}
+type cmdScript struct{}
+
+const (
+	replyNoScript = "NOSCRIPT No matching script. Please use EVAL."
+	replyNotBusy  = "NOTBUSY No scripts in execution right now."
+	replyBusy     = "BUSY Godis is busy running a script. You can only call "
+)
+
+// scriptingInit creates the Lua interpreter of the scripts, and the client
+// executing the commands they call.
+func scriptingInit(s *Server) {
+	var reply bytes.Buffer
+	s.lua = luaCreateState()
+	s.luaScripts = make(map[string]*lua.LFunction)
+	s.luaReply = &reply
+	s.luaClient = &Client{
+		db:     s.db[0],
+		writer: protocol.NewWriter(&reply),
+		wg:     new(sync.WaitGroup),
+	}
+}
+
+// luaCreateState returns an interpreter with the libraries and the redis
+// API available to the scripts and the functions.
+func luaCreateState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// the scripts can't access the file system
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redis := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"call":         luaRedisCall,
+		"pcall":        luaRedisPCall,
+		"sha1hex":      luaRedisSha1hex,
+		"error_reply":  luaRedisErrorReply,
+		"status_reply": luaRedisStatusReply,
+		"log":          luaRedisLog,
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.RawSetString(level, lua.LNumber(i))
+	}
+	L.SetGlobal("redis", redis)
+
+	// the globals would be shared by all the scripts
+	mt := L.NewTable()
+	mt.RawSetString("__newindex", L.NewFunction(luaProtectGlobals))
+	L.SetMetatable(L.G.Global, mt)
+	return L
+}
+
+func luaProtectGlobals(L *lua.LState) int {
+	L.RaiseError("Script attempted to create global variable '%s'", L.CheckAny(2).String())
+	return 0
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// luaCreateFunction compiles the script, which is cached by its SHA1 for
+// EVALSHA.
+func luaCreateFunction(body string) (string, *lua.LFunction, string) {
+	sha := sha1hex(body)
+	if fn := godisServer.luaScripts[sha]; fn != nil {
+		return sha, fn, ""
+	}
+
+	fn, err := godisServer.lua.Load(strings.NewReader(body), "user_script")
+	if err != nil {
+		return "", nil, "Error compiling script (new function): " + err.Error()
+	}
+	godisServer.luaScripts[sha] = fn
+	return sha, fn, ""
+}
+
+// EVAL script numkeys [key [key ...]] [arg [arg ...]]
+func (*cmdEval) Exec(c *Client, r *protocol.Request) error {
+	return evalGenericCommand(c, r, false, false)
+}
+
+// EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+func (*cmdEvalSha) Exec(c *Client, r *protocol.Request) error {
+	return evalGenericCommand(c, r, true, false)
+}
+
+// EVAL_RO script numkeys [key [key ...]] [arg [arg ...]]
+func (*cmdEvalRO) Exec(c *Client, r *protocol.Request) error {
+	return evalGenericCommand(c, r, false, true)
+}
+
+// EVALSHA_RO sha1 numkeys [key [key ...]] [arg [arg ...]]
+func (*cmdEvalShaRO) Exec(c *Client, r *protocol.Request) error {
+	return evalGenericCommand(c, r, true, true)
+}
+
+func evalGenericCommand(c *Client, r *protocol.Request, evalsha, readonly bool) error {
+	keys, args, msg := scriptGetKeys(r)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	var sha string
+	var fn *lua.LFunction
+	if evalsha {
+		sha = strings.ToLower(r.ArgvAt(1))
+		if fn = godisServer.luaScripts[sha]; fn == nil {
+			return c.ReplyError(replyNoScript)
+		}
+	} else {
+		if sha, fn, msg = luaCreateFunction(r.ArgvAt(1)); msg != "" {
+			return c.ReplyError(msg)
+		}
+	}
+
+	L := godisServer.lua
+	L.G.Global.RawSetString("KEYS", luaStringsTable(L, keys))
+	L.G.Global.RawSetString("ARGV", luaStringsTable(L, args))
+	return luaCallFunction(c, L, fn, nil, readonly, "f_"+sha, CmdNameScript)
+}
+
+// scriptGetKeys returns the keys and the arguments of EVAL and FCALL,
+// which are given after the number of keys.
+func scriptGetKeys(r *protocol.Request) ([]string, []string, string) {
+	if r.ArgCount() < 3 {
+		return nil, nil, "wrong number of arguments for '" + strings.ToLower(r.CommandName()) + "' command"
+	}
+
+	numkeys, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return nil, nil, ReplyNotInteger
+	}
+	if numkeys > int64(r.ArgCount()-3) {
+		return nil, nil, "Number of keys can't be greater than number of args"
+	}
+	if numkeys < 0 {
+		return nil, nil, "Number of keys can't be negative"
+	}
+
+	argv := r.Argv()
+	return argv[3 : 3+numkeys], argv[3+numkeys:], ""
+}
+
+// luaCallFunction runs the script or the function of L for the client,
+// name identifies it in the errors, and killCommand is the command which
+// can kill it once it's too slow. The commands called by the script are
+// written to the AOF in place of the script, wrapped in MULTI/EXEC, so
+// that the script can be non deterministic.
+func luaCallFunction(c *Client, L *lua.LState, fn *lua.LFunction, args []lua.LValue, readonly bool, name, killCommand string) error {
+	s := godisServer
+
+	// the commands of the script are executed at once like a transaction,
+	// which is already wrapped in MULTI/EXEC if the script is called by one.
+	wrapped := c.multi && c.mstate.propagated
+	lc := s.luaClient
+	lc.db = c.db
+	lc.multi = true
+	lc.mstate = multiState{propagated: wrapped}
+	s.luaReadonly = readonly
+	atomic.StoreInt32(&s.luaWriteDirty, 0)
+
+	ctx, kill := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	deferred := make(chan []*IOEvent)
+	// the watchdog can't read the state of the clients changed by the
+	// script, the blocked ones are copied before
+	blocked := make(map[*Client]bool, len(s.blockedClients))
+	for bc := range s.blockedClients {
+		blocked[bc] = true
+	}
+	go s.luaWatchdog(c, killCommand, blocked, done, deferred, kill)
+
+	L.SetContext(ctx)
+	err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...)
+	L.RemoveContext()
+	killed := ctx.Err() != nil
+	close(done)
+	s.luaDeferredEvents = append(s.luaDeferredEvents, <-deferred...)
+	kill()
+
+	lc.multi = false
+	if lc.mstate.propagated && !wrapped {
+		if c.multi {
+			c.mstate.propagated = true
+		} else {
+			c.propagate(CmdNameExec)
+		}
+	}
+	// the effects of the script are propagated instead of the script
+	if c.propagated == nil {
+		c.propagated = [][]string{}
+	}
+
+	if err != nil {
+		if killed {
+			return c.ReplyError("Script killed by user with " + strings.ToUpper(killCommand) + " KILL...")
+		}
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if tbl, ok := apiErr.Object.(*lua.LTable); ok {
+				if msg, ok := tbl.RawGetString("err").(lua.LString); ok {
+					return c.ReplyError(string(msg))
+				}
+			}
+			return c.ReplyError("Error running script (call to " + name + "): " + apiErr.Object.String())
+		}
+		return c.ReplyError("Error running script (call to " + name + "): " + err.Error())
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+	return luaReplyToRedisReply(c, ret)
+}
+
+// luaWatchdog answers the other clients with a BUSY error once the script
+// runs for longer than lua-time-limit, only killCommand KILL is served. The
+// events which can't be answered while the script is running are returned
+// when it's done, to be processed by the event loop, like the events of the
+// clients blocked when the script started.
+func (s *Server) luaWatchdog(caller *Client, killCommand string, blocked map[*Client]bool, done <-chan struct{}, deferred chan<- []*IOEvent, kill func()) {
+	timer := time.NewTimer(time.Duration(s.luaTimeLimit) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-done:
+		deferred <- nil
+		return
+	case <-timer.C:
+		log.Printf("slow script detected: still in execution after %d milliseconds", s.luaTimeLimit)
+	}
+
+	var events []*IOEvent
+	for {
+		select {
+		case <-done:
+			deferred <- events
+			return
+		case e := <-s.events:
+			if e.r == nil || e.c == caller || blocked[e.c] {
+				events = append(events, e)
+				continue
+			}
+			// the reply is queued at once rather than written to the client,
+			// which the event loop may be writing to as well
+			var reply bytes.Buffer
+			w := protocol.NewWriter(&reply)
+			w.SetProtocol(e.c.protocol())
+			if strings.ToLower(e.r.CommandName()) == killCommand && e.r.ArgCount() == 2 &&
+				strings.ToLower(e.r.ArgvAt(1)) == "kill" {
+				if atomic.LoadInt32(&s.luaWriteDirty) != 0 {
+					w.WriteError("UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+						"You can wait the script termination, or kill the server in a hard way.")
+				} else {
+					kill()
+					w.WriteSimpleString("OK")
+				}
+			} else {
+				w.WriteError(replyBusy + strings.ToUpper(killCommand) + " KILL.")
+			}
+			e.c.out.writeReply(reply.Bytes())
+			e.c.wg.Done()
+		}
+	}
+}
+
+func luaStringsTable(L *lua.LState, list []string) *lua.LTable {
+	tbl := L.CreateTable(len(list), 0)
+	for _, s := range list {
+		tbl.Append(lua.LString(s))
+	}
+	return tbl
+}
+
+// luaError returns the error to the script in a table with the err field,
+// which is raised by redis.call and returned by redis.pcall.
+func luaError(L *lua.LState, msg string, raise bool) int {
+	tbl := L.NewTable()
+	tbl.RawSetString("err", lua.LString(msg))
+	if raise {
+		L.Error(tbl, 1)
+		return 0
+	}
+	L.Push(tbl)
+	return 1
+}
+
+func luaRedisCall(L *lua.LState) int {
+	return luaRedisGenericCommand(L, true)
+}
+
+func luaRedisPCall(L *lua.LState) int {
+	return luaRedisGenericCommand(L, false)
+}
+
+// luaRedisGenericCommand executes a command for redis.call and redis.pcall,
+// and converts its reply to Lua.
+func luaRedisGenericCommand(L *lua.LState, raise bool) int {
+	s := godisServer
+	if s.functionLoading != nil {
+		L.RaiseError("redis.call and redis.pcall are not allowed during FUNCTION LOAD")
+	}
+	argc := L.GetTop()
+	if argc == 0 {
+		return luaError(L, "Please specify at least one argument for this redis lib call", raise)
+	}
+	argv := make([]string, argc)
+	for i := 1; i <= argc; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			argv[i-1] = string(v)
+		case lua.LNumber:
+			argv[i-1] = v.String()
+		default:
+			return luaError(L, "Lua redis lib command arguments must be strings or integers", raise)
+		}
+	}
+
+	cmd := LoopupCommand(argv[0])
+	if cmd == unknownCommandInfo {
+		return luaError(L, "Unknown Redis command called from script", raise)
+	}
+	if !cmd.checkArity(argc) {
+		return luaError(L, "Wrong number of args calling Redis command from script", raise)
+	}
+	if cmd.flags&CmdFlagNoScript != 0 {
+		return luaError(L, "This Redis command is not allowed from script", raise)
+	}
+	if cmd.flags&CmdFlagWrite != 0 {
+		if s.luaReadonly {
+			return luaError(L, "Write commands are not allowed from read-only scripts.", raise)
+		}
+		atomic.StoreInt32(&s.luaWriteDirty, 1)
+	}
+
+	s.luaReply.Reset()
+	call(s.luaClient, protocol.NewRequest(argv...))
+	ret, _ := luaParseReply(L, s.luaReply.Bytes())
+	if tbl, ok := ret.(*lua.LTable); ok && raise {
+		if _, ok := tbl.RawGetString("err").(lua.LString); ok {
+			L.Error(tbl, 1)
+		}
+	}
+	L.Push(ret)
+	return 1
+}
+
+// luaParseReply converts the first RESP reply of data to a Lua value, and
+// returns the remaining data.
+func luaParseReply(L *lua.LState, data []byte) (lua.LValue, []byte) {
+	if len(data) == 0 {
+		return lua.LFalse, data
+	}
+	end := bytes.Index(data, []byte("\r\n"))
+	line, rest := string(data[1:end]), data[end+2:]
+
+	switch data[0] {
+	case '+':
+		tbl := L.NewTable()
+		tbl.RawSetString("ok", lua.LString(line))
+		return tbl, rest
+	case '-':
+		tbl := L.NewTable()
+		tbl.RawSetString("err", lua.LString(line))
+		return tbl, rest
+	case ':':
+		n, _ := strconv.ParseInt(line, 10, 64)
+		return lua.LNumber(n), rest
+	case '$':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return lua.LFalse, rest
+		}
+		return lua.LString(rest[:n]), rest[n+2:]
+	case '*':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return lua.LFalse, rest
+		}
+		tbl := L.CreateTable(n, 0)
+		for i := 0; i < n; i++ {
+			var v lua.LValue
+			v, rest = luaParseReply(L, rest)
+			tbl.Append(v)
+		}
+		return tbl, rest
+	}
+	return lua.LFalse, nil
+}
+
+// luaReplyToRedisReply replies the value returned by the script.
+func luaReplyToRedisReply(c *Client, v lua.LValue) error {
+	switch v := v.(type) {
+	case lua.LString:
+		return c.ReplyBulkString(string(v))
+	case lua.LBool:
+		if v {
+			return c.ReplyInt(1)
+		}
+		return c.ReplyEmpty()
+	case lua.LNumber:
+		return c.ReplyInt(int64(v))
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return c.ReplyError(string(msg))
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return c.Reply(string(msg))
+		}
+		// the array stops at the first nil element
+		var elems []lua.LValue
+		for i := 1; ; i++ {
+			e := v.RawGetInt(i)
+			if e == lua.LNil {
+				break
+			}
+			elems = append(elems, e)
+		}
+		c.ReplyArrayLen(len(elems))
+		for _, e := range elems {
+			luaReplyToRedisReply(c, e)
+		}
+		return nil
+	default:
+		return c.ReplyEmpty()
+	}
+}
+
+func luaRedisSha1hex(L *lua.LState) int {
+	if L.GetTop() != 1 {
+		L.RaiseError("wrong number of arguments")
+	}
+	L.Push(lua.LString(sha1hex(L.CheckString(1))))
+	return 1
+}
+
+func luaRedisErrorReply(L *lua.LState) int {
+	tbl := L.NewTable()
+	tbl.RawSetString("err", lua.LString(L.CheckString(1)))
+	L.Push(tbl)
+	return 1
+}
+
+func luaRedisStatusReply(L *lua.LState) int {
+	tbl := L.NewTable()
+	tbl.RawSetString("ok", lua.LString(L.CheckString(1)))
+	L.Push(tbl)
+	return 1
+}
+
+func luaRedisLog(L *lua.LState) int {
+	if L.GetTop() < 2 {
+		L.RaiseError("redis.log() requires two arguments or more.")
+	}
+	level := L.CheckInt(1)
+	if level < 0 || level > 3 {
+		L.RaiseError("Invalid debug level.")
+	}
+	msg := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		msg = append(msg, L.Get(i).String())
+	}
+	log.Print(strings.Join(msg, " "))
+	return 0
+}
+
+// SCRIPT LOAD script
+// SCRIPT EXISTS sha1 [sha1 ...]
+// SCRIPT FLUSH [ASYNC|SYNC]
+// SCRIPT KILL
+func (*cmdScript) Exec(c *Client, r *protocol.Request) error {
+	switch sub := strings.ToLower(r.ArgvAt(1)); sub {
+	case "load":
+		if r.ArgCount() != 3 {
+			return c.ReplyError("wrong number of arguments for 'script|load' command")
+		}
+		sha, _, msg := luaCreateFunction(r.ArgvAt(2))
+		if msg != "" {
+			return c.ReplyError(msg)
+		}
+		return c.ReplyBulkString(sha)
+	case "exists":
+		if r.ArgCount() < 3 {
+			return c.ReplyError("wrong number of arguments for 'script|exists' command")
+		}
+		reply := make([]interface{}, 0, r.ArgCount()-2)
+		for i := 2; i < r.ArgCount(); i++ {
+			if godisServer.luaScripts[strings.ToLower(r.ArgvAt(i))] != nil {
+				reply = append(reply, 1)
+			} else {
+				reply = append(reply, 0)
+			}
+		}
+		return c.ReplyBulk(reply...)
+	case "flush":
+		if r.ArgCount() > 3 {
+			return c.ReplyError("wrong number of arguments for 'script|flush' command")
+		}
+		if r.ArgCount() == 3 {
+			if mode := strings.ToLower(r.ArgvAt(2)); mode != "async" && mode != "sync" {
+				return c.ReplyError("SCRIPT FLUSH only support SYNC|ASYNC option")
+			}
+		}
+		godisServer.lua.Close()
+		scriptingInit(godisServer)
+		return c.Reply("OK")
+	case "kill":
+		if r.ArgCount() != 2 {
+			return c.ReplyError("wrong number of arguments for 'script|kill' command")
+		}
+		// a running script is killed by the watchdog, as the event loop
+		// is busy with it.
+		return c.ReplyError(replyNotBusy)
+	default:
+		return c.ReplyError("unknown subcommand '" + r.ArgvAt(1) + "'. Try SCRIPT HELP.")
+	}
+}
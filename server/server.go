@@ -1,30 +1,94 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/kzinglzy/godis/server/protocol"
+	lua "github.com/yuin/gopher-lua"
 )
 
 type Server struct {
 	addr     string
-	db       *Database
+	db       []*Database
+	dbnum    int
 	listener net.Listener
 
 	// client
-	events  chan *IOEvent
-	clients []*Client
+	events      chan *IOEvent
+	clients     []*Client
+	protoLimits *protocol.Limits // shared by the parsers of the clients
+
+	// the clients with replies not queued yet
+	clientsPendingWrite []*outputBuffer
+
+	// blocking operations
+	blockedClients map[*Client]bool
+	readyKeys      []*readyKey
+
+	// pubsub, the subscribers of every channel and pattern
+	pubsubChannels      map[string][]*Client
+	pubsubPatterns      map[string][]*Client
+	pubsubShardChannels map[string][]*Client
+
+	// the classes of keyspace events to publish
+	notifyKeyspaceEvents int
+
+	// the bytes of messages a subscriber can have pending
+	clientOutputBufferLimitPubsub int
+
+	// scripting
+	lua               *lua.LState
+	luaScripts        map[string]*lua.LFunction // by SHA1
+	luaClient         *Client                   // executes the commands of the scripts
+	luaReply          *bytes.Buffer             // the reply of the command called by the script
+	luaReadonly       bool
+	luaWriteDirty     int32 // accessed atomically, as the watchdog reads it
+	luaTimeLimit      int   // ms
+	luaDeferredEvents []*IOEvent
+
+	// functions
+	functionsLua    *lua.LState
+	functionLibs    map[string]*functionLib
+	functions       map[string]*functionInfo
+	functionLoading *functionLib // the library being loaded by FUNCTION LOAD
 
 	// aof
+	loading                bool
 	dirty                  int64
 	aof                    *os.File
 	aofBuf                 []byte
 	aofFsyncPolicy         int
 	aofFlushPostponedStart int64
-	aofFlushInProgress     bool
+	aofFsyncDone           chan struct{} // closed once the background fsync is done
+	aofCurrentSize         int64
+	aofRewriteBaseSize     int64
+	aofRewriteBuf          []byte
+	aofRewriteDone         chan error
+	aofSelectedDB          int
+
+	// the copies of the keyspace in progress for BGSAVE and BGREWRITEAOF
+	snapshots []*keyspaceSnapshot
+
+	// rdb
+	saveParams        []saveParam
+	lastsave          int64
+	rdbSaveDone       chan error
+	dirtyBeforeBgsave int64
+
+	// encodings
+	hashMaxZiplistEntries int
+	hashMaxZiplistValue   int
+	setMaxIntsetEntries   int
+	listMaxZiplistSize    int
+	hllSparseMaxBytes     int
+	streamNodeMaxBytes    int
+	streamNodeMaxEntries  int
 
 	// memory policy
 	maxmemory       int64
@@ -33,28 +97,68 @@ type Server struct {
 
 var godisServer *Server
 
+// IOEvent is a request of a client, a nil request means that the client
+// is disconnected, after the protocol error err if any.
 type IOEvent struct {
-	c *Client
-	r *protocol.Request
+	c   *Client
+	r   *protocol.Request
+	err error
 }
 
-func MakeServer(addr string) (*Server, error) {
+var errInvalidDBNum = errors.New("invalid number of databases, it must be at least 1")
+
+func MakeServer(addr string, dbnum int) (*Server, error) {
+	if dbnum < 1 {
+		return nil, errInvalidDBNum
+	}
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Panicf("Failed listening at %s", addr)
 	}
 
 	server := &Server{
-		addr:            addr,
-		db:              NewDatabase(),
-		listener:        listener,
-		events:          make(chan *IOEvent, 1000),
-		clients:         []*Client{},
-		aofFsyncPolicy:  AOFFsyncEverysec,
-		maxmemory:       MaxMemory,
-		maxmemoryPolicy: MaxmemoryAllkeysLRU,
+		addr:           addr,
+		dbnum:          dbnum,
+		listener:       listener,
+		events:         make(chan *IOEvent, 1000),
+		clients:        []*Client{},
+		protoLimits:    protocol.NewLimits(),
+		blockedClients: make(map[*Client]bool),
+
+		pubsubChannels:      make(map[string][]*Client),
+		pubsubPatterns:      make(map[string][]*Client),
+		pubsubShardChannels: make(map[string][]*Client),
+		aofFsyncPolicy:      AOFFsyncEverysec,
+		aofSelectedDB:       -1,
+		maxmemory:           MaxMemory,
+		maxmemoryPolicy:     MaxmemoryAllkeysLRU,
+		luaTimeLimit:        LuaTimeLimit,
+
+		clientOutputBufferLimitPubsub: ClientOutputBufferLimitPubsub,
+
+		hashMaxZiplistEntries: HashMaxZiplistEntries,
+		hashMaxZiplistValue:   HashMaxZiplistValue,
+		setMaxIntsetEntries:   SetMaxIntsetEntries,
+		listMaxZiplistSize:    ListMaxZiplistSize,
+		hllSparseMaxBytes:     HLLSparseMaxBytes,
+		streamNodeMaxBytes:    StreamNodeMaxBytes,
+		streamNodeMaxEntries:  StreamNodeMaxEntries,
+
+		saveParams: []saveParam{
+			{seconds: 3600, changes: 1},
+			{seconds: 300, changes: 100},
+			{seconds: 60, changes: 10000},
+		},
+		lastsave: time.Now().Unix(),
+	}
+	for i := 0; i < dbnum; i++ {
+		db := NewDatabase()
+		db.id = i
+		server.db = append(server.db, db)
 	}
 	godisServer = server
+	scriptingInit(server)
+	functionsInit(server)
 
 	server.openAofFile()
 	server.loadDataFromDisk()
@@ -75,16 +179,37 @@ func (s *Server) Run() {
 
 func (s *Server) Close() {
 	flushAppendOnlyFile(true)
+	s.waitAofFsync()
 	s.aof.Close()
 	s.listener.Close()
 }
 
 func (s *Server) afterEvent() {
-	s.db.doExpireCycle()
+	for _, db := range s.db {
+		db.doExpireCycle()
+	}
+	s.snapshotCron()
 	flushAppendOnlyFile(false)
+	s.handleClientsWithPendingWrites()
+}
+
+// handleClientsWithPendingWrites queues the replies written by the event
+// loop, to be written to the connections.
+func (s *Server) handleClientsWithPendingWrites() {
+	for _, out := range s.clientsPendingWrite {
+		out.commit()
+	}
+	s.clientsPendingWrite = nil
 }
 
 func (s *Server) processIOEvent() {
+	// the events received while a script was running are processed first
+	for len(s.luaDeferredEvents) > 0 {
+		e := s.luaDeferredEvents[0]
+		s.luaDeferredEvents = s.luaDeferredEvents[1:]
+		s.handleIOEvent(e)
+	}
+
 	n := 0
 	scheduled := false
 
@@ -93,31 +218,144 @@ func (s *Server) processIOEvent() {
 		scheduled = true
 	case e := <-s.events:
 		n++
-		freeMemoryIfNeed()
+		s.handleIOEvent(e)
 
-		dirty := s.dirty
-		cmd := LoopupCommand(e.r.CommandName())
-		cmd.Exec(e.c, e.r)
+		if n >= MaxIOEventsPerLoop || scheduled {
+			return
+		}
+	}
+}
+
+func (s *Server) handleIOEvent(e *IOEvent) {
+	if e.r == nil {
+		if e.err != nil {
+			e.c.ReplyError("ERR Protocol error: " + e.err.Error())
+		}
+		s.freeClient(e.c)
 		e.c.wg.Done()
+		return
+	}
 
-		if s.dirty-dirty > 0 {
-			feedAppendOnlyFile(e.r)
+	// the requests of a blocked client are queued until it's unblocked
+	if e.c.blocked {
+		e.c.pending = append(e.c.pending, e)
+		return
+	}
+
+	freeMemoryIfNeed()
+	s.processCommand(e)
+	s.handleClientsBlockedOnKeys()
+}
+
+// processCommand executes the request, the event is done unless the
+// command blocked the client.
+func (s *Server) processCommand(e *IOEvent) {
+	if msg := commandRejected(LoopupCommand(e.r.CommandName()), e.r); msg != "" {
+		// the transaction fails like when the command can't be queued
+		if e.c.multi {
+			e.c.dirtyExec = true
 		}
+		e.c.ReplyError(msg)
+	} else if e.c.isSubscriber() && e.c.protocol() == protocol.RESP2 && !isPubsubCommand(e.r.CommandName()) {
+		e.c.ReplyError("Can't execute '" + strings.ToLower(e.r.CommandName()) +
+			"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context")
+	} else if e.c.multi && !isTransactionCommand(e.r.CommandName()) {
+		queueMultiCommand(e.c, e.r)
+	} else {
+		call(e.c, e.r)
+	}
+	if e.c.blocked {
+		e.c.bstate.event = e
+		return
+	}
+	e.c.wg.Done()
+}
 
-		if n >= MaxIOEventsPerLoop || scheduled {
-			return
+// processPendingCommands executes the requests queued while the client
+// was blocked, until it blocks again.
+func (s *Server) processPendingCommands(c *Client) {
+	for !c.blocked && len(c.pending) > 0 {
+		e := c.pending[0]
+		c.pending = c.pending[1:]
+		s.processCommand(e)
+	}
+}
+
+// freeClient releases the state of a disconnected client, its pending
+// requests are discarded.
+func (s *Server) freeClient(c *Client) {
+	if c.blocked {
+		unblockClient(c).c.wg.Done()
+	}
+	for _, e := range c.pending {
+		e.c.wg.Done()
+	}
+	c.pending = nil
+	discardTransaction(c)
+	pubsubFreeClient(c)
+	// the replies left are written before the connection is closed
+	if c.out != nil {
+		c.out.commit()
+	}
+}
+
+// call executes the command, and feeds the AOF if it changed the dataset.
+func call(c *Client, r *protocol.Request) {
+	dirty := godisServer.dirty
+	cmd := LoopupCommand(r.CommandName())
+	// the keys are copied by the snapshots in progress before they're
+	// modified in place
+	if len(godisServer.snapshots) > 0 && cmd.flags&CmdFlagWrite != 0 {
+		for _, i := range cmd.getKeys(r) {
+			godisServer.snapshotKey(c.db, r.ArgvAt(i))
 		}
 	}
+	cmd.Exec(c, r)
+
+	if godisServer.dirty-dirty > 0 && !godisServer.loading {
+		feedSelectIfNeed(c.db.id)
+		// the commands of a transaction are wrapped in MULTI/EXEC, so that a
+		// partial transaction is never replayed
+		if c.multi && !c.mstate.propagated {
+			catAppendOnlyCommand(1, []string{CmdNameMulti})
+			c.mstate.propagated = true
+		}
+		if c.propagated != nil {
+			for _, argv := range c.propagated {
+				catAppendOnlyCommand(len(argv), argv)
+			}
+		} else {
+			feedAppendOnlyFile(r)
+		}
+	}
+	c.propagated = nil
 }
 
 func (s *Server) processTimeEvent() {
-	s.db.doExpireCycle()
-	s.db.incrementallyRehash()
+	s.handleBlockedClientsTimeout()
+	s.handleClientsBlockedOnKeys()
+	for _, db := range s.db {
+		db.doExpireCycle()
+		db.incrementallyRehash()
+	}
 
 	if s.aofFlushPostponedStart != 0 {
 		flushAppendOnlyFile(false)
 	}
-	rewriteAOFBackgroundIfNeed()
+
+	select {
+	case err := <-s.aofRewriteDone:
+		backgroundRewriteDoneHandler(err)
+	default:
+		rewriteAOFBackgroundIfNeed()
+	}
+
+	select {
+	case err := <-s.rdbSaveDone:
+		backgroundSaveDoneHandler(err)
+	default:
+		rdbSaveBackgroundIfNeed()
+	}
 }
 
 func (s *Server) handleConnection() {
@@ -134,7 +372,8 @@ func (s *Server) handleConnection() {
 func (s *Server) handleClient(conn net.Conn) {
 	log.Println("create new client")
 
-	client := NewClient(conn, s.db)
+	client := NewClient(conn, s.db[0])
+	client.parser.SetLimits(s.protoLimits)
 	defer client.Close()
 
 	s.clients = append(s.clients, client)
@@ -148,6 +387,9 @@ func (s *Server) handleClient(conn net.Conn) {
 		s.events <- &e
 	}
 
+	client.wg.Add(1)
+	s.events <- &IOEvent{c: client, err: client.parser.Err()}
+
 	client.wg.Wait()
 }
 
@@ -159,12 +401,29 @@ func (s *Server) memPolicyRandom() bool {
 	return s.maxmemoryPolicy == MaxmemoryAllkeysRandom
 }
 
+// loadDataFromDisk replays the AOF, or loads the snapshot file
+// when there is no AOF yet.
 func (s *Server) loadDataFromDisk() {
-	log.Printf("loading data from disk")
-	fakeClient := NewFakeClient(s.aof, s.db)
-	for req := range fakeClient.Requests() {
-		cmd := LoopupCommand(req.CommandName())
-		cmd.Exec(fakeClient, req)
+	if s.aofCurrentSize > 0 {
+		log.Printf("loading data from append only file")
+		if err := s.loadAppendOnlyFile(s.aof); err != nil {
+			log.Fatalf("failed loading the append only file: %v", err)
+		}
+		return
+	}
+
+	err := rdbLoad(RDBFileName, s.db)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Fatalf("failed loading the snapshot file: %v", err)
+	}
+	keys := s.dbsize()
+	log.Printf("DB loaded from disk: %d keys", keys)
+
+	// the AOF is empty, rebuild it so the loaded dataset survives a restart
+	if keys > 0 {
+		rewriteAppendOnlyFileBackground()
 	}
 }
 
@@ -174,16 +433,64 @@ func (s *Server) openAofFile() {
 		log.Fatalf("can't open the append log file: %v", err)
 	}
 	s.aof = fd
+
+	if info, err := fd.Stat(); err == nil {
+		s.aofCurrentSize = info.Size()
+		s.aofRewriteBaseSize = info.Size()
+	}
+}
+
+// dbsize returns the number of keys in all the databases.
+func (s *Server) dbsize() int64 {
+	var keys int64
+	for _, db := range s.db {
+		keys += db.store.Used()
+	}
+	return keys
+}
+
+// snapshot copies the live keys of every database at once.
+func (s *Server) snapshot() *keyspaceSnapshot {
+	return snapshotDatabases(s.db...)
+}
+
+func (s *Server) rdbSaveInProgress() bool {
+	return s.rdbSaveDone != nil
+}
+
+func (s *Server) aofRewriteInProgress() bool {
+	return s.aofRewriteDone != nil
 }
 
 func (s *Server) resetAofState() {
-	s.dirty = 0
 	s.aofFlushPostponedStart = 0
 	s.aofBuf = []byte{}
 }
 
-func (s *Server) aofFsync() {
-	s.aofFlushInProgress = true
-	s.aof.Sync()
-	s.aofFlushInProgress = false
+// aofFsync fsyncs the AOF in background, the file is passed in as the
+// event loop replaces s.aof when a rewrite is done.
+func aofFsync(fd *os.File, done chan<- struct{}) {
+	fd.Sync()
+	close(done)
+}
+
+func (s *Server) aofFlushInProgress() bool {
+	if s.aofFsyncDone == nil {
+		return false
+	}
+	select {
+	case <-s.aofFsyncDone:
+		s.aofFsyncDone = nil
+		return false
+	default:
+		return true
+	}
+}
+
+// waitAofFsync waits for the background fsync before the AOF is closed.
+func (s *Server) waitAofFsync() {
+	if s.aofFsyncDone != nil {
+		<-s.aofFsyncDone
+		s.aofFsyncDone = nil
+	}
 }
@@ -1,14 +1,76 @@
 package server
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
 	"github.com/stretchr/testify/assert"
 )
 
 func init() {
-	MakeServer(":6666")
+	MakeServer(":6666", DefaultDBNum)
+}
+
+func newTestClient(db *Database) (*Client, *bytes.Buffer) {
+	var buf bytes.Buffer
+	c := &Client{
+		db:     db,
+		writer: protocol.NewWriter(&buf),
+		wg:     new(sync.WaitGroup),
+	}
+	return c, &buf
+}
+
+func newRequest(argv ...string) *protocol.Request {
+	parser := protocol.NewParser(strings.NewReader(formatCommand(len(argv), argv)))
+	req, err := parser.ReadRequest()
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+// execCommand executes the command against db, and returns the raw reply.
+func execCommand(db *Database, argv ...string) string {
+	c, buf := newTestClient(db)
+	call(c, newRequest(argv...))
+	return buf.String()
+}
+
+// sendCommand processes the command like a request received from c.
+func sendCommand(c *Client, argv ...string) {
+	c.wg.Add(1)
+	godisServer.processCommand(&IOEvent{c: c, r: newRequest(argv...)})
+	godisServer.handleClientsBlockedOnKeys()
+}
+
+func listObject(values []string) *dt.Object {
+	o := listTypeCreate()
+	for _, v := range values {
+		listTypePush(o, v, listTail)
+	}
+	return o
+}
+
+func listValues(o *dt.Object) []string {
+	var values []string
+	it := o.Ptr.(*dt.Quicklist).Iterator(0, false)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		values = append(values, v)
+	}
+	return values
 }
 
 func TestDatabase(t *testing.T) {
@@ -49,3 +111,1677 @@ func TestDatabase(t *testing.T) {
 		})
 	}
 }
+
+func TestRewriteAppendOnlyFile(t *testing.T) {
+	db := NewDatabase()
+	db.Set("str", dt.NewObj(dt.ObjString, "hello"))
+	db.setExpire("str", mstime()+10000)
+	db.Set("expired", dt.NewObj(dt.ObjString, "bye"))
+	db.setExpire("expired", mstime()-1)
+
+	var list []string
+	for i := 0; i < AOFRewriteItemsPerCmd*2+1; i++ {
+		list = append(list, strconv.Itoa(i))
+	}
+	db.Add("list", listObject(list))
+
+	f, err := ioutil.TempFile("", "godis-aof")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	other := NewDatabase()
+	other.Set("str", dt.NewObj(dt.ObjString, "other"))
+	assert.Nil(t, rewriteAppendOnlyFile(f.Name(), snapshotDatabases(db, nil, other), nil))
+
+	// replay the file on empty databases, as SELECT switches to the server ones
+	dbs := godisServer.db
+	defer func() { godisServer.db = dbs }()
+	godisServer.db = []*Database{NewDatabase(), NewDatabase(), NewDatabase()}
+	loaded := godisServer.db[0]
+	c := NewFakeClient(f, loaded)
+	for req := range c.Requests() {
+		LoopupCommand(req.CommandName()).Exec(c, req)
+	}
+
+	assert.Equal(t, int64(2), loaded.store.Used())
+	assert.Equal(t, "other", godisServer.db[2].Get("str").Ptr.(string))
+	assert.Equal(t, "hello", loaded.Get("str").Ptr.(string))
+	assert.Equal(t, db.getExpire("str"), loaded.getExpire("str"))
+	assert.Equal(t, list, listValues(loaded.Get("list")))
+}
+
+func TestAofFsync(t *testing.T) {
+	f, err := ioutil.TempFile("", "godis-aof")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	defer func(aof *os.File) { godisServer.aof = aof }(godisServer.aof)
+	godisServer.aof = f
+
+	// the file is fsynced in background, and waited for before it's closed
+	godisServer.aofBuf = []byte(formatCommand(1, []string{"ping"}))
+	flushAppendOnlyFile(true)
+	assert.NotNil(t, godisServer.aofFsyncDone)
+	godisServer.waitAofFsync()
+	assert.False(t, godisServer.aofFlushInProgress())
+	assert.Nil(t, f.Close())
+	data, err := ioutil.ReadFile(f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, "*1\r\n$4\r\nping\r\n", string(data))
+}
+
+func TestRdbSaveAndLoad(t *testing.T) {
+	db := NewDatabase()
+	db.Set("str", dt.NewObj(dt.ObjString, "hello"))
+	db.setExpire("str", mstime()+10000)
+	db.Set("long", dt.NewObj(dt.ObjString, string(make([]byte, 1<<15))))
+	db.Add("list", listObject([]string{"a", "", "c"}))
+
+	dir, err := ioutil.TempDir("", "godis-rdb")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, RDBFileName)
+	other := NewDatabase()
+	other.Set("str", dt.NewObj(dt.ObjString, "other"))
+	assert.Nil(t, rdbSave(filename, snapshotDatabases(db, other), nil))
+
+	loaded, loadedOther := NewDatabase(), NewDatabase()
+	assert.Nil(t, rdbLoad(filename, []*Database{loaded, loadedOther}))
+	assert.Equal(t, "other", loadedOther.Get("str").Ptr.(string))
+	assert.NotNil(t, rdbLoad(filename, []*Database{NewDatabase()}))
+	assert.Equal(t, int64(3), loaded.store.Used())
+	assert.Equal(t, "hello", loaded.Get("str").Ptr.(string))
+	assert.Equal(t, db.getExpire("str"), loaded.getExpire("str"))
+	assert.Equal(t, 1<<15, len(loaded.Get("long").Ptr.(string)))
+	assert.Equal(t, []string{"a", "", "c"}, listValues(loaded.Get("list")))
+
+	// flip a byte of the payload to break the checksum
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	data[len(data)-10] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(filename, data, 0644))
+	target := NewDatabase()
+	target.Set("kept", dt.NewObj(dt.ObjString, "v"))
+	assert.Equal(t, errRDBBadChecksum, rdbLoad(filename, []*Database{target, NewDatabase()}))
+	// nothing is loaded from the corrupt file
+	assert.Equal(t, int64(1), target.store.Used())
+	assert.NotNil(t, target.Get("kept"))
+
+	// a corrupt length larger than the file is a short read, not an allocation
+	corrupt := append([]byte("GODIS0001"), RDBOpcodeSelectDB, 0, RDBTypeString, RDB64BitLen)
+	corrupt = append(corrupt, 0, 0, 0x10, 0, 0, 0, 0, 0)
+	assert.Nil(t, ioutil.WriteFile(filename, corrupt, 0644))
+	assert.EqualError(t, rdbLoad(filename, []*Database{NewDatabase()}), "Short read or OOM loading DB. Unrecoverable error, aborting now")
+}
+
+func TestBackgroundSave(t *testing.T) {
+	s := godisServer
+	db := s.db[0]
+	defer os.Remove(RDBFileName)
+	defer db.flush()
+	for i := 0; i < 10*SnapshotKeysPerLoop; i++ {
+		db.Set("k"+strconv.Itoa(i), dt.NewObj(dt.ObjString, "v"))
+	}
+	execCommand(db, "hset", "h", "f", "v")
+
+	// a step copies about the number of keys asked, a bucket at once
+	ks := newKeyspaceSnapshot([]*Database{db})
+	assert.False(t, ks.step(100))
+	assert.True(t, len(ks.queue) >= 100 && len(ks.queue) < 110, len(ks.queue))
+
+	// BGSAVE doesn't copy the keyspace, the clients are served while the
+	// keys are copied a batch per loop
+	c, buf := newTestClient(db)
+	sendCommand(c, "bgsave")
+	assert.Equal(t, "+Background saving started\r\n", buf.String())
+	assert.Len(t, s.snapshots, 1)
+	assert.Empty(t, s.snapshots[0].queue)
+	sendCommand(c, "set", "k0", "new")
+	sendCommand(c, "append", "k1", "w")
+	sendCommand(c, "del", "k2")
+	sendCommand(c, "set", "created", "v")
+	sendCommand(c, "expire", "k3", "100")
+	sendCommand(c, "hset", "h", "f", "new")
+	s.snapshotCron()
+	assert.Len(t, s.snapshots, 1)
+	for len(s.snapshots) > 0 {
+		s.snapshotCron()
+	}
+	backgroundSaveDoneHandler(<-s.rdbSaveDone)
+
+	// the keys are saved as they were when BGSAVE started
+	loaded := NewDatabase()
+	assert.Nil(t, rdbLoad(RDBFileName, []*Database{loaded}))
+	assert.Equal(t, int64(10*SnapshotKeysPerLoop+1), loaded.store.Used())
+	for _, key := range []string{"k0", "k1", "k2"} {
+		assert.Equal(t, "v", loaded.Get(key).Ptr.(string), key)
+	}
+	// the hash is modified in place, it's copied before
+	v, _ := hashTypeGet(loaded.Get("h"), "f")
+	assert.Equal(t, "v", v)
+	assert.Nil(t, loaded.Get("created"))
+	assert.Equal(t, int64(-1), loaded.getExpire("k3"))
+}
+
+func TestHashCommands(t *testing.T) {
+	db := NewDatabase()
+
+	assert.Equal(t, ":2\r\n", execCommand(db, "hset", "h", "a", "1", "b", "2"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "hset", "h", "a", "3"))
+	assert.Equal(t, "$1\r\n3\r\n", execCommand(db, "hget", "h", "a"))
+	assert.Equal(t, "*2\r\n$1\r\n2\r\n$-1\r\n", execCommand(db, "hmget", "h", "b", "c"))
+	assert.Equal(t, ":13\r\n", execCommand(db, "hincrby", "h", "b", "11"))
+	assert.Equal(t, "$4\r\n13.5\r\n", execCommand(db, "hincrbyfloat", "h", "b", "0.5"))
+	assert.Equal(t, "-hash value is not an integer\r\n", execCommand(db, "hincrby", "h", "b", "1"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "hsetnx", "h", "a", "x"))
+	assert.Equal(t, ":2\r\n", execCommand(db, "hlen", "h"))
+	assert.Equal(t, int64(2), db.elements)
+	assert.Equal(t, uint8(dt.ObjEncodingZiplist), db.Get("h").Encoding)
+
+	// a long value converts the hash to a real hash table
+	long := strings.Repeat("x", HashMaxZiplistValue+1)
+	execCommand(db, "hset", "h", "long", long)
+	assert.Equal(t, uint8(dt.ObjEncodingHt), db.Get("h").Encoding)
+	assert.Equal(t, ":65\r\n", execCommand(db, "hstrlen", "h", "long"))
+
+	assert.Equal(t, ":2\r\n", execCommand(db, "hdel", "h", "a", "long", "missing"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "hdel", "h", "b"))
+	assert.Nil(t, db.Get("h"))
+	assert.Equal(t, int64(0), db.elements)
+
+	// a ziplist with a field without value is refused by the snapshot loader
+	d := &rdbDecoder{r: bytes.NewReader([]byte{2, 1, 'a'}), left: 3}
+	assert.Nil(t, d.readObject(RDBTypeHashZiplist))
+	assert.Equal(t, errRDBBadFormat, d.err)
+}
+
+func TestHashScan(t *testing.T) {
+	db := NewDatabase()
+	for i := 0; i < 1000; i++ {
+		execCommand(db, "hset", "h", "f"+strconv.Itoa(i), "v")
+	}
+
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply := execCommand(db, "hscan", "h", cursor, "match", "f1*", "count", "50", "novalues")
+		lines := strings.Split(reply, "\r\n")
+		cursor = lines[2]
+		for i := 5; i < len(lines)-1; i += 2 {
+			seen[lines[i]] = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, 111, len(seen))
+}
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		nocase  bool
+		want    bool
+	}{
+		{"*", "", false, true},
+		{"f*o", "foo", false, true},
+		{"f*o", "fob", false, false},
+		{"f?o", "fao", false, true},
+		{"f[a-c]o", "fbo", false, true},
+		{"f[^a-c]o", "fbo", false, false},
+		{"f\\*", "f*", false, true},
+		{"F*", "foo", true, true},
+		{"*a*b", "xaxxb", false, true},
+		{"*a*b", "xaxxbx", false, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, stringMatch(tt.pattern, tt.str, tt.nocase), tt.pattern, tt.str)
+	}
+
+	// the patterns with many * don't take an exponential time
+	start := time.Now()
+	assert.False(t, stringMatch(strings.Repeat("a*", 12)+"b", strings.Repeat("a", 40), false))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestScanAndKeys(t *testing.T) {
+	db := NewDatabase()
+	for i := 0; i < 500; i++ {
+		execCommand(db, "set", "k"+strconv.Itoa(i), "v")
+	}
+	execCommand(db, "rpush", "k1000", "a")
+	db.Set("expired", dt.NewObj(dt.ObjString, "v"))
+	db.setExpire("expired", mstime()-1)
+
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply := execCommand(db, "scan", cursor, "match", "k1*", "count", "20", "type", "string")
+		lines := strings.Split(reply, "\r\n")
+		cursor = lines[2]
+		for i := 5; i < len(lines)-1; i += 2 {
+			seen[lines[i]] = true
+		}
+		// grow the keyspace while scanning
+		execCommand(db, "set", "new"+cursor, "v")
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, 111, len(seen))
+	assert.False(t, seen["k1000"])
+
+	assert.Equal(t, "-unknown type name 'foo'\r\n", execCommand(db, "scan", "0", "type", "foo"))
+	assert.Equal(t, "-invalid cursor\r\n", execCommand(db, "scan", "x"))
+	keys := execCommand(db, "keys", "k100*")
+	assert.True(t, strings.HasPrefix(keys, "*2\r\n"))
+	assert.Contains(t, keys, "$4\r\nk100\r\n")
+	assert.Contains(t, keys, "$5\r\nk1000\r\n")
+	assert.Equal(t, "*0\r\n", execCommand(db, "keys", "exp*"))
+}
+
+func TestSortedSetCommands(t *testing.T) {
+	db := NewDatabase()
+
+	assert.Equal(t, ":3\r\n", execCommand(db, "zadd", "z", "1", "a", "2", "b", "3", "c"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "zadd", "z", "xx", "ch", "gt", "0", "a", "5", "b"))
+	assert.Equal(t, "$-1\r\n", execCommand(db, "zadd", "z", "nx", "incr", "1", "a"))
+	assert.Equal(t, "$3\r\n1.5\r\n", execCommand(db, "zincrby", "z", "0.5", "a"))
+	assert.Equal(t, "-XX and NX options at the same time are not compatible\r\n",
+		execCommand(db, "zadd", "z", "nx", "xx", "1", "a"))
+
+	assert.Equal(t, "*4\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\na\r\n$3\r\n1.5\r\n",
+		execCommand(db, "zrange", "z", "(5", "-inf", "byscore", "rev", "limit", "0", "2", "withscores"))
+	assert.Equal(t, ":2\r\n", execCommand(db, "zrank", "z", "b"))
+	assert.Equal(t, ":2\r\n", execCommand(db, "zcount", "z", "(1.5", "+inf"))
+
+	assert.Equal(t, ":2\r\n", execCommand(db, "zrangestore", "dst", "z", "0", "1"))
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$3\r\n1.5\r\n", execCommand(db, "zpopmin", "dst"))
+	assert.Equal(t, ":2\r\n", execCommand(db, "zremrangebyscore", "z", "-inf", "3"))
+	assert.Equal(t, int64(2), db.elements)
+}
+
+func TestGeoCommands(t *testing.T) {
+	db := NewDatabase()
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"geoadd", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"}, ":2\r\n"},
+		{[]string{"geoadd", "Sicily", "xx", "ch", "13.361389", "38.115556", "Palermo", "1", "1", "x"}, ":0\r\n"},
+		{[]string{"geoadd", "Sicily", "nx", "xx", "1", "1", "x"}, "-" + ReplySyntaxErr + "\r\n"},
+		{[]string{"geoadd", "Sicily", "200", "100", "x"}, "-invalid longitude,latitude pair 200.000000,100.000000\r\n"},
+		{[]string{"type", "Sicily"}, "+zset\r\n"},
+		{[]string{"zscore", "Sicily", "Palermo"}, "$16\r\n3479099956230698\r\n"},
+		{[]string{"geodist", "Sicily", "Palermo", "Catania"}, "$11\r\n166274.1516\r\n"},
+		{[]string{"geodist", "Sicily", "Palermo", "Catania", "km"}, "$8\r\n166.2742\r\n"},
+		{[]string{"geodist", "Sicily", "Palermo", "Catania", "yd"}, "-unsupported unit provided. please use M, KM, FT, MI\r\n"},
+		{[]string{"geodist", "Sicily", "Palermo", "missing"}, "$-1\r\n"},
+		{[]string{"geopos", "Sicily", "Palermo", "missing"}, "*2\r\n*2\r\n$20\r\n13.36138933897018433\r\n$20\r\n38.11555639549629859\r\n*-1\r\n"},
+		{[]string{"geohash", "Sicily", "Palermo", "Catania", "missing"}, "*3\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n$-1\r\n"},
+		{[]string{"geoadd", "Sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2"}, ":2\r\n"},
+		{[]string{"geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "asc"}, "*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n"},
+		{[]string{"geosearch", "Sicily", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "desc", "count", "1", "withdist", "withhash"},
+			"*1\r\n*3\r\n$5\r\nedge1\r\n$8\r\n279.7405\r\n:3479273021651468\r\n"},
+		{[]string{"geosearch", "Sicily", "frommember", "Catania", "byradius", "100", "km", "withcoord"},
+			"*1\r\n*2\r\n$7\r\nCatania\r\n*2\r\n$20\r\n15.08726745843887329\r\n$20\r\n37.50266842333162032\r\n"},
+		{[]string{"geosearch", "Sicily", "fromlonlat", "0", "0", "byradius", "1", "m", "withdist"}, "*0\r\n"},
+		{[]string{"geosearch", "Sicily", "frommember", "missing", "byradius", "1", "km"}, "-could not decode requested zset member\r\n"},
+		{[]string{"geosearch", "Sicily", "frommember", "Palermo", "fromlonlat", "1", "1", "byradius", "1", "km"},
+			"-exactly one of FROMMEMBER or FROMLONLAT can be specified for geosearch\r\n"},
+		{[]string{"geosearch", "Sicily", "frommember", "Palermo", "byradius", "1", "km", "bybox", "1", "1", "km"},
+			"-exactly one of BYRADIUS and BYBOX can be specified for geosearch\r\n"},
+		{[]string{"geosearch", "Sicily", "frommember", "Palermo", "byradius", "1", "km", "any"}, "-the ANY argument requires COUNT argument\r\n"},
+		{[]string{"geosearch", "missing", "frommember", "Palermo", "byradius", "1", "km"}, "*0\r\n"},
+		{[]string{"geosearchstore", "dst", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "storedist"}, ":2\r\n"},
+		{[]string{"zrange", "dst", "0", "-1", "withscores"}, "*4\r\n$7\r\nCatania\r\n$16\r\n56.4412578701582\r\n$7\r\nPalermo\r\n$18\r\n190.44242984775795\r\n"},
+		{[]string{"geosearchstore", "dst", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "withdist"},
+			"-GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options\r\n"},
+		{[]string{"geosearchstore", "dst", "missing", "fromlonlat", "15", "37", "byradius", "200", "km"}, ":0\r\n"},
+		{[]string{"exists", "dst"}, ":0\r\n"},
+	}
+	for _, tC := range tests {
+		assert.Equal(t, tC.want, execCommand(db, tC.argv...), strings.Join(tC.argv, " "))
+	}
+}
+
+func TestSetCommands(t *testing.T) {
+	db := NewDatabase()
+
+	assert.Equal(t, ":3\r\n", execCommand(db, "sadd", "s1", "1", "2", "3"))
+	assert.Equal(t, "$6\r\nintset\r\n", execCommand(db, "object", "encoding", "s1"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "sadd", "s1", "a"))
+	assert.Equal(t, "$9\r\nhashtable\r\n", execCommand(db, "object", "encoding", "s1"))
+
+	execCommand(db, "sadd", "s2", "2", "3", "4")
+	assert.Equal(t, "*2\r\n:1\r\n:0\r\n", execCommand(db, "smismember", "s2", "4", "a"))
+	assert.Equal(t, ":2\r\n", execCommand(db, "sintercard", "2", "s1", "s2"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "sintercard", "2", "s1", "s2", "limit", "1"))
+	assert.Equal(t, ":5\r\n", execCommand(db, "sunionstore", "dst", "s1", "s2"))
+	assert.Equal(t, ":2\r\n", execCommand(db, "sdiffstore", "dst", "s1", "s2", "missing"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "sinterstore", "dst", "s1", "missing"))
+	assert.Nil(t, db.Get("dst"))
+
+	assert.Equal(t, ":1\r\n", execCommand(db, "smove", "s2", "s3", "4"))
+	assert.Equal(t, "*1\r\n$1\r\n4\r\n", execCommand(db, "smembers", "s3"))
+	assert.Equal(t, "$1\r\n4\r\n", execCommand(db, "spop", "s3"))
+	assert.Nil(t, db.Get("s3"))
+	assert.Equal(t, int64(6), db.elements)
+
+	assert.Equal(t, "+OK\r\n", execCommand(db, "config", "set", "set-max-intset-entries", "2"))
+	execCommand(db, "sadd", "s4", "1", "2", "3")
+	assert.Equal(t, "$9\r\nhashtable\r\n", execCommand(db, "object", "encoding", "s4"))
+	assert.Equal(t, "*2\r\n$22\r\nset-max-intset-entries\r\n$1\r\n2\r\n",
+		execCommand(db, "config", "get", "set-*"))
+	execCommand(db, "config", "set", "set-max-intset-entries", strconv.Itoa(SetMaxIntsetEntries))
+}
+
+func TestListCommands(t *testing.T) {
+	db := NewDatabase()
+
+	assert.Equal(t, ":3\r\n", execCommand(db, "rpush", "l", "a", "b", "c"))
+	assert.Equal(t, ":5\r\n", execCommand(db, "lpush", "l", "y", "x"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "lpushx", "missing", "a"))
+	assert.Equal(t, "$9\r\nquicklist\r\n", execCommand(db, "object", "encoding", "l"))
+
+	assert.Equal(t, "*3\r\n$1\r\ny\r\n$1\r\na\r\n$1\r\nb\r\n", execCommand(db, "lrange", "l", "1", "-2"))
+	assert.Equal(t, "$1\r\nc\r\n", execCommand(db, "lindex", "l", "-1"))
+	assert.Equal(t, ":6\r\n", execCommand(db, "linsert", "l", "before", "b", "a"))
+	assert.Equal(t, ":3\r\n", execCommand(db, "lpos", "l", "a", "rank", "-1"))
+	assert.Equal(t, "*2\r\n:2\r\n:3\r\n", execCommand(db, "lpos", "l", "a", "count", "0"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "lrem", "l", "-1", "a"))
+	assert.Equal(t, "+OK\r\n", execCommand(db, "lset", "l", "0", "z"))
+	assert.Equal(t, "-index out of range\r\n", execCommand(db, "lset", "l", "10", "z"))
+
+	assert.Equal(t, "*2\r\n$1\r\nz\r\n$1\r\ny\r\n", execCommand(db, "lpop", "l", "2"))
+	assert.Equal(t, "$1\r\nc\r\n", execCommand(db, "rpoplpush", "l", "l"))
+	assert.Equal(t, "$1\r\nb\r\n", execCommand(db, "lmove", "l", "dst", "right", "left"))
+	assert.Equal(t, []string{"c", "a"}, listValues(db.Get("l")))
+
+	assert.Equal(t, "+OK\r\n", execCommand(db, "ltrim", "l", "1", "0"))
+	assert.Nil(t, db.Get("l"))
+	assert.Equal(t, "*-1\r\n", execCommand(db, "rpop", "l", "1"))
+	assert.Equal(t, int64(1), db.elements)
+}
+
+func TestLoadLegacyAppendOnlyFile(t *testing.T) {
+	defer func(dbs []*Database) { godisServer.db = dbs }(godisServer.db)
+	db := NewDatabase()
+	godisServer.db = []*Database{db}
+
+	// the lists of an AOF written before PUSH and POP were removed
+	aof := "*4\r\n$4\r\npush\r\n$1\r\nl\r\n$1\r\na\r\n$1\r\nb\r\n" +
+		"*3\r\n$4\r\nPUSH\r\n$1\r\nl\r\n$1\r\nc\r\n" +
+		"*2\r\n$3\r\npop\r\n$1\r\nl\r\n"
+	assert.Nil(t, godisServer.loadAppendOnlyFile(strings.NewReader(aof)))
+	assert.Equal(t, []string{"a", "b"}, listValues(db.Get("l")))
+
+	assert.EqualError(t, godisServer.loadAppendOnlyFile(strings.NewReader("*1\r\n$5\r\nrange\r\n")),
+		"unknown command 'range' reading the append only file")
+}
+
+func TestBlockingPop(t *testing.T) {
+	db := NewDatabase()
+	c1, buf1 := newTestClient(db)
+	c2, buf2 := newTestClient(db)
+	c3, _ := newTestClient(db)
+
+	sendCommand(c1, "blpop", "q1", "q2", "0")
+	sendCommand(c2, "brpop", "q2", "0")
+	assert.True(t, c1.blocked)
+	assert.True(t, c2.blocked)
+	assert.Equal(t, "", buf1.String())
+
+	// the clients are served in the order they blocked
+	sendCommand(c3, "rpush", "q2", "a", "b", "c")
+	assert.Equal(t, "*2\r\n$2\r\nq2\r\n$1\r\na\r\n", buf1.String())
+	assert.Equal(t, "*2\r\n$2\r\nq2\r\n$1\r\nc\r\n", buf2.String())
+	assert.Equal(t, []string{"b"}, listValues(db.Get("q2")))
+	assert.Empty(t, db.blockingKeys)
+
+	// the requests of a blocked client are queued until it's unblocked
+	buf1.Reset()
+	sendCommand(c1, "blmove", "src", "dst", "left", "right", "0.01")
+	c1.wg.Add(1)
+	c1.pending = append(c1.pending, &IOEvent{c: c1, r: newRequest("ping")})
+	time.Sleep(20 * time.Millisecond)
+	godisServer.handleBlockedClientsTimeout()
+	assert.False(t, c1.blocked)
+	assert.Equal(t, "$-1\r\n+PONG\r\n", buf1.String())
+	assert.Empty(t, godisServer.blockedClients)
+
+	// a timeout under 1 ms is rounded up instead of blocking forever
+	buf1.Reset()
+	sendCommand(c1, "blpop", "q3", "0.0001")
+	assert.NotZero(t, c1.bstate.timeout)
+	time.Sleep(2 * time.Millisecond)
+	godisServer.handleBlockedClientsTimeout()
+	assert.False(t, c1.blocked)
+	assert.Equal(t, "*-1\r\n", buf1.String())
+}
+
+func TestMultipleDatabases(t *testing.T) {
+	for _, dbnum := range []int{0, -1} {
+		s, err := MakeServer(":0", dbnum)
+		assert.Nil(t, s)
+		assert.Equal(t, errInvalidDBNum, err)
+	}
+
+	dbs := godisServer.db
+	defer func() { godisServer.db = dbs }()
+	godisServer.db = []*Database{NewDatabase(), NewDatabase(), NewDatabase()}
+	for i, db := range godisServer.db {
+		db.id = i
+	}
+	db0, db1 := godisServer.db[0], godisServer.db[1]
+
+	c, buf := newTestClient(db0)
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"set", "k", "v"}, "+OK\r\n"},
+		{[]string{"expire", "k", "100"}, ":1\r\n"},
+		{[]string{"select", "3"}, "-DB index is out of range\r\n"},
+		{[]string{"select", "x"}, "-" + ReplyNotInteger + "\r\n"},
+		{[]string{"move", "k", "0"}, "-source and destination objects are the same\r\n"},
+		{[]string{"move", "k", "1"}, ":1\r\n"},
+		{[]string{"move", "k", "1"}, ":0\r\n"},
+		{[]string{"dbsize"}, ":0\r\n"},
+		{[]string{"select", "1"}, "+OK\r\n"},
+		{[]string{"get", "k"}, "$1\r\nv\r\n"},
+		{[]string{"swapdb", "1", "2"}, "+OK\r\n"},
+		{[]string{"dbsize"}, ":0\r\n"},
+		{[]string{"swapdb", "0", "x"}, "-invalid second DB index\r\n"},
+		{[]string{"select", "2"}, "+OK\r\n"},
+		{[]string{"dbsize"}, ":1\r\n"},
+		{[]string{"flushdb", "now"}, "-" + ReplySyntaxErr + "\r\n"},
+		{[]string{"flushdb", "async"}, "+OK\r\n"},
+		{[]string{"dbsize"}, ":0\r\n"},
+	}
+	for _, tC := range tests {
+		buf.Reset()
+		call(c, newRequest(tC.argv...))
+		assert.Equal(t, tC.want, buf.String(), strings.Join(tC.argv, " "))
+	}
+	assert.Nil(t, db1.Get("k"))
+	assert.Equal(t, int64(-1), godisServer.db[2].getExpire("k"))
+
+	// the AOF selects the DB when a write runs in another one
+	godisServer.aofBuf = []byte{}
+	godisServer.aofSelectedDB = 2
+	execCommand(db0, "set", "a", "1")
+	execCommand(db0, "set", "b", "1")
+	execCommand(db1, "set", "a", "1")
+	aof := formatCommand(2, []string{"select", "0"}) +
+		formatCommand(3, []string{"set", "a", "1"}) +
+		formatCommand(3, []string{"set", "b", "1"}) +
+		formatCommand(2, []string{"select", "1"}) +
+		formatCommand(3, []string{"set", "a", "1"})
+	assert.Equal(t, aof, string(godisServer.aofBuf))
+}
+
+func TestKeyspaceCommands(t *testing.T) {
+	db := NewDatabase()
+	execCommand(db, "set", "a", "1")
+	execCommand(db, "rpush", "l", "x", "y")
+	execCommand(db, "pexpire", "l", "100000")
+
+	assert.Equal(t, ":3\r\n", execCommand(db, "exists", "a", "a", "l", "missing"))
+	assert.Equal(t, "+string\r\n", execCommand(db, "type", "a"))
+	assert.Equal(t, "+none\r\n", execCommand(db, "type", "missing"))
+	assert.Equal(t, ":2\r\n", execCommand(db, "touch", "a", "l", "missing"))
+
+	assert.Equal(t, "-no such key\r\n", execCommand(db, "rename", "missing", "b"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "renamenx", "l", "a"))
+	assert.Equal(t, "+OK\r\n", execCommand(db, "rename", "l", "l2"))
+	assert.Nil(t, db.Get("l"))
+	assert.True(t, db.getExpire("l2") > mstime())
+	assert.Equal(t, int64(2), db.elements)
+
+	assert.Equal(t, "-source and destination objects are the same\r\n", execCommand(db, "copy", "l2", "l2"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "copy", "l2", "a"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "copy", "l2", "a", "replace"))
+	execCommand(db, "rpush", "a", "z")
+	assert.Equal(t, []string{"x", "y"}, listValues(db.Get("l2")))
+	assert.Equal(t, []string{"x", "y", "z"}, listValues(db.Get("a")))
+	assert.Equal(t, int64(5), db.elements)
+
+	assert.Equal(t, ":2\r\n", execCommand(db, "del", "a", "l2", "missing"))
+	assert.Equal(t, int64(0), db.elements)
+	assert.Equal(t, "$-1\r\n", execCommand(db, "randomkey"))
+	execCommand(db, "set", "b", "1")
+	assert.Equal(t, "$1\r\nb\r\n", execCommand(db, "randomkey"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "unlink", "b"))
+}
+
+func TestExpireCommands(t *testing.T) {
+	db := NewDatabase()
+	execCommand(db, "set", "a", "1")
+
+	assert.Equal(t, ":-1\r\n", execCommand(db, "ttl", "a"))
+	assert.Equal(t, ":-2\r\n", execCommand(db, "pttl", "missing"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "expire", "a", "100", "xx"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "expire", "a", "100", "gt"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "expire", "a", "100", "nx"))
+	assert.Equal(t, ":100\r\n", execCommand(db, "ttl", "a"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "pexpire", "a", "200000", "lt"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "pexpire", "a", "200000", "gt"))
+	assert.Equal(t, "-GT and LT options at the same time are not compatible\r\n", execCommand(db, "expire", "a", "1", "gt", "lt"))
+	assert.Equal(t, "-Unsupported option foo\r\n", execCommand(db, "expire", "a", "1", "foo"))
+	assert.Equal(t, "-invalid expire time in 'expire' command\r\n", execCommand(db, "expire", "a", "9223372036854775807"))
+
+	// EXPIREAT takes seconds, PEXPIREAT milliseconds
+	at := time.Now().Unix() + 1000
+	assert.Equal(t, ":1\r\n", execCommand(db, "expireat", "a", strconv.FormatInt(at, 10)))
+	assert.Equal(t, ":"+strconv.FormatInt(at, 10)+"\r\n", execCommand(db, "expiretime", "a"))
+	assert.Equal(t, ":"+strconv.FormatInt(at*1000, 10)+"\r\n", execCommand(db, "pexpiretime", "a"))
+	assert.Equal(t, ":1\r\n", execCommand(db, "pexpireat", "a", strconv.FormatInt(at*1000+1, 10)))
+	assert.Equal(t, at*1000+1, db.getExpire("a"))
+
+	assert.Equal(t, ":1\r\n", execCommand(db, "persist", "a"))
+	assert.Equal(t, ":0\r\n", execCommand(db, "persist", "a"))
+	assert.Equal(t, ":-1\r\n", execCommand(db, "expiretime", "a"))
+
+	// the expirations are propagated with absolute times, or as deletions
+	godisServer.aofBuf = []byte{}
+	godisServer.aofSelectedDB = db.id
+	execCommand(db, "pexpireat", "a", strconv.FormatInt(at*1000, 10))
+	execCommand(db, "expire", "a", "-1")
+	aof := formatCommand(3, []string{"pexpireat", "a", strconv.FormatInt(at*1000, 10)}) +
+		formatCommand(2, []string{"del", "a"})
+	assert.Equal(t, aof, string(godisServer.aofBuf))
+	assert.Nil(t, db.Get("a"))
+}
+
+func TestSetOptions(t *testing.T) {
+	db := NewDatabase()
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"set", "k", "v", "ex", "100"}, "+OK\r\n"},
+		{[]string{"ttl", "k"}, ":100\r\n"},
+		{[]string{"set", "k", "v2", "keepttl"}, "+OK\r\n"},
+		{[]string{"ttl", "k"}, ":100\r\n"},
+		{[]string{"set", "k", "v3", "get"}, "$2\r\nv2\r\n"},
+		{[]string{"ttl", "k"}, ":-1\r\n"},
+		{[]string{"set", "k", "v", "nx"}, "$-1\r\n"},
+		{[]string{"set", "k", "v", "NX", "get"}, "$2\r\nv3\r\n"},
+		{[]string{"set", "missing", "v", "xx"}, "$-1\r\n"},
+		{[]string{"set", "k", "v", "nx", "xx"}, "-" + ReplySyntaxErr + "\r\n"},
+		{[]string{"set", "k", "v", "ex", "10", "px", "10"}, "-" + ReplySyntaxErr + "\r\n"},
+		{[]string{"set", "k", "v", "ex", "10", "keepttl"}, "-" + ReplySyntaxErr + "\r\n"},
+		{[]string{"set", "k", "v", "ex"}, "-" + ReplySyntaxErr + "\r\n"},
+		{[]string{"set", "k", "v", "ex", "0"}, "-invalid expire time in 'set' command\r\n"},
+		{[]string{"set", "k", "v", "px", "x"}, "-" + ReplyNotInteger + "\r\n"},
+		{[]string{"set", "k", "v", "exat", "9223372036854775807"}, "-invalid expire time in 'set' command\r\n"},
+		{[]string{"setex", "k", "100", "v"}, "+OK\r\n"},
+		{[]string{"psetex", "k", "0", "v"}, "-invalid expire time in 'psetex' command\r\n"},
+		{[]string{"setnx", "k", "v"}, ":0\r\n"},
+		{[]string{"getset", "k", "w"}, "$1\r\nv\r\n"},
+		{[]string{"ttl", "k"}, ":-1\r\n"},
+		{[]string{"getex", "k", "px", "100000"}, "$1\r\nw\r\n"},
+		{[]string{"ttl", "k"}, ":100\r\n"},
+		{[]string{"getex", "k", "persist"}, "$1\r\nw\r\n"},
+		{[]string{"ttl", "k"}, ":-1\r\n"},
+		{[]string{"getex", "k", "persist", "ex", "1"}, "-" + ReplySyntaxErr + "\r\n"},
+		{[]string{"getdel", "k"}, "$1\r\nw\r\n"},
+		{[]string{"getdel", "k"}, "$-1\r\n"},
+		{[]string{"rpush", "l", "a"}, ":1\r\n"},
+		{[]string{"get", "l"}, "-" + ReplyWrongType + "\r\n"},
+		{[]string{"set", "l", "v", "get"}, "-" + ReplyWrongType + "\r\n"},
+		{[]string{"set", "l", "v"}, "+OK\r\n"},
+	}
+	for _, tC := range tests {
+		assert.Equal(t, tC.want, execCommand(db, tC.argv...), strings.Join(tC.argv, " "))
+	}
+
+	// relative expires are written to the AOF as absolute ones
+	godisServer.aofBuf = []byte{}
+	godisServer.aofSelectedDB = db.id
+	execCommand(db, "set", "k", "v", "exat", "4000000000", "nx")
+	execCommand(db, "setex", "k", "10", "v")
+	execCommand(db, "getex", "k", "exat", "4000000001")
+	aof := string(godisServer.aofBuf)
+	assert.True(t, strings.HasPrefix(aof, formatCommand(5, []string{"set", "k", "v", "pxat", "4000000000000"})))
+	assert.Equal(t, 2, strings.Count(aof, "$4\r\npxat\r\n"))
+	assert.True(t, strings.HasSuffix(aof, formatCommand(3, []string{"pexpireat", "k", "4000000001000"})))
+}
+
+func TestCounters(t *testing.T) {
+	db := NewDatabase()
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"incr", "n"}, ":1\r\n"},
+		{[]string{"incrby", "n", "41"}, ":42\r\n"},
+		{[]string{"decr", "n"}, ":41\r\n"},
+		{[]string{"decrby", "n", "-9"}, ":50\r\n"},
+		{[]string{"get", "n"}, "$2\r\n50\r\n"},
+		{[]string{"object", "encoding", "n"}, "$3\r\nint\r\n"},
+		{[]string{"incrby", "n", "x"}, "-" + ReplyNotInteger + "\r\n"},
+		{[]string{"decrby", "n", "-9223372036854775808"}, "-decrement would overflow\r\n"},
+		{[]string{"decrby", "n", "9223372036854775808"}, "-" + ReplyNotInteger + "\r\n"},
+		{[]string{"set", "max", "9223372036854775807"}, "+OK\r\n"},
+		{[]string{"incr", "max"}, "-" + ReplyOverflow + "\r\n"},
+		{[]string{"set", "s", "007"}, "+OK\r\n"},
+		{[]string{"object", "encoding", "s"}, "$6\r\nembstr\r\n"},
+		{[]string{"incr", "s"}, "-" + ReplyNotInteger + "\r\n"},
+		{[]string{"set", "s", strings.Repeat("x", 45)}, "+OK\r\n"},
+		{[]string{"object", "encoding", "s"}, "$3\r\nraw\r\n"},
+		{[]string{"incrbyfloat", "f", "10.5"}, "$4\r\n10.5\r\n"},
+		{[]string{"incrbyfloat", "f", "-0.5"}, "$2\r\n10\r\n"},
+		{[]string{"object", "encoding", "f"}, "$3\r\nint\r\n"},
+		{[]string{"incrbyfloat", "f", "x"}, "-" + ReplyNotFloat + "\r\n"},
+		{[]string{"incrbyfloat", "s", "1"}, "-" + ReplyNotFloat + "\r\n"},
+		{[]string{"rpush", "l", "a"}, ":1\r\n"},
+		{[]string{"incr", "l"}, "-" + ReplyWrongType + "\r\n"},
+	}
+	for _, tC := range tests {
+		assert.Equal(t, tC.want, execCommand(db, tC.argv...), strings.Join(tC.argv, " "))
+	}
+
+	// the counters keep their TTL
+	execCommand(db, "expire", "n", "100")
+	execCommand(db, "incr", "n")
+	assert.Equal(t, ":100\r\n", execCommand(db, "ttl", "n"))
+
+	// small integers are shared unless the keys are evicted by LRU
+	maxmemory := godisServer.maxmemory
+	defer func() { godisServer.maxmemory = maxmemory }()
+	godisServer.maxmemory = 0
+	execCommand(db, "set", "a", "7")
+	execCommand(db, "set", "b", "6")
+	execCommand(db, "incr", "b")
+	assert.True(t, db.Get("a") == db.Get("b"))
+	godisServer.maxmemory = maxmemory
+	execCommand(db, "set", "b", "7")
+	assert.False(t, db.Get("a") == db.Get("b"))
+}
+
+func TestStringCommands(t *testing.T) {
+	db := NewDatabase()
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"mset", "a", "1", "b", "hello"}, "+OK\r\n"},
+		{[]string{"mset", "a", "1", "b"}, "-wrong number of arguments for 'mset' command\r\n"},
+		{[]string{"msetnx", "c", "1", "a", "2"}, ":0\r\n"},
+		{[]string{"exists", "c"}, ":0\r\n"},
+		{[]string{"msetnx", "c", "1", "d", "2"}, ":1\r\n"},
+		{[]string{"rpush", "l", "x"}, ":1\r\n"},
+		{[]string{"mget", "a", "l", "missing", "b"}, "*4\r\n$1\r\n1\r\n$-1\r\n$-1\r\n$5\r\nhello\r\n"},
+		{[]string{"append", "a", "23"}, ":3\r\n"},
+		{[]string{"object", "encoding", "a"}, "$3\r\nraw\r\n"},
+		{[]string{"incr", "a"}, ":124\r\n"},
+		{[]string{"append", "new", "xy"}, ":2\r\n"},
+		{[]string{"strlen", "b"}, ":5\r\n"},
+		{[]string{"strlen", "a"}, ":3\r\n"},
+		{[]string{"strlen", "missing"}, ":0\r\n"},
+		{[]string{"getrange", "b", "1", "-2"}, "$3\r\nell\r\n"},
+		{[]string{"getrange", "b", "-100", "100"}, "$5\r\nhello\r\n"},
+		{[]string{"getrange", "b", "-1", "-5"}, "$0\r\n\r\n"},
+		{[]string{"getrange", "b", "3", "1"}, "$0\r\n\r\n"},
+		{[]string{"setrange", "b", "3", "p!"}, ":5\r\n"},
+		{[]string{"get", "b"}, "$5\r\nhelp!\r\n"},
+		{[]string{"setrange", "z", "3", "ab"}, ":5\r\n"},
+		{[]string{"get", "z"}, "$5\r\n\x00\x00\x00ab\r\n"},
+		{[]string{"setrange", "empty", "3", ""}, ":0\r\n"},
+		{[]string{"exists", "empty"}, ":0\r\n"},
+		{[]string{"setrange", "z", "-1", "a"}, "-offset is out of range\r\n"},
+		{[]string{"setrange", "z", "536870911", "ab"}, "-string exceeds maximum allowed size (proto-max-bulk-len)\r\n"},
+		{[]string{"append", "l", "x"}, "-" + ReplyWrongType + "\r\n"},
+	}
+	for _, tC := range tests {
+		assert.Equal(t, tC.want, execCommand(db, tC.argv...), strings.Join(tC.argv, " "))
+	}
+}
+
+func TestBitmapCommands(t *testing.T) {
+	db := NewDatabase()
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"setbit", "bm", "7", "1"}, ":0\r\n"},
+		{[]string{"get", "bm"}, "$1\r\n\x01\r\n"},
+		{[]string{"setbit", "bm", "7", "0"}, ":1\r\n"},
+		{[]string{"setbit", "bm", "-1", "1"}, "-bit offset is not an integer or out of range\r\n"},
+		{[]string{"setbit", "bm", "4294967296", "1"}, "-bit offset is not an integer or out of range\r\n"},
+		{[]string{"setbit", "bm", "1", "2"}, "-bit is not an integer or out of range\r\n"},
+		{[]string{"getbit", "bm", "100"}, ":0\r\n"},
+		{[]string{"set", "s", "foobar"}, "+OK\r\n"},
+		{[]string{"getbit", "s", "1"}, ":1\r\n"},
+		{[]string{"bitcount", "s"}, ":26\r\n"},
+		{[]string{"bitcount", "s", "0", "0"}, ":4\r\n"},
+		{[]string{"bitcount", "s", "1", "1", "byte"}, ":6\r\n"},
+		{[]string{"bitcount", "s", "5", "30", "bit"}, ":17\r\n"},
+		{[]string{"bitcount", "s", "0"}, "-" + ReplySyntaxErr + "\r\n"},
+		{[]string{"bitcount", "missing"}, ":0\r\n"},
+		{[]string{"set", "p", "\x00\xff\xf0"}, "+OK\r\n"},
+		{[]string{"bitpos", "p", "1", "0"}, ":8\r\n"},
+		{[]string{"bitpos", "p", "1", "2"}, ":16\r\n"},
+		{[]string{"bitpos", "p", "1", "2", "-1", "byte"}, ":16\r\n"},
+		{[]string{"bitpos", "p", "1", "7", "15", "bit"}, ":8\r\n"},
+		{[]string{"bitpos", "p", "1", "7", "-3", "bit"}, ":8\r\n"},
+		{[]string{"bitpos", "p", "0", "1", "1"}, ":-1\r\n"},
+		{[]string{"bitpos", "p", "2"}, "-The bit argument must be 1 or 0.\r\n"},
+		{[]string{"set", "ones", "\xff\xff"}, "+OK\r\n"},
+		{[]string{"bitpos", "ones", "0"}, ":16\r\n"},
+		{[]string{"bitpos", "ones", "0", "0", "-1"}, ":-1\r\n"},
+		{[]string{"bitpos", "missing", "0"}, ":0\r\n"},
+		{[]string{"bitpos", "missing", "1"}, ":-1\r\n"},
+		{[]string{"set", "a", "foobar"}, "+OK\r\n"},
+		{[]string{"set", "b", "abcdef"}, "+OK\r\n"},
+		{[]string{"bitop", "and", "dest", "a", "b"}, ":6\r\n"},
+		{[]string{"get", "dest"}, "$6\r\n`bc`ab\r\n"},
+		{[]string{"bitop", "or", "dest", "a", "missing"}, ":6\r\n"},
+		{[]string{"get", "dest"}, "$6\r\nfoobar\r\n"},
+		{[]string{"bitop", "not", "dest", "ones"}, ":2\r\n"},
+		{[]string{"get", "dest"}, "$2\r\n\x00\x00\r\n"},
+		{[]string{"bitop", "not", "dest", "missing"}, ":0\r\n"},
+		{[]string{"exists", "dest"}, ":0\r\n"},
+		{[]string{"bitop", "not", "dest", "a", "b"}, "-BITOP NOT must be called with a single source key.\r\n"},
+		{[]string{"rpush", "l", "x"}, ":1\r\n"},
+		{[]string{"bitop", "xor", "dest", "a", "l"}, "-" + ReplyWrongType + "\r\n"},
+		{[]string{"getbit", "l", "0"}, "-" + ReplyWrongType + "\r\n"},
+	}
+	for _, tC := range tests {
+		assert.Equal(t, tC.want, execCommand(db, tC.argv...), strings.Join(tC.argv, " "))
+	}
+}
+
+func TestBitField(t *testing.T) {
+	db := NewDatabase()
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"bitfield", "bf", "incrby", "i5", "100", "1", "get", "u4", "0"}, "*2\r\n:1\r\n:0\r\n"},
+		{[]string{"bitfield", "bf", "set", "i8", "#1", "200"}, "*1\r\n:0\r\n"},
+		{[]string{"bitfield", "bf", "get", "i8", "8", "get", "u8", "#1"}, "*2\r\n:-56\r\n:200\r\n"},
+		{[]string{"bitfield", "c", "incrby", "u2", "100", "1", "overflow", "sat", "incrby", "u2", "102", "1"}, "*2\r\n:1\r\n:1\r\n"},
+		{[]string{"bitfield", "c", "incrby", "u2", "100", "1", "overflow", "sat", "incrby", "u2", "102", "1"}, "*2\r\n:2\r\n:2\r\n"},
+		{[]string{"bitfield", "c", "incrby", "u2", "100", "1", "overflow", "sat", "incrby", "u2", "102", "1"}, "*2\r\n:3\r\n:3\r\n"},
+		{[]string{"bitfield", "c", "incrby", "u2", "100", "1", "overflow", "sat", "incrby", "u2", "102", "1"}, "*2\r\n:0\r\n:3\r\n"},
+		{[]string{"bitfield", "c", "overflow", "fail", "incrby", "u2", "102", "1"}, "*1\r\n$-1\r\n"},
+		{[]string{"bitfield", "c", "overflow", "fail", "set", "i4", "0", "8"}, "*1\r\n$-1\r\n"},
+		{[]string{"bitfield", "big", "set", "i64", "0", "9223372036854775807", "overflow", "sat", "incrby", "i64", "0", "1"},
+			"*2\r\n:0\r\n:9223372036854775807\r\n"},
+		{[]string{"bitfield", "big", "overflow", "wrap", "incrby", "i64", "0", "1"}, "*1\r\n:-9223372036854775808\r\n"},
+		{[]string{"bitfield", "big", "overflow", "sat", "incrby", "i64", "0", "-1"}, "*1\r\n:-9223372036854775808\r\n"},
+		{[]string{"bitfield", "bf", "get", "u64", "0"}, "-Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.\r\n"},
+		{[]string{"bitfield", "bf", "overflow", "foo"}, "-Invalid OVERFLOW type specified\r\n"},
+		{[]string{"bitfield", "bf", "get", "u8"}, "-" + ReplySyntaxErr + "\r\n"},
+		{[]string{"bitfield", "missing"}, "*0\r\n"},
+		{[]string{"bitfield_ro", "bf", "get", "u8", "#1"}, "*1\r\n:200\r\n"},
+		{[]string{"bitfield_ro", "bf", "set", "u8", "0", "1"}, "-BITFIELD_RO only supports the GET subcommand\r\n"},
+	}
+	for _, tC := range tests {
+		assert.Equal(t, tC.want, execCommand(db, tC.argv...), strings.Join(tC.argv, " "))
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	db := NewDatabase()
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"pfadd", "h1", "a", "b", "c"}, ":1\r\n"},
+		{[]string{"pfadd", "h1", "a"}, ":0\r\n"},
+		{[]string{"pfadd", "empty"}, ":1\r\n"},
+		{[]string{"pfadd", "empty"}, ":0\r\n"},
+		{[]string{"pfcount", "h1"}, ":3\r\n"},
+		{[]string{"pfcount", "empty", "missing"}, ":0\r\n"},
+		{[]string{"pfadd", "h2", "c", "d"}, ":1\r\n"},
+		{[]string{"pfcount", "h1", "h2"}, ":4\r\n"},
+		{[]string{"pfmerge", "h3", "h1", "h2", "missing"}, "+OK\r\n"},
+		{[]string{"pfcount", "h3"}, ":4\r\n"},
+		{[]string{"type", "h3"}, "+string\r\n"},
+		{[]string{"pfmerge", "h4"}, "+OK\r\n"},
+		{[]string{"pfcount", "h4"}, ":0\r\n"},
+		{[]string{"set", "s", "hello"}, "+OK\r\n"},
+		{[]string{"pfadd", "s", "a"}, "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{[]string{"pfcount", "h1", "s"}, "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{[]string{"rpush", "l", "x"}, ":1\r\n"},
+		{[]string{"pfmerge", "h1", "l"}, "-" + ReplyWrongType + "\r\n"},
+		{[]string{"set", "bad", "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x7f"}, "+OK\r\n"},
+		{[]string{"pfcount", "bad"}, "-INVALIDOBJ Corrupted HLL object detected\r\n"},
+	}
+	for _, tC := range tests {
+		assert.Equal(t, tC.want, execCommand(db, tC.argv...), strings.Join(tC.argv, " "))
+	}
+
+	// the sparse HLLs are converted to dense when too large
+	assert.Equal(t, dt.HLLSparse, dt.HLLEncoding(stringBytes(db.lookupKey("h1", false))))
+	godisServer.hllSparseMaxBytes = 20
+	defer func() { godisServer.hllSparseMaxBytes = HLLSparseMaxBytes }()
+	assert.Equal(t, ":1\r\n", execCommand(db, "pfadd", "h1", "e", "f"))
+	assert.Equal(t, dt.HLLDense, dt.HLLEncoding(stringBytes(db.lookupKey("h1", false))))
+	assert.Equal(t, ":5\r\n", execCommand(db, "pfcount", "h1"))
+	assert.Equal(t, "+OK\r\n", execCommand(db, "pfmerge", "h5", "h2", "h1"))
+	assert.Equal(t, dt.HLLDense, dt.HLLEncoding(stringBytes(db.lookupKey("h5", false))))
+	assert.Equal(t, ":6\r\n", execCommand(db, "pfcount", "h5"))
+}
+
+func TestLCS(t *testing.T) {
+	db := NewDatabase()
+	execCommand(db, "mset", "key1", "ohmytext", "key2", "mynewtext")
+
+	assert.Equal(t, "$6\r\nmytext\r\n", execCommand(db, "lcs", "key1", "key2"))
+	assert.Equal(t, ":6\r\n", execCommand(db, "lcs", "key1", "key2", "len"))
+	assert.Equal(t, "*4\r\n$7\r\nmatches\r\n*2\r\n"+
+		"*2\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n"+
+		"*2\r\n*2\r\n:2\r\n:3\r\n*2\r\n:0\r\n:1\r\n"+
+		"$3\r\nlen\r\n:6\r\n", execCommand(db, "lcs", "key1", "key2", "idx"))
+	assert.Equal(t, "*4\r\n$7\r\nmatches\r\n*1\r\n"+
+		"*3\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n:4\r\n"+
+		"$3\r\nlen\r\n:6\r\n", execCommand(db, "lcs", "key1", "key2", "idx", "minmatchlen", "4", "withmatchlen"))
+	assert.Equal(t, "$0\r\n\r\n", execCommand(db, "lcs", "key1", "missing"))
+	assert.Equal(t, "-If you want both the length and indexes, please just use IDX.\r\n", execCommand(db, "lcs", "key1", "key2", "len", "idx"))
+}
+
+func TestStreamCommands(t *testing.T) {
+	db := NewDatabase()
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"xadd", "s", "1-1", "a", "1"}, "$3\r\n1-1\r\n"},
+		{[]string{"xadd", "s", "1-*", "b", "2"}, "$3\r\n1-2\r\n"},
+		{[]string{"xadd", "s", "1", "a", "1"}, "-The ID specified in XADD is equal or smaller than the target stream top item\r\n"},
+		{[]string{"xadd", "s", "0-0", "a", "1"}, "-The ID specified in XADD must be greater than 0-0\r\n"},
+		{[]string{"xadd", "s", "bad", "a", "1"}, "-" + replyInvalidStreamID + "\r\n"},
+		{[]string{"xadd", "s", "3-0", "a"}, "-wrong number of arguments for 'xadd' command\r\n"},
+		{[]string{"xadd", "s", "3-0", "a", "3", "b", "3"}, "$3\r\n3-0\r\n"},
+		{[]string{"xadd", "missing", "nomkstream", "*", "a", "1"}, "$-1\r\n"},
+		{[]string{"xlen", "s"}, ":3\r\n"},
+		{[]string{"type", "s"}, "+stream\r\n"},
+		{[]string{"object", "encoding", "s"}, "$6\r\nstream\r\n"},
+		{[]string{"xrange", "s", "-", "+", "count", "1"}, "*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{[]string{"xrange", "s", "(1-1", "1"}, "*1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"xrange", "s", "-", "+", "count", "0"}, "*-1\r\n"},
+		{[]string{"xrange", "missing", "-", "+"}, "*0\r\n"},
+		{[]string{"xrevrange", "s", "+", "(1-2"}, "*1\r\n*2\r\n$3\r\n3-0\r\n*4\r\n$1\r\na\r\n$1\r\n3\r\n$1\r\nb\r\n$1\r\n3\r\n"},
+		{[]string{"xrange", "s", "(-", "+"}, "-" + replyInvalidStreamID + "\r\n"},
+		{[]string{"xdel", "s", "1-2", "9-9"}, ":1\r\n"},
+		{[]string{"xread", "count", "1", "streams", "s", "0"}, "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{[]string{"xread", "streams", "s", "$"}, "*-1\r\n"},
+		{[]string{"xread", "streams", "s", "missing", "0"}, "-Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.\r\n"},
+		{[]string{"xtrim", "s", "maxlen", "1", "limit", "10"}, "-syntax error, LIMIT cannot be used without the special ~ option\r\n"},
+		{[]string{"xtrim", "s", "maxlen", "=", "1"}, ":1\r\n"},
+		{[]string{"xadd", "s", "maxlen", "1", "minid", "0", "*", "a", "1"}, "-syntax error, MAXLEN and MINID options at the same time are not compatible\r\n"},
+		{[]string{"xsetid", "s", "2-0"}, "-The ID specified in XSETID is smaller than the target stream top item\r\n"},
+		{[]string{"xsetid", "s", "5-0", "entriesadded", "7", "maxdeletedid", "4-0"}, "+OK\r\n"},
+		{[]string{"xadd", "s", "minid", "6", "*", "c", "4"}, "$" + strconv.Itoa(len(strconv.FormatInt(mstime(), 10))+2) + "\r\n"},
+		{[]string{"xlen", "s"}, ":1\r\n"},
+		{[]string{"set", "str", "x"}, "+OK\r\n"},
+		{[]string{"xlen", "str"}, "-" + ReplyWrongType + "\r\n"},
+	}
+	for _, tC := range tests {
+		got := execCommand(db, tC.argv...)
+		if tC.argv[0] == "xadd" && tC.argv[len(tC.argv)-3] == "*" {
+			// the generated ID is only checked by its length
+			got = got[:strings.Index(got, "\r\n")+2]
+		}
+		assert.Equal(t, tC.want, got, strings.Join(tC.argv, " "))
+	}
+
+	s := db.Get("s").Ptr.(*dt.Stream)
+	assert.Equal(t, int64(8), s.EntriesAdded)
+	assert.Equal(t, dt.StreamID{Ms: 4}, s.MaxDeletedID)
+	assert.Equal(t, int64(1), db.elements)
+}
+
+func TestStreamGroups(t *testing.T) {
+	db := NewDatabase()
+	for i := 1; i <= 3; i++ {
+		execCommand(db, "xadd", "s", strconv.Itoa(i), "f", strconv.Itoa(i))
+	}
+
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"xgroup", "create", "missing", "g", "$"}, "-The XGROUP subcommand requires the key to exist. " +
+			"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n"},
+		{[]string{"xgroup", "create", "s", "g", "0"}, "+OK\r\n"},
+		{[]string{"xgroup", "create", "s", "g", "0"}, "-BUSYGROUP Consumer Group name already exists\r\n"},
+		{[]string{"xgroup", "createconsumer", "s", "nogroup", "c"}, "-NOGROUP No such consumer group 'nogroup' for key name 's'\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c1", "count", "2", "streams", "s", ">"},
+			"*1\r\n*2\r\n$1\r\ns\r\n*2\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\n1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$1\r\n2\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c2", "streams", "s", ">"},
+			"*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nf\r\n$1\r\n3\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c2", "streams", "s", ">"}, "*-1\r\n"},
+		{[]string{"xreadgroup", "group", "nogroup", "c", "streams", "s", ">"},
+			"-NOGROUP No such key 's' or consumer group 'nogroup' in XREADGROUP with GROUP option\r\n"},
+		{[]string{"xpending", "s", "g"}, "*4\r\n:3\r\n$3\r\n1-0\r\n$3\r\n3-0\r\n*2\r\n*2\r\n$2\r\nc1\r\n$1\r\n2\r\n*2\r\n$2\r\nc2\r\n$1\r\n1\r\n"},
+		{[]string{"xack", "s", "g", "1-0", "9-0"}, ":1\r\n"},
+		{[]string{"xdel", "s", "2-0"}, ":1\r\n"},
+		// the history of the consumer includes the deleted entries
+		{[]string{"xreadgroup", "group", "g", "c1", "streams", "s", "0"},
+			"*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*-1\r\n"},
+		{[]string{"xclaim", "s", "g", "c2", "0", "2-0", "justid"}, "*0\r\n"},
+		{[]string{"xpending", "s", "g", "-", "+", "10", "c1"}, "*0\r\n"},
+		{[]string{"xclaim", "s", "g", "c1", "0", "3-0", "justid", "bad"}, "-Unrecognized XCLAIM option 'bad'\r\n"},
+		{[]string{"xclaim", "s", "g", "c1", "0", "3-0", "justid"}, "*1\r\n$3\r\n3-0\r\n"},
+		{[]string{"xautoclaim", "s", "g", "c2", "0", "0", "count", "1"},
+			"*3\r\n$3\r\n0-0\r\n*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nf\r\n$1\r\n3\r\n*0\r\n"},
+		{[]string{"xgroup", "delconsumer", "s", "g", "c2"}, ":1\r\n"},
+		{[]string{"xpending", "s", "g"}, "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n"},
+		{[]string{"xgroup", "setid", "s", "g", "0", "entriesread", "0"}, "+OK\r\n"},
+		{[]string{"xgroup", "destroy", "s", "g"}, ":1\r\n"},
+		{[]string{"xgroup", "destroy", "s", "g"}, ":0\r\n"},
+		{[]string{"xgroup", "create", "new", "g", "$", "mkstream"}, "+OK\r\n"},
+		{[]string{"xlen", "new"}, ":0\r\n"},
+	}
+	for _, tC := range tests {
+		assert.Equal(t, tC.want, execCommand(db, tC.argv...), strings.Join(tC.argv, " "))
+	}
+}
+
+func TestStreamInfo(t *testing.T) {
+	db := NewDatabase()
+	execCommand(db, "xadd", "s", "1-0", "a", "1")
+	execCommand(db, "xadd", "s", "2-0", "b", "2")
+	execCommand(db, "xgroup", "create", "s", "g", "0")
+	execCommand(db, "xreadgroup", "group", "g", "c", "count", "1", "streams", "s", ">")
+
+	assert.Equal(t, "*20\r\n"+
+		"$6\r\nlength\r\n:2\r\n"+
+		"$15\r\nradix-tree-keys\r\n:1\r\n"+
+		"$16\r\nradix-tree-nodes\r\n:2\r\n"+
+		"$17\r\nlast-generated-id\r\n$3\r\n2-0\r\n"+
+		"$20\r\nmax-deleted-entry-id\r\n$3\r\n0-0\r\n"+
+		"$13\r\nentries-added\r\n:2\r\n"+
+		"$23\r\nrecorded-first-entry-id\r\n$3\r\n1-0\r\n"+
+		"$6\r\ngroups\r\n:1\r\n"+
+		"$11\r\nfirst-entry\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n"+
+		"$10\r\nlast-entry\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		execCommand(db, "xinfo", "stream", "s"))
+	assert.Equal(t, "*1\r\n*12\r\n"+
+		"$4\r\nname\r\n$1\r\ng\r\n"+
+		"$9\r\nconsumers\r\n:1\r\n"+
+		"$7\r\npending\r\n:1\r\n"+
+		"$17\r\nlast-delivered-id\r\n$3\r\n1-0\r\n"+
+		"$12\r\nentries-read\r\n:1\r\n"+
+		"$3\r\nlag\r\n:1\r\n",
+		execCommand(db, "xinfo", "groups", "s"))
+	assert.True(t, strings.HasPrefix(execCommand(db, "xinfo", "consumers", "s", "g"), "*1\r\n*8\r\n$4\r\nname\r\n$1\r\nc\r\n$7\r\npending\r\n:1\r\n"))
+	assert.Equal(t, "-no such key\r\n", execCommand(db, "xinfo", "stream", "missing"))
+	assert.Equal(t, "-unknown subcommand 'bad'. Try XINFO HELP.\r\n", execCommand(db, "xinfo", "bad", "s"))
+}
+
+func TestBlockingXRead(t *testing.T) {
+	db := NewDatabase()
+	c1, buf1 := newTestClient(db)
+	c2, buf2 := newTestClient(db)
+	c3, _ := newTestClient(db)
+
+	execCommand(db, "xadd", "s", "1-0", "a", "1")
+	execCommand(db, "xgroup", "create", "s", "g", "$")
+	sendCommand(c1, "xread", "block", "0", "streams", "s", "$")
+	sendCommand(c2, "xreadgroup", "group", "g", "c", "block", "0", "streams", "s", ">")
+	assert.True(t, c1.blocked)
+	assert.True(t, c2.blocked)
+
+	// deleting entries doesn't serve the clients
+	sendCommand(c3, "xdel", "s", "1-0")
+	assert.True(t, c1.blocked)
+
+	sendCommand(c3, "xadd", "s", "2-0", "b", "2")
+	entry := "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	assert.Equal(t, entry, buf1.String())
+	assert.Equal(t, entry, buf2.String())
+	assert.Equal(t, 1, db.Get("s").Ptr.(*dt.Stream).Group("g").PendingLen())
+	assert.Empty(t, db.blockingKeys)
+
+	// the clients blocked on a group are unblocked when it's destroyed
+	buf2.Reset()
+	sendCommand(c2, "xreadgroup", "group", "g", "c", "block", "0", "streams", "s", ">")
+	assert.True(t, c2.blocked)
+	sendCommand(c3, "xgroup", "destroy", "s", "g")
+	assert.False(t, c2.blocked)
+	assert.Equal(t, "-NOGROUP No such key 's' or consumer group 'g' in XREADGROUP with GROUP option\r\n", buf2.String())
+}
+
+func TestStreamPersistence(t *testing.T) {
+	db := NewDatabase()
+	for i := 1; i <= 5; i++ {
+		execCommand(db, "xadd", "s", strconv.Itoa(i), "f", strconv.Itoa(i))
+	}
+	execCommand(db, "xdel", "s", "2-0")
+	execCommand(db, "xgroup", "create", "s", "g", "0")
+	execCommand(db, "xreadgroup", "group", "g", "c1", "count", "2", "streams", "s", ">")
+	execCommand(db, "xgroup", "createconsumer", "s", "g", "c2")
+	execCommand(db, "xadd", "empty", "maxlen", "0", "7-0", "f", "v")
+
+	// checks that the loaded streams are the same as the ones of db
+	check := func(loaded *Database) {
+		for _, key := range []string{"s", "empty"} {
+			want, got := db.Get(key).Ptr.(*dt.Stream), loaded.Get(key).Ptr.(*dt.Stream)
+			assert.Equal(t, want.Len(), got.Len())
+			assert.Equal(t, want.LastID, got.LastID)
+			assert.Equal(t, want.FirstID, got.FirstID)
+			assert.Equal(t, want.MaxDeletedID, got.MaxDeletedID)
+			assert.Equal(t, want.EntriesAdded, got.EntriesAdded)
+			assert.Equal(t, want.GroupsLen(), got.GroupsLen())
+		}
+		assert.Equal(t, execCommand(db, "xrange", "s", "-", "+"), execCommand(loaded, "xrange", "s", "-", "+"))
+		assert.Equal(t, execCommand(db, "xpending", "s", "g"), execCommand(loaded, "xpending", "s", "g"))
+		assert.Equal(t, execCommand(db, "xinfo", "groups", "s"), execCommand(loaded, "xinfo", "groups", "s"))
+	}
+
+	dir, err := ioutil.TempDir("", "godis-stream")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, RDBFileName)
+	assert.Nil(t, rdbSave(filename, snapshotDatabases(db), nil))
+	loaded := NewDatabase()
+	assert.Nil(t, rdbLoad(filename, []*Database{loaded}))
+	check(loaded)
+
+	aof := filepath.Join(dir, AOFFileName)
+	assert.Nil(t, rewriteAppendOnlyFile(aof, snapshotDatabases(db), nil))
+	f, err := os.Open(aof)
+	assert.Nil(t, err)
+	defer f.Close()
+	dbs := godisServer.db
+	defer func() { godisServer.db = dbs }()
+	godisServer.db = []*Database{NewDatabase()}
+	loaded = godisServer.db[0]
+	c := NewFakeClient(f, loaded)
+	for req := range c.Requests() {
+		LoopupCommand(req.CommandName()).Exec(c, req)
+	}
+	check(loaded)
+}
+
+func TestTransactions(t *testing.T) {
+	db := NewDatabase()
+	c, buf := newTestClient(db)
+
+	godisServer.aofBuf = nil
+	for _, argv := range [][]string{
+		{"multi"}, {"set", "k", "1"}, {"incr", "k"}, {"get", "k"}, {"exec"},
+	} {
+		sendCommand(c, argv...)
+	}
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n+OK\r\n:2\r\n$1\r\n2\r\n", buf.String())
+	aof := string(godisServer.aofBuf)
+	assert.True(t, strings.HasPrefix(aof[strings.Index(aof, "*1\r\n$5\r\nmulti"):], "*1\r\n$5\r\nmulti\r\n*3\r\n$3\r\nset"))
+	assert.True(t, strings.HasSuffix(aof, "*1\r\n$4\r\nexec\r\n"))
+
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"exec"}, "-EXEC without MULTI\r\n"},
+		{[]string{"discard"}, "-DISCARD without MULTI\r\n"},
+		{[]string{"multi"}, "+OK\r\n"},
+		{[]string{"multi"}, "-MULTI calls can not be nested\r\n"},
+		{[]string{"watch", "k"}, "-WATCH inside MULTI is not allowed\r\n"},
+		{[]string{"incr", "k"}, "+QUEUED\r\n"},
+		{[]string{"discard"}, "+OK\r\n"},
+		{[]string{"get", "k"}, "$1\r\n2\r\n"},
+		// errors at queue time abort the transaction
+		{[]string{"multi"}, "+OK\r\n"},
+		{[]string{"nosuchcommand"}, "-unknown command\r\n"},
+		{[]string{"incr", "k"}, "+QUEUED\r\n"},
+		{[]string{"exec"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		// errors at runtime don't
+		{[]string{"multi"}, "+OK\r\n"},
+		{[]string{"lpush", "k", "a"}, "+QUEUED\r\n"},
+		{[]string{"incr", "k"}, "+QUEUED\r\n"},
+		{[]string{"exec"}, "*2\r\n-" + ReplyWrongType + "\r\n:3\r\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		sendCommand(c, tt.argv...)
+		assert.Equal(t, tt.want, buf.String(), tt.argv)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db := NewDatabase()
+	c1, buf1 := newTestClient(db)
+	c2, _ := newTestClient(db)
+
+	// a watched key modified by another client aborts the transaction
+	sendCommand(c1, "watch", "k")
+	sendCommand(c2, "set", "k", "v")
+	sendCommand(c1, "multi")
+	sendCommand(c1, "set", "k", "other")
+	buf1.Reset()
+	sendCommand(c1, "exec")
+	assert.Equal(t, "*-1\r\n", buf1.String())
+	assert.Equal(t, "v", db.Get("k").Ptr.(string))
+	assert.Empty(t, db.watchedKeys)
+
+	// the keys are unwatched by EXEC, and by UNWATCH
+	sendCommand(c1, "watch", "k", "other")
+	sendCommand(c1, "unwatch")
+	sendCommand(c2, "del", "k")
+	sendCommand(c1, "multi")
+	sendCommand(c1, "set", "k", "mine")
+	buf1.Reset()
+	sendCommand(c1, "exec")
+	assert.Equal(t, "*1\r\n+OK\r\n", buf1.String())
+
+	// so does the expiration of a watched key
+	sendCommand(c2, "set", "k", "v", "px", "10")
+	sendCommand(c1, "watch", "k")
+	time.Sleep(20 * time.Millisecond)
+	sendCommand(c1, "multi")
+	sendCommand(c1, "get", "k")
+	buf1.Reset()
+	sendCommand(c1, "exec")
+	assert.Equal(t, "*-1\r\n", buf1.String())
+
+	// but deleting a key which was already expired when watched doesn't
+	sendCommand(c2, "set", "k", "v", "px", "1")
+	time.Sleep(5 * time.Millisecond)
+	sendCommand(c1, "watch", "k")
+	sendCommand(c2, "get", "k")
+	sendCommand(c1, "multi")
+	sendCommand(c1, "get", "k")
+	buf1.Reset()
+	sendCommand(c1, "exec")
+	assert.Equal(t, "*1\r\n$-1\r\n", buf1.String())
+
+	// and neither does flushing an empty database
+	sendCommand(c1, "watch", "nosuchkey")
+	sendCommand(c2, "flushdb")
+	sendCommand(c1, "multi")
+	sendCommand(c1, "ping")
+	buf1.Reset()
+	sendCommand(c1, "exec")
+	assert.Equal(t, "*1\r\n+PONG\r\n", buf1.String())
+}
+
+func TestPubsub(t *testing.T) {
+	db := NewDatabase()
+	sub, subBuf := newTestClient(db)
+	psub, psubBuf := newTestClient(db)
+	pub, pubBuf := newTestClient(db)
+	defer godisServer.freeClient(sub)
+	defer godisServer.freeClient(psub)
+
+	sendCommand(sub, "subscribe", "news", "sports")
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$6\r\nsports\r\n:2\r\n", subBuf.String())
+	sendCommand(psub, "psubscribe", "n*")
+	assert.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:1\r\n", psubBuf.String())
+
+	// only the pubsub commands are allowed in the subscriber mode
+	subBuf.Reset()
+	sendCommand(sub, "get", "k")
+	sendCommand(sub, "ping")
+	assert.Equal(t, "-Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context\r\n"+
+		"*2\r\n$4\r\npong\r\n$0\r\n\r\n", subBuf.String())
+
+	subBuf.Reset()
+	psubBuf.Reset()
+	sendCommand(pub, "publish", "news", "hello")
+	assert.Equal(t, ":2\r\n", pubBuf.String())
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n", subBuf.String())
+	assert.Equal(t, "*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n", psubBuf.String())
+
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"publish", "sports", "goal"}, ":1\r\n"},
+		{[]string{"publish", "weather", "rain"}, ":0\r\n"},
+		{[]string{"pubsub", "channels", "s*"}, "*1\r\n$6\r\nsports\r\n"},
+		{[]string{"pubsub", "numsub", "news", "nosuchchannel"}, "*4\r\n$4\r\nnews\r\n:1\r\n$13\r\nnosuchchannel\r\n:0\r\n"},
+		{[]string{"pubsub", "numpat"}, ":1\r\n"},
+		{[]string{"pubsub", "shardchannels"}, "*0\r\n"},
+		{[]string{"spublish", "news", "hello"}, ":0\r\n"},
+	}
+	for _, tt := range tests {
+		pubBuf.Reset()
+		sendCommand(pub, tt.argv...)
+		assert.Equal(t, tt.want, pubBuf.String(), tt.argv)
+	}
+
+	// the shard channels are independent from the global ones
+	sendCommand(sub, "ssubscribe", "news")
+	subBuf.Reset()
+	pubBuf.Reset()
+	sendCommand(pub, "spublish", "news", "hi")
+	assert.Equal(t, ":1\r\n", pubBuf.String())
+	assert.Equal(t, "*3\r\n$8\r\nsmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n", subBuf.String())
+
+	subBuf.Reset()
+	sendCommand(sub, "unsubscribe")
+	sendCommand(sub, "sunsubscribe")
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$11\r\nunsubscribe\r\n$6\r\nsports\r\n:0\r\n"+
+		"*3\r\n$12\r\nsunsubscribe\r\n$4\r\nnews\r\n:0\r\n", subBuf.String())
+	assert.False(t, sub.isSubscriber())
+	assert.Empty(t, godisServer.pubsubChannels)
+	assert.Empty(t, godisServer.pubsubShardChannels)
+
+	subBuf.Reset()
+	sendCommand(sub, "punsubscribe")
+	assert.Equal(t, "*3\r\n$12\r\npunsubscribe\r\n$-1\r\n:0\r\n", subBuf.String())
+
+	// a disconnected client is unsubscribed
+	godisServer.freeClient(psub)
+	assert.Empty(t, godisServer.pubsubPatterns)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	db := NewDatabase()
+	pub, pubBuf := newTestClient(db)
+	conn, peer := net.Pipe()
+	sub := NewClient(conn, db)
+	defer godisServer.freeClient(sub)
+	defer func(limit int) { godisServer.clientOutputBufferLimitPubsub = limit }(godisServer.clientOutputBufferLimitPubsub)
+	godisServer.clientOutputBufferLimitPubsub = 1024
+
+	// the subscriber never reads, the messages are queued without blocking
+	// the publisher until the limit, then it's disconnected
+	sendCommand(sub, "subscribe", "news")
+	message := strings.Repeat("x", 100)
+	for i := 0; i < 100; i++ {
+		sendCommand(pub, "publish", "news", message)
+	}
+	assert.Equal(t, strings.Repeat(":1\r\n", 100), pubBuf.String())
+	assert.True(t, sub.out.size() <= 1024)
+	<-sub.out.done
+	_, err := ioutil.ReadAll(peer)
+	assert.NoError(t, err)
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	db := NewDatabase()
+	c, buf := newTestClient(db)
+	sub, subBuf := newTestClient(db)
+	defer godisServer.freeClient(sub)
+	defer func() { godisServer.notifyKeyspaceEvents = 0 }()
+
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"config", "set", "notify-keyspace-events", "Kw"}, "-CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKEtn'.\r\n"},
+		{[]string{"config", "set", "notify-keyspace-events", "KEA"}, "+OK\r\n"},
+		{[]string{"config", "get", "notify-keyspace-events"}, "*2\r\n$22\r\nnotify-keyspace-events\r\n$3\r\nAKE\r\n"},
+		{[]string{"config", "set", "notify-keyspace-events", "El$x"}, "+OK\r\n"},
+		{[]string{"config", "get", "notify-keyspace-events"}, "*2\r\n$22\r\nnotify-keyspace-events\r\n$4\r\n$lxE\r\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		sendCommand(c, tt.argv...)
+		assert.Equal(t, tt.want, buf.String(), tt.argv)
+	}
+
+	// only the keyevent channels of the list, string and expired classes
+	sendCommand(sub, "psubscribe", "__key*")
+	subBuf.Reset()
+	sendCommand(c, "rpush", "l", "a")
+	sendCommand(c, "lpop", "l")
+	sendCommand(c, "sadd", "s", "a")
+	sendCommand(c, "set", "k", "v", "px", "1")
+	time.Sleep(5 * time.Millisecond)
+	db.doExpireCycle()
+
+	var events []string
+	for _, event := range []string{"rpush l", "lpop l", "set k", "expired k"} {
+		fields := strings.Fields(event)
+		channel := "__keyevent@0__:" + fields[0]
+		events = append(events, "*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$"+strconv.Itoa(len(channel))+"\r\n"+channel+"\r\n$1\r\n"+fields[1]+"\r\n")
+	}
+	assert.Equal(t, strings.Join(events, ""), subBuf.String())
+
+	// the keyspace channels get the events of their key
+	sendCommand(c, "config", "set", "notify-keyspace-events", "Kg")
+	subBuf.Reset()
+	sendCommand(c, "set", "a", "1")
+	sendCommand(c, "rename", "a", "b")
+	sendCommand(c, "del", "b")
+	assert.Equal(t, "*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$16\r\n__keyspace@0__:a\r\n$11\r\nrename_from\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$16\r\n__keyspace@0__:b\r\n$9\r\nrename_to\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$16\r\n__keyspace@0__:b\r\n$3\r\ndel\r\n", subBuf.String())
+}
+
+func TestScripting(t *testing.T) {
+	db := NewDatabase()
+	c, buf := newTestClient(db)
+
+	script := "return redis.call('set', KEYS[1], ARGV[1])"
+	sha := sha1hex(script)
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"evalsha", sha, "0"}, "-NOSCRIPT No matching script. Please use EVAL.\r\n"},
+		{[]string{"eval", script, "1", "k", "v"}, "+OK\r\n"},
+		{[]string{"script", "exists", sha, "ffff"}, "*2\r\n:1\r\n:0\r\n"},
+		{[]string{"evalsha", strings.ToUpper(sha), "1", "k", "w"}, "+OK\r\n"},
+		{[]string{"eval", "return {1, 'a', {false}, 2.9, nil, 3}", "0"}, "*4\r\n:1\r\n$1\r\na\r\n*1\r\n$-1\r\n:2\r\n"},
+		{[]string{"eval", "return redis.call('get', KEYS[1])", "1", "k"}, "$1\r\nw\r\n"},
+		{[]string{"eval", "return redis.call('incr', 'k')", "0"}, "-value is not an integer or out of range\r\n"},
+		{[]string{"eval", "return redis.pcall('incr', 'k')['err']", "0"}, "$39\r\nvalue is not an integer or out of range\r\n"},
+		{[]string{"eval", "return redis.status_reply('FINE')", "0"}, "+FINE\r\n"},
+		{[]string{"eval", "x = 1", "0"}, "-Error running script (call to f_" + sha1hex("x = 1") + "): user_script:1: Script attempted to create global variable 'x'\r\n"},
+		{[]string{"eval", "return redis.call('multi')", "0"}, "-This Redis command is not allowed from script\r\n"},
+		{[]string{"eval_ro", "return redis.call('del', 'k')", "0"}, "-Write commands are not allowed from read-only scripts.\r\n"},
+		{[]string{"eval", "return 1", "2", "k"}, "-Number of keys can't be greater than number of args\r\n"},
+		{[]string{"script", "kill"}, "-NOTBUSY No scripts in execution right now.\r\n"},
+		{[]string{"script", "flush"}, "+OK\r\n"},
+		{[]string{"script", "exists", sha}, "*1\r\n:0\r\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		sendCommand(c, tt.argv...)
+		assert.Equal(t, tt.want, buf.String(), tt.argv)
+	}
+
+	// the effects of the script are written to the AOF instead of the script
+	godisServer.aofBuf = nil
+	sendCommand(c, "eval", "redis.call('set', 'a', 1) redis.call('get', 'a') redis.call('del', 'a')", "0")
+	aof := string(godisServer.aofBuf)
+	assert.True(t, strings.HasPrefix(aof[strings.Index(aof, "*1\r\n$5\r\nmulti"):], "*1\r\n$5\r\nmulti\r\n"+
+		"*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\ndel\r\n$1\r\na\r\n*1\r\n$4\r\nexec\r\n"))
+	assert.NotContains(t, aof, "eval")
+}
+
+func TestSlowScript(t *testing.T) {
+	db := NewDatabase()
+	c, buf := newTestClient(db)
+	conn, peer := net.Pipe()
+	sub := NewClient(conn, db)
+	received := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(peer)
+		received <- string(data)
+	}()
+	defer func(limit int) { godisServer.luaTimeLimit = limit }(godisServer.luaTimeLimit)
+	godisServer.luaTimeLimit = 1
+
+	// the watchdog answers the subscriber while the script publishes to it,
+	// the replies aren't interleaved
+	sendCommand(sub, "subscribe", "ch")
+	godisServer.handleClientsWithPendingWrites()
+	sub.wg.Add(2)
+	godisServer.events <- &IOEvent{c: sub, r: newRequest("ping")}
+	godisServer.events <- &IOEvent{c: sub, r: newRequest("script", "kill")}
+	sendCommand(c, "eval", "while true do redis.call('publish', 'ch', 'm') end", "0")
+	sub.wg.Wait()
+	godisServer.freeClient(sub)
+	sub.Close()
+
+	assert.Equal(t, "-Script killed by user with SCRIPT KILL...\r\n", buf.String())
+	subscribed := "*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"
+	message := "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$1\r\nm\r\n"
+	output := <-received
+	assert.Contains(t, output, message)
+	assert.Equal(t, subscribed+"-"+replyBusy+"SCRIPT KILL.\r\n+OK\r\n", strings.Replace(output, message, "", -1))
+}
+
+func TestFunctions(t *testing.T) {
+	db := NewDatabase()
+	c, buf := newTestClient(db)
+	defer sendCommand(c, "function", "flush")
+
+	lib := "#!lua name=mylib\n" +
+		"redis.register_function('myset', function(keys, args) return redis.call('set', keys[1], args[1]) end)\n" +
+		"redis.register_function{function_name='myget', callback=function(keys) return redis.call('get', keys[1]) end, flags={'no-writes'}}"
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"function", "load", "return 1"}, "-Missing library metadata\r\n"},
+		{[]string{"function", "load", "#!js name=x\n"}, "-Engine 'js' not found\r\n"},
+		{[]string{"function", "load", "#!lua name=empty\nlocal x = 1"}, "-No functions registered\r\n"},
+		{[]string{"function", "load", "#!lua name=bad\nredis.call('ping')"}, "-Error registering functions: user_function:2: redis.call and redis.pcall are not allowed during FUNCTION LOAD\r\n"},
+		{[]string{"function", "load", lib}, "$5\r\nmylib\r\n"},
+		{[]string{"function", "load", lib}, "-Library 'mylib' already exists\r\n"},
+		{[]string{"function", "load", "replace", lib}, "$5\r\nmylib\r\n"},
+		{[]string{"function", "load", "#!lua name=other\nredis.register_function('myget', function() end)"}, "-Function myget already exists\r\n"},
+		{[]string{"fcall", "myset", "1", "k", "v"}, "+OK\r\n"},
+		{[]string{"fcall_ro", "myget", "1", "k"}, "$1\r\nv\r\n"},
+		{[]string{"fcall_ro", "myset", "1", "k", "v"}, "-Can not execute a script with write flag using *_ro command.\r\n"},
+		{[]string{"fcall", "nope", "0"}, "-Function not found\r\n"},
+		{[]string{"function", "list", "libraryname", "my*"}, "*1\r\n*6\r\n$12\r\nlibrary_name\r\n$5\r\nmylib\r\n$6\r\nengine\r\n$3\r\nLUA\r\n$9\r\nfunctions\r\n*2\r\n" +
+			"*6\r\n$4\r\nname\r\n$5\r\nmyget\r\n$11\r\ndescription\r\n$-1\r\n$5\r\nflags\r\n*1\r\n$9\r\nno-writes\r\n" +
+			"*6\r\n$4\r\nname\r\n$5\r\nmyset\r\n$11\r\ndescription\r\n$-1\r\n$5\r\nflags\r\n*0\r\n"},
+		{[]string{"function", "list", "libraryname", "x*"}, "*0\r\n"},
+		{[]string{"function", "delete", "nope"}, "-Library not found\r\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		sendCommand(c, tt.argv...)
+		assert.Equal(t, tt.want, buf.String(), tt.argv)
+	}
+
+	// the dump is restored after the libraries are flushed
+	buf.Reset()
+	sendCommand(c, "function", "dump")
+	payload := buf.String()[strings.Index(buf.String(), "\r\n")+2 : buf.Len()-2]
+	sendCommand(c, "function", "delete", "mylib")
+	buf.Reset()
+	sendCommand(c, "function", "restore", payload[:len(payload)-1])
+	sendCommand(c, "function", "restore", payload)
+	sendCommand(c, "function", "restore", payload)
+	sendCommand(c, "function", "restore", payload, "replace")
+	assert.Equal(t, "-payload version or checksum are wrong\r\n+OK\r\n-Library 'mylib' already exists\r\n+OK\r\n", buf.String())
+
+	// the libraries are saved in the snapshot and the AOF
+	dir, err := ioutil.TempDir("", "godis-functions")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dump.rdb")
+	aof := filepath.Join(dir, "godis.aof")
+	assert.Nil(t, rdbSave(filename, snapshotDatabases(db), godisServer.functionsSnapshot()))
+	assert.Nil(t, rewriteAppendOnlyFile(aof, snapshotDatabases(), godisServer.functionsSnapshot()))
+	for _, load := range []func(){
+		func() { assert.Nil(t, rdbLoad(filename, []*Database{db})) },
+		func() {
+			f, _ := os.Open(aof)
+			defer f.Close()
+			fake := NewFakeClient(f, db)
+			for req := range fake.Requests() {
+				LoopupCommand(req.CommandName()).Exec(fake, req)
+			}
+		},
+	} {
+		sendCommand(c, "function", "flush")
+		load()
+		buf.Reset()
+		sendCommand(c, "fcall", "myget", "1", "k")
+		assert.Equal(t, "$1\r\nv\r\n", buf.String())
+	}
+}
+
+func TestCommandTable(t *testing.T) {
+	db := NewDatabase()
+	c, buf := newTestClient(db)
+
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"get"}, "-wrong number of arguments for 'get' command\r\n"},
+		{[]string{"ttl"}, "-wrong number of arguments for 'ttl' command\r\n"},
+		{[]string{"lpop", "l", "1", "2"}, "-wrong number of arguments for 'lpop' command\r\n"},
+		{[]string{"nope"}, "-unknown command\r\n"},
+		{[]string{"multi"}, "+OK\r\n"},
+		{[]string{"set", "k"}, "-wrong number of arguments for 'set' command\r\n"},
+		{[]string{"exec"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{[]string{"eval", "return redis.call('get')", "0"}, "-Wrong number of args calling Redis command from script\r\n"},
+		{[]string{"command", "count"}, ":" + strconv.Itoa(len(CommandTable)) + "\r\n"},
+		{[]string{"command", "info", "get", "nope"}, "*2\r\n*10\r\n$3\r\nget\r\n:2\r\n*2\r\n$8\r\nreadonly\r\n$4\r\nfast\r\n:1\r\n:1\r\n:1\r\n" +
+			"*3\r\n$5\r\n@read\r\n$5\r\n@fast\r\n$7\r\n@string\r\n*0\r\n" +
+			"*1\r\n*6\r\n$5\r\nflags\r\n*1\r\n$2\r\nRO\r\n$12\r\nbegin_search\r\n*4\r\n$4\r\ntype\r\n$5\r\nindex\r\n$4\r\nspec\r\n*2\r\n$5\r\nindex\r\n:1\r\n" +
+			"$9\r\nfind_keys\r\n*4\r\n$4\r\ntype\r\n$5\r\nrange\r\n$4\r\nspec\r\n*6\r\n$7\r\nlastkey\r\n:0\r\n$7\r\nkeystep\r\n:1\r\n$5\r\nlimit\r\n:0\r\n" +
+			"*0\r\n$-1\r\n"},
+		{[]string{"command", "docs", "get"}, "*2\r\n$3\r\nget\r\n*4\r\n$7\r\nsummary\r\n$34\r\nReturns the string value of a key.\r\n$5\r\ngroup\r\n$6\r\nstring\r\n"},
+		{[]string{"command", "getkeys", "mset", "a", "1", "b", "2"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"command", "getkeys", "eval", "return 1", "2", "a", "b", "c"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"command", "getkeys", "xread", "count", "1", "streams", "a", "b", "0", "0"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"command", "getkeys", "blpop", "a", "b", "0"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"command", "getkeys", "xgroup", "create", "s", "g", "$"}, "*1\r\n$1\r\ns\r\n"},
+		{[]string{"command", "getkeys", "xinfo", "stream", "s"}, "*1\r\n$1\r\ns\r\n"},
+		{[]string{"command", "getkeys", "xgroup", "help"}, "-The command has no key arguments\r\n"},
+		{[]string{"command", "getkeys", "eval", "return 1", "3", "a"}, "-Invalid arguments specified for command\r\n"},
+		{[]string{"command", "getkeys", "ping"}, "-The command has no key arguments\r\n"},
+		{[]string{"command", "getkeys", "get"}, "-Invalid number of arguments specified for command\r\n"},
+		{[]string{"command", "getkeys", "nope"}, "-Invalid command specified\r\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		sendCommand(c, tt.argv...)
+		assert.Equal(t, tt.want, buf.String(), tt.argv)
+	}
+
+	// every command has its documentation
+	for name := range CommandTable {
+		assert.NotEmpty(t, commandDocs[name].summary, name)
+	}
+}
+
+func TestResp3(t *testing.T) {
+	db := NewDatabase()
+	c, buf := newTestClient(db)
+	sub, subBuf := newTestClient(db)
+	defer godisServer.freeClient(sub)
+
+	hello := func(proto string) string {
+		return "$6\r\nserver\r\n$5\r\ngodis\r\n$7\r\nversion\r\n$5\r\n" + GodisVersion + "\r\n$5\r\nproto\r\n:" + proto + "\r\n" +
+			"$2\r\nid\r\n:0\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"
+	}
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"hello", "4"}, "-NOPROTO unsupported protocol version\r\n"},
+		{[]string{"hello", "3", "setname"}, "-Syntax error in HELLO option 'setname'\r\n"},
+		{[]string{"hset", "h", "f", "v"}, ":1\r\n"},
+		{[]string{"zadd", "z", "1.5", "m"}, ":1\r\n"},
+		{[]string{"sadd", "s", "a"}, ":1\r\n"},
+
+		// RESP2 replies
+		{[]string{"hello"}, "*14\r\n" + hello("2")},
+		{[]string{"hgetall", "h"}, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{[]string{"zscore", "z", "m"}, "$3\r\n1.5\r\n"},
+		{[]string{"get", "nope"}, "$-1\r\n"},
+
+		// RESP3 replies
+		{[]string{"hello", "3", "auth", "default", "secret", "setname", "conn"}, "%7\r\n" + hello("3")},
+		{[]string{"hgetall", "h"}, "%1\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{[]string{"hgetall", "nope"}, "%0\r\n"},
+		{[]string{"hkeys", "h"}, "*1\r\n$1\r\nf\r\n"},
+		{[]string{"zscore", "z", "m"}, ",1.5\r\n"},
+		{[]string{"zincrby", "z", "1", "m"}, ",2.5\r\n"},
+		{[]string{"zmscore", "z", "m", "nope"}, "*2\r\n,2.5\r\n_\r\n"},
+		{[]string{"smembers", "s"}, "~1\r\n$1\r\na\r\n"},
+		{[]string{"config", "get", "lua-time-limit"}, "%1\r\n$14\r\nlua-time-limit\r\n$4\r\n5000\r\n"},
+		{[]string{"get", "nope"}, "_\r\n"},
+		{[]string{"hello", "2"}, "*14\r\n" + hello("2")},
+		{[]string{"zscore", "z", "m"}, "$3\r\n2.5\r\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		sendCommand(c, tt.argv...)
+		assert.Equal(t, tt.want, buf.String(), tt.argv)
+	}
+	assert.Equal(t, "conn", c.name)
+
+	// the messages are pushed, and any command is allowed while subscribed
+	sendCommand(sub, "hello", "3")
+	subBuf.Reset()
+	sendCommand(sub, "subscribe", "news")
+	sendCommand(sub, "ping")
+	sendCommand(c, "publish", "news", "hello")
+	assert.Equal(t, ">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n+PONG\r\n>3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n", subBuf.String())
+
+	// the types without an equivalent are downgraded in RESP2
+	var out bytes.Buffer
+	w := protocol.NewWriter(&out)
+	for _, proto := range []int{protocol.RESP2, protocol.RESP3} {
+		w.SetProtocol(proto)
+		w.WriteBool(true)
+		w.WriteBigNumber("3492890328409238509324850943850943825024385")
+		w.WriteVerbatim("txt", "Some string")
+		w.WriteAttributeLen(1)
+		w.WriteNull()
+	}
+	assert.Equal(t, ":1\r\n$43\r\n3492890328409238509324850943850943825024385\r\n$11\r\nSome string\r\n$-1\r\n"+
+		"#t\r\n(3492890328409238509324850943850943825024385\r\n=15\r\ntxt:Some string\r\n|1\r\n_\r\n", out.String())
+}
+
+func TestProtocolLimits(t *testing.T) {
+	db := NewDatabase()
+	c, buf := newTestClient(db)
+
+	// more arguments and larger bulks than the read buffer
+	argv := []string{"mset"}
+	for i := 0; i < 11; i++ {
+		argv = append(argv, "k"+strconv.Itoa(i), "v")
+	}
+	assert.Equal(t, "+OK\r\n", execCommand(db, argv...))
+	value := strings.Repeat("x", 100*1024)
+	parser := protocol.NewParser(iotest.HalfReader(strings.NewReader(formatCommand(3, []string{"set", "big", value}))))
+	req, err := parser.ReadRequest()
+	assert.NoError(t, err)
+	call(c, req)
+	assert.Equal(t, "$102400\r\n"+value+"\r\n", execCommand(db, "get", "big"))
+
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"config", "get", "proto-max-*"}, "*4\r\n$18\r\nproto-max-bulk-len\r\n$9\r\n536870912\r\n$23\r\nproto-max-multibulk-len\r\n$7\r\n1048576\r\n"},
+		{[]string{"config", "set", "proto-max-bulk-len", "1000"}, "-CONFIG SET failed (possibly related to argument 'proto-max-bulk-len') - argument must be between 1048576 and 9223372036854775807 inclusive\r\n"},
+		{[]string{"config", "set", "proto-max-bulk-len", "2097152", "proto-max-multibulk-len", "3"}, "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		sendCommand(c, tt.argv...)
+		assert.Equal(t, tt.want, buf.String(), tt.argv)
+	}
+	defer godisServer.protoLimits.SetMaxBulkLen(protocol.DefaultMaxBulkLen)
+	defer godisServer.protoLimits.SetMaxMultibulkLen(protocol.DefaultMaxMultibulkLen)
+
+	// the requests over the limits end with a protocol error
+	for _, tt := range []struct {
+		request string
+		err     string
+	}{
+		{"*3\r\n$3\r\nset\r\n$1\r\nk\r\n$2097153\r\n", "invalid bulk length"},
+		{"*4\r\n$3\r\ndel\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", "invalid multibulk length"},
+		{"*2\r\n$3\r\nget\r\n$x\r\n", "invalid bulk length"},
+		{"*1\r\n+get\r\n", "expected '$'"},
+		{"*1\r\n$4\r\nping\r\n", ""},
+	} {
+		parser := protocol.NewParser(strings.NewReader(tt.request))
+		parser.SetLimits(godisServer.protoLimits)
+		for range parser.Requests() {
+		}
+		if tt.err == "" {
+			assert.NoError(t, parser.Err(), tt.request)
+			continue
+		}
+		assert.EqualError(t, parser.Err(), tt.err, tt.request)
+
+		buf.Reset()
+		c.wg.Add(1)
+		godisServer.handleIOEvent(&IOEvent{c: c, err: parser.Err()})
+		assert.Equal(t, "-ERR Protocol error: "+tt.err+"\r\n", buf.String())
+	}
+
+	// the null and empty arrays are skipped
+	parser = protocol.NewParser(iotest.OneByteReader(strings.NewReader("*-1\r\n*0\r\n*1\r\n$4\r\nping\r\n*-1\r\n")))
+	req, err = parser.ReadRequest()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ping"}, req.Argv())
+	req, err = parser.ReadRequest()
+	assert.Nil(t, req)
+	assert.Equal(t, io.EOF, err)
+}
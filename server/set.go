@@ -0,0 +1,635 @@
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdSAdd struct{}
+type cmdSRem struct{}
+type cmdSIsMember struct{}
+type cmdSMIsMember struct{}
+type cmdSCard struct{}
+type cmdSMembers struct{}
+type cmdSPop struct{}
+type cmdSRandMember struct{}
+type cmdSMove struct{}
+type cmdSInter struct{}
+type cmdSInterStore struct{}
+type cmdSInterCard struct{}
+type cmdSUnion struct{}
+type cmdSUnionStore struct{}
+type cmdSDiff struct{}
+type cmdSDiffStore struct{}
+type cmdSScan struct{}
+
+// A set is encoded as an intset while all its members are integers, and is
+// converted to a dict whose keys are the members when a non integer member
+// is added, or when it grows beyond setMaxIntsetEntries.
+
+// isIntsetMember returns the integer value of s if it can be stored in an
+// intset without changing its string representation.
+func isIntsetMember(s string) (int64, bool) {
+	return dt.StringToInt64(s)
+}
+
+// setTypeCreate returns a set object with an encoding able to hold value.
+func setTypeCreate(value string) *dt.Object {
+	if _, ok := isIntsetMember(value); ok {
+		return dt.NewIntsetObject()
+	}
+	return dt.NewSet()
+}
+
+func setTypeSize(o *dt.Object) int64 {
+	if o.Encoding == dt.ObjEncodingIntset {
+		return int64(o.Ptr.(*dt.Intset).Len())
+	}
+	return o.Ptr.(*dt.Dict).Used()
+}
+
+// setTypeAdd adds the member, and returns false if it already exists.
+func setTypeAdd(o *dt.Object, member string) bool {
+	if o.Encoding == dt.ObjEncodingIntset {
+		v, ok := isIntsetMember(member)
+		if ok {
+			is := o.Ptr.(*dt.Intset)
+			if !is.Add(v) {
+				return false
+			}
+			if is.Len() > godisServer.setMaxIntsetEntries {
+				setTypeConvert(o)
+			}
+			return true
+		}
+		setTypeConvert(o)
+	}
+
+	d := o.Ptr.(*dt.Dict)
+	if d.Get(member) != nil {
+		return false
+	}
+	d.Add(member, nil)
+	return true
+}
+
+func setTypeRemove(o *dt.Object, member string) bool {
+	if o.Encoding == dt.ObjEncodingIntset {
+		v, ok := isIntsetMember(member)
+		return ok && o.Ptr.(*dt.Intset).Remove(v)
+	}
+
+	d := o.Ptr.(*dt.Dict)
+	if d.Get(member) == nil {
+		return false
+	}
+	d.Delete(member)
+	return true
+}
+
+func setTypeIsMember(o *dt.Object, member string) bool {
+	if o.Encoding == dt.ObjEncodingIntset {
+		v, ok := isIntsetMember(member)
+		return ok && o.Ptr.(*dt.Intset).Find(v)
+	}
+	return o.Ptr.(*dt.Dict).Get(member) != nil
+}
+
+// setTypeIterate calls fn for every member of the set until fn returns false.
+func setTypeIterate(o *dt.Object, fn func(member string) bool) {
+	if o.Encoding == dt.ObjEncodingIntset {
+		o.Ptr.(*dt.Intset).Iterate(func(v int64) bool {
+			return fn(strconv.FormatInt(v, 10))
+		})
+		return
+	}
+
+	o.Ptr.(*dt.Dict).Iterate(func(de *dt.Entry) bool {
+		return fn(de.Key)
+	})
+}
+
+func setTypeMembers(o *dt.Object) []string {
+	members := make([]string, 0, setTypeSize(o))
+	setTypeIterate(o, func(member string) bool {
+		members = append(members, member)
+		return true
+	})
+	return members
+}
+
+func setTypeRandomElement(o *dt.Object) string {
+	if o.Encoding == dt.ObjEncodingIntset {
+		return strconv.FormatInt(o.Ptr.(*dt.Intset).Random(), 10)
+	}
+	return o.Ptr.(*dt.Dict).RandomEntry().Key
+}
+
+func setTypeConvert(o *dt.Object) {
+	d := dt.NewDict()
+	setTypeIterate(o, func(member string) bool {
+		d.Add(member, nil)
+		return true
+	})
+	o.Ptr = d
+	o.Encoding = dt.ObjEncodingHt
+}
+
+// SADD key member [member ...]
+func (*cmdSAdd) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		o = setTypeCreate(r.ArgvAt(2))
+		c.db.Add(key, o)
+	} else if o.ObjType != dt.ObjSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	var added int64
+	for i := 2; i < r.ArgCount(); i++ {
+		if setTypeAdd(o, r.ArgvAt(i)) {
+			added++
+		}
+	}
+	c.db.elements += added
+	if added > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifySet, "sadd", key, c.db.id)
+	}
+	godisServer.dirty += added
+	return c.ReplyInt(added)
+}
+
+// SREM key member [member ...]
+func (*cmdSRem) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	var deleted int64
+	for i := 2; i < r.ArgCount(); i++ {
+		if setTypeRemove(o, r.ArgvAt(i)) {
+			deleted++
+		}
+	}
+	c.db.elements -= deleted
+	if deleted > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifySet, "srem", key, c.db.id)
+	}
+	if setTypeSize(o) == 0 {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+	}
+	godisServer.dirty += deleted
+	return c.ReplyInt(deleted)
+}
+
+func (*cmdSIsMember) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	if setTypeIsMember(o, r.ArgvAt(2)) {
+		return c.ReplyInt(1)
+	}
+	return c.ReplyInt(0)
+}
+
+// SMISMEMBER key member [member ...]
+func (*cmdSMIsMember) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	values := make([]interface{}, 0, r.ArgCount()-2)
+	for i := 2; i < r.ArgCount(); i++ {
+		if o != nil && setTypeIsMember(o, r.ArgvAt(i)) {
+			values = append(values, int64(1))
+		} else {
+			values = append(values, int64(0))
+		}
+	}
+	return c.ReplyBulk(values...)
+}
+
+func (*cmdSCard) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+	return c.ReplyInt(setTypeSize(o))
+}
+
+func (*cmdSMembers) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplySet(nil)
+	}
+	if o.ObjType != dt.ObjSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+	return c.ReplySet(setTypeMembers(o))
+}
+
+// SPOP key [count]
+func (*cmdSPop) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	if argc != 2 && argc != 3 {
+		return c.ReplyError("wrong number of arguments for 'spop' command")
+	}
+
+	count := int64(1)
+	if argc == 3 {
+		n, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+		if err != nil || n < 0 {
+			return c.ReplyError("value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		if argc == 2 {
+			return c.ReplyEmpty()
+		}
+		return c.ReplyList(nil)
+	}
+	if o.ObjType != dt.ObjSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	var popped []string
+	for ; count > 0 && setTypeSize(o) > 0; count-- {
+		member := setTypeRandomElement(o)
+		setTypeRemove(o, member)
+		popped = append(popped, member)
+	}
+
+	n := int64(len(popped))
+	c.db.elements -= n
+	if n > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifySet, "spop", key, c.db.id)
+	}
+	if setTypeSize(o) == 0 {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+	}
+	godisServer.dirty += n
+
+	// the popped members are random, so replicate them as SREM commands
+	// to make sure the AOF is replayed with the same result.
+	for i := 0; i < len(popped); i += AOFRewriteItemsPerCmd {
+		j := i + AOFRewriteItemsPerCmd
+		if j > len(popped) {
+			j = len(popped)
+		}
+		c.propagate(append([]string{CmdNameSRem, key}, popped[i:j]...)...)
+	}
+
+	if argc == 2 {
+		if n == 0 {
+			return c.ReplyEmpty()
+		}
+		return c.ReplyBulkString(popped[0])
+	}
+	return c.ReplyList(popped)
+}
+
+// SRANDMEMBER key [count]
+func (*cmdSRandMember) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	if argc != 2 && argc != 3 {
+		return c.ReplyError("wrong number of arguments for 'srandmember' command")
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	if argc == 2 {
+		if o == nil {
+			return c.ReplyEmpty()
+		}
+		return c.ReplyBulkString(setTypeRandomElement(o))
+	}
+
+	count, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+	if o == nil || count == 0 {
+		return c.ReplyList(nil)
+	}
+
+	var list []string
+
+	// a negative count allows the same member to be returned multiple times
+	if count < 0 {
+		for i := count; i < 0; i++ {
+			list = append(list, setTypeRandomElement(o))
+		}
+		return c.ReplyList(list)
+	}
+
+	size := setTypeSize(o)
+	if count*3 > size || o.Encoding == dt.ObjEncodingIntset {
+		members := setTypeMembers(o)
+		if count > size {
+			count = size
+		}
+		for i := int64(0); i < count; i++ {
+			j := i + rand.Int63n(size-i)
+			members[i], members[j] = members[j], members[i]
+		}
+		return c.ReplyList(members[:count])
+	}
+
+	// the count is small compared to the size of the set, pick random
+	// members until we have enough distinct ones.
+	picked := make(map[string]bool, count)
+	for int64(len(picked)) < count {
+		member := setTypeRandomElement(o)
+		if !picked[member] {
+			picked[member] = true
+			list = append(list, member)
+		}
+	}
+	return c.ReplyList(list)
+}
+
+// SMOVE source destination member
+func (*cmdSMove) Exec(c *Client, r *protocol.Request) error {
+	srckey, dstkey, member := r.ArgvAt(1), r.ArgvAt(2), r.ArgvAt(3)
+	src := c.db.Get(srckey)
+	dst := c.db.Get(dstkey)
+	if src == nil {
+		return c.ReplyInt(0)
+	}
+	if src.ObjType != dt.ObjSet || (dst != nil && dst.ObjType != dt.ObjSet) {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	// if source and destination are the same set, SMOVE is a no-op
+	if src == dst {
+		if setTypeIsMember(src, member) {
+			return c.ReplyInt(1)
+		}
+		return c.ReplyInt(0)
+	}
+
+	if !setTypeRemove(src, member) {
+		return c.ReplyInt(0)
+	}
+	c.db.elements--
+	notifyKeyspaceEvent(NotifySet, "srem", srckey, c.db.id)
+	if setTypeSize(src) == 0 {
+		c.db.deleteKey(srckey)
+		notifyKeyspaceEvent(NotifyGeneric, "del", srckey, c.db.id)
+	}
+
+	if dst == nil {
+		dst = setTypeCreate(member)
+		c.db.Add(dstkey, dst)
+	}
+	if setTypeAdd(dst, member) {
+		c.db.elements++
+		notifyKeyspaceEvent(NotifySet, "sadd", dstkey, c.db.id)
+	}
+	signalModifiedKey(c.db, srckey)
+	signalModifiedKey(c.db, dstkey)
+	godisServer.dirty++
+	return c.ReplyInt(1)
+}
+
+// lookupSets returns the sets stored at keys, with nil for the missing ones.
+func lookupSets(c *Client, keys []string) ([]*dt.Object, bool) {
+	sets := make([]*dt.Object, len(keys))
+	for i, key := range keys {
+		o := c.db.Get(key)
+		if o != nil && o.ObjType != dt.ObjSet {
+			return nil, false
+		}
+		sets[i] = o
+	}
+	return sets, true
+}
+
+// storeSetResult stores the members at dstkey, replacing the old value,
+// and replies with the size of the new set. The event is the one notified
+// when the set isn't empty.
+func storeSetResult(c *Client, dstkey string, members []string, event string) error {
+	if len(members) == 0 {
+		if c.db.Get(dstkey) != nil {
+			c.db.deleteKey(dstkey)
+			signalModifiedKey(c.db, dstkey)
+			notifyKeyspaceEvent(NotifyGeneric, "del", dstkey, c.db.id)
+			godisServer.dirty++
+		}
+		return c.ReplyInt(0)
+	}
+
+	o := setTypeCreate(members[0])
+	for _, member := range members {
+		setTypeAdd(o, member)
+	}
+	c.db.Set(dstkey, o)
+	signalModifiedKey(c.db, dstkey)
+	notifyKeyspaceEvent(NotifySet, event, dstkey, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(setTypeSize(o))
+}
+
+// sinterGeneric returns the members of the intersection of the sets,
+// stopping once limit members are found when limit is positive.
+func sinterGeneric(sets []*dt.Object, limit int64) []string {
+	for _, o := range sets {
+		if o == nil {
+			return nil
+		}
+	}
+
+	// iterate the smallest set, checking every member against the others
+	sorted := append([]*dt.Object(nil), sets...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return setTypeSize(sorted[i]) < setTypeSize(sorted[j])
+	})
+
+	var members []string
+	setTypeIterate(sorted[0], func(member string) bool {
+		for _, o := range sorted[1:] {
+			if !setTypeIsMember(o, member) {
+				return true
+			}
+		}
+		members = append(members, member)
+		return limit <= 0 || int64(len(members)) < limit
+	})
+	return members
+}
+
+const (
+	setOpUnion = iota
+	setOpDiff
+)
+
+func sunionDiffGeneric(sets []*dt.Object, op int) []string {
+	var members []string
+	seen := make(map[string]bool)
+	add := func(member string) {
+		if !seen[member] {
+			seen[member] = true
+			members = append(members, member)
+		}
+	}
+
+	switch op {
+	case setOpUnion:
+		for _, o := range sets {
+			if o != nil {
+				setTypeIterate(o, func(member string) bool {
+					add(member)
+					return true
+				})
+			}
+		}
+	case setOpDiff:
+		if sets[0] == nil {
+			return nil
+		}
+		setTypeIterate(sets[0], func(member string) bool {
+			for _, o := range sets[1:] {
+				if o != nil && setTypeIsMember(o, member) {
+					return true
+				}
+			}
+			add(member)
+			return true
+		})
+	}
+	return members
+}
+
+// setOpGenericCommand implements SINTER, SUNION, SDIFF and their STORE
+// variants, the source keys start at the i-th argument.
+func setOpGenericCommand(c *Client, r *protocol.Request, i int, op func([]*dt.Object) []string) error {
+	if r.ArgCount() < i+1 {
+		return c.ReplyError("wrong number of arguments for '" + strings.ToLower(r.CommandName()) + "' command")
+	}
+
+	sets, ok := lookupSets(c, r.Argv()[i:])
+	if !ok {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	members := op(sets)
+	if i == 2 {
+		return storeSetResult(c, r.ArgvAt(1), members, strings.ToLower(r.CommandName()))
+	}
+	return c.ReplySet(members)
+}
+
+func sinter(sets []*dt.Object) []string {
+	return sinterGeneric(sets, 0)
+}
+
+func sunion(sets []*dt.Object) []string {
+	return sunionDiffGeneric(sets, setOpUnion)
+}
+
+func sdiff(sets []*dt.Object) []string {
+	return sunionDiffGeneric(sets, setOpDiff)
+}
+
+func (*cmdSInter) Exec(c *Client, r *protocol.Request) error {
+	return setOpGenericCommand(c, r, 1, sinter)
+}
+
+func (*cmdSInterStore) Exec(c *Client, r *protocol.Request) error {
+	return setOpGenericCommand(c, r, 2, sinter)
+}
+
+func (*cmdSUnion) Exec(c *Client, r *protocol.Request) error {
+	return setOpGenericCommand(c, r, 1, sunion)
+}
+
+func (*cmdSUnionStore) Exec(c *Client, r *protocol.Request) error {
+	return setOpGenericCommand(c, r, 2, sunion)
+}
+
+func (*cmdSDiff) Exec(c *Client, r *protocol.Request) error {
+	return setOpGenericCommand(c, r, 1, sdiff)
+}
+
+func (*cmdSDiffStore) Exec(c *Client, r *protocol.Request) error {
+	return setOpGenericCommand(c, r, 2, sdiff)
+}
+
+// SINTERCARD numkeys key [key ...] [LIMIT limit]
+func (*cmdSInterCard) Exec(c *Client, r *protocol.Request) error {
+	numkeys, err := strconv.ParseInt(r.ArgvAt(1), 10, 64)
+	if err != nil || numkeys <= 0 {
+		return c.ReplyError("numkeys should be greater than 0")
+	}
+	if numkeys > int64(r.ArgCount()-2) {
+		return c.ReplyError("Number of keys can't be greater than number of args")
+	}
+
+	var limit int64
+	for i := 2 + int(numkeys); i < r.ArgCount(); i++ {
+		if strings.EqualFold(r.ArgvAt(i), "limit") && i+1 < r.ArgCount() {
+			limit, err = strconv.ParseInt(r.ArgvAt(i+1), 10, 64)
+			if err != nil || limit < 0 {
+				return c.ReplyError("LIMIT can't be negative")
+			}
+			i++
+		} else {
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+
+	sets, ok := lookupSets(c, r.Argv()[2:2+numkeys])
+	if !ok {
+		return c.ReplyError(ReplyWrongType)
+	}
+	return c.ReplyInt(int64(len(sinterGeneric(sets, limit))))
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func (*cmdSScan) Exec(c *Client, r *protocol.Request) error {
+	cursor, err := parseScanCursor(r.ArgvAt(2))
+	if err != nil {
+		return c.ReplyError("invalid cursor")
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if o == nil {
+		return c.ReplyBulk("0", []string{})
+	}
+	return scanGenericCommand(c, r, o, cursor, 3)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/kzinglzy/godis/dt"
+)
+
+// snapshotEntry is a point-in-time copy of a key, used to persist the
+// keyspace in background without blocking the event loop.
+type snapshotEntry struct {
+	db     int
+	key    string
+	val    *dt.Object
+	expire int64
+}
+
+// keyspaceSnapshot is a point-in-time copy of the keyspace, made by the
+// event loop a batch of keys per loop rather than all at once, for BGSAVE
+// and BGREWRITEAOF. A key not copied yet is copied right before it's first
+// modified, deleted or created, so that the loop only pays for the keys it
+// touches. The copies are queued to the goroutine writing them.
+type keyspaceSnapshot struct {
+	dbs []*dbSnapshot
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*snapshotEntry
+	closed  bool // every key is queued
+	stopped bool // the writer is gone, the copies are dropped
+}
+
+// dbSnapshot is the copy in progress of a database. It follows the dicts
+// of the database at the start rather than the database, as FLUSHDB and
+// SWAPDB replace them.
+type dbSnapshot struct {
+	id      int
+	store   *dt.Dict
+	expires *dt.Dict
+	cursor  uint64
+	done    bool
+
+	// the keys copied, or created since the start, which the scan of the
+	// store skips. It grows up to the number of keys of the database, and
+	// is released once the scan is done.
+	copied map[string]bool
+}
+
+// newKeyspaceSnapshot starts the snapshot of the databases, the i-th one
+// is copied as the database i.
+func newKeyspaceSnapshot(dbs []*Database) *keyspaceSnapshot {
+	ks := &keyspaceSnapshot{}
+	ks.cond = sync.NewCond(&ks.mu)
+	for id, db := range dbs {
+		if db == nil {
+			continue
+		}
+		ks.dbs = append(ks.dbs, &dbSnapshot{
+			id:      id,
+			store:   db.store,
+			expires: db.expires,
+			copied:  make(map[string]bool),
+		})
+	}
+	return ks
+}
+
+// snapshotDatabases copies the databases at once, for the synchronous saves.
+func snapshotDatabases(dbs ...*Database) *keyspaceSnapshot {
+	ks := newKeyspaceSnapshot(dbs)
+	for !ks.step(SnapshotKeysPerLoop) {
+	}
+	ks.close()
+	return ks
+}
+
+// step visits about count keys, copying the ones not copied yet, and
+// returns true once every key is copied. The empty buckets visited are
+// bounded to 10 times count, like SCAN does.
+func (ks *keyspaceSnapshot) step(count int) bool {
+	emptyVisits := count * 10
+	for _, sdb := range ks.dbs {
+		for !sdb.done && count > 0 && emptyVisits > 0 {
+			visited := count
+			sdb.cursor = sdb.store.Scan(sdb.cursor, func(de *dt.Entry) {
+				if !sdb.copied[de.Key] {
+					sdb.copied[de.Key] = true
+					ks.copyEntry(sdb, de)
+				}
+				count--
+			})
+			if visited == count {
+				emptyVisits--
+			}
+			if sdb.cursor == 0 {
+				sdb.done = true
+				sdb.copied = nil
+			}
+		}
+		if !sdb.done {
+			return false
+		}
+	}
+	return true
+}
+
+// copyKey copies the key unless it was already, before it's modified.
+func (ks *keyspaceSnapshot) copyKey(sdb *dbSnapshot, key string) {
+	if sdb.done || sdb.copied[key] {
+		return
+	}
+	sdb.copied[key] = true
+	if de := sdb.store.Get(key); de != nil {
+		ks.copyEntry(sdb, de)
+	}
+}
+
+func (ks *keyspaceSnapshot) copyEntry(sdb *dbSnapshot, de *dt.Entry) {
+	expire := int64(-1)
+	if e := sdb.expires.Get(de.Key); e != nil {
+		expire = e.Value.(int64)
+	}
+	if expire != -1 && expire < mstime() {
+		return
+	}
+
+	entry := &snapshotEntry{db: sdb.id, key: de.Key, val: de.Value.(*dt.Object).Dup(), expire: expire}
+	ks.mu.Lock()
+	if !ks.stopped {
+		ks.queue = append(ks.queue, entry)
+		ks.cond.Signal()
+	}
+	ks.mu.Unlock()
+}
+
+func (ks *keyspaceSnapshot) close() {
+	ks.mu.Lock()
+	ks.closed = true
+	ks.cond.Broadcast()
+	ks.mu.Unlock()
+}
+
+// stop drops the copies not written, when the writer returns early.
+func (ks *keyspaceSnapshot) stop() {
+	ks.mu.Lock()
+	ks.stopped = true
+	ks.queue = nil
+	ks.mu.Unlock()
+}
+
+// next returns the next copy to write, waiting for it if needed, or false
+// once every key is written.
+func (ks *keyspaceSnapshot) next() (*snapshotEntry, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for len(ks.queue) == 0 && !ks.closed {
+		ks.cond.Wait()
+	}
+	if len(ks.queue) == 0 {
+		return nil, false
+	}
+	entry := ks.queue[0]
+	ks.queue[0] = nil
+	ks.queue = ks.queue[1:]
+	return entry, true
+}
+
+// startSnapshot starts a snapshot of the keyspace copied in background.
+func (s *Server) startSnapshot() *keyspaceSnapshot {
+	ks := newKeyspaceSnapshot(s.db)
+	s.snapshots = append(s.snapshots, ks)
+	return ks
+}
+
+// snapshotCron copies a batch of keys for every snapshot in progress.
+func (s *Server) snapshotCron() {
+	active := s.snapshots[:0]
+	for _, ks := range s.snapshots {
+		if ks.step(SnapshotKeysPerLoop) {
+			ks.close()
+		} else {
+			active = append(active, ks)
+		}
+	}
+	s.snapshots = active
+}
+
+// snapshotKey is called before the key of db is modified, deleted or
+// created, so that the snapshots in progress copy it first.
+func (s *Server) snapshotKey(db *Database, key string) {
+	for _, ks := range s.snapshots {
+		for _, sdb := range ks.dbs {
+			if sdb.store == db.store {
+				ks.copyKey(sdb, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,1498 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdXAdd struct{}
+type cmdXLen struct{}
+type cmdXRange struct{}
+type cmdXRevRange struct{}
+type cmdXRead struct{}
+type cmdXDel struct{}
+type cmdXTrim struct{}
+type cmdXSetID struct{}
+type cmdXGroup struct{}
+type cmdXReadGroup struct{}
+type cmdXAck struct{}
+type cmdXPending struct{}
+type cmdXClaim struct{}
+type cmdXAutoClaim struct{}
+type cmdXInfo struct{}
+
+const replyInvalidStreamID = "Invalid stream ID specified as stream command argument"
+
+// getStream returns the stream of the key, or an error message if the key
+// isn't a stream.
+func getStream(c *Client, key string) (*dt.Stream, string) {
+	o := c.db.Get(key)
+	if o == nil {
+		return nil, ""
+	}
+	if o.ObjType != dt.ObjStream {
+		return nil, ReplyWrongType
+	}
+	return o.Ptr.(*dt.Stream), ""
+}
+
+// parseStreamID parses an ID as ms-seq, or as ms alone with missingSeq as
+// the sequence number. Unless strict, "-" and "+" are the smallest and the
+// largest IDs.
+func parseStreamID(s string, strict bool, missingSeq uint64) (dt.StreamID, bool) {
+	if !strict {
+		switch s {
+		case "-":
+			return dt.StreamID{}, true
+		case "+":
+			return dt.MaxStreamID, true
+		}
+	}
+
+	var id dt.StreamID
+	var err error
+	ms, seq := s, ""
+	i := strings.IndexByte(s, '-')
+	if i >= 0 {
+		ms, seq = s[:i], s[i+1:]
+	}
+	if id.Ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return id, false
+	}
+	if i < 0 {
+		id.Seq = missingSeq
+		return id, true
+	}
+	id.Seq, err = strconv.ParseUint(seq, 10, 64)
+	return id, err == nil
+}
+
+// parseIntervalID parses the start or the end of a range of IDs, which is
+// excluded when prefixed with "(". The error message is empty on success.
+func parseIntervalID(s string, missingSeq uint64, start bool) (dt.StreamID, string) {
+	exclude := len(s) > 1 && s[0] == '('
+	if !exclude {
+		id, ok := parseStreamID(s, false, missingSeq)
+		if !ok {
+			return id, replyInvalidStreamID
+		}
+		return id, ""
+	}
+
+	id, ok := parseStreamID(s[1:], true, missingSeq)
+	if !ok {
+		return id, replyInvalidStreamID
+	}
+	if start {
+		if id, ok = id.Incr(); !ok {
+			return id, "invalid start ID for the interval"
+		}
+	} else if id, ok = id.Decr(); !ok {
+		return id, "invalid end ID for the interval"
+	}
+	return id, ""
+}
+
+// parseStreamIDs parses the IDs of argv strictly.
+func parseStreamIDs(argv []string) ([]dt.StreamID, bool) {
+	ids := make([]dt.StreamID, len(argv))
+	for i, arg := range argv {
+		id, ok := parseStreamID(arg, true, 0)
+		if !ok {
+			return nil, false
+		}
+		ids[i] = id
+	}
+	return ids, true
+}
+
+// streamEntryReply returns the reply of an entry, as its ID followed by
+// its field, value pairs.
+func streamEntryReply(id dt.StreamID, fields []string) []interface{} {
+	fv := make([]interface{}, len(fields))
+	for i, f := range fields {
+		fv[i] = f
+	}
+	return []interface{}{id.String(), fv}
+}
+
+// streamRangeReply returns the entries from start to end, at most count
+// of them unless count is 0.
+func streamRangeReply(s *dt.Stream, start, end dt.StreamID, rev bool, count int64) []interface{} {
+	entries := []interface{}{}
+	s.Range(start, end, rev, func(id dt.StreamID, fields []string) bool {
+		entries = append(entries, streamEntryReply(id, fields))
+		return count == 0 || int64(len(entries)) < count
+	})
+	return entries
+}
+
+// trimming strategies
+const (
+	trimNone = iota
+	trimMaxLen
+	trimMinID
+)
+
+// streamAddTrimArgs are the options of XADD and XTRIM.
+type streamAddTrimArgs struct {
+	strategy int
+	maxlen   int64
+	minid    dt.StreamID
+	approx   bool
+	limit    int64 // the maximum number of entries to trim, or 0
+	valueIdx int   // the index of the MAXLEN or MINID threshold
+
+	// XADD only
+	nomkstream bool
+	idIdx      int
+}
+
+// parseStreamAddTrimArgs parses the options following the key of XADD or
+// XTRIM, XADD stops at the ID of the entry. The error message is empty on
+// success.
+func parseStreamAddTrimArgs(c *Client, r *protocol.Request, xadd bool) (*streamAddTrimArgs, string) {
+	args := &streamAddTrimArgs{}
+	limitGiven := false
+
+	i := 2
+loop:
+	for ; i < r.ArgCount(); i++ {
+		moreargs := r.ArgCount() - 1 - i
+		opt := r.ArgvAt(i)
+		switch {
+		case xadd && opt == "*":
+			break loop
+		case (strings.EqualFold(opt, "maxlen") || strings.EqualFold(opt, "minid")) && moreargs > 0:
+			if args.strategy != trimNone {
+				return nil, "syntax error, MAXLEN and MINID options at the same time are not compatible"
+			}
+			args.approx = false
+			if next := r.ArgvAt(i + 1); moreargs >= 2 && (next == "~" || next == "=") {
+				args.approx = next == "~"
+				i++
+			}
+			i++
+			args.valueIdx = i
+
+			if strings.EqualFold(opt, "maxlen") {
+				maxlen, err := strconv.ParseInt(r.ArgvAt(i), 10, 64)
+				if err != nil {
+					return nil, ReplyNotInteger
+				}
+				if maxlen < 0 {
+					return nil, "The MAXLEN argument must be >= 0."
+				}
+				args.strategy, args.maxlen = trimMaxLen, maxlen
+			} else {
+				minid, ok := parseStreamID(r.ArgvAt(i), true, 0)
+				if !ok {
+					return nil, replyInvalidStreamID
+				}
+				args.strategy, args.minid = trimMinID, minid
+			}
+		case strings.EqualFold(opt, "limit") && moreargs > 0:
+			i++
+			limit, err := strconv.ParseInt(r.ArgvAt(i), 10, 64)
+			if err != nil {
+				return nil, ReplyNotInteger
+			}
+			if limit < 0 {
+				return nil, "The LIMIT argument must be >= 0."
+			}
+			args.limit, limitGiven = limit, true
+		case xadd && strings.EqualFold(opt, "nomkstream"):
+			args.nomkstream = true
+		case xadd:
+			// the first argument which isn't an option is the ID
+			break loop
+		default:
+			return nil, ReplySyntaxErr
+		}
+	}
+	args.idIdx = i
+
+	if args.limit > 0 && args.strategy == trimNone {
+		return nil, "syntax error, LIMIT cannot be used without specifying a trimming strategy"
+	}
+	if !xadd && args.strategy == trimNone {
+		return nil, "syntax error, XTRIM must be called with a trimming strategy"
+	}
+
+	// the commands of the AOF are replayed exactly as they were executed
+	if c.fake {
+		args.limit = 0
+	} else if limitGiven {
+		if !args.approx {
+			return nil, "syntax error, LIMIT cannot be used without the special ~ option"
+		}
+	} else if args.approx {
+		args.limit = 100 * int64(godisServer.streamNodeMaxEntries)
+		if args.limit <= 0 || args.limit > 1000000 {
+			args.limit = 1000000
+		}
+	}
+	return args, ""
+}
+
+// trim trims the stream, and returns the number of entries removed.
+func (args *streamAddTrimArgs) trim(s *dt.Stream) int64 {
+	switch args.strategy {
+	case trimMaxLen:
+		return s.TrimByLen(args.maxlen, args.approx, args.limit)
+	case trimMinID:
+		return s.TrimByID(args.minid, args.approx, args.limit)
+	}
+	return 0
+}
+
+// rewriteApprox replaces an approximated trimming in argv by the exact
+// trimming it amounted to, since the stream may be split in other blocks
+// when the command is replayed.
+func (args *streamAddTrimArgs) rewriteApprox(argv []string, s *dt.Stream) {
+	if !args.approx {
+		return
+	}
+	argv[args.valueIdx-1] = "="
+	if args.strategy == trimMaxLen {
+		argv[args.valueIdx] = strconv.FormatInt(s.Len(), 10)
+	} else if s.Len() > 0 {
+		argv[args.valueIdx] = s.FirstID.String()
+	}
+}
+
+// streamAddID returns the ID of a new entry of a stream whose last ID is
+// last: the given id, or an ID generated from the current time when autoID
+// is set, or from the ms of id when autoSeq is set. It fails if the ID
+// isn't greater than last.
+func streamAddID(last, id dt.StreamID, autoID, autoSeq bool) (dt.StreamID, bool) {
+	switch {
+	case autoID:
+		if ms := uint64(mstime()); ms > last.Ms {
+			return dt.StreamID{Ms: ms}, true
+		}
+		return last.Incr()
+	case autoSeq && id.Ms == last.Ms:
+		if last.Seq == math.MaxUint64 {
+			return id, false
+		}
+		return dt.StreamID{Ms: id.Ms, Seq: last.Seq + 1}, true
+	}
+	return id, id.Compare(last) > 0
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func (*cmdXAdd) Exec(c *Client, r *protocol.Request) error {
+	args, msg := parseStreamAddTrimArgs(c, r, true)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if n := r.ArgCount() - args.idIdx - 1; n < 2 || n%2 != 0 {
+		return c.ReplyError("wrong number of arguments for 'xadd' command")
+	}
+
+	idarg := r.ArgvAt(args.idIdx)
+	autoID := idarg == "*"
+	autoSeq := !autoID && strings.HasSuffix(idarg, "-*")
+	var id dt.StreamID
+	switch {
+	case autoSeq:
+		ms, err := strconv.ParseUint(strings.TrimSuffix(idarg, "-*"), 10, 64)
+		if err != nil {
+			return c.ReplyError(replyInvalidStreamID)
+		}
+		id.Ms = ms
+	case !autoID:
+		var ok bool
+		if id, ok = parseStreamID(idarg, true, 0); !ok {
+			return c.ReplyError(replyInvalidStreamID)
+		}
+		if id.IsZero() {
+			return c.ReplyError("The ID specified in XADD must be greater than 0-0")
+		}
+	}
+
+	key := r.ArgvAt(1)
+	s, msg := getStream(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if s == nil {
+		if args.nomkstream {
+			return c.ReplyEmpty()
+		}
+		o := dt.NewStreamObject()
+		c.db.Add(key, o)
+		s = o.Ptr.(*dt.Stream)
+	}
+
+	if s.LastID == dt.MaxStreamID {
+		return c.ReplyError("The stream has exhausted the last possible ID, unable to add more items")
+	}
+	id, ok := streamAddID(s.LastID, id, autoID, autoSeq)
+	if !ok {
+		return c.ReplyError("The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	s.Append(id, r.Argv()[args.idIdx+1:], godisServer.streamNodeMaxBytes, godisServer.streamNodeMaxEntries)
+	c.db.elements++
+	trimmed := args.trim(s)
+	c.db.elements -= trimmed
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyStream, "xadd", key, c.db.id)
+	if trimmed > 0 {
+		notifyKeyspaceEvent(NotifyStream, "xtrim", key, c.db.id)
+	}
+	godisServer.dirty++
+	signalKeyAsReady(c.db, key)
+
+	// propagate the ID and the trimming which were actually used
+	argv := r.Argv()
+	argv[args.idIdx] = id.String()
+	args.rewriteApprox(argv, s)
+	c.propagate(argv...)
+
+	return c.ReplyBulkString(id.String())
+}
+
+// XLEN key
+func (*cmdXLen) Exec(c *Client, r *protocol.Request) error {
+	s, msg := getStream(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if s == nil {
+		return c.ReplyInt(0)
+	}
+	return c.ReplyInt(s.Len())
+}
+
+func (*cmdXRange) Exec(c *Client, r *protocol.Request) error {
+	return xrangeGenericCommand(c, r, false)
+}
+
+func (*cmdXRevRange) Exec(c *Client, r *protocol.Request) error {
+	return xrangeGenericCommand(c, r, true)
+}
+
+// XRANGE key start end [COUNT count]
+// XREVRANGE key end start [COUNT count]
+func xrangeGenericCommand(c *Client, r *protocol.Request, rev bool) error {
+	startarg, endarg := r.ArgvAt(2), r.ArgvAt(3)
+	if rev {
+		startarg, endarg = endarg, startarg
+	}
+	start, msg := parseIntervalID(startarg, 0, true)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	end, msg := parseIntervalID(endarg, math.MaxUint64, false)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	count := int64(-1)
+	for i := 4; i < r.ArgCount(); i++ {
+		if !strings.EqualFold(r.ArgvAt(i), "count") || i+1 == r.ArgCount() {
+			return c.ReplyError(ReplySyntaxErr)
+		}
+		i++
+		n, err := strconv.ParseInt(r.ArgvAt(i), 10, 64)
+		if err != nil {
+			return c.ReplyError(ReplyNotInteger)
+		}
+		if n < 0 {
+			n = 0
+		}
+		count = n
+	}
+
+	s, msg := getStream(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if s == nil {
+		return c.ReplyList(nil)
+	}
+	if count == 0 {
+		return c.ReplyNullArray()
+	}
+	if count < 0 {
+		count = 0
+	}
+	return c.ReplyBulk(streamRangeReply(s, start, end, rev, count)...)
+}
+
+func (*cmdXRead) Exec(c *Client, r *protocol.Request) error {
+	return xreadGenericCommand(c, r, false)
+}
+
+func (*cmdXReadGroup) Exec(c *Client, r *protocol.Request) error {
+	return xreadGenericCommand(c, r, true)
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func xreadGenericCommand(c *Client, r *protocol.Request, xreadgroup bool) error {
+	name := strings.ToLower(r.CommandName())
+	if r.ArgCount() < 4 || (xreadgroup && r.ArgCount() < 7) {
+		return c.ReplyError("wrong number of arguments for '" + name + "' command")
+	}
+
+	var groupname, consumername string
+	var count, timeout int64
+	grouped, noack, block := false, false, false
+	streamsArg := 0
+	for i := 1; i < r.ArgCount() && streamsArg == 0; i++ {
+		moreargs := r.ArgCount() - 1 - i
+		opt := r.ArgvAt(i)
+		switch {
+		case strings.EqualFold(opt, "block") && moreargs > 0:
+			i++
+			var err error
+			if timeout, err = parseBlockTimeout(r.ArgvAt(i)); err != nil {
+				return c.ReplyError(err.Error())
+			}
+			block = true
+		case strings.EqualFold(opt, "count") && moreargs > 0:
+			i++
+			n, err := strconv.ParseInt(r.ArgvAt(i), 10, 64)
+			if err != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			if n < 0 {
+				n = 0
+			}
+			count = n
+		case strings.EqualFold(opt, "streams") && moreargs > 0:
+			streamsArg = i + 1
+			if (r.ArgCount()-streamsArg)%2 != 0 {
+				return c.ReplyError("Unbalanced '" + name + "' list of streams: for each stream key an ID or '$' must be specified.")
+			}
+		case xreadgroup && strings.EqualFold(opt, "group") && moreargs >= 2:
+			groupname, consumername = r.ArgvAt(i+1), r.ArgvAt(i+2)
+			grouped = true
+			i += 2
+		case xreadgroup && strings.EqualFold(opt, "noack"):
+			noack = true
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+	if streamsArg == 0 {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+	if xreadgroup && !grouped {
+		return c.ReplyError("Missing GROUP option for XREADGROUP")
+	}
+
+	n := (r.ArgCount() - streamsArg) / 2
+	keys := r.Argv()[streamsArg : streamsArg+n]
+	streams := make([]*dt.Stream, n)
+	groups := make([]*dt.StreamCG, n)
+	ids := make([]dt.StreamID, n)
+	history := make([]bool, n)
+	for i, key := range keys {
+		s, msg := getStream(c, key)
+		if msg != "" {
+			return c.ReplyError(msg)
+		}
+		streams[i] = s
+		if xreadgroup {
+			if s != nil {
+				groups[i] = s.Group(groupname)
+			}
+			if groups[i] == nil {
+				return c.ReplyError("NOGROUP No such key '" + key + "' or consumer group '" + groupname + "' in XREADGROUP with GROUP option")
+			}
+		}
+
+		switch arg := r.ArgvAt(streamsArg + n + i); arg {
+		case "$":
+			if xreadgroup {
+				return c.ReplyError("The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+			}
+			if s != nil {
+				ids[i] = s.LastID
+			}
+		case ">":
+			if !xreadgroup {
+				return c.ReplyError("The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+			}
+		default:
+			id, ok := parseStreamID(arg, true, 0)
+			if !ok {
+				return c.ReplyError(replyInvalidStreamID)
+			}
+			ids[i] = id
+			history[i] = xreadgroup
+		}
+	}
+
+	// a group reads the pending entries of the consumer after an ID, or
+	// the entries never delivered with >
+	now := mstime()
+	propagated := len(c.propagated)
+	reply := []interface{}{}
+	for i, key := range keys {
+		s := streams[i]
+		if s == nil {
+			continue
+		}
+		if !history[i] {
+			last := ids[i]
+			if xreadgroup {
+				last = groups[i].LastID
+			}
+			if s.Len() == 0 || s.LastValidID().Compare(last) <= 0 {
+				continue
+			}
+		}
+
+		var entries []interface{}
+		switch {
+		case xreadgroup:
+			cg := groups[i]
+			consumer, created := streamLookupConsumer(c, key, cg, consumername, now)
+			if created {
+				c.propagate(CmdNameXGroup, "CREATECONSUMER", key, groupname, consumername)
+			}
+			if history[i] {
+				entries = streamReadPending(c, key, groupname, s, cg, consumer, ids[i], count, now)
+			} else {
+				entries = streamDeliver(c, key, groupname, s, cg, consumer, count, noack, now)
+			}
+		default:
+			start, _ := ids[i].Incr()
+			entries = streamRangeReply(s, start, dt.MaxStreamID, false, count)
+		}
+		reply = append(reply, []interface{}{key, entries})
+	}
+	if len(c.propagated) > propagated {
+		godisServer.dirty++
+	}
+
+	if len(reply) > 0 {
+		return c.ReplyBulk(reply...)
+	}
+	// the AOF is loaded with a fake client, and the commands of a
+	// transaction are executed at once, so they can't block
+	if !block || c.fake || c.multi {
+		return c.ReplyNullArray()
+	}
+
+	// the $ IDs are resolved, so that the command executed again once the
+	// client is unblocked serves the entries added since now
+	for i := range keys {
+		if r.ArgvAt(streamsArg+n+i) == "$" {
+			r.SetArgvAt(streamsArg+n+i, ids[i].String())
+		}
+	}
+	blockForKeys(c, dt.ObjStream, keys, timeout)
+	c.bstate.streamIDs = ids
+	c.bstate.group, c.bstate.readGroup = groupname, xreadgroup
+	return nil
+}
+
+// streamLookupConsumer returns the consumer of the group of the stream at
+// key, which is created if needed and marked as seen at now.
+func streamLookupConsumer(c *Client, key string, cg *dt.StreamCG, name string, now int64) (*dt.StreamConsumer, bool) {
+	consumer := cg.Consumer(name)
+	if consumer != nil {
+		consumer.SeenTime = now
+		return consumer, false
+	}
+	notifyKeyspaceEvent(NotifyStream, "xgroup-createconsumer", key, c.db.id)
+	return cg.CreateConsumer(name, now), true
+}
+
+// streamDeliver delivers to the consumer the entries following the last ID
+// of the group, at most count of them unless count is 0, and returns them.
+// The entries are pending for the consumer until acknowledged, unless
+// noack is set.
+func streamDeliver(c *Client, key, groupname string, s *dt.Stream, cg *dt.StreamCG, consumer *dt.StreamConsumer,
+	count int64, noack bool, now int64) []interface{} {
+	entries := []interface{}{}
+	start, _ := cg.LastID.Incr()
+	s.Range(start, dt.MaxStreamID, false, func(id dt.StreamID, fields []string) bool {
+		// the counter of the group is valid as long as no entry after it
+		// was deleted
+		if cg.EntriesRead != dt.StreamEntriesReadInvalid && !s.RangeHasTombstones(id, dt.MaxStreamID) {
+			cg.EntriesRead++
+		} else if s.EntriesAdded > 0 {
+			cg.EntriesRead = s.EstimateDistance(id)
+		}
+		cg.LastID = id
+
+		entries = append(entries, streamEntryReply(id, fields))
+		if !noack {
+			nack := cg.Deliver(id, consumer, now)
+			consumer.ActiveTime = now
+			propagateXClaim(c, key, groupname, cg, id, nack)
+		}
+		return count == 0 || int64(len(entries)) < count
+	})
+
+	if len(entries) > 0 {
+		c.propagate(CmdNameXGroup, "SETID", key, groupname, cg.LastID.String(),
+			"ENTRIESREAD", strconv.FormatInt(cg.EntriesRead, 10))
+	}
+	return entries
+}
+
+// streamReadPending delivers again the entries pending for the consumer
+// after start, at most count of them unless count is 0, and returns them.
+// The deleted entries are replied with a nil value.
+func streamReadPending(c *Client, key, groupname string, s *dt.Stream, cg *dt.StreamCG, consumer *dt.StreamConsumer,
+	start dt.StreamID, count int64, now int64) []interface{} {
+	entries := []interface{}{}
+	start, ok := start.Incr()
+	if !ok {
+		return entries
+	}
+	consumer.PendingRange(start, dt.MaxStreamID, func(id dt.StreamID, nack *dt.StreamNACK) bool {
+		if fields, ok := s.Get(id); ok {
+			entries = append(entries, streamEntryReply(id, fields))
+		} else {
+			entries = append(entries, []interface{}{id.String(), []interface{}(nil)})
+		}
+		nack.DeliveryTime = now
+		nack.DeliveryCount++
+		propagateXClaim(c, key, groupname, cg, id, nack)
+		return count == 0 || int64(len(entries)) < count
+	})
+	return entries
+}
+
+// propagateXClaim propagates the state of a pending entry as an XCLAIM,
+// which also removes it once its entry is deleted.
+func propagateXClaim(c *Client, key, groupname string, cg *dt.StreamCG, id dt.StreamID, nack *dt.StreamNACK) {
+	c.propagate(CmdNameXClaim, key, groupname, nack.Consumer.Name, "0", id.String(),
+		"TIME", strconv.FormatInt(nack.DeliveryTime, 10),
+		"RETRYCOUNT", strconv.FormatInt(nack.DeliveryCount, 10),
+		"FORCE", "JUSTID", "LASTID", cg.LastID.String())
+}
+
+// XDEL key id [id ...]
+func (*cmdXDel) Exec(c *Client, r *protocol.Request) error {
+	s, msg := getStream(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if s == nil {
+		return c.ReplyInt(0)
+	}
+
+	// the IDs are checked first, so the command is not partially executed
+	ids, ok := parseStreamIDs(r.Argv()[2:])
+	if !ok {
+		return c.ReplyError(replyInvalidStreamID)
+	}
+	var deleted int64
+	for _, id := range ids {
+		if s.Delete(id) {
+			deleted++
+		}
+	}
+	c.db.elements -= deleted
+	if deleted > 0 {
+		signalModifiedKey(c.db, r.ArgvAt(1))
+		notifyKeyspaceEvent(NotifyStream, "xdel", r.ArgvAt(1), c.db.id)
+	}
+	godisServer.dirty += deleted
+	return c.ReplyInt(deleted)
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func (*cmdXTrim) Exec(c *Client, r *protocol.Request) error {
+	s, msg := getStream(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if s == nil {
+		return c.ReplyInt(0)
+	}
+	args, msg := parseStreamAddTrimArgs(c, r, false)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	removed := args.trim(s)
+	if removed > 0 {
+		c.db.elements -= removed
+		signalModifiedKey(c.db, r.ArgvAt(1))
+		notifyKeyspaceEvent(NotifyStream, "xtrim", r.ArgvAt(1), c.db.id)
+		godisServer.dirty += removed
+		argv := r.Argv()
+		args.rewriteApprox(argv, s)
+		c.propagate(argv...)
+	}
+	return c.ReplyInt(removed)
+}
+
+// XSETID key last-id [ENTRIESADDED entries-added] [MAXDELETEDID max-deleted-id]
+func (*cmdXSetID) Exec(c *Client, r *protocol.Request) error {
+	id, ok := parseStreamID(r.ArgvAt(2), true, 0)
+	if !ok {
+		return c.ReplyError(replyInvalidStreamID)
+	}
+	entriesAdded := int64(-1)
+	var maxDeleted dt.StreamID
+	for i := 3; i < r.ArgCount(); i += 2 {
+		opt := r.ArgvAt(i)
+		switch {
+		case strings.EqualFold(opt, "entriesadded") && i+1 < r.ArgCount():
+			n, err := strconv.ParseInt(r.ArgvAt(i+1), 10, 64)
+			if err != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			if n < 0 {
+				return c.ReplyError("entries_added must be positive")
+			}
+			entriesAdded = n
+		case strings.EqualFold(opt, "maxdeletedid") && i+1 < r.ArgCount():
+			if maxDeleted, ok = parseStreamID(r.ArgvAt(i+1), true, 0); !ok {
+				return c.ReplyError(replyInvalidStreamID)
+			}
+			if id.Compare(maxDeleted) < 0 {
+				return c.ReplyError("The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+			}
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+
+	s, msg := getStream(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if s == nil {
+		return c.ReplyError("no such key")
+	}
+	if id.Compare(s.MaxDeletedID) < 0 {
+		return c.ReplyError("The ID specified in XSETID is smaller than current max_deleted_entry_id")
+	}
+	// the IDs must stay increasing
+	if s.Len() > 0 {
+		if id.Compare(s.LastValidID()) < 0 {
+			return c.ReplyError("The ID specified in XSETID is smaller than the target stream top item")
+		}
+		if entriesAdded != -1 && s.Len() > entriesAdded {
+			return c.ReplyError("The entries_added specified in XSETID is smaller than the target stream length")
+		}
+	}
+
+	s.LastID = id
+	if entriesAdded != -1 {
+		s.EntriesAdded = entriesAdded
+	}
+	if !maxDeleted.IsZero() {
+		s.MaxDeletedID = maxDeleted
+	}
+	signalModifiedKey(c.db, r.ArgvAt(1))
+	notifyKeyspaceEvent(NotifyStream, "xsetid", r.ArgvAt(1), c.db.id)
+	godisServer.dirty++
+	return c.Reply("OK")
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD entries-read]
+// XGROUP SETID key group id|$ [ENTRIESREAD entries-read]
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+func (*cmdXGroup) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	sub := strings.ToLower(r.ArgvAt(1))
+	var arity bool
+	switch sub {
+	case "create", "setid":
+		arity = argc >= 5
+	case "destroy":
+		arity = argc == 4
+	case "createconsumer", "delconsumer":
+		arity = argc == 5
+	default:
+		return c.ReplyError("unknown subcommand '" + r.ArgvAt(1) + "'. Try XGROUP HELP.")
+	}
+	if !arity {
+		return c.ReplyError("wrong number of arguments for 'xgroup|" + sub + "' command")
+	}
+
+	mkstream := false
+	entriesRead := int64(dt.StreamEntriesReadInvalid)
+	for i := 5; i < argc && (sub == "create" || sub == "setid"); i++ {
+		switch opt := r.ArgvAt(i); {
+		case sub == "create" && strings.EqualFold(opt, "mkstream"):
+			mkstream = true
+		case strings.EqualFold(opt, "entriesread") && i+1 < argc:
+			i++
+			n, err := strconv.ParseInt(r.ArgvAt(i), 10, 64)
+			if err != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			if n < 0 && n != dt.StreamEntriesReadInvalid {
+				return c.ReplyError("value for ENTRIESREAD must be positive or -1")
+			}
+			entriesRead = n
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+
+	key, groupname := r.ArgvAt(2), r.ArgvAt(3)
+	s, msg := getStream(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if s == nil && !mkstream {
+		return c.ReplyError("The XGROUP subcommand requires the key to exist. " +
+			"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	var cg *dt.StreamCG
+	if s != nil {
+		cg = s.Group(groupname)
+	}
+	if cg == nil && sub != "create" && sub != "destroy" {
+		return c.ReplyError("NOGROUP No such consumer group '" + groupname + "' for key name '" + key + "'")
+	}
+
+	switch sub {
+	case "create":
+		var id dt.StreamID
+		if r.ArgvAt(4) == "$" {
+			if s != nil {
+				id = s.LastID
+			}
+		} else {
+			var ok bool
+			if id, ok = parseStreamID(r.ArgvAt(4), true, 0); !ok {
+				return c.ReplyError(replyInvalidStreamID)
+			}
+		}
+		if s == nil {
+			o := dt.NewStreamObject()
+			c.db.Add(key, o)
+			signalModifiedKey(c.db, key)
+			s = o.Ptr.(*dt.Stream)
+		}
+		if s.CreateGroup(groupname, id, entriesRead) == nil {
+			return c.ReplyError("BUSYGROUP Consumer Group name already exists")
+		}
+		notifyKeyspaceEvent(NotifyStream, "xgroup-create", key, c.db.id)
+		godisServer.dirty++
+		return c.Reply("OK")
+	case "setid":
+		id := s.LastID
+		if r.ArgvAt(4) != "$" {
+			var ok bool
+			if id, ok = parseStreamID(r.ArgvAt(4), false, 0); !ok {
+				return c.ReplyError(replyInvalidStreamID)
+			}
+		}
+		cg.LastID, cg.EntriesRead = id, entriesRead
+		notifyKeyspaceEvent(NotifyStream, "xgroup-setid", key, c.db.id)
+		godisServer.dirty++
+		return c.Reply("OK")
+	case "destroy":
+		if cg == nil {
+			return c.ReplyInt(0)
+		}
+		s.DeleteGroup(groupname)
+		notifyKeyspaceEvent(NotifyStream, "xgroup-destroy", key, c.db.id)
+		godisServer.dirty++
+		// the clients blocked on the group get an error
+		signalKeyAsReady(c.db, key)
+		return c.ReplyInt(1)
+	case "createconsumer":
+		if cg.CreateConsumer(r.ArgvAt(4), mstime()) == nil {
+			return c.ReplyInt(0)
+		}
+		notifyKeyspaceEvent(NotifyStream, "xgroup-createconsumer", key, c.db.id)
+		godisServer.dirty++
+		return c.ReplyInt(1)
+	default:
+		pending, deleted := cg.DeleteConsumer(r.ArgvAt(4))
+		if deleted {
+			notifyKeyspaceEvent(NotifyStream, "xgroup-delconsumer", key, c.db.id)
+		}
+		godisServer.dirty++
+		return c.ReplyInt(pending)
+	}
+}
+
+// XACK key group id [id ...]
+func (*cmdXAck) Exec(c *Client, r *protocol.Request) error {
+	ids, ok := parseStreamIDs(r.Argv()[3:])
+	if !ok {
+		return c.ReplyError(replyInvalidStreamID)
+	}
+	s, msg := getStream(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	var cg *dt.StreamCG
+	if s != nil {
+		cg = s.Group(r.ArgvAt(2))
+	}
+	if cg == nil {
+		return c.ReplyInt(0)
+	}
+
+	var acked int64
+	for _, id := range ids {
+		if cg.Ack(id) {
+			acked++
+		}
+	}
+	godisServer.dirty += acked
+	return c.ReplyInt(acked)
+}
+
+// getStreamGroup returns the stream of the key and its group, or an error
+// message if either doesn't exist.
+func getStreamGroup(c *Client, key, groupname string) (*dt.Stream, *dt.StreamCG, string) {
+	s, msg := getStream(c, key)
+	if msg != "" {
+		return nil, nil, msg
+	}
+	var cg *dt.StreamCG
+	if s != nil {
+		cg = s.Group(groupname)
+	}
+	if cg == nil {
+		return nil, nil, "NOGROUP No such key '" + key + "' or consumer group '" + groupname + "'"
+	}
+	return s, cg, ""
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func (*cmdXPending) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	if argc != 3 && (argc < 6 || argc > 9) {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	// the range is parsed first, so that syntax errors are reported before
+	// any other error
+	var minidle, count int64
+	var start, end dt.StreamID
+	consumerIdx := 0
+	if argc >= 6 {
+		i := 3
+		if strings.EqualFold(r.ArgvAt(3), "idle") {
+			var err error
+			if minidle, err = strconv.ParseInt(r.ArgvAt(4), 10, 64); err != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			if argc < 8 {
+				return c.ReplyError(ReplySyntaxErr)
+			}
+			i += 2
+		}
+
+		var err error
+		if count, err = strconv.ParseInt(r.ArgvAt(i+2), 10, 64); err != nil {
+			return c.ReplyError(ReplyNotInteger)
+		}
+		if count < 0 {
+			count = 0
+		}
+		var msg string
+		if start, msg = parseIntervalID(r.ArgvAt(i), 0, true); msg != "" {
+			return c.ReplyError(msg)
+		}
+		if end, msg = parseIntervalID(r.ArgvAt(i+1), math.MaxUint64, false); msg != "" {
+			return c.ReplyError(msg)
+		}
+		if i+3 < argc {
+			consumerIdx = i + 3
+		}
+		if i+4 < argc {
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+
+	_, cg, msg := getStreamGroup(c, r.ArgvAt(1), r.ArgvAt(2))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	// the summary of the pending entries
+	if argc == 3 {
+		if cg.PendingLen() == 0 {
+			return c.ReplyBulk(int64(0), nil, nil, []interface{}(nil))
+		}
+		var first, last dt.StreamID
+		found := false
+		cg.PendingRange(dt.StreamID{}, dt.MaxStreamID, func(id dt.StreamID, _ *dt.StreamNACK) bool {
+			if !found {
+				first, found = id, true
+			}
+			last = id
+			return true
+		})
+		consumers := []interface{}{}
+		cg.Consumers(func(consumer *dt.StreamConsumer) bool {
+			if n := consumer.PendingLen(); n > 0 {
+				consumers = append(consumers, []interface{}{consumer.Name, strconv.Itoa(n)})
+			}
+			return true
+		})
+		return c.ReplyBulk(int64(cg.PendingLen()), first.String(), last.String(), consumers)
+	}
+
+	pendingRange := cg.PendingRange
+	if consumerIdx > 0 {
+		consumer := cg.Consumer(r.ArgvAt(consumerIdx))
+		if consumer == nil {
+			return c.ReplyList(nil)
+		}
+		pendingRange = consumer.PendingRange
+	}
+
+	now := mstime()
+	entries := []interface{}{}
+	pendingRange(start, end, func(id dt.StreamID, nack *dt.StreamNACK) bool {
+		if int64(len(entries)) >= count {
+			return false
+		}
+		idle := now - nack.DeliveryTime
+		if idle < minidle {
+			return true
+		}
+		if idle < 0 {
+			idle = 0
+		}
+		entries = append(entries, []interface{}{id.String(), nack.Consumer.Name, idle, nack.DeliveryCount})
+		return true
+	})
+	return c.ReplyBulk(entries...)
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func (*cmdXClaim) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	key, groupname := r.ArgvAt(1), r.ArgvAt(2)
+	s, cg, msg := getStreamGroup(c, key, groupname)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	minidle, err := strconv.ParseInt(r.ArgvAt(4), 10, 64)
+	if err != nil {
+		return c.ReplyError("Invalid min-idle-time argument for XCLAIM")
+	}
+	if minidle < 0 {
+		minidle = 0
+	}
+
+	// the IDs are followed by the options, and the whole command is
+	// checked before claiming any entry
+	j := 5
+	for ; j < argc; j++ {
+		if _, ok := parseStreamID(r.ArgvAt(j), true, 0); !ok {
+			break
+		}
+	}
+	ids, _ := parseStreamIDs(r.Argv()[5:j])
+
+	now := mstime()
+	deliveryTime, retryCount := int64(-1), int64(-1)
+	force, justid := false, false
+	var lastID dt.StreamID
+	for ; j < argc; j++ {
+		moreargs := argc - 1 - j
+		opt := r.ArgvAt(j)
+		switch {
+		case strings.EqualFold(opt, "force"):
+			force = true
+		case strings.EqualFold(opt, "justid"):
+			justid = true
+		case strings.EqualFold(opt, "idle") && moreargs > 0:
+			j++
+			idle, err := strconv.ParseInt(r.ArgvAt(j), 10, 64)
+			if err != nil {
+				return c.ReplyError("Invalid IDLE option argument for XCLAIM")
+			}
+			deliveryTime = now - idle
+		case strings.EqualFold(opt, "time") && moreargs > 0:
+			j++
+			if deliveryTime, err = strconv.ParseInt(r.ArgvAt(j), 10, 64); err != nil {
+				return c.ReplyError("Invalid TIME option argument for XCLAIM")
+			}
+		case strings.EqualFold(opt, "retrycount") && moreargs > 0:
+			j++
+			if retryCount, err = strconv.ParseInt(r.ArgvAt(j), 10, 64); err != nil {
+				return c.ReplyError("Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+		case strings.EqualFold(opt, "lastid") && moreargs > 0:
+			j++
+			var ok bool
+			if lastID, ok = parseStreamID(r.ArgvAt(j), true, 0); !ok {
+				return c.ReplyError(replyInvalidStreamID)
+			}
+		default:
+			return c.ReplyError("Unrecognized XCLAIM option '" + opt + "'")
+		}
+	}
+
+	propagateLastID := false
+	if lastID.Compare(cg.LastID) > 0 {
+		cg.LastID = lastID
+		propagateLastID = true
+	}
+	// a time in the future is likely a clock difference with the client
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	var consumer *dt.StreamConsumer
+	claimed := []interface{}{}
+	for _, id := range ids {
+		nack := cg.Pending(id)
+
+		// the entries deleted from the stream are removed from the group
+		fields, exists := s.Get(id)
+		if !exists {
+			if nack != nil {
+				propagateXClaim(c, key, groupname, cg, id, nack)
+				propagateLastID = false
+				cg.Ack(id)
+				godisServer.dirty++
+			}
+			continue
+		}
+
+		// FORCE creates the pending entry, which is used to rebuild the
+		// groups from the AOF
+		forced := false
+		if nack == nil {
+			if !force {
+				continue
+			}
+			forced = true
+		}
+		if !forced && minidle > 0 && now-nack.DeliveryTime < minidle {
+			continue
+		}
+
+		if consumer == nil {
+			consumer, _ = streamLookupConsumer(c, key, cg, r.ArgvAt(3), now)
+		}
+		if forced {
+			nack = cg.Deliver(id, consumer, deliveryTime)
+		} else {
+			cg.Claim(id, nack, consumer)
+		}
+		nack.DeliveryTime = deliveryTime
+		if retryCount >= 0 {
+			nack.DeliveryCount = retryCount
+		} else if !justid {
+			nack.DeliveryCount++
+		}
+		consumer.ActiveTime = now
+
+		if justid {
+			claimed = append(claimed, id.String())
+		} else {
+			claimed = append(claimed, streamEntryReply(id, fields))
+		}
+		propagateXClaim(c, key, groupname, cg, id, nack)
+		propagateLastID = false
+		godisServer.dirty++
+	}
+
+	if propagateLastID {
+		c.propagate(CmdNameXGroup, "SETID", key, groupname, cg.LastID.String(),
+			"ENTRIESREAD", strconv.FormatInt(cg.EntriesRead, 10))
+		godisServer.dirty++
+	}
+	return c.ReplyBulk(claimed...)
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func (*cmdXAutoClaim) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	minidle, err := strconv.ParseInt(r.ArgvAt(4), 10, 64)
+	if err != nil {
+		return c.ReplyError("Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	if minidle < 0 {
+		minidle = 0
+	}
+	start, msg := parseIntervalID(r.ArgvAt(5), 0, true)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	// at most count entries are claimed, among 10 times as many scanned
+	const attemptsFactor = 10
+	count := int64(100)
+	justid := false
+	for j := 6; j < argc; j++ {
+		opt := r.ArgvAt(j)
+		switch {
+		case strings.EqualFold(opt, "count") && j+1 < argc:
+			j++
+			count, err = strconv.ParseInt(r.ArgvAt(j), 10, 64)
+			if err != nil || count < 1 || count > math.MaxInt64/16 {
+				return c.ReplyError("COUNT must be > 0")
+			}
+		case strings.EqualFold(opt, "justid"):
+			justid = true
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+
+	key, groupname := r.ArgvAt(1), r.ArgvAt(2)
+	s, cg, msg := getStreamGroup(c, key, groupname)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	// the scanned entries and the next one, which is the cursor of the
+	// following call
+	attempts := count * attemptsFactor
+	var ids []dt.StreamID
+	var nacks []*dt.StreamNACK
+	cg.PendingRange(start, dt.MaxStreamID, func(id dt.StreamID, nack *dt.StreamNACK) bool {
+		ids = append(ids, id)
+		nacks = append(nacks, nack)
+		return int64(len(ids)) <= attempts
+	})
+
+	now := mstime()
+	var consumer *dt.StreamConsumer
+	claimed, deleted := []interface{}{}, []interface{}{}
+	i := 0
+	for ; i < len(ids) && attempts > 0 && count > 0; i++ {
+		attempts--
+		id, nack := ids[i], nacks[i]
+
+		fields, exists := s.Get(id)
+		if !exists {
+			propagateXClaim(c, key, groupname, cg, id, nack)
+			cg.Ack(id)
+			godisServer.dirty++
+			deleted = append(deleted, id.String())
+			count--
+			continue
+		}
+		if minidle > 0 && now-nack.DeliveryTime < minidle {
+			continue
+		}
+
+		if consumer == nil {
+			consumer, _ = streamLookupConsumer(c, key, cg, r.ArgvAt(3), now)
+		}
+		cg.Claim(id, nack, consumer)
+		nack.DeliveryTime = now
+		if !justid {
+			nack.DeliveryCount++
+		}
+		consumer.ActiveTime = now
+
+		if justid {
+			claimed = append(claimed, id.String())
+		} else {
+			claimed = append(claimed, streamEntryReply(id, fields))
+		}
+		count--
+		propagateXClaim(c, key, groupname, cg, id, nack)
+		godisServer.dirty++
+	}
+
+	var cursor dt.StreamID
+	if i < len(ids) {
+		cursor = ids[i]
+	}
+	return c.ReplyBulk(cursor.String(), claimed, deleted)
+}
+
+// XINFO CONSUMERS key group
+// XINFO GROUPS key
+// XINFO STREAM key [FULL [COUNT count]]
+func (*cmdXInfo) Exec(c *Client, r *protocol.Request) error {
+	argc := r.ArgCount()
+	sub := strings.ToLower(r.ArgvAt(1))
+	var arity bool
+	switch sub {
+	case "consumers":
+		arity = argc == 4
+	case "groups":
+		arity = argc == 3
+	case "stream":
+		arity = argc >= 3
+	default:
+		return c.ReplyError("unknown subcommand '" + r.ArgvAt(1) + "'. Try XINFO HELP.")
+	}
+	if !arity {
+		return c.ReplyError("wrong number of arguments for 'xinfo|" + sub + "' command")
+	}
+
+	key := r.ArgvAt(2)
+	s, msg := getStream(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if s == nil {
+		return c.ReplyError("no such key")
+	}
+
+	now := mstime()
+	switch sub {
+	case "consumers":
+		cg := s.Group(r.ArgvAt(3))
+		if cg == nil {
+			return c.ReplyError("NOGROUP No such consumer group '" + r.ArgvAt(3) + "' for key name '" + key + "'")
+		}
+		consumers := []interface{}{}
+		cg.Consumers(func(consumer *dt.StreamConsumer) bool {
+			idle := now - consumer.SeenTime
+			if idle < 0 {
+				idle = 0
+			}
+			inactive := int64(-1)
+			if consumer.ActiveTime != -1 {
+				inactive = now - consumer.ActiveTime
+			}
+			consumers = append(consumers, []interface{}{
+				"name", consumer.Name,
+				"pending", int64(consumer.PendingLen()),
+				"idle", idle,
+				"inactive", inactive,
+			})
+			return true
+		})
+		return c.ReplyBulk(consumers...)
+	case "groups":
+		groups := []interface{}{}
+		s.Groups(func(name string, cg *dt.StreamCG) bool {
+			groups = append(groups, []interface{}{
+				"name", name,
+				"consumers", int64(cg.ConsumersLen()),
+				"pending", int64(cg.PendingLen()),
+				"last-delivered-id", cg.LastID.String(),
+				"entries-read", streamEntriesRead(cg),
+				"lag", streamGroupLag(s, cg),
+			})
+			return true
+		})
+		return c.ReplyBulk(groups...)
+	}
+
+	full := false
+	count := int64(10)
+	if argc > 3 {
+		if !strings.EqualFold(r.ArgvAt(3), "full") {
+			return c.ReplyError(ReplySyntaxErr)
+		}
+		if argc > 4 {
+			if argc != 6 || !strings.EqualFold(r.ArgvAt(4), "count") {
+				return c.ReplyError(ReplySyntaxErr)
+			}
+			n, err := strconv.ParseInt(r.ArgvAt(5), 10, 64)
+			if err != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			if n < 0 {
+				n = 0
+			}
+			count = n
+		}
+		full = true
+	}
+
+	info := []interface{}{
+		"length", s.Len(),
+		"radix-tree-keys", int64(s.Blocks()),
+		"radix-tree-nodes", int64(s.RaxNodes()),
+		"last-generated-id", s.LastID.String(),
+		"max-deleted-entry-id", s.MaxDeletedID.String(),
+		"entries-added", s.EntriesAdded,
+		"recorded-first-entry-id", s.FirstID.String(),
+	}
+	if !full {
+		var first, last interface{}
+		if entries := streamRangeReply(s, dt.StreamID{}, dt.MaxStreamID, false, 1); len(entries) > 0 {
+			first = entries[0]
+		}
+		if entries := streamRangeReply(s, dt.StreamID{}, dt.MaxStreamID, true, 1); len(entries) > 0 {
+			last = entries[0]
+		}
+		info = append(info,
+			"groups", int64(s.GroupsLen()),
+			"first-entry", first,
+			"last-entry", last)
+		return c.ReplyBulk(info...)
+	}
+
+	// the entries and the pending entries are limited to count, unless 0
+	groups := []interface{}{}
+	s.Groups(func(name string, cg *dt.StreamCG) bool {
+		pending := []interface{}{}
+		cg.PendingRange(dt.StreamID{}, dt.MaxStreamID, func(id dt.StreamID, nack *dt.StreamNACK) bool {
+			pending = append(pending, []interface{}{id.String(), nack.Consumer.Name, nack.DeliveryTime, nack.DeliveryCount})
+			return count == 0 || int64(len(pending)) < count
+		})
+
+		consumers := []interface{}{}
+		cg.Consumers(func(consumer *dt.StreamConsumer) bool {
+			pending := []interface{}{}
+			consumer.PendingRange(dt.StreamID{}, dt.MaxStreamID, func(id dt.StreamID, nack *dt.StreamNACK) bool {
+				pending = append(pending, []interface{}{id.String(), nack.DeliveryTime, nack.DeliveryCount})
+				return count == 0 || int64(len(pending)) < count
+			})
+			consumers = append(consumers, []interface{}{
+				"name", consumer.Name,
+				"seen-time", consumer.SeenTime,
+				"active-time", consumer.ActiveTime,
+				"pel-count", int64(consumer.PendingLen()),
+				"pending", pending,
+			})
+			return true
+		})
+
+		groups = append(groups, []interface{}{
+			"name", name,
+			"last-delivered-id", cg.LastID.String(),
+			"entries-read", streamEntriesRead(cg),
+			"lag", streamGroupLag(s, cg),
+			"pel-count", int64(cg.PendingLen()),
+			"pending", pending,
+			"consumers", consumers,
+		})
+		return true
+	})
+	info = append(info,
+		"entries", streamRangeReply(s, dt.StreamID{}, dt.MaxStreamID, false, count),
+		"groups", groups)
+	return c.ReplyBulk(info...)
+}
+
+// streamEntriesRead returns the logical counter of the group, or nil if
+// it's unknown.
+func streamEntriesRead(cg *dt.StreamCG) interface{} {
+	if cg.EntriesRead == dt.StreamEntriesReadInvalid {
+		return nil
+	}
+	return cg.EntriesRead
+}
+
+// streamGroupLag returns the number of entries not yet delivered to the
+// group, or nil if it can't be known because of deleted entries.
+func streamGroupLag(s *dt.Stream, cg *dt.StreamCG) interface{} {
+	if s.EntriesAdded == 0 {
+		return int64(0)
+	}
+	if cg.EntriesRead != dt.StreamEntriesReadInvalid && !s.RangeHasTombstones(cg.LastID, dt.MaxStreamID) {
+		return s.EntriesAdded - cg.EntriesRead
+	}
+	if read := s.EstimateDistance(cg.LastID); read != dt.StreamEntriesReadInvalid {
+		return s.EntriesAdded - read
+	}
+	return nil
+}
@@ -0,0 +1,757 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdGet struct{}
+type cmdSet struct{}
+type cmdSetEX struct{}
+type cmdPSetEX struct{}
+type cmdSetNX struct{}
+type cmdGetSet struct{}
+type cmdGetDel struct{}
+type cmdGetEx struct{}
+type cmdIncr struct{}
+type cmdDecr struct{}
+type cmdIncrBy struct{}
+type cmdDecrBy struct{}
+type cmdIncrByFloat struct{}
+type cmdMGet struct{}
+type cmdMSet struct{}
+type cmdMSetNX struct{}
+type cmdAppend struct{}
+type cmdStrLen struct{}
+type cmdGetRange struct{}
+type cmdSetRange struct{}
+type cmdLCS struct{}
+
+// The options of SET and GETEX, a command setting an expire is written to
+// the AOF with the absolute unix time in ms of the expiration.
+const (
+	setNX = 1 << iota
+	setXX
+	setGet
+	setKeepTTL
+	setEX
+	setPX
+	setEXAT
+	setPXAT
+	setPersist
+
+	setExpireFlags = setEX | setPX | setEXAT | setPXAT
+)
+
+// parseExtendedStringArgs parses the options of SET, or of GETEX when
+// getex is true, starting from the i-th argument. It returns the flags
+// and the absolute expire time in ms, or -1 if no expire is given.
+func parseExtendedStringArgs(r *protocol.Request, i int, getex bool) (int, int64, string) {
+	flags := 0
+	expire := ""
+	for ; i < r.ArgCount(); i++ {
+		opt := strings.ToLower(r.ArgvAt(i))
+		more := i+1 < r.ArgCount()
+		switch {
+		case opt == "nx" && !getex && flags&setXX == 0:
+			flags |= setNX
+		case opt == "xx" && !getex && flags&setNX == 0:
+			flags |= setXX
+		case opt == "get" && !getex:
+			flags |= setGet
+		case opt == "keepttl" && !getex && flags&setExpireFlags == 0:
+			flags |= setKeepTTL
+		case opt == "persist" && getex && flags&setExpireFlags == 0:
+			flags |= setPersist
+		case opt == "ex" && more && flags&(setKeepTTL|setPersist|setExpireFlags) == 0:
+			flags |= setEX
+			expire = r.ArgvAt(i + 1)
+			i++
+		case opt == "px" && more && flags&(setKeepTTL|setPersist|setExpireFlags) == 0:
+			flags |= setPX
+			expire = r.ArgvAt(i + 1)
+			i++
+		case opt == "exat" && more && flags&(setKeepTTL|setPersist|setExpireFlags) == 0:
+			flags |= setEXAT
+			expire = r.ArgvAt(i + 1)
+			i++
+		case opt == "pxat" && more && flags&(setKeepTTL|setPersist|setExpireFlags) == 0:
+			flags |= setPXAT
+			expire = r.ArgvAt(i + 1)
+			i++
+		default:
+			return 0, 0, ReplySyntaxErr
+		}
+	}
+
+	if flags&setExpireFlags == 0 {
+		return flags, -1, ""
+	}
+	when, msg := parseStringExpire(r, expire, flags)
+	return flags, when, msg
+}
+
+// parseStringExpire converts the expire argument to an absolute unix time in
+// ms according to the EX, PX, EXAT or PXAT flag.
+func parseStringExpire(r *protocol.Request, expire string, flags int) (int64, string) {
+	n, err := strconv.ParseInt(expire, 10, 64)
+	if err != nil {
+		return 0, ReplyNotInteger
+	}
+	invalid := "invalid expire time in '" + strings.ToLower(r.CommandName()) + "' command"
+	if n <= 0 {
+		return 0, invalid
+	}
+
+	if flags&(setEX|setEXAT) != 0 {
+		if n > math.MaxInt64/1000 {
+			return 0, invalid
+		}
+		n *= 1000
+	}
+	if flags&(setEX|setPX) != 0 {
+		now := mstime()
+		if n > math.MaxInt64-now {
+			return 0, invalid
+		}
+		n += now
+	}
+	return n, ""
+}
+
+// canShareIntegers reports whether the keys can reference the shared
+// integer objects, which is not the case when the keys are evicted by LRU
+// as every key needs its own access time.
+func canShareIntegers() bool {
+	return godisServer.maxmemory == 0 || !godisServer.memPolicyLru()
+}
+
+// createStringObject creates the object of the string value s, with the
+// most compact encoding.
+func createStringObject(s string) *dt.Object {
+	return dt.TryStringEncoding(s, canShareIntegers())
+}
+
+// createIntObject creates the object of the integer value v.
+func createIntObject(v int64) *dt.Object {
+	if v >= 0 && v < dt.ObjSharedIntegers && canShareIntegers() {
+		return dt.SharedIntegers[v]
+	}
+	return dt.NewIntObject(v)
+}
+
+// getString returns the value of a string key, the error to reply is
+// returned if the key holds another type.
+func getString(c *Client, key string) (*dt.Object, string) {
+	o := c.db.Get(key)
+	if o != nil && o.ObjType != dt.ObjString {
+		return nil, ReplyWrongType
+	}
+	return o, ""
+}
+
+// replyString replies the value of the string o, or nil if o is nil.
+func replyString(c *Client, o *dt.Object) error {
+	if o == nil {
+		return c.ReplyEmpty()
+	}
+	return c.ReplyBulkString(o.StringValue())
+}
+
+// setGenericCommand implements SET and its variants. The expire is an
+// absolute unix time in ms, or -1.
+func setGenericCommand(c *Client, key, value string, flags int, expire int64) error {
+	old, msg := getString(c, key)
+	if msg != "" && flags&setGet != 0 {
+		return c.ReplyError(msg)
+	}
+
+	exists := c.db.lookupKey(key, false) != nil
+	if (flags&setNX != 0 && exists) || (flags&setXX != 0 && !exists) {
+		if flags&setGet != 0 {
+			return replyString(c, old)
+		}
+		return c.ReplyEmpty()
+	}
+
+	obj := createStringObject(value)
+	if flags&setKeepTTL != 0 {
+		c.db.Add(key, obj)
+	} else {
+		c.db.Set(key, obj)
+	}
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyString, "set", key, c.db.id)
+	godisServer.dirty++
+
+	switch {
+	case expire != -1:
+		c.db.setExpire(key, expire)
+		notifyKeyspaceEvent(NotifyGeneric, "expire", key, c.db.id)
+		c.propagate(CmdNameSet, key, value, "pxat", strconv.FormatInt(expire, 10))
+	case flags&setKeepTTL != 0:
+		c.propagate(CmdNameSet, key, value, "keepttl")
+	default:
+		c.propagate(CmdNameSet, key, value)
+	}
+
+	if flags&setGet != 0 {
+		return replyString(c, old)
+	}
+	return c.Reply("OK")
+}
+
+// GET key
+func (*cmdGet) Exec(c *Client, r *protocol.Request) error {
+	o, msg := getString(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	return replyString(c, o)
+}
+
+// SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|KEEPTTL]
+func (*cmdSet) Exec(c *Client, r *protocol.Request) error {
+	flags, expire, msg := parseExtendedStringArgs(r, 3, false)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	return setGenericCommand(c, r.ArgvAt(1), r.ArgvAt(2), flags, expire)
+}
+
+// SETEX key seconds value
+func (*cmdSetEX) Exec(c *Client, r *protocol.Request) error {
+	return setexGenericCommand(c, r, setEX)
+}
+
+// PSETEX key milliseconds value
+func (*cmdPSetEX) Exec(c *Client, r *protocol.Request) error {
+	return setexGenericCommand(c, r, setPX)
+}
+
+func setexGenericCommand(c *Client, r *protocol.Request, flags int) error {
+	expire, msg := parseStringExpire(r, r.ArgvAt(2), flags)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	return setGenericCommand(c, r.ArgvAt(1), r.ArgvAt(3), flags, expire)
+}
+
+// SETNX key value
+func (*cmdSetNX) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	if c.db.lookupKey(key, false) != nil {
+		return c.ReplyInt(0)
+	}
+	c.db.Set(key, createStringObject(r.ArgvAt(2)))
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyString, "set", key, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(1)
+}
+
+// GETSET key value
+func (*cmdGetSet) Exec(c *Client, r *protocol.Request) error {
+	return setGenericCommand(c, r.ArgvAt(1), r.ArgvAt(2), setGet, -1)
+}
+
+// GETDEL key
+func (*cmdGetDel) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	o, msg := getString(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if o != nil {
+		c.db.deleteKey(key)
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+		godisServer.dirty++
+		c.propagate(CmdNameDel, key)
+	}
+	return replyString(c, o)
+}
+
+// GETEX key [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|PERSIST]
+func (*cmdGetEx) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	flags, expire, msg := parseExtendedStringArgs(r, 2, true)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	o, msg := getString(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if o == nil {
+		return c.ReplyEmpty()
+	}
+
+	switch {
+	case expire != -1 && expire <= mstime() && !c.fake:
+		c.db.deleteKey(key)
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+		godisServer.dirty++
+		c.propagate(CmdNameDel, key)
+	case expire != -1:
+		c.db.setExpire(key, expire)
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyGeneric, "expire", key, c.db.id)
+		godisServer.dirty++
+		c.propagate(CmdNamePExpireAt, key, strconv.FormatInt(expire, 10))
+	case flags&setPersist != 0 && c.db.removeExpire(key):
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyGeneric, "persist", key, c.db.id)
+		godisServer.dirty++
+		c.propagate(CmdNamePersist, key)
+	}
+	return replyString(c, o)
+}
+
+// INCR key
+func (*cmdIncr) Exec(c *Client, r *protocol.Request) error {
+	return incrDecrCommand(c, r.ArgvAt(1), 1)
+}
+
+// DECR key
+func (*cmdDecr) Exec(c *Client, r *protocol.Request) error {
+	return incrDecrCommand(c, r.ArgvAt(1), -1)
+}
+
+// INCRBY key increment
+func (*cmdIncrBy) Exec(c *Client, r *protocol.Request) error {
+	incr, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+	return incrDecrCommand(c, r.ArgvAt(1), incr)
+}
+
+// DECRBY key decrement
+func (*cmdDecrBy) Exec(c *Client, r *protocol.Request) error {
+	decr, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+	// -math.MinInt64 isn't an int64
+	if decr == math.MinInt64 {
+		return c.ReplyError("decrement would overflow")
+	}
+	return incrDecrCommand(c, r.ArgvAt(1), -decr)
+}
+
+// getInt returns the integer value of a string object, a missing key is 0.
+func getInt(o *dt.Object) (int64, bool) {
+	if o == nil {
+		return 0, true
+	}
+	if o.Encoding == dt.ObjEncodingInt {
+		return o.Ptr.(int64), true
+	}
+	return dt.StringToInt64(o.StringValue())
+}
+
+// incrDecrCommand adds incr to the integer value of the key, the TTL of
+// the key is retained.
+func incrDecrCommand(c *Client, key string, incr int64) error {
+	o, msg := getString(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	value, ok := getInt(o)
+	if !ok {
+		return c.ReplyError(ReplyNotInteger)
+	}
+	if addOverflows(value, incr) {
+		return c.ReplyError(ReplyOverflow)
+	}
+	value += incr
+
+	c.db.Add(key, createIntObject(value))
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyString, "incrby", key, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(value)
+}
+
+// INCRBYFLOAT key increment
+func (*cmdIncrByFloat) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	o, msg := getString(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	var value float64
+	if o != nil {
+		v, err := parseFloat(o.StringValue())
+		if err != nil {
+			return c.ReplyError(ReplyNotFloat)
+		}
+		value = v
+	}
+	incr, err := parseFloat(r.ArgvAt(2))
+	if err != nil {
+		return c.ReplyError(ReplyNotFloat)
+	}
+
+	value += incr
+	if isNaNOrInf(value) {
+		return c.ReplyError("increment would produce NaN or Infinity")
+	}
+
+	s := formatFloat(value)
+	c.db.Add(key, createStringObject(s))
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyString, "incrbyfloat", key, c.db.id)
+	godisServer.dirty++
+
+	// always replicate INCRBYFLOAT as a SET with the final value, so float
+	// precision or formatting differences can't create discrepancies.
+	c.propagate(CmdNameSet, key, s, "keepttl")
+	return c.ReplyBulkString(s)
+}
+
+// MGET key [key ...]
+func (*cmdMGet) Exec(c *Client, r *protocol.Request) error {
+	values := make([]interface{}, 0, r.ArgCount()-1)
+	for i := 1; i < r.ArgCount(); i++ {
+		o := c.db.Get(r.ArgvAt(i))
+		if o == nil || o.ObjType != dt.ObjString {
+			values = append(values, nil)
+		} else {
+			values = append(values, o.StringValue())
+		}
+	}
+	return c.ReplyBulk(values...)
+}
+
+// MSET key value [key value ...]
+func (*cmdMSet) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() < 3 || r.ArgCount()%2 != 1 {
+		return c.ReplyError("wrong number of arguments for 'mset' command")
+	}
+
+	msetGenericCommand(c, r)
+	return c.Reply("OK")
+}
+
+// MSETNX key value [key value ...]
+func (*cmdMSetNX) Exec(c *Client, r *protocol.Request) error {
+	if r.ArgCount() < 3 || r.ArgCount()%2 != 1 {
+		return c.ReplyError("wrong number of arguments for 'msetnx' command")
+	}
+
+	// set nothing if any of the keys exists
+	for i := 1; i < r.ArgCount(); i += 2 {
+		if c.db.lookupKey(r.ArgvAt(i), false) != nil {
+			return c.ReplyInt(0)
+		}
+	}
+	msetGenericCommand(c, r)
+	return c.ReplyInt(1)
+}
+
+func msetGenericCommand(c *Client, r *protocol.Request) {
+	for i := 1; i < r.ArgCount(); i += 2 {
+		c.db.Set(r.ArgvAt(i), createStringObject(r.ArgvAt(i+1)))
+		signalModifiedKey(c.db, r.ArgvAt(i))
+		notifyKeyspaceEvent(NotifyString, "set", r.ArgvAt(i), c.db.id)
+		godisServer.dirty++
+	}
+}
+
+// checkStringLength returns the error to reply if a string of size bytes
+// would be bigger than the max size of a string.
+func checkStringLength(size int64) string {
+	if size > StringMaxSize {
+		return "string exceeds maximum allowed size (proto-max-bulk-len)"
+	}
+	return ""
+}
+
+// unshareStringValue returns the string object of the key as raw bytes
+// which can be modified in place, the object is replaced if it's encoded
+// or it may be shared.
+func unshareStringValue(db *Database, key string, o *dt.Object) *dt.Object {
+	if _, ok := o.Ptr.([]byte); ok {
+		return o
+	}
+	o = dt.NewBytesObject([]byte(o.StringValue()))
+	db.Add(key, o)
+	return o
+}
+
+// stringBytes returns the bytes of the string o, for read only commands.
+func stringBytes(o *dt.Object) []byte {
+	if o == nil {
+		return nil
+	}
+	if b, ok := o.Ptr.([]byte); ok {
+		return b
+	}
+	return []byte(o.StringValue())
+}
+
+// lookupStringForWrite returns the string object o of the key as raw bytes
+// zero padded to at least size bytes, the key is created if o is nil.
+func lookupStringForWrite(db *Database, key string, o *dt.Object, size int64) *dt.Object {
+	if o == nil {
+		o = dt.NewBytesObject(make([]byte, size))
+		db.Add(key, o)
+		return o
+	}
+
+	o = unshareStringValue(db, key, o)
+	if buf := o.Ptr.([]byte); int64(len(buf)) < size {
+		o.Ptr = append(buf, make([]byte, size-int64(len(buf)))...)
+	}
+	return o
+}
+
+// APPEND key value
+func (*cmdAppend) Exec(c *Client, r *protocol.Request) error {
+	key, value := r.ArgvAt(1), r.ArgvAt(2)
+	o, msg := getString(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	if o == nil {
+		o = createStringObject(value)
+		c.db.Add(key, o)
+	} else {
+		if msg := checkStringLength(int64(o.StringLen()) + int64(len(value))); msg != "" {
+			return c.ReplyError(msg)
+		}
+		// the appended string is likely to be appended again, so it's
+		// converted to raw bytes which are appended in place.
+		o = unshareStringValue(c.db, key, o)
+		o.Ptr = append(o.Ptr.([]byte), value...)
+	}
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyString, "append", key, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(int64(o.StringLen()))
+}
+
+// STRLEN key
+func (*cmdStrLen) Exec(c *Client, r *protocol.Request) error {
+	o, msg := getString(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	return c.ReplyInt(int64(o.StringLen()))
+}
+
+// GETRANGE key start end
+func (*cmdGetRange) Exec(c *Client, r *protocol.Request) error {
+	start, err1 := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	end, err2 := strconv.ParseInt(r.ArgvAt(3), 10, 64)
+	if err1 != nil || err2 != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+	o, msg := getString(c, r.ArgvAt(1))
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+	if o == nil {
+		return c.ReplyBulkString("")
+	}
+
+	s := o.StringValue()
+	n := int64(len(s))
+	if start < 0 && end < 0 && start > end {
+		return c.ReplyBulkString("")
+	}
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if n == 0 || start > end {
+		return c.ReplyBulkString("")
+	}
+	return c.ReplyBulkString(s[start : end+1])
+}
+
+// SETRANGE key offset value
+func (*cmdSetRange) Exec(c *Client, r *protocol.Request) error {
+	key, value := r.ArgvAt(1), r.ArgvAt(3)
+	offset, err := strconv.ParseInt(r.ArgvAt(2), 10, 64)
+	if err != nil {
+		return c.ReplyError(ReplyNotInteger)
+	}
+	if offset < 0 {
+		return c.ReplyError("offset is out of range")
+	}
+	o, msg := getString(c, key)
+	if msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	// an empty value changes nothing, and doesn't create the key
+	if len(value) == 0 {
+		if o == nil {
+			return c.ReplyInt(0)
+		}
+		return c.ReplyInt(int64(o.StringLen()))
+	}
+	if msg := checkStringLength(offset + int64(len(value))); msg != "" {
+		return c.ReplyError(msg)
+	}
+
+	o = lookupStringForWrite(c.db, key, o, offset+int64(len(value)))
+	buf := o.Ptr.([]byte)
+	copy(buf[offset:], value)
+	signalModifiedKey(c.db, key)
+	notifyKeyspaceEvent(NotifyString, "setrange", key, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(int64(len(buf)))
+}
+
+// LCS key1 key2 [LEN] [IDX] [MINMATCHLEN len] [WITHMATCHLEN]
+func (*cmdLCS) Exec(c *Client, r *protocol.Request) error {
+	var getlen, getidx, withmatchlen bool
+	var minmatchlen int64
+	for i := 3; i < r.ArgCount(); i++ {
+		opt := strings.ToLower(r.ArgvAt(i))
+		switch {
+		case opt == "len":
+			getlen = true
+		case opt == "idx":
+			getidx = true
+		case opt == "withmatchlen":
+			withmatchlen = true
+		case opt == "minmatchlen" && i+1 < r.ArgCount():
+			n, err := strconv.ParseInt(r.ArgvAt(i+1), 10, 64)
+			if err != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			if n > 0 {
+				minmatchlen = n
+			}
+			i++
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+	if getlen && getidx {
+		return c.ReplyError("If you want both the length and indexes, please just use IDX.")
+	}
+
+	var a, b string
+	for i, s := range []*string{&a, &b} {
+		o := c.db.Get(r.ArgvAt(1 + i))
+		if o != nil && o.ObjType != dt.ObjString {
+			return c.ReplyError("The specified keys must contain string values")
+		}
+		if o != nil {
+			*s = o.StringValue()
+		}
+	}
+
+	alen, blen := len(a), len(b)
+	if int64(alen+1)*int64(blen+1) > StringMaxSize/4 {
+		return c.ReplyError("Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+	}
+
+	// lcs[i][j] is the length of the LCS of a[:i] and b[:j]
+	width := blen + 1
+	lcs := make([]uint32, (alen+1)*width)
+	for i := 1; i <= alen; i++ {
+		for j := 1; j <= blen; j++ {
+			if a[i-1] == b[j-1] {
+				lcs[i*width+j] = lcs[(i-1)*width+j-1] + 1
+			} else if l1, l2 := lcs[(i-1)*width+j], lcs[i*width+j-1]; l1 > l2 {
+				lcs[i*width+j] = l1
+			} else {
+				lcs[i*width+j] = l2
+			}
+		}
+	}
+
+	idx := int(lcs[alen*width+blen])
+	if getlen {
+		return c.ReplyInt(int64(idx))
+	}
+
+	// walk the table backward to build the LCS, and the matching ranges
+	// of the two strings from the last to the first.
+	result := make([]byte, idx)
+	matches := []interface{}{}
+	i, j := alen, blen
+	astart, aend, bstart, bend := alen, 0, 0, 0
+	for i > 0 && j > 0 {
+		emit := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if astart == alen {
+				astart, aend = i-1, i-1
+				bstart, bend = j-1, j-1
+			} else if astart == i && bstart == j {
+				// extend the range backward, as it's contiguous
+				astart--
+				bstart--
+			} else {
+				emit = true
+			}
+			if astart == 0 || bstart == 0 {
+				emit = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if lcs[(i-1)*width+j] > lcs[i*width+j-1] {
+				i--
+			} else {
+				j--
+			}
+			if astart != alen {
+				emit = true
+			}
+		}
+
+		if emit && getidx {
+			matchlen := int64(aend - astart + 1)
+			if minmatchlen == 0 || matchlen >= minmatchlen {
+				match := []interface{}{
+					[]interface{}{int64(astart), int64(aend)},
+					[]interface{}{int64(bstart), int64(bend)},
+				}
+				if withmatchlen {
+					match = append(match, matchlen)
+				}
+				matches = append(matches, match)
+			}
+		}
+		if emit {
+			astart = alen
+		}
+	}
+
+	if getidx {
+		return c.ReplyBulk("matches", matches, "len", int64(len(result)))
+	}
+	return c.ReplyBulkString(string(result))
+}
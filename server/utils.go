@@ -1,6 +1,13 @@
 package server
 
-import "time"
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+var errNotFloat = errors.New("value is not a valid float")
 
 func mstime() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
@@ -13,5 +20,145 @@ func ustime() int64 {
 func usedmemory() int64 {
 	/* FIXME how do we trace the memory useage painless?
 	 */
-	return godisServer.db.store.Used()
+	var used int64
+	for _, db := range godisServer.db {
+		used += db.store.Used() + db.elements
+	}
+	return used
+}
+
+// stringMatch reports whether str matches the glob-style pattern,
+// supporting *, ?, [abc], [^abc], [a-z] and \ escaping.
+func stringMatch(pattern, str string, nocase bool) bool {
+	skipLongerMatches := false
+	return stringMatchImpl(pattern, str, nocase, &skipLongerMatches)
+}
+
+// stringMatchImpl sets skipLongerMatches once a * tried every offset up to
+// the end of str, the * before it can't match either by trying the later
+// offsets, which are shorter. Otherwise patterns with many * would take an
+// exponential time.
+func stringMatchImpl(pattern, str string, nocase bool, skipLongerMatches *bool) bool {
+	p, s := 0, 0
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for ; s <= len(str); s++ {
+				if stringMatchImpl(pattern[p+1:], str[s:], nocase, skipLongerMatches) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+			}
+			*skipLongerMatches = true
+			return false
+		case '?':
+			if s >= len(str) {
+				return false
+			}
+			s++
+		case '[':
+			if s >= len(str) {
+				return false
+			}
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for p < len(pattern) && pattern[p] != ']' {
+				if pattern[p] == '\\' && p+1 < len(pattern) {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start, end, c := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(pattern[p], str[s], nocase) {
+					match = true
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if s >= len(str) || !equalByte(pattern[p], str[s], nocase) {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+	return s == len(str)
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+// parseFloat parses a float argument, refusing NaN.
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// formatFloat formats f with the minimum number of digits which can
+// represent it exactly.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "inf"
+	} else if math.IsInf(f, -1) {
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func isNaNOrInf(f float64) bool {
+	return math.IsNaN(f) || math.IsInf(f, 0)
+}
+
+// addOverflows reports whether a+b overflows an int64.
+func addOverflows(a, b int64) bool {
+	return (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b)
 }
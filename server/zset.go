@@ -0,0 +1,915 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kzinglzy/godis/dt"
+	"github.com/kzinglzy/godis/server/protocol"
+)
+
+type cmdZAdd struct{}
+type cmdZIncrBy struct{}
+type cmdZRem struct{}
+type cmdZScore struct{}
+type cmdZMScore struct{}
+type cmdZCard struct{}
+type cmdZCount struct{}
+type cmdZLexCount struct{}
+type cmdZRank struct{}
+type cmdZRevRank struct{}
+type cmdZRange struct{}
+type cmdZRangeStore struct{}
+type cmdZRevRange struct{}
+type cmdZRangeByScore struct{}
+type cmdZRevRangeByScore struct{}
+type cmdZRangeByLex struct{}
+type cmdZRevRangeByLex struct{}
+type cmdZPopMin struct{}
+type cmdZPopMax struct{}
+type cmdZRemRangeByRank struct{}
+type cmdZRemRangeByScore struct{}
+type cmdZRemRangeByLex struct{}
+type cmdZScan struct{}
+
+var (
+	errZRangeNotFloat = errors.New("min or max is not a float")
+	errZRangeNotLex   = errors.New("min or max not valid string range item")
+)
+
+// ZADD input flags
+const (
+	zaddIncr = 1 << iota
+	zaddNX
+	zaddXX
+	zaddGT
+	zaddLT
+	zaddCH
+)
+
+// zsetAdd results
+const (
+	zaddNop = iota
+	zaddNaN
+	zaddAdded
+	zaddUpdated
+	zaddUnchanged
+)
+
+func zsetLength(o *dt.Object) int64 {
+	return o.Ptr.(*dt.SortedSet).Len()
+}
+
+// zsetAdd adds the member or updates its score according to the ZADD
+// flags, and returns what was done together with the new score.
+func zsetAdd(zs *dt.SortedSet, score float64, member string, flags int) (int, float64) {
+	incr := flags&zaddIncr != 0
+	nx := flags&zaddNX != 0
+	xx := flags&zaddXX != 0
+	gt := flags&zaddGT != 0
+	lt := flags&zaddLT != 0
+
+	if math.IsNaN(score) {
+		return zaddNaN, 0
+	}
+
+	if cur, ok := zs.Score(member); ok {
+		if nx {
+			return zaddNop, cur
+		}
+		if incr {
+			score += cur
+			if math.IsNaN(score) {
+				return zaddNaN, 0
+			}
+		}
+		if (lt && score >= cur) || (gt && score <= cur) {
+			return zaddNop, cur
+		}
+		if score != cur {
+			zs.Add(member, score)
+			return zaddUpdated, score
+		}
+		return zaddUnchanged, score
+	} else if !xx {
+		zs.Add(member, score)
+		return zaddAdded, score
+	}
+	return zaddNop, 0
+}
+
+// formatScore formats a score like the %.17g format of Redis, with
+// the minimum number of digits needed to represent it exactly.
+func formatScore(f float64) string {
+	if math.IsInf(f, 0) {
+		return formatFloat(f)
+	}
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-4 || abs >= 1e17) {
+		return strconv.FormatFloat(f, 'e', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseScoreBound parses a score bound, prefixed with "(" when exclusive.
+func parseScoreBound(s string) (float64, bool, error) {
+	ex := strings.HasPrefix(s, "(")
+	if ex {
+		s = s[1:]
+	}
+	f, err := parseFloat(s)
+	if err != nil {
+		return 0, false, errZRangeNotFloat
+	}
+	return f, ex, nil
+}
+
+func parseScoreRange(min, max string) (*dt.ZRangeSpec, error) {
+	r := new(dt.ZRangeSpec)
+	var err error
+	if r.Min, r.MinEx, err = parseScoreBound(min); err != nil {
+		return nil, err
+	}
+	if r.Max, r.MaxEx, err = parseScoreBound(max); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseLexBound parses a lex bound: "-", "+", "[inclusive" or "(exclusive".
+func parseLexBound(s string) (string, bool, int, error) {
+	if s == "-" {
+		return "", false, -1, nil
+	} else if s == "+" {
+		return "", false, 1, nil
+	} else if strings.HasPrefix(s, "[") {
+		return s[1:], false, 0, nil
+	} else if strings.HasPrefix(s, "(") {
+		return s[1:], true, 0, nil
+	}
+	return "", false, 0, errZRangeNotLex
+}
+
+func parseLexRange(min, max string) (*dt.ZLexRangeSpec, error) {
+	r := new(dt.ZLexRangeSpec)
+	var err error
+	if r.Min, r.MinEx, r.MinInf, err = parseLexBound(min); err != nil {
+		return nil, err
+	}
+	if r.Max, r.MaxEx, r.MaxInf, err = parseLexBound(max); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func (*cmdZAdd) Exec(c *Client, r *protocol.Request) error {
+	return zaddGenericCommand(c, r, 0)
+}
+
+// ZINCRBY key increment member
+func (*cmdZIncrBy) Exec(c *Client, r *protocol.Request) error {
+	return zaddGenericCommand(c, r, zaddIncr)
+}
+
+func zaddGenericCommand(c *Client, r *protocol.Request, flags int) error {
+	if r.ArgCount() < 4 {
+		return c.ReplyError("wrong number of arguments for '" + strings.ToLower(r.CommandName()) + "' command")
+	}
+
+	key := r.ArgvAt(1)
+	i := 2
+options:
+	for ; i < r.ArgCount(); i++ {
+		switch strings.ToLower(r.ArgvAt(i)) {
+		case "nx":
+			flags |= zaddNX
+		case "xx":
+			flags |= zaddXX
+		case "gt":
+			flags |= zaddGT
+		case "lt":
+			flags |= zaddLT
+		case "ch":
+			flags |= zaddCH
+		case "incr":
+			flags |= zaddIncr
+		default:
+			break options
+		}
+	}
+
+	elements := r.ArgCount() - i
+	if elements == 0 || elements%2 != 0 {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+	elements /= 2
+
+	incr := flags&zaddIncr != 0
+	nx, xx := flags&zaddNX != 0, flags&zaddXX != 0
+	gt, lt := flags&zaddGT != 0, flags&zaddLT != 0
+	if nx && xx {
+		return c.ReplyError("XX and NX options at the same time are not compatible")
+	}
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		return c.ReplyError("GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && elements > 1 {
+		return c.ReplyError("INCR option supports a single increment-element pair")
+	}
+
+	// parse all the scores before modifying the sorted set,
+	// so the command is either fully executed or not at all.
+	scores := make([]float64, elements)
+	for j := 0; j < elements; j++ {
+		score, err := parseFloat(r.ArgvAt(i + j*2))
+		if err != nil {
+			return c.ReplyError(ReplyNotFloat)
+		}
+		scores[j] = score
+	}
+
+	o := c.db.Get(key)
+	if o != nil && o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if o == nil {
+		if xx {
+			if incr {
+				return c.ReplyEmpty()
+			}
+			return c.ReplyInt(0)
+		}
+		o = dt.NewZSet()
+		c.db.Add(key, o)
+	}
+
+	zs := o.Ptr.(*dt.SortedSet)
+	var added, updated, processed int64
+	var score float64
+	for j := 0; j < elements; j++ {
+		var res int
+		res, score = zsetAdd(zs, scores[j], r.ArgvAt(i+j*2+1), flags)
+		switch res {
+		case zaddNaN:
+			if zs.Len() == 0 {
+				c.db.deleteKey(key)
+			}
+			return c.ReplyError("resulting score is not a number (NaN)")
+		case zaddAdded:
+			added++
+			processed++
+		case zaddUpdated:
+			updated++
+			processed++
+		case zaddUnchanged:
+			processed++
+		}
+	}
+
+	c.db.elements += added
+	if added+updated > 0 {
+		signalModifiedKey(c.db, key)
+		if incr {
+			notifyKeyspaceEvent(NotifyZset, "zincr", key, c.db.id)
+		} else {
+			notifyKeyspaceEvent(NotifyZset, "zadd", key, c.db.id)
+		}
+	}
+	godisServer.dirty += added + updated
+	if zs.Len() == 0 {
+		c.db.deleteKey(key)
+	}
+
+	if incr {
+		if processed == 0 {
+			return c.ReplyEmpty()
+		}
+		return c.ReplyDouble(score)
+	}
+	if flags&zaddCH != 0 {
+		return c.ReplyInt(added + updated)
+	}
+	return c.ReplyInt(added)
+}
+
+func (*cmdZRem) Exec(c *Client, r *protocol.Request) error {
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	zs := o.Ptr.(*dt.SortedSet)
+	var deleted int64
+	for i := 2; i < r.ArgCount(); i++ {
+		if zs.Delete(r.ArgvAt(i)) {
+			deleted++
+		}
+	}
+	c.db.elements -= deleted
+	if deleted > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyZset, "zrem", key, c.db.id)
+	}
+	if zs.Len() == 0 {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+	}
+	godisServer.dirty += deleted
+	return c.ReplyInt(deleted)
+}
+
+func (*cmdZScore) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyEmpty()
+	}
+	if o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	score, ok := o.Ptr.(*dt.SortedSet).Score(r.ArgvAt(2))
+	if !ok {
+		return c.ReplyEmpty()
+	}
+	return c.ReplyDouble(score)
+}
+
+func (*cmdZMScore) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	c.ReplyArrayLen(r.ArgCount() - 2)
+	for i := 2; i < r.ArgCount(); i++ {
+		if o == nil {
+			c.ReplyEmpty()
+		} else if score, ok := o.Ptr.(*dt.SortedSet).Score(r.ArgvAt(i)); ok {
+			c.ReplyDouble(score)
+		} else {
+			c.ReplyEmpty()
+		}
+	}
+	return nil
+}
+
+func (*cmdZCard) Exec(c *Client, r *protocol.Request) error {
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+	return c.ReplyInt(zsetLength(o))
+}
+
+// ZCOUNT key min max
+func (*cmdZCount) Exec(c *Client, r *protocol.Request) error {
+	spec, err := parseScoreRange(r.ArgvAt(2), r.ArgvAt(3))
+	if err != nil {
+		return c.ReplyError(err.Error())
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	zsl := o.Ptr.(*dt.SortedSet).Skiplist()
+	first := zsl.FirstInRange(spec)
+	if first == nil {
+		return c.ReplyInt(0)
+	}
+	last := zsl.LastInRange(spec)
+	return c.ReplyInt(zsl.Rank(last.Score, last.Member) - zsl.Rank(first.Score, first.Member) + 1)
+}
+
+// ZLEXCOUNT key min max
+func (*cmdZLexCount) Exec(c *Client, r *protocol.Request) error {
+	spec, err := parseLexRange(r.ArgvAt(2), r.ArgvAt(3))
+	if err != nil {
+		return c.ReplyError(err.Error())
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	zsl := o.Ptr.(*dt.SortedSet).Skiplist()
+	first := zsl.FirstInLexRange(spec)
+	if first == nil {
+		return c.ReplyInt(0)
+	}
+	last := zsl.LastInLexRange(spec)
+	return c.ReplyInt(zsl.Rank(last.Score, last.Member) - zsl.Rank(first.Score, first.Member) + 1)
+}
+
+func (*cmdZRank) Exec(c *Client, r *protocol.Request) error {
+	return zrankGenericCommand(c, r, false)
+}
+
+func (*cmdZRevRank) Exec(c *Client, r *protocol.Request) error {
+	return zrankGenericCommand(c, r, true)
+}
+
+// ZRANK key member [WITHSCORE]
+func zrankGenericCommand(c *Client, r *protocol.Request, reverse bool) error {
+	if r.ArgCount() != 3 && r.ArgCount() != 4 {
+		return c.ReplyError("wrong number of arguments for '" + strings.ToLower(r.CommandName()) + "' command")
+	}
+	withscore := r.ArgCount() == 4
+	if withscore && !strings.EqualFold(r.ArgvAt(3), "withscore") {
+		return c.ReplyError(ReplySyntaxErr)
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	var rank int64
+	var ok bool
+	if o != nil {
+		rank, ok = o.Ptr.(*dt.SortedSet).Rank(r.ArgvAt(2), reverse)
+	}
+	if !ok {
+		if withscore {
+			return c.ReplyBulk([]interface{}(nil))
+		}
+		return c.ReplyEmpty()
+	}
+
+	if withscore {
+		score, _ := o.Ptr.(*dt.SortedSet).Score(r.ArgvAt(2))
+		return c.ReplyBulk(rank, formatScore(score))
+	}
+	return c.ReplyInt(rank)
+}
+
+// ZRANGE range types
+const (
+	zrangeAuto = iota
+	zrangeRank
+	zrangeScore
+	zrangeLex
+)
+
+// ZRANGE directions
+const (
+	zrangeDirectionAuto = iota
+	zrangeDirectionForward
+	zrangeDirectionReverse
+)
+
+// zrangeResult collects the members in the range, then replies them or
+// stores them in the destination key for ZRANGESTORE.
+type zrangeResult struct {
+	c          *Client
+	dstkey     string
+	withscores bool
+	members    []string
+	scores     []float64
+}
+
+func (res *zrangeResult) add(member string, score float64) {
+	res.members = append(res.members, member)
+	res.scores = append(res.scores, score)
+}
+
+func (res *zrangeResult) finalize() error {
+	c := res.c
+	if res.dstkey == "" {
+		var list []string
+		for i, member := range res.members {
+			list = append(list, member)
+			if res.withscores {
+				list = append(list, formatScore(res.scores[i]))
+			}
+		}
+		return c.ReplyList(list)
+	}
+
+	if len(res.members) == 0 {
+		if c.db.Get(res.dstkey) != nil {
+			c.db.deleteKey(res.dstkey)
+			signalModifiedKey(c.db, res.dstkey)
+			notifyKeyspaceEvent(NotifyGeneric, "del", res.dstkey, c.db.id)
+			godisServer.dirty++
+		}
+		return c.ReplyInt(0)
+	}
+
+	o := dt.NewZSet()
+	zs := o.Ptr.(*dt.SortedSet)
+	for i, member := range res.members {
+		zs.Add(member, res.scores[i])
+	}
+	c.db.Set(res.dstkey, o)
+	signalModifiedKey(c.db, res.dstkey)
+	notifyKeyspaceEvent(NotifyZset, "zrangestore", res.dstkey, c.db.id)
+	godisServer.dirty++
+	return c.ReplyInt(zs.Len())
+}
+
+func (*cmdZRange) Exec(c *Client, r *protocol.Request) error {
+	return zrangeGenericCommand(c, r, 1, false, zrangeAuto, zrangeDirectionAuto)
+}
+
+func (*cmdZRangeStore) Exec(c *Client, r *protocol.Request) error {
+	return zrangeGenericCommand(c, r, 2, true, zrangeAuto, zrangeDirectionAuto)
+}
+
+func (*cmdZRevRange) Exec(c *Client, r *protocol.Request) error {
+	return zrangeGenericCommand(c, r, 1, false, zrangeRank, zrangeDirectionReverse)
+}
+
+func (*cmdZRangeByScore) Exec(c *Client, r *protocol.Request) error {
+	return zrangeGenericCommand(c, r, 1, false, zrangeScore, zrangeDirectionForward)
+}
+
+func (*cmdZRevRangeByScore) Exec(c *Client, r *protocol.Request) error {
+	return zrangeGenericCommand(c, r, 1, false, zrangeScore, zrangeDirectionReverse)
+}
+
+func (*cmdZRangeByLex) Exec(c *Client, r *protocol.Request) error {
+	return zrangeGenericCommand(c, r, 1, false, zrangeLex, zrangeDirectionForward)
+}
+
+func (*cmdZRevRangeByLex) Exec(c *Client, r *protocol.Request) error {
+	return zrangeGenericCommand(c, r, 1, false, zrangeLex, zrangeDirectionReverse)
+}
+
+// zrangeGenericCommand implements ZRANGE, ZRANGESTORE and the legacy
+// ZREVRANGE, Z[REV]RANGEBYSCORE and Z[REV]RANGEBYLEX commands.
+//
+// ZRANGE <key> <min> <max> [BYSCORE | BYLEX] [REV] [WITHSCORES] [LIMIT offset count]
+// ZRANGESTORE <dst> <src> <min> <max> [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+func zrangeGenericCommand(c *Client, r *protocol.Request, argvStart int, store bool, rangetype, direction int) error {
+	minidx, maxidx := argvStart+1, argvStart+2
+	if r.ArgCount() < argvStart+3 {
+		return c.ReplyError("wrong number of arguments for '" + strings.ToLower(r.CommandName()) + "' command")
+	}
+
+	res := &zrangeResult{c: c}
+	if store {
+		res.dstkey = r.ArgvAt(1)
+	}
+
+	var offset, limit int64 = 0, -1
+	for j := argvStart + 3; j < r.ArgCount(); j++ {
+		leftargs := r.ArgCount() - j - 1
+		opt := strings.ToLower(r.ArgvAt(j))
+		switch {
+		case !store && opt == "withscores":
+			res.withscores = true
+		case opt == "limit" && leftargs >= 2:
+			var err1, err2 error
+			offset, err1 = strconv.ParseInt(r.ArgvAt(j+1), 10, 64)
+			limit, err2 = strconv.ParseInt(r.ArgvAt(j+2), 10, 64)
+			if err1 != nil || err2 != nil {
+				return c.ReplyError(ReplyNotInteger)
+			}
+			j += 2
+		case direction == zrangeDirectionAuto && opt == "rev":
+			direction = zrangeDirectionReverse
+		case rangetype == zrangeAuto && opt == "bylex":
+			rangetype = zrangeLex
+		case rangetype == zrangeAuto && opt == "byscore":
+			rangetype = zrangeScore
+		default:
+			return c.ReplyError(ReplySyntaxErr)
+		}
+	}
+
+	if direction == zrangeDirectionAuto {
+		direction = zrangeDirectionForward
+	}
+	if rangetype == zrangeAuto {
+		rangetype = zrangeRank
+	}
+
+	if limit != -1 && rangetype == zrangeRank {
+		return c.ReplyError("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if res.withscores && rangetype == zrangeLex {
+		return c.ReplyError("syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	// the reverse ranges by score and by lex take the max first
+	reverse := direction == zrangeDirectionReverse
+	if reverse && rangetype != zrangeRank {
+		minidx, maxidx = maxidx, minidx
+	}
+
+	var start, end int64
+	var scoreRange *dt.ZRangeSpec
+	var lexRange *dt.ZLexRangeSpec
+	var err error
+	switch rangetype {
+	case zrangeRank:
+		var err1, err2 error
+		start, err1 = strconv.ParseInt(r.ArgvAt(minidx), 10, 64)
+		end, err2 = strconv.ParseInt(r.ArgvAt(maxidx), 10, 64)
+		if err1 != nil || err2 != nil {
+			return c.ReplyError(ReplyNotInteger)
+		}
+	case zrangeScore:
+		scoreRange, err = parseScoreRange(r.ArgvAt(minidx), r.ArgvAt(maxidx))
+	case zrangeLex:
+		lexRange, err = parseLexRange(r.ArgvAt(minidx), r.ArgvAt(maxidx))
+	}
+	if err != nil {
+		return c.ReplyError(err.Error())
+	}
+
+	o := c.db.Get(r.ArgvAt(argvStart))
+	if o != nil && o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if o == nil {
+		return res.finalize()
+	}
+
+	zs := o.Ptr.(*dt.SortedSet)
+	switch rangetype {
+	case zrangeRank:
+		genericZrangebyrank(res, zs, start, end, reverse)
+	case zrangeScore:
+		genericZrangebyscore(res, zs, scoreRange, offset, limit, reverse)
+	case zrangeLex:
+		genericZrangebylex(res, zs, lexRange, offset, limit, reverse)
+	}
+	return res.finalize()
+}
+
+func genericZrangebyrank(res *zrangeResult, zs *dt.SortedSet, start, end int64, reverse bool) {
+	llen := zs.Len()
+	if start < 0 {
+		start += llen
+	}
+	if end < 0 {
+		end += llen
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	if start > end || start >= llen {
+		return
+	}
+	if end >= llen {
+		end = llen - 1
+	}
+
+	var ln *dt.SkiplistNode
+	if reverse {
+		ln = zs.Skiplist().ByRank(llen - start)
+	} else {
+		ln = zs.Skiplist().ByRank(start + 1)
+	}
+	for rangelen := end - start + 1; rangelen > 0 && ln != nil; rangelen-- {
+		res.add(ln.Member, ln.Score)
+		if reverse {
+			ln = ln.Prev()
+		} else {
+			ln = ln.Next()
+		}
+	}
+}
+
+func genericZrangebyscore(res *zrangeResult, zs *dt.SortedSet, spec *dt.ZRangeSpec, offset, limit int64, reverse bool) {
+	if offset < 0 {
+		return
+	}
+
+	var ln *dt.SkiplistNode
+	if reverse {
+		ln = zs.Skiplist().LastInRange(spec)
+	} else {
+		ln = zs.Skiplist().FirstInRange(spec)
+	}
+
+	next := func(ln *dt.SkiplistNode) *dt.SkiplistNode {
+		if reverse {
+			return ln.Prev()
+		}
+		return ln.Next()
+	}
+
+	for ; ln != nil && offset > 0; offset-- {
+		ln = next(ln)
+	}
+	for ; ln != nil && limit != 0; limit-- {
+		if (reverse && !spec.GteMin(ln.Score)) || (!reverse && !spec.LteMax(ln.Score)) {
+			break
+		}
+		res.add(ln.Member, ln.Score)
+		ln = next(ln)
+	}
+}
+
+func genericZrangebylex(res *zrangeResult, zs *dt.SortedSet, spec *dt.ZLexRangeSpec, offset, limit int64, reverse bool) {
+	if offset < 0 {
+		return
+	}
+
+	var ln *dt.SkiplistNode
+	if reverse {
+		ln = zs.Skiplist().LastInLexRange(spec)
+	} else {
+		ln = zs.Skiplist().FirstInLexRange(spec)
+	}
+
+	next := func(ln *dt.SkiplistNode) *dt.SkiplistNode {
+		if reverse {
+			return ln.Prev()
+		}
+		return ln.Next()
+	}
+
+	for ; ln != nil && offset > 0; offset-- {
+		ln = next(ln)
+	}
+	for ; ln != nil && limit != 0; limit-- {
+		if (reverse && !spec.GteMin(ln.Member)) || (!reverse && !spec.LteMax(ln.Member)) {
+			break
+		}
+		res.add(ln.Member, ln.Score)
+		ln = next(ln)
+	}
+}
+
+func (*cmdZPopMin) Exec(c *Client, r *protocol.Request) error {
+	return zpopGenericCommand(c, r, false)
+}
+
+func (*cmdZPopMax) Exec(c *Client, r *protocol.Request) error {
+	return zpopGenericCommand(c, r, true)
+}
+
+// ZPOPMIN key [count]
+func zpopGenericCommand(c *Client, r *protocol.Request, max bool) error {
+	if r.ArgCount() != 2 && r.ArgCount() != 3 {
+		return c.ReplyError("wrong number of arguments for '" + strings.ToLower(r.CommandName()) + "' command")
+	}
+
+	count := int64(1)
+	if r.ArgCount() == 3 {
+		var err error
+		count, err = strconv.ParseInt(r.ArgvAt(2), 10, 64)
+		if err != nil || count < 0 {
+			return c.ReplyError("value is out of range, must be positive")
+		}
+	}
+
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		return c.ReplyList(nil)
+	}
+	if o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	var list []string
+	zs := o.Ptr.(*dt.SortedSet)
+	for ; count > 0 && zs.Len() > 0; count-- {
+		ln := zs.Skiplist().First()
+		if max {
+			ln = zs.Skiplist().Last()
+		}
+		list = append(list, ln.Member, formatScore(ln.Score))
+		zs.Delete(ln.Member)
+	}
+
+	popped := int64(len(list) / 2)
+	c.db.elements -= popped
+	if popped > 0 {
+		signalModifiedKey(c.db, key)
+		if max {
+			notifyKeyspaceEvent(NotifyZset, "zpopmax", key, c.db.id)
+		} else {
+			notifyKeyspaceEvent(NotifyZset, "zpopmin", key, c.db.id)
+		}
+	}
+	if zs.Len() == 0 {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+	}
+	godisServer.dirty += popped
+	return c.ReplyList(list)
+}
+
+func (*cmdZRemRangeByRank) Exec(c *Client, r *protocol.Request) error {
+	return zremrangeGenericCommand(c, r, zrangeRank)
+}
+
+func (*cmdZRemRangeByScore) Exec(c *Client, r *protocol.Request) error {
+	return zremrangeGenericCommand(c, r, zrangeScore)
+}
+
+func (*cmdZRemRangeByLex) Exec(c *Client, r *protocol.Request) error {
+	return zremrangeGenericCommand(c, r, zrangeLex)
+}
+
+// ZREMRANGEBY[RANK|SCORE|LEX] key min max
+func zremrangeGenericCommand(c *Client, r *protocol.Request, rangetype int) error {
+	var start, end int64
+	var scoreRange *dt.ZRangeSpec
+	var lexRange *dt.ZLexRangeSpec
+	var err error
+	switch rangetype {
+	case zrangeRank:
+		var err1, err2 error
+		start, err1 = strconv.ParseInt(r.ArgvAt(2), 10, 64)
+		end, err2 = strconv.ParseInt(r.ArgvAt(3), 10, 64)
+		if err1 != nil || err2 != nil {
+			return c.ReplyError(ReplyNotInteger)
+		}
+	case zrangeScore:
+		scoreRange, err = parseScoreRange(r.ArgvAt(2), r.ArgvAt(3))
+	case zrangeLex:
+		lexRange, err = parseLexRange(r.ArgvAt(2), r.ArgvAt(3))
+	}
+	if err != nil {
+		return c.ReplyError(err.Error())
+	}
+
+	key := r.ArgvAt(1)
+	o := c.db.Get(key)
+	if o == nil {
+		return c.ReplyInt(0)
+	}
+	if o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+
+	zs := o.Ptr.(*dt.SortedSet)
+	var deleted int64
+	switch rangetype {
+	case zrangeRank:
+		llen := zs.Len()
+		if start < 0 {
+			start += llen
+		}
+		if end < 0 {
+			end += llen
+		}
+		if start < 0 {
+			start = 0
+		}
+		if start <= end && start < llen {
+			if end >= llen {
+				end = llen - 1
+			}
+			deleted = zs.DeleteRangeByRank(start, end)
+		}
+	case zrangeScore:
+		deleted = zs.DeleteRangeByScore(scoreRange)
+	case zrangeLex:
+		deleted = zs.DeleteRangeByLex(lexRange)
+	}
+
+	c.db.elements -= deleted
+	if deleted > 0 {
+		signalModifiedKey(c.db, key)
+		notifyKeyspaceEvent(NotifyZset, strings.ToLower(r.CommandName()), key, c.db.id)
+	}
+	if zs.Len() == 0 {
+		c.db.deleteKey(key)
+		notifyKeyspaceEvent(NotifyGeneric, "del", key, c.db.id)
+	}
+	godisServer.dirty += deleted
+	return c.ReplyInt(deleted)
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count]
+func (*cmdZScan) Exec(c *Client, r *protocol.Request) error {
+	cursor, err := parseScanCursor(r.ArgvAt(2))
+	if err != nil {
+		return c.ReplyError("invalid cursor")
+	}
+
+	o := c.db.Get(r.ArgvAt(1))
+	if o != nil && o.ObjType != dt.ObjZSet {
+		return c.ReplyError(ReplyWrongType)
+	}
+	if o == nil {
+		return c.ReplyBulk("0", []string{})
+	}
+	return scanGenericCommand(c, r, o, cursor, 3)
+}